@@ -1838,16 +1838,7 @@ func (c *HostClient) dialHostHard(dialTimeout time.Duration) (conn net.Conn, err
 		n = 1
 	}
 
-	dial := c.Dial
-	if dialTimeout != 0 && dial == nil {
-		dial = func(addr string) (net.Conn, error) {
-			if c.DialDualStack {
-				return DialDualStackTimeout(addr, dialTimeout)
-			}
-			return DialTimeout(addr, dialTimeout)
-		}
-	}
-
+	dial := c.dialFunc(dialTimeout)
 	timeout := c.ReadTimeout + c.WriteTimeout
 	if timeout <= 0 {
 		timeout = DefaultDialTimeout
@@ -1868,6 +1859,21 @@ func (c *HostClient) dialHostHard(dialTimeout time.Duration) (conn net.Conn, err
 	return nil, err
 }
 
+// dialFunc returns the function dialing the hosts, or nil if dialAddr must use the
+// default dialer. dialTimeout only applies to the default dialer.
+func (c *HostClient) dialFunc(dialTimeout time.Duration) DialFunc {
+	dial := c.Dial
+	if dialTimeout != 0 && dial == nil {
+		dial = func(addr string) (net.Conn, error) {
+			if c.DialDualStack {
+				return DialDualStackTimeout(addr, dialTimeout)
+			}
+			return DialTimeout(addr, dialTimeout)
+		}
+	}
+	return dial
+}
+
 func (c *HostClient) cachedTLSConfig(addr string) *tls.Config {
 	if !c.IsTLS {
 		return nil
@@ -1946,6 +1952,32 @@ func dialAddr(addr string, dial DialFunc, dialDualStack, isTLS bool, tlsConfig *
 	return conn, nil
 }
 
+// negotiatedProtocol completes the handshake of a TLS connection returned by dialAddr
+// and returns the application protocol negotiated with ALPN, see tls.Config.NextProtos.
+// It returns an empty string for other connections.
+func negotiatedProtocol(conn net.Conn, deadline time.Time) (string, error) {
+	tc, ok := conn.(interface {
+		Handshake() error
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return "", nil
+	}
+	if !deadline.IsZero() {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return "", err
+		}
+		defer conn.SetDeadline(time.Time{}) //nolint:errcheck
+	}
+	if err := tc.Handshake(); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "", ErrTLSHandshakeTimeout
+		}
+		return "", err
+	}
+	return tc.ConnectionState().NegotiatedProtocol, nil
+}
+
 // AddMissingPort adds a port to a host if it is missing.
 // A literal IPv6 address in hostport must be enclosed in square
 // brackets, as in "[::1]:80", "[::1%lo0]:80".
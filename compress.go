@@ -223,6 +223,23 @@ func AppendGunzipBytes(dst, src []byte) ([]byte, error) {
 	return w.b, err
 }
 
+// AppendGunzipBytesLimit appends gunzipped src to dst and returns the resulting dst.
+// It returns ErrBodyTooLarge as soon as more than maxSize bytes are gunzipped, so that
+// a small src can't make it allocate an arbitrary amount of memory.
+func AppendGunzipBytesLimit(dst, src []byte, maxSize int) ([]byte, error) {
+	zr, err := acquireGzipReader(&byteSliceReader{src})
+	if err != nil {
+		return dst, err
+	}
+	w := &byteSliceWriter{dst}
+	n, err := copyZeroAlloc(w, io.LimitReader(zr, int64(maxSize)+1))
+	releaseGzipReader(zr)
+	if err == nil && n > int64(maxSize) {
+		err = ErrBodyTooLarge
+	}
+	return w.b, err
+}
+
 // AppendDeflateBytesLevel appends deflated src to dst using the given
 // compression level and returns the resulting dst.
 //
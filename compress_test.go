@@ -90,6 +90,23 @@ func testGzipBytesSingleCase(s string) error {
 	return nil
 }
 
+func TestAppendGunzipBytesLimit(t *testing.T) {
+	t.Parallel()
+
+	src := AppendGzipBytes(nil, createFixedBody(1e4))
+	b, err := AppendGunzipBytesLimit([]byte("foobar"), src, 1e4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(b) != "foobar"+string(createFixedBody(1e4)) {
+		t.Fatalf("unexpected uncompressed data %q", b)
+	}
+
+	if _, err = AppendGunzipBytesLimit(nil, src, 1e4-1); err != ErrBodyTooLarge {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBodyTooLarge)
+	}
+}
+
 func testDeflateBytesSingleCase(s string) error {
 	prefix := []byte("foobar")
 	deflatedS := AppendDeflateBytes(prefix, []byte(s))
@@ -0,0 +1,361 @@
+package grpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pablolagos/fns"
+	"golang.org/x/net/http2"
+)
+
+// newTestClient serves gs over cleartext HTTP/2 and returns a client and the base URL
+func newTestClient(t *testing.T, gs *Server) (*http.Client, string) {
+	t.Helper()
+
+	s := &fns.Server{
+		Handler: gs.Handler(func(ctx *fns.RequestCtx) {
+			ctx.SetBodyString("not grpc")
+		}),
+		StreamRequestBody: true,
+	}
+	fns.EnableHTTP2(s, fns.ServerConfig{H2C: true})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.Serve(ln) //nolint:errcheck
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}, "http://" + ln.Addr().String()
+}
+
+func frameMsg(msg []byte, compressed bool) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	if compressed {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func readMsg(t *testing.T, r io.Reader) ([]byte, bool) {
+	t.Helper()
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		t.Fatalf("unexpected error reading message: %v", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatalf("unexpected error reading message: %v", err)
+	}
+	return msg, prefix[0] == 1
+}
+
+func newRequest(t *testing.T, url string, body io.Reader) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	return req
+}
+
+// expectStatus reads the remaining response body and checks the status trailers
+func expectStatus(t *testing.T, resp *http.Response, code Code, message string) []byte {
+	t.Helper()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if v := resp.Trailer.Get("Grpc-Status"); v != strconv.FormatUint(uint64(code), 10) {
+		t.Fatalf("unexpected grpc-status %q, expected %d (%s)", v, code, code)
+	}
+	if v := resp.Trailer.Get("Grpc-Message"); v != message {
+		t.Fatalf("unexpected grpc-message %q, expected %q", v, message)
+	}
+	return body
+}
+
+func TestUnary(t *testing.T) {
+	t.Parallel()
+
+	gs := NewServer()
+	gs.HandleUnary("/test.Echo/Say", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+		ctx.Response.Header.Set("X-Meta", string(ctx.Request.Header.Peek("X-Meta")))
+		return append([]byte("hello "), req...), nil
+	})
+	gs.HandleUnary("/test.Echo/Fail", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+		return []byte("dropped"), Errorf(NotFound, "no %s at 100%%", req)
+	})
+	c, url := newTestClient(t, gs)
+
+	req := newRequest(t, url+"/test.Echo/Say", bytes.NewReader(frameMsg([]byte("world"), false)))
+	req.Header.Set("X-Meta", "foo")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %d", resp.StatusCode)
+	}
+	if v := resp.Header.Get("Content-Type"); v != "application/grpc" {
+		t.Fatalf("unexpected content-type %q", v)
+	}
+	if v := resp.Header.Get("X-Meta"); v != "foo" {
+		t.Fatalf("unexpected x-meta %q", v)
+	}
+	if msg, _ := readMsg(t, resp.Body); string(msg) != "hello world" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+	if body := expectStatus(t, resp, OK, ""); len(body) > 0 {
+		t.Fatalf("unexpected data after the message %q", body)
+	}
+
+	resp, err = c.Do(newRequest(t, url+"/test.Echo/Fail", bytes.NewReader(frameMsg([]byte("thing"), false))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if body := expectStatus(t, resp, NotFound, "no thing at 100%25"); len(body) > 0 {
+		t.Fatalf("unexpected message for a failed call %q", body)
+	}
+}
+
+func TestUnimplemented(t *testing.T) {
+	t.Parallel()
+
+	c, url := newTestClient(t, NewServer())
+
+	resp, err := c.Do(newRequest(t, url+"/test.Echo/Missing", bytes.NewReader(frameMsg(nil, false))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectStatus(t, resp, Unimplemented, "unknown method /test.Echo/Missing")
+
+	// Requests other than gRPC calls are passed to the next handler
+	resp, err = c.Get(url + "/test.Echo/Missing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "not grpc" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	gs := NewServer()
+	gs.HandleStream("/test.Echo/Chat", func(stream *ServerStream) error {
+		for {
+			msg, err := stream.RecvMsg()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(bytes.ToUpper(msg)); err != nil {
+				return err
+			}
+		}
+	})
+	c, url := newTestClient(t, gs)
+
+	msgs := []string{"foo", "bar", "baz"}
+	pr, pw := io.Pipe()
+	// The response headers are only sent along with the first response message
+	go pw.Write(frameMsg([]byte(msgs[0]), false)) //nolint:errcheck
+	resp, err := c.Do(newRequest(t, url+"/test.Echo/Chat", pr))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every message is answered before the next one is sent
+	for i, s := range msgs {
+		if i > 0 {
+			if _, err := pw.Write(frameMsg([]byte(s), false)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if msg, _ := readMsg(t, resp.Body); string(msg) != strings.ToUpper(s) {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+	pw.Close()
+	expectStatus(t, resp, OK, "")
+}
+
+func TestMaxRecvMsgSize(t *testing.T) {
+	t.Parallel()
+
+	gs := NewServer()
+	gs.MaxRecvMsgSize = 4
+	gs.HandleUnary("/test.Echo/Say", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+		return req, nil
+	})
+	c, url := newTestClient(t, gs)
+
+	resp, err := c.Do(newRequest(t, url+"/test.Echo/Say", bytes.NewReader(frameMsg([]byte("hello"), false))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectStatus(t, resp, ResourceExhausted, "message larger than max (5 vs. 4)")
+}
+
+func TestMaxRecvMsgSizeGzip(t *testing.T) {
+	t.Parallel()
+
+	gs := NewServer()
+	gs.MaxRecvMsgSize = 64 << 10
+	gs.HandleUnary("/test.Echo/Say", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+		t.Errorf("unexpected call to the handler")
+		return req, nil
+	})
+	c, url := newTestClient(t, gs)
+
+	// A few KB inflating to 10MB are rejected once the limit is exceeded
+	bomb := fns.AppendGzipBytes(nil, make([]byte, 10<<20))
+	req := newRequest(t, url+"/test.Echo/Say", bytes.NewReader(frameMsg(bomb, true)))
+	req.Header.Set("Grpc-Encoding", "gzip")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectStatus(t, resp, ResourceExhausted, "decompressed message larger than max (65536)")
+}
+
+func TestGzip(t *testing.T) {
+	t.Parallel()
+
+	gs := NewServer()
+	gs.HandleUnary("/test.Echo/Say", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+		return append([]byte("hello "), req...), nil
+	})
+	c, url := newTestClient(t, gs)
+
+	req := newRequest(t, url+"/test.Echo/Say", bytes.NewReader(frameMsg(fns.AppendGzipBytes(nil, []byte("world")), true)))
+	req.Header.Set("Grpc-Encoding", "gzip")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := resp.Header.Get("Grpc-Encoding"); v != "gzip" {
+		t.Fatalf("unexpected grpc-encoding %q", v)
+	}
+	msg, compressed := readMsg(t, resp.Body)
+	if !compressed {
+		t.Fatalf("expected a compressed message")
+	}
+	if msg, err = fns.AppendGunzipBytes(nil, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(msg) != "hello world" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+	expectStatus(t, resp, OK, "")
+
+	req = newRequest(t, url+"/test.Echo/Say", bytes.NewReader(frameMsg([]byte("world"), true)))
+	req.Header.Set("Grpc-Encoding", "snappy")
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := resp.Header.Get("Grpc-Accept-Encoding"); v != "gzip" {
+		t.Fatalf("unexpected grpc-accept-encoding %q", v)
+	}
+	expectStatus(t, resp, Unimplemented, `unsupported grpc-encoding "snappy"`)
+}
+
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+
+	gs := NewServer()
+	gs.HandleUnary("/test.Echo/Wait", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, Errorf(Internal, "no deadline")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		return req, nil
+	})
+	c, url := newTestClient(t, gs)
+
+	req := newRequest(t, url+"/test.Echo/Wait", bytes.NewReader(frameMsg([]byte("hello"), false)))
+	req.Header.Set("Grpc-Timeout", "50m")
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if body := expectStatus(t, resp, DeadlineExceeded, "deadline exceeded"); len(body) > 0 {
+		t.Fatalf("unexpected message after the deadline %q", body)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("the call took %s", d)
+	}
+
+	req = newRequest(t, url+"/test.Echo/Wait", bytes.NewReader(frameMsg([]byte("hello"), false)))
+	req.Header.Set("Grpc-Timeout", "50x")
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectStatus(t, resp, Internal, "malformed grpc-timeout: invalid timeout")
+}
+
+func TestParseTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		v   string
+		d   time.Duration
+		err bool
+	}{
+		{"1H", time.Hour, false},
+		{"2M", 2 * time.Minute, false},
+		{"3S", 3 * time.Second, false},
+		{"40m", 40 * time.Millisecond, false},
+		{"50u", 50 * time.Microsecond, false},
+		{"12345678n", 12345678, false},
+		{"99999999H", 0, false},
+		{"", 0, true},
+		{"S", 0, true},
+		{"123456789S", 0, true},
+		{"-1S", 0, true},
+		{"1s", 0, true},
+	} {
+		d, err := parseTimeout(tc.v)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error for %q: %v", tc.v, err)
+		}
+		if d != tc.d {
+			t.Fatalf("unexpected timeout for %q: %s, expected %s", tc.v, d, tc.d)
+		}
+	}
+}
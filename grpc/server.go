@@ -0,0 +1,198 @@
+// Package grpc serves gRPC services from a fns.Server with HTTP/2 enabled,
+// alongside the other handlers of the server.
+//
+// Messages are passed to the handlers as encoded bytes, so any codec, such
+// as protocol buffers, can be used to decode them.
+//
+//	gs := grpc.NewServer()
+//	gs.HandleUnary("/helloworld.Greeter/SayHello", func(ctx *fns.RequestCtx, req []byte) ([]byte, error) {
+//		...
+//	})
+//	s := &fns.Server{Handler: gs.Handler(restHandler)}
+//	fns.EnableHTTP2(s, fns.ServerConfig{})
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablolagos/fns"
+)
+
+// DefaultMaxRecvMsgSize is the maximum size of a request message when
+// Server.MaxRecvMsgSize is not set.
+const DefaultMaxRecvMsgSize = 4 << 20
+
+// UnaryHandler handles a call with a single request and response message
+type UnaryHandler func(ctx *fns.RequestCtx, req []byte) ([]byte, error)
+
+// StreamHandler handles a streaming call. The call ends when it returns, with the
+// status of the returned error.
+type StreamHandler func(stream *ServerStream) error
+
+type method struct {
+	unary  UnaryHandler
+	stream StreamHandler
+}
+
+// Server routes gRPC calls to the handlers registered for their method.
+//
+// Handlers must not be registered while the server is serving calls.
+type Server struct {
+	// MaxRecvMsgSize is the maximum size of a request message, after decompression.
+	// Larger messages fail the call with ResourceExhausted.
+	//
+	// DefaultMaxRecvMsgSize is used if not set.
+	MaxRecvMsgSize int
+
+	methods map[string]method
+}
+
+// NewServer returns a Server without any method registered
+func NewServer() *Server {
+	return &Server{methods: make(map[string]method)}
+}
+
+// HandleUnary registers h for the unary method with the given path, such
+// as "/helloworld.Greeter/SayHello".
+func (s *Server) HandleUnary(path string, h UnaryHandler) {
+	s.methods[path] = method{unary: h}
+}
+
+// HandleStream registers h for the client, server or bidirectional streaming
+// method with the given path.
+func (s *Server) HandleStream(path string, h StreamHandler) {
+	s.methods[path] = method{stream: h}
+}
+
+// Handler returns a request handler serving the gRPC calls, the other requests
+// are passed to next.
+func (s *Server) Handler(next fns.RequestHandler) fns.RequestHandler {
+	return func(ctx *fns.RequestCtx) {
+		if IsGRPCRequest(ctx) {
+			s.ServeGRPC(ctx)
+			return
+		}
+		next(ctx)
+	}
+}
+
+// IsGRPCRequest reports whether the request is a gRPC call, based on its content type
+func IsGRPCRequest(ctx *fns.RequestCtx) bool {
+	contentType := ctx.Request.Header.ContentType()
+	if !bytes.HasPrefix(contentType, strApplicationGRPC) {
+		return false
+	}
+	rest := contentType[len(strApplicationGRPC):]
+	return len(rest) == 0 || rest[0] == '+' || rest[0] == ';'
+}
+
+var strApplicationGRPC = []byte("application/grpc")
+
+var errInvalidTimeout = errors.New("invalid timeout")
+
+// ServeGRPC serves a gRPC call. The status of the call is sent in the
+// grpc-status and grpc-message trailers.
+func (s *Server) ServeGRPC(ctx *fns.RequestCtx) {
+	h := &ctx.Response.Header
+	h.SetContentType("application/grpc")
+	_ = h.SetTrailer("Grpc-Status, Grpc-Message")
+
+	stream := &ServerStream{ctx: ctx, srv: s}
+	stream.finish(s.serve(stream))
+}
+
+func (s *Server) serve(stream *ServerStream) error {
+	ctx := stream.ctx
+	if !ctx.IsPost() {
+		return Errorf(Unimplemented, "unexpected method %s", ctx.Method())
+	}
+
+	switch encoding := string(ctx.Request.Header.Peek("Grpc-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		// The responses are compressed like the requests
+		stream.gzip = true
+		ctx.Response.Header.Set("Grpc-Encoding", "gzip")
+	default:
+		ctx.Response.Header.Set("Grpc-Accept-Encoding", "gzip")
+		return Errorf(Unimplemented, "unsupported grpc-encoding %q", encoding)
+	}
+
+	if timeout := ctx.Request.Header.Peek("Grpc-Timeout"); len(timeout) > 0 {
+		d, err := parseTimeout(string(timeout))
+		if err != nil {
+			return Errorf(Internal, "malformed grpc-timeout: %v", err)
+		}
+		if d > 0 {
+			ctx.SetDeadline(time.Now().Add(d))
+		}
+	}
+
+	m, ok := s.methods[string(ctx.Path())]
+	if !ok {
+		return Errorf(Unimplemented, "unknown method %s", ctx.Path())
+	}
+
+	stream.init()
+	var err error
+	if m.unary != nil {
+		err = stream.serveUnary(m.unary)
+	} else {
+		err = m.stream(stream)
+	}
+	if err == nil && ctx.Err() == context.DeadlineExceeded {
+		err = Errorf(DeadlineExceeded, "deadline exceeded")
+	}
+	return err
+}
+
+func (s *Server) maxRecvMsgSize() int {
+	if s.MaxRecvMsgSize > 0 {
+		return s.MaxRecvMsgSize
+	}
+	return DefaultMaxRecvMsgSize
+}
+
+// parseTimeout parses a grpc-timeout header value: at most 8 digits followed by
+// a unit. It returns 0 for timeouts too large to be represented.
+func parseTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, errInvalidTimeout
+	}
+
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, errInvalidTimeout
+	}
+
+	digits := v[:len(v)-1]
+	if strings.TrimLeft(digits, "0123456789") != "" {
+		return 0, errInvalidTimeout
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, errInvalidTimeout
+	}
+	if n > int64(1<<63-1)/int64(unit) {
+		return 0, nil
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,111 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Code is a gRPC status code, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+type Code uint32
+
+// gRPC status codes
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// Status is an error carrying a gRPC status code. It is sent to the client in
+// the grpc-status and grpc-message trailers.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc error: code = %s desc = %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status error with the given code and formatted message
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// StatusFromError returns the status of err. A nil error is OK, and errors not
+// wrapping a Status are Unknown.
+func StatusFromError(err error) *Status {
+	if err == nil {
+		return &Status{Code: OK}
+	}
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// encodeGRPCMessage percent-encodes a status message for the grpc-message trailer
+func encodeGRPCMessage(msg string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b []byte
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			if b != nil {
+				b = append(b, c)
+			}
+			continue
+		}
+		if b == nil {
+			b = append(make([]byte, 0, len(msg)+8), msg[:i]...)
+		}
+		b = append(b, '%', hex[c>>4], hex[c&0xf])
+	}
+	if b == nil {
+		return msg
+	}
+	return string(b)
+}
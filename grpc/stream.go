@@ -0,0 +1,160 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/pablolagos/fns"
+)
+
+// ServerStream reads the request messages of a call and sends its response messages.
+//
+// The messages are framed with a 5-byte prefix: a compressed flag and the length of
+// the message, see https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md.
+type ServerStream struct {
+	ctx  *fns.RequestCtx
+	srv  *Server
+	body io.Reader
+
+	// gzip is true if the messages are compressed with gzip in both directions
+	gzip bool
+
+	// sending is true once the response headers are sent with the first message
+	sending bool
+
+	prefix [5]byte
+}
+
+// Context returns the request of the call. The request metadata is found in its
+// headers, and the response metadata is set on its response headers.
+func (s *ServerStream) Context() *fns.RequestCtx {
+	return s.ctx
+}
+
+// init sets up the reader of the request messages. A body streamed with
+// Server.StreamRequestBody is read as the messages arrive.
+func (s *ServerStream) init() {
+	if r := s.ctx.RequestBodyStream(); r != nil {
+		s.body = r
+	} else {
+		s.body = bytes.NewReader(s.ctx.PostBody())
+	}
+}
+
+// RecvMsg reads the next request message. It returns io.EOF once the client
+// has sent all of them.
+func (s *ServerStream) RecvMsg() ([]byte, error) {
+	if _, err := io.ReadFull(s.body, s.prefix[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, Errorf(Internal, "error reading message: %v", err)
+	}
+
+	compressed := s.prefix[0] == 1
+	n := binary.BigEndian.Uint32(s.prefix[1:])
+	maxSize := s.srv.maxRecvMsgSize()
+	if uint64(n) > uint64(maxSize) {
+		return nil, Errorf(ResourceExhausted, "message larger than max (%d vs. %d)", n, maxSize)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(s.body, msg); err != nil {
+		return nil, Errorf(Internal, "error reading message: %v", err)
+	}
+
+	if compressed {
+		if !s.gzip {
+			return nil, Errorf(Internal, "compressed message without grpc-encoding")
+		}
+		return gunzipMsg(msg, maxSize)
+	}
+	return msg, nil
+}
+
+// gunzipMsg decompresses msg, it fails as soon as more than maxSize bytes come out so
+// a small message can't make the server allocate an arbitrary amount of memory
+func gunzipMsg(msg []byte, maxSize int) ([]byte, error) {
+	msg, err := fns.AppendGunzipBytesLimit(nil, msg, maxSize)
+	if err == fns.ErrBodyTooLarge {
+		return nil, Errorf(ResourceExhausted, "decompressed message larger than max (%d)", maxSize)
+	}
+	if err != nil {
+		return nil, Errorf(Internal, "error decompressing message: %v", err)
+	}
+	return msg, nil
+}
+
+// SendMsg sends a response message. The response headers are sent along with the
+// first message, they can't be modified afterwards.
+func (s *ServerStream) SendMsg(msg []byte) error {
+	if err := s.ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
+	// The messages are sent as they are written
+	if !s.sending {
+		s.ctx.DisableBuffering()
+		s.sending = true
+	}
+	if _, err := s.ctx.Write(s.appendMsg(nil, msg)); err != nil {
+		return Errorf(Unavailable, "error sending message: %v", err)
+	}
+	return nil
+}
+
+// appendMsg appends the framed msg to dst
+func (s *ServerStream) appendMsg(dst, msg []byte) []byte {
+	var compressed byte
+	if s.gzip {
+		msg = fns.AppendGzipBytes(nil, msg)
+		compressed = 1
+	}
+	dst = append(dst, compressed, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(dst[len(dst)-4:], uint32(len(msg)))
+	return append(dst, msg...)
+}
+
+// serveUnary serves a unary call. The response is buffered, so it is sent
+// along with the trailers.
+func (s *ServerStream) serveUnary(h UnaryHandler) error {
+	req, err := s.RecvMsg()
+	if err == io.EOF {
+		return Errorf(Internal, "missing request message")
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := h(s.ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	s.ctx.Response.SetBody(s.appendMsg(nil, resp))
+	return nil
+}
+
+// finish sets the trailers with the status of the call. The response messages
+// of a failed unary call are dropped.
+func (s *ServerStream) finish(err error) {
+	st := StatusFromError(err)
+	h := &s.ctx.Response.Header
+	if st.Code != OK && !s.sending {
+		s.ctx.Response.ResetBody()
+	}
+	h.Set("Grpc-Status", strconv.FormatUint(uint64(st.Code), 10))
+	h.Set("Grpc-Message", encodeGRPCMessage(st.Message))
+}
+
+// contextError converts the error of a canceled request to a status
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return Errorf(DeadlineExceeded, "deadline exceeded")
+	}
+	return Errorf(Canceled, "%v", err)
+}
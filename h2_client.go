@@ -0,0 +1,216 @@
+package fns
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxH2UnprocessedRetries is how many times a request not processed by the server, as
+// reported by REFUSED_STREAM or GOAWAY, is sent again on another connection
+const maxH2UnprocessedRetries = 5
+
+var (
+	// errH2Unprocessed is returned for the requests the server has not processed, they
+	// can be sent again safely whatever their method, see RFC 9113 section 8.7
+	errH2Unprocessed = errors.New("request not processed by the server")
+
+	// errH2NotNegotiated is returned when the server doesn't select h2 with ALPN
+	errH2NotNegotiated = errors.New("server did not negotiate HTTP/2")
+)
+
+// H2Transport is a RoundTripper sending the requests of a HostClient over HTTP/2. It is
+// used by setting HostClient.Transport, or Client.ConfigureClient for a Client.
+//
+// The requests sent to a host are multiplexed over a single connection, as many at the
+// same time as the server's SETTINGS_MAX_CONCURRENT_STREAMS allows. The others wait for
+// a stream to finish. The requests the server didn't process, because it refused their
+// stream or was going away, are sent again on a new connection.
+//
+// TLS hosts negotiate HTTP/2 with ALPN. The hosts which don't support it are sent the
+// requests with Fallback. Plaintext hosts are only reached over HTTP/2 if AllowHTTP is
+// set, with prior knowledge as described in RFC 9113 section 3.3.
+//
+// The response bodies are fully buffered, Response.StreamBody and
+// HostClient.StreamResponseBody are not supported.
+type H2Transport struct {
+	// AllowHTTP sends the requests of HostClients without IsTLS over cleartext HTTP/2
+	// (h2c), the server must support it. Otherwise they are sent with Fallback.
+	AllowHTTP bool
+
+	// Fallback sends the requests to the hosts that don't support HTTP/2.
+	//
+	// DefaultTransport is used if not set.
+	Fallback RoundTripper
+
+	// InitialWindowSize is the flow-control window granted to the server for sending
+	// each response, and InitialConnWindowSize for all the responses of a connection.
+	//
+	// DefaultH2InitialWindowSize and DefaultH2InitialConnWindowSize are used if not set.
+	InitialWindowSize     uint32
+	InitialConnWindowSize uint32
+
+	// MaxConcurrentStreams limits the number of requests sent at the same time on a
+	// connection, besides the server's SETTINGS_MAX_CONCURRENT_STREAMS.
+	//
+	// There is no limit besides the server's if not set.
+	MaxConcurrentStreams uint32
+
+	mu    sync.Mutex
+	conns map[h2ConnKey]*h2ClientConn
+	dials map[h2ConnKey]*h2Dial
+
+	// http1 holds the hosts which didn't negotiate HTTP/2
+	http1 map[h2ConnKey]struct{}
+}
+
+// h2ConnKey identifies the connection shared by the requests to addr. The HostClients
+// sharing the transport share the connections too.
+type h2ConnKey struct {
+	addr  string
+	isTLS bool
+}
+
+// h2Dial is a connection being dialed, the other requests to the host wait for it
+type h2Dial struct {
+	done chan struct{}
+	cc   *h2ClientConn
+	err  error
+}
+
+// RoundTrip implements RoundTripper
+func (t *H2Transport) RoundTrip(hc *HostClient, req *Request, resp *Response) (retry bool, err error) {
+	if !hc.IsTLS && !t.AllowHTTP {
+		return t.fallback().RoundTrip(hc, req, resp)
+	}
+
+	for attempt := 0; ; attempt++ {
+		addr := hc.nextAddr()
+		cc, err := t.getConn(hc, addr)
+		if err == errH2NotNegotiated {
+			return t.fallback().RoundTrip(hc, req, resp)
+		}
+		if err != nil {
+			return true, err
+		}
+
+		err = cc.roundTrip(hc, req, resp)
+		switch {
+		case err == nil:
+			return false, nil
+		case err == errH2Unprocessed && attempt < maxH2UnprocessedRetries:
+			continue
+		case err == ErrTimeout || err == ErrBodyTooLarge:
+			return false, err
+		}
+		var resetErr h2StreamResetError
+		return !errors.As(err, &resetErr), err
+	}
+}
+
+func (t *H2Transport) fallback() RoundTripper {
+	if t.Fallback == nil {
+		return DefaultTransport
+	}
+	return t.Fallback
+}
+
+// CloseIdleConnections closes the connections without requests in flight
+func (t *H2Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	conns := make([]*h2ClientConn, 0, len(t.conns))
+	for _, cc := range t.conns {
+		conns = append(conns, cc)
+	}
+	t.mu.Unlock()
+
+	for _, cc := range conns {
+		cc.closeIfIdle()
+	}
+}
+
+// getConn returns the connection to addr, dialing it if there is none usable
+func (t *H2Transport) getConn(hc *HostClient, addr string) (*h2ClientConn, error) {
+	key := h2ConnKey{addr: addr, isTLS: hc.IsTLS}
+
+	t.mu.Lock()
+	if _, ok := t.http1[key]; ok {
+		t.mu.Unlock()
+		return nil, errH2NotNegotiated
+	}
+	if cc := t.conns[key]; cc != nil && cc.canTakeNewRequest() {
+		t.mu.Unlock()
+		return cc, nil
+	}
+	if d := t.dials[key]; d != nil {
+		t.mu.Unlock()
+		<-d.done
+		return d.cc, d.err
+	}
+	d := &h2Dial{done: make(chan struct{})}
+	if t.dials == nil {
+		t.dials = make(map[h2ConnKey]*h2Dial)
+	}
+	t.dials[key] = d
+	t.mu.Unlock()
+
+	d.cc, d.err = t.dialConn(hc, key)
+
+	t.mu.Lock()
+	delete(t.dials, key)
+	switch {
+	case d.err == nil:
+		if t.conns == nil {
+			t.conns = make(map[h2ConnKey]*h2ClientConn)
+		}
+		t.conns[key] = d.cc
+	case d.err == errH2NotNegotiated:
+		if t.http1 == nil {
+			t.http1 = make(map[h2ConnKey]struct{})
+		}
+		t.http1[key] = struct{}{}
+	}
+	t.mu.Unlock()
+	close(d.done)
+	return d.cc, d.err
+}
+
+// removeConn forgets a connection that can't take new requests anymore
+func (t *H2Transport) removeConn(cc *h2ClientConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[cc.key] == cc {
+		delete(t.conns, cc.key)
+	}
+}
+
+// dialConn dials a new connection and starts HTTP/2 on it
+func (t *H2Transport) dialConn(hc *HostClient, key h2ConnKey) (*h2ClientConn, error) {
+	var tlsConfig *tls.Config
+	if hc.IsTLS {
+		tlsConfig = newClientTLSConfig(hc.TLSConfig, key.addr)
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	conn, err := dialAddr(key.addr, hc.dialFunc(0), hc.DialDualStack, hc.IsTLS, tlsConfig, hc.WriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if hc.IsTLS {
+		var deadline time.Time
+		if hc.WriteTimeout > 0 {
+			deadline = time.Now().Add(hc.WriteTimeout)
+		}
+		proto, err := negotiatedProtocol(conn, deadline)
+		if err == nil && proto != "h2" {
+			err = errH2NotNegotiated
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return newH2ClientConn(t, key, hc, conn)
+}
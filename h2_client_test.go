@@ -0,0 +1,393 @@
+package fns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	xhpack "golang.org/x/net/http2/hpack"
+)
+
+// newH2ClientTestServer serves s with HTTP/2 enabled, over TLS if isTLS is set and with
+// prior knowledge h2c otherwise, and returns a HostClient sending requests to it over t
+func newH2ClientTestServer(tb testing.TB, s *Server, conf ServerConfig, isTLS bool, t *H2Transport) *HostClient {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	conf.H2C = !isTLS
+	EnableHTTP2(s, conf)
+	if isTLS {
+		certData, keyData, err := GenerateTestCertificate("localhost")
+		if err != nil {
+			tb.Fatalf("unexpected error: %v", err)
+		}
+		go s.ServeTLSEmbed(ln, certData, keyData) //nolint:errcheck
+	} else {
+		go s.Serve(ln) //nolint:errcheck
+	}
+
+	return &HostClient{
+		Addr:      ln.Addr().String(),
+		IsTLS:     isTLS,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Transport: t,
+	}
+}
+
+// h2ClientTestHandler echoes the request, along with the connection it was received on
+func h2ClientTestHandler(ctx *RequestCtx) {
+	ctx.Response.Header.Set("X-Conn-ID", fmt.Sprint(ctx.ConnID()))
+	ctx.Response.Header.Set("X-Method", string(ctx.Method()))
+	ctx.Response.Header.Set("X-Host", string(ctx.Host()))
+	ctx.Response.Header.Set("X-Foo", string(ctx.Request.Header.Peek("X-Foo")))
+	ctx.SetBody(ctx.PostBody())
+}
+
+func doH2TestRequest(tb testing.TB, hc *HostClient, method, url, body string) *Response {
+	tb.Helper()
+
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(url)
+	req.Header.Set("X-Foo", "bar")
+	req.SetBodyString(body)
+
+	resp := &Response{}
+	if err := hc.DoTimeout(req, resp, 5*time.Second); err != nil {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+	return resp
+}
+
+func TestH2Transport(t *testing.T) {
+	t.Parallel()
+
+	for _, isTLS := range []bool{false, true} {
+		isTLS := isTLS
+		t.Run(fmt.Sprintf("TLS=%v", isTLS), func(t *testing.T) {
+			t.Parallel()
+
+			hc := newH2ClientTestServer(t, &Server{Handler: h2ClientTestHandler}, ServerConfig{}, isTLS, &H2Transport{AllowHTTP: true})
+			scheme := "http"
+			if isTLS {
+				scheme = "https"
+			}
+
+			resp := doH2TestRequest(t, hc, MethodGet, scheme+"://example.com/get", "")
+			if resp.StatusCode() != StatusOK {
+				t.Fatalf("unexpected status code %d", resp.StatusCode())
+			}
+			if v := string(resp.Header.Peek("X-Method")); v != MethodGet {
+				t.Fatalf("unexpected method %q", v)
+			}
+			if v := string(resp.Header.Peek("X-Host")); v != "example.com" {
+				t.Fatalf("unexpected host %q", v)
+			}
+			if v := string(resp.Header.Peek("X-Foo")); v != "bar" {
+				t.Fatalf("unexpected header value %q", v)
+			}
+			connID := string(resp.Header.Peek("X-Conn-ID"))
+
+			resp = doH2TestRequest(t, hc, MethodPost, scheme+"://example.com/post", "hello")
+			if v := string(resp.Header.Peek("X-Method")); v != MethodPost {
+				t.Fatalf("unexpected method %q", v)
+			}
+			if string(resp.Body()) != "hello" {
+				t.Fatalf("unexpected body %q", resp.Body())
+			}
+			if resp.Header.ContentLength() != 5 {
+				t.Fatalf("unexpected content length %d", resp.Header.ContentLength())
+			}
+			if v := string(resp.Header.Peek("X-Conn-ID")); v != connID {
+				t.Fatalf("the requests were sent on different connections %s and %s", connID, v)
+			}
+		})
+	}
+}
+
+func TestH2TransportMultiplexing(t *testing.T) {
+	t.Parallel()
+
+	var inFlight, maxInFlight int32
+	handler := func(ctx *RequestCtx) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		h2ClientTestHandler(ctx)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		serverStreams uint32
+		clientStreams uint32
+		maxInFlight   int32
+	}{
+		{name: "unlimited", maxInFlight: 10},
+		{name: "server limit", serverStreams: 2, maxInFlight: 2},
+		{name: "client limit", clientStreams: 3, maxInFlight: 3},
+	} {
+		atomic.StoreInt32(&maxInFlight, 0)
+		hc := newH2ClientTestServer(t, &Server{Handler: handler}, ServerConfig{MaxConcurrentStreams: tc.serverStreams}, false,
+			&H2Transport{AllowHTTP: true, MaxConcurrentStreams: tc.clientStreams})
+
+		var wg sync.WaitGroup
+		connIDs := make([]string, 10)
+		for i := range connIDs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := AcquireRequest()
+				defer ReleaseRequest(req)
+				req.SetRequestURI("http://example.com/")
+				var resp Response
+				if err := hc.DoTimeout(req, &resp, 5*time.Second); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				connIDs[i] = string(resp.Header.Peek("X-Conn-ID"))
+			}(i)
+		}
+		wg.Wait()
+
+		for _, id := range connIDs {
+			if id != connIDs[0] {
+				t.Fatalf("%s: the requests were sent on different connections %v", tc.name, connIDs)
+			}
+		}
+		if n := atomic.LoadInt32(&maxInFlight); n > tc.maxInFlight || (tc.maxInFlight < 10 && n != tc.maxInFlight) {
+			t.Fatalf("%s: unexpected number of concurrent requests %d, expected %d", tc.name, n, tc.maxInFlight)
+		}
+	}
+}
+
+func TestH2TransportFlowControl(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		ctx.SetBody(bytes.Repeat(ctx.PostBody(), 3))
+	}}
+	hc := newH2ClientTestServer(t, s, ServerConfig{InitialWindowSize: 1 << 14, InitialConnWindowSize: 1 << 16}, false,
+		&H2Transport{AllowHTTP: true, InitialWindowSize: 1 << 14, InitialConnWindowSize: 1 << 16})
+
+	body := strings.Repeat("0123456789", 100<<10)
+	resp := doH2TestRequest(t, hc, MethodPost, "http://example.com/", body)
+	if string(resp.Body()) != strings.Repeat(body, 3) {
+		t.Fatalf("unexpected body of %d bytes, expected %d bytes", len(resp.Body()), 3*len(body))
+	}
+
+	// The body stream is sent as it is read
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	req.Header.SetMethod(MethodPost)
+	req.SetRequestURI("http://example.com/")
+	req.SetBodyStream(strings.NewReader(body), -1)
+	resp.Reset()
+	if err := hc.DoTimeout(req, resp, 5*time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Body()) != 3*len(body) {
+		t.Fatalf("unexpected body of %d bytes, expected %d bytes", len(resp.Body()), 3*len(body))
+	}
+
+	hc.MaxResponseBodySize = len(body)
+	req.SetBodyString(body)
+	if err := hc.DoTimeout(req, resp, 5*time.Second); err != ErrBodyTooLarge {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBodyTooLarge)
+	}
+}
+
+func TestH2TransportTimeout(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		if string(ctx.Path()) == "/slow" {
+			time.Sleep(time.Second)
+		}
+		h2ClientTestHandler(ctx)
+	}}
+	hc := newH2ClientTestServer(t, s, ServerConfig{}, false, &H2Transport{AllowHTTP: true})
+
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	req.SetRequestURI("http://example.com/slow")
+	if err := hc.DoTimeout(req, nil, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrTimeout)
+	}
+
+	// Only the stream was cancelled, the connection is still usable
+	doH2TestRequest(t, hc, MethodGet, "http://example.com/", "")
+}
+
+func TestH2TransportFallback(t *testing.T) {
+	t.Parallel()
+
+	certData, keyData, err := GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ln.Close()
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		ctx.SetBodyString("http/1")
+	}}
+	go s.ServeTLSEmbed(ln, certData, keyData) //nolint:errcheck
+
+	tr := &H2Transport{}
+	hc := &HostClient{
+		Addr:      ln.Addr().String(),
+		IsTLS:     true,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Transport: tr,
+	}
+	for i := 0; i < 2; i++ {
+		resp := doH2TestRequest(t, hc, MethodGet, "https://example.com/", "")
+		if string(resp.Body()) != "http/1" {
+			t.Fatalf("unexpected body %q", resp.Body())
+		}
+	}
+	if len(tr.conns) != 0 || len(tr.http1) != 1 {
+		t.Fatalf("unexpected HTTP/2 connections %v, HTTP/1 hosts %v", tr.conns, tr.http1)
+	}
+}
+
+// h2ClientFakeServer answers the requests of each HTTP/2 connection it accepts with serve
+func h2ClientFakeServer(t *testing.T, serve func(fr *http2.Framer, enc *xhpack.Encoder, buf *bytes.Buffer)) *HostClient {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				preface := make([]byte, len(ClientPreface))
+				if _, err := c.Read(preface); err != nil || string(preface) != ClientPreface {
+					return
+				}
+				fr := http2.NewFramer(c, c)
+				if err := fr.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100}); err != nil {
+					return
+				}
+				var buf bytes.Buffer
+				serve(fr, xhpack.NewEncoder(&buf), &buf)
+			}(c)
+		}
+	}()
+
+	return &HostClient{Addr: ln.Addr().String(), Transport: &H2Transport{AllowHTTP: true}}
+}
+
+// readH2Request skips the frames until the HEADERS frame of a request
+func readH2Request(fr *http2.Framer) (*http2.HeadersFrame, error) {
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hf, ok := f.(*http2.HeadersFrame); ok {
+			return hf, nil
+		}
+	}
+}
+
+func TestH2TransportRetryUnprocessed(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		refuse func(fr *http2.Framer, streamID uint32)
+		conns  int32
+	}{
+		// The request goes to a new connection after GOAWAY
+		{"GOAWAY", func(fr *http2.Framer, streamID uint32) {
+			fr.WriteGoAway(0, http2.ErrCodeNo, nil) //nolint:errcheck
+		}, 2},
+		{"REFUSED_STREAM", func(fr *http2.Framer, streamID uint32) {
+			fr.WriteRSTStream(streamID, http2.ErrCodeRefusedStream) //nolint:errcheck
+		}, 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var conns, refused int32
+			hc := h2ClientFakeServer(t, func(fr *http2.Framer, enc *xhpack.Encoder, buf *bytes.Buffer) {
+				atomic.AddInt32(&conns, 1)
+				for {
+					hf, err := readH2Request(fr)
+					if err != nil {
+						return
+					}
+					if atomic.CompareAndSwapInt32(&refused, 0, 1) {
+						// The request isn't processed, even a POST can be sent again
+						tc.refuse(fr, hf.StreamID)
+						continue
+					}
+					buf.Reset()
+					enc.WriteField(xhpack.HeaderField{Name: ":status", Value: "200"})                                             //nolint:errcheck
+					fr.WriteHeaders(http2.HeadersFrameParam{StreamID: hf.StreamID, BlockFragment: buf.Bytes(), EndHeaders: true}) //nolint:errcheck
+					fr.WriteData(hf.StreamID, true, []byte("processed"))                                                          //nolint:errcheck
+				}
+			})
+
+			resp := doH2TestRequest(t, hc, MethodPost, "http://example.com/", "body")
+			if string(resp.Body()) != "processed" {
+				t.Fatalf("unexpected body %q", resp.Body())
+			}
+			if n := atomic.LoadInt32(&conns); n != tc.conns {
+				t.Fatalf("unexpected number of connections %d, expected %d", n, tc.conns)
+			}
+		})
+	}
+}
+
+func TestH2TransportStreamReset(t *testing.T) {
+	t.Parallel()
+
+	hc := h2ClientFakeServer(t, func(fr *http2.Framer, enc *xhpack.Encoder, buf *bytes.Buffer) {
+		for {
+			hf, err := readH2Request(fr)
+			if err != nil {
+				return
+			}
+			fr.WriteRSTStream(hf.StreamID, http2.ErrCodeInternal) //nolint:errcheck
+		}
+	})
+
+	req := AcquireRequest()
+	defer ReleaseRequest(req)
+	req.SetRequestURI("http://example.com/")
+	err := hc.DoTimeout(req, nil, 5*time.Second)
+	if _, ok := err.(h2StreamResetError); !ok || err.(h2StreamResetError).code != 0x2 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
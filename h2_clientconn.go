@@ -0,0 +1,1034 @@
+package fns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pablolagos/fns/internal/frames"
+	"github.com/pablolagos/fns/internal/hpack"
+)
+
+// maxClientStreamID is the largest stream ID a client can open, the connection can't
+// take new requests past it
+const maxClientStreamID = 1<<31 - 1
+
+// errH2StreamDone stops sending a request body once its stream is finished
+var errH2StreamDone = errors.New("stream finished before the request body was sent")
+
+// h2StreamResetError is returned when the server resets the stream of a request
+type h2StreamResetError struct {
+	code uint32
+}
+
+func (e h2StreamResetError) Error() string {
+	return fmt.Sprintf("stream reset by the server with error code %d", e.code)
+}
+
+// h2ClientConn is an HTTP/2 connection to a server, shared by the requests to the
+// same address. Its read loop dispatches the responses to the streams.
+type h2ClientConn struct {
+	t    *H2Transport
+	key  h2ConnKey
+	conn net.Conn
+	br   *bufio.Reader
+
+	// writeTimeout bounds each write and idleTimeout closes the connection once it
+	// has no streams for that long, from the HostClient that dialed it
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	// wmu serializes the writes. The HEADERS frames are encoded and written while
+	// holding it, so the streams are opened in increasing ID order and the server
+	// decodes the header blocks in the order they were encoded.
+	wmu  sync.Mutex
+	bw   *bufio.Writer
+	enc  *hpack.Encoder
+	hbuf bytes.Buffer
+
+	// dec and the header block being received are only used by the read loop
+	dec             *hpack.Decoder
+	headerBlock     []byte
+	headerStreamID  uint32
+	headerEndStream bool
+
+	// mu guards the fields below, cond is signaled when a stream finishes, the send
+	// windows grow or the connection state changes. mu is never held while writing,
+	// and wmu is taken before mu when both are needed.
+	mu               sync.Mutex
+	cond             *sync.Cond
+	streams          map[uint32]*h2ClientStream
+	nextStreamID     uint32
+	reserved         int
+	peerSettings     Settings
+	settingsReceived bool
+	flow             outflow
+	inflow           inflow
+	goAway           bool
+	closed           bool
+	idleTimer        *time.Timer
+}
+
+// h2ClientStream is a request in flight. The read loop fills resp while the stream
+// is registered in the connection, and closes done once it is removed.
+type h2ClientStream struct {
+	id          uint32
+	resp        *Response
+	skipBody    bool
+	maxBodySize int
+
+	// contentLength is the value of the content-length response header, or -1
+	contentLength int
+
+	flow   outflow
+	inflow inflow
+
+	// gotResponse is set once the final response headers have been received
+	gotResponse bool
+
+	done chan struct{}
+	err  error
+}
+
+// newH2ClientConn starts HTTP/2 on a new connection, sending the connection preface
+// and our settings, see RFC 9113 section 3.4
+func newH2ClientConn(t *H2Transport, key h2ConnKey, hc *HostClient, conn net.Conn) (*h2ClientConn, error) {
+	cc := &h2ClientConn{
+		t:            t,
+		key:          key,
+		conn:         conn,
+		br:           bufio.NewReaderSize(conn, DefaultMaxFrameSize),
+		writeTimeout: hc.WriteTimeout,
+		idleTimeout:  hc.MaxIdleConnDuration,
+		bw:           bufio.NewWriterSize(conn, DefaultMaxFrameSize),
+		enc:          hpack.NewEncoder(),
+		dec:          hpack.NewDecoder(),
+		streams:      make(map[uint32]*h2ClientStream),
+		nextStreamID: 1,
+		peerSettings: NewSettings(),
+		flow:         outflow{n: DefaultInitialWindowSize},
+	}
+	if cc.idleTimeout <= 0 {
+		cc.idleTimeout = DefaultMaxIdleConnDuration
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+	cc.inflow.init(int32(t.initialConnWindowSize()))
+
+	settings := NewSettings()
+	settings.Set(SettingEnablePush, 0)
+	settings.Set(SettingInitialWindowSize, t.initialWindowSize())
+
+	frame := frames.AcquireFrame(frames.FrameSettings)
+	defer frames.ReleaseFrame(frame)
+	if err := settings.PutParams(&frame.Body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err := cc.extendWriteDeadline()
+	if err == nil {
+		_, err = cc.bw.WriteString(ClientPreface)
+	}
+	if err == nil {
+		err = frame.Write(cc.bw)
+	}
+	if inc := t.initialConnWindowSize() - DefaultInitialWindowSize; err == nil && inc > 0 {
+		err = cc.writeWindowUpdate(0, inc)
+	}
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	cc.mu.Lock()
+	cc.startIdleTimer()
+	cc.mu.Unlock()
+
+	go cc.readLoop()
+	return cc, nil
+}
+
+func (t *H2Transport) initialWindowSize() uint32 {
+	if t.InitialWindowSize == 0 {
+		return DefaultH2InitialWindowSize
+	}
+	return t.InitialWindowSize
+}
+
+func (t *H2Transport) initialConnWindowSize() uint32 {
+	if t.InitialConnWindowSize == 0 {
+		return DefaultH2InitialConnWindowSize
+	}
+	return t.InitialConnWindowSize
+}
+
+// canTakeNewRequest reports whether new streams can be opened on the connection. The
+// requests may still have to wait for the streams in flight to finish.
+func (cc *h2ClientConn) canTakeNewRequest() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return !cc.closed && !cc.goAway
+}
+
+// maxConcurrentStreams returns the number of streams that can be open at the same time
+func (cc *h2ClientConn) maxConcurrentStreams() int {
+	n := cc.peerSettings.Get(SettingMaxConcurrentStreams)
+	if m := cc.t.MaxConcurrentStreams; m > 0 && m < n {
+		n = m
+	}
+	return int(n)
+}
+
+// roundTrip sends the request on a new stream and waits for the response
+func (cc *h2ClientConn) roundTrip(hc *HostClient, req *Request, resp *Response) error {
+	var deadline time.Time
+	if req.timeout > 0 {
+		deadline = time.Now().Add(req.timeout)
+	}
+
+	if err := req.prepareWrite(); err != nil {
+		return err
+	}
+	var body []byte
+	if !req.IsBodyStream() {
+		var err error
+		if body, err = req.bodyToWrite(); err != nil {
+			return err
+		}
+		if len(body) != 0 || !req.Header.ignoreBody() {
+			req.Header.SetContentLength(len(body))
+		}
+	}
+	scheme := "http"
+	if hc.IsTLS {
+		scheme = "https"
+	}
+	fields := appendH2RequestHeaders(nil, &req.Header, scheme)
+	streamedBody := req.IsBodyStream()
+	hasBody := streamedBody || len(body) > 0
+
+	resp.parseNetConn(cc.conn)
+	if req.Header.IsHead() {
+		resp.SkipBody = true
+	}
+	if hc.DisableHeaderNamesNormalizing {
+		resp.Header.DisableNormalizing()
+	}
+	cs := &h2ClientStream{
+		resp:          resp,
+		skipBody:      resp.SkipBody,
+		maxBodySize:   hc.MaxResponseBodySize,
+		contentLength: -1,
+		done:          make(chan struct{}),
+	}
+
+	if err := cc.reserveStream(deadline); err != nil {
+		return err
+	}
+	if err := cc.writeHeaders(cs, fields, !hasBody); err != nil {
+		return err
+	}
+
+	// The body is sent while waiting for the response, the server may answer
+	// before reading all of it
+	var bodyDone chan error
+	if hasBody {
+		bodyDone = make(chan error, 1)
+		go func() {
+			var err error
+			if streamedBody {
+				err = cc.writeBodyStream(cs, req.bodyStream)
+				if closeErr := req.closeBodyStream(); err == nil {
+					err = closeErr
+				}
+			} else {
+				err = cc.writeData(cs, body, true)
+			}
+			bodyDone <- err
+		}()
+	}
+
+	waitDeadline := deadline
+	if hc.ReadTimeout > 0 {
+		if d := time.Now().Add(hc.ReadTimeout); waitDeadline.IsZero() || d.Before(waitDeadline) {
+			waitDeadline = d
+		}
+	}
+	var timeout <-chan time.Time
+	if !waitDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(waitDeadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var bodyErr error
+	select {
+	case <-cs.done:
+	case bodyErr = <-bodyDone:
+		bodyDone = nil
+		if bodyErr != nil && bodyErr != errH2StreamDone {
+			cc.cancelStream(cs, bodyErr)
+		}
+		select {
+		case <-cs.done:
+		case <-timeout:
+			cc.cancelStream(cs, ErrTimeout)
+		}
+	case <-timeout:
+		cc.cancelStream(cs, ErrTimeout)
+	}
+	<-cs.done
+
+	if bodyDone != nil {
+		// Sending the body stops once the stream is finished
+		bodyErr = <-bodyDone
+	}
+	if bodyErr == errH2StreamDone && cs.err == nil {
+		// The response is complete, the rest of the request body is not needed
+		cc.writeRSTStream(cs.id, 0x8) // CANCEL
+	}
+
+	if cs.err == errH2Unprocessed && streamedBody {
+		// The body stream was consumed, the request can't be sent again
+		return fmt.Errorf("%w, the request body stream was consumed", errH2Unprocessed)
+	}
+	return cs.err
+}
+
+// reserveStream waits until a new stream can be opened without exceeding the server's
+// SETTINGS_MAX_CONCURRENT_STREAMS, which is only known once its SETTINGS frame arrives
+func (cc *h2ClientConn) reserveStream(deadline time.Time) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	var timer *time.Timer
+	for {
+		if cc.closed || cc.goAway {
+			return errH2Unprocessed
+		}
+		if cc.settingsReceived && len(cc.streams)+cc.reserved < cc.maxConcurrentStreams() {
+			cc.reserved++
+			cc.stopIdleTimer()
+			return nil
+		}
+		if !deadline.IsZero() {
+			if !time.Now().Before(deadline) {
+				return ErrTimeout
+			}
+			if timer == nil {
+				timer = time.AfterFunc(time.Until(deadline), cc.broadcast)
+				defer timer.Stop()
+			}
+		}
+		cc.cond.Wait()
+	}
+}
+
+// broadcast wakes up the goroutines waiting for a change of the connection state
+func (cc *h2ClientConn) broadcast() {
+	cc.mu.Lock()
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+}
+
+// writeHeaders opens the stream reserved by reserveStream and sends the request header
+// fields in a HEADERS frame, followed by CONTINUATION frames if they don't fit
+func (cc *h2ClientConn) writeHeaders(cs *h2ClientStream, fields []hpack.HeaderField, endStream bool) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	cc.mu.Lock()
+	cc.reserved--
+	if cc.closed || cc.goAway {
+		cc.mu.Unlock()
+		return errH2Unprocessed
+	}
+	cs.id = cc.nextStreamID
+	cc.nextStreamID += 2
+	if cc.nextStreamID > maxClientStreamID {
+		// The stream IDs are exhausted, the next requests go to a new connection
+		cc.goAway = true
+		defer cc.t.removeConn(cc)
+	}
+	cs.flow = outflow{n: int32(cc.peerSettings.Get(SettingInitialWindowSize)), conn: &cc.flow}
+	cs.inflow.init(int32(cc.t.initialWindowSize()))
+	cc.streams[cs.id] = cs
+	maxFrameSize := int(cc.peerSettings.Get(SettingMaxFrameSize))
+	cc.mu.Unlock()
+
+	cc.hbuf.Reset()
+	for _, f := range fields {
+		if err := cc.enc.EncodeField(&cc.hbuf, f); err != nil {
+			cc.closeWithError(err)
+			return err
+		}
+	}
+
+	block := cc.hbuf.Bytes()
+	frameType := frames.FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		frame := frames.AcquireFrame(frameType)
+		frame.StreamID = cs.id
+		n := len(block)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		frame.Body = append(frame.Body[:0], block[:n]...)
+		block = block[n:]
+		if len(block) == 0 {
+			frame.Flags |= frames.FlagEndHeaders
+		}
+		if first && endStream {
+			frame.Flags |= frames.FlagEndStream
+		}
+
+		err := cc.extendWriteDeadline()
+		if err == nil {
+			err = frame.Write(cc.bw)
+		}
+		frames.ReleaseFrame(frame)
+		if err != nil {
+			cc.closeWithError(err)
+			return err
+		}
+		frameType = frames.FrameContinuation
+	}
+	if err := cc.bw.Flush(); err != nil {
+		cc.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// writeBodyStream sends the request body read from r
+func (cc *h2ClientConn) writeBodyStream(cs *h2ClientStream, r io.Reader) error {
+	buf := make([]byte, DefaultMaxFrameSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := cc.writeData(cs, buf[:n], false); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return cc.writeData(cs, nil, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeData sends data in DATA frames as the stream and connection windows allow
+func (cc *h2ClientConn) writeData(cs *h2ClientStream, data []byte, endStream bool) error {
+	for {
+		n, err := cc.awaitFlow(cs, len(data))
+		if err != nil {
+			return err
+		}
+
+		frame := frames.AcquireFrame(frames.FrameData)
+		frame.StreamID = cs.id
+		frame.Body = append(frame.Body[:0], data[:n]...)
+		data = data[n:]
+		last := len(data) == 0
+		if last && endStream {
+			frame.Flags |= frames.FlagEndStream
+		}
+
+		cc.wmu.Lock()
+		err = cc.extendWriteDeadline()
+		if err == nil {
+			err = frame.Write(cc.bw)
+		}
+		if err == nil {
+			err = cc.bw.Flush()
+		}
+		cc.wmu.Unlock()
+		frames.ReleaseFrame(frame)
+		if err != nil {
+			cc.closeWithError(err)
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// awaitFlow waits until up to n bytes can be sent on the stream, and takes them from
+// the windows. It returns immediately if n is 0, for sending an empty DATA frame.
+func (cc *h2ClientConn) awaitFlow(cs *h2ClientStream, n int) (int, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for {
+		if cc.streams[cs.id] != cs {
+			return 0, errH2StreamDone
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		if avail := int(cs.flow.available()); avail > 0 {
+			if avail < n {
+				n = avail
+			}
+			if maxFrameSize := int(cc.peerSettings.Get(SettingMaxFrameSize)); maxFrameSize < n {
+				n = maxFrameSize
+			}
+			cs.flow.take(int32(n))
+			return n, nil
+		}
+		cc.cond.Wait()
+	}
+}
+
+// cancelStream finishes a stream with err and resets it, if it is still in flight
+func (cc *h2ClientConn) cancelStream(cs *h2ClientStream, err error) {
+	cc.mu.Lock()
+	inFlight := cc.streams[cs.id] == cs
+	if inFlight {
+		cc.removeStream(cs, err)
+	}
+	cc.mu.Unlock()
+
+	if inFlight {
+		cc.writeRSTStream(cs.id, 0x8) // CANCEL
+	}
+}
+
+// streamError finishes a stream with err after a stream error, see RFC 9113 section 5.4.2
+func (cc *h2ClientConn) streamError(cs *h2ClientStream, errorCode uint32, err error) {
+	cc.mu.Lock()
+	cc.removeStream(cs, err)
+	cc.mu.Unlock()
+
+	cc.writeRSTStream(cs.id, errorCode)
+}
+
+// removeStream finishes a stream, it must be called with mu held. The connection is
+// closed if it was going away and this was its last stream.
+func (cc *h2ClientConn) removeStream(cs *h2ClientStream, err error) {
+	if cc.streams[cs.id] != cs {
+		return
+	}
+	delete(cc.streams, cs.id)
+	cs.err = err
+	close(cs.done)
+	cc.cond.Broadcast()
+
+	if len(cc.streams) == 0 && cc.reserved == 0 {
+		if cc.goAway {
+			cc.conn.Close()
+		} else {
+			cc.startIdleTimer()
+		}
+	}
+}
+
+// startIdleTimer closes the connection if no request is sent on it for idleTimeout,
+// it must be called with mu held
+func (cc *h2ClientConn) startIdleTimer() {
+	if cc.closed {
+		return
+	}
+	if cc.idleTimer == nil {
+		cc.idleTimer = time.AfterFunc(cc.idleTimeout, cc.closeIfIdle)
+	} else {
+		cc.idleTimer.Reset(cc.idleTimeout)
+	}
+}
+
+// stopIdleTimer must be called with mu held
+func (cc *h2ClientConn) stopIdleTimer() {
+	if cc.idleTimer != nil {
+		cc.idleTimer.Stop()
+	}
+}
+
+// closeIfIdle gracefully closes the connection if it has no request in flight
+func (cc *h2ClientConn) closeIfIdle() {
+	cc.mu.Lock()
+	if cc.closed || len(cc.streams) > 0 || cc.reserved > 0 {
+		cc.mu.Unlock()
+		return
+	}
+	cc.goAway = true
+	cc.mu.Unlock()
+
+	cc.t.removeConn(cc)
+	cc.writeGoAway(0x0) // NO_ERROR
+	cc.conn.Close()
+}
+
+// closeWithError closes the connection, failing the requests in flight with err
+func (cc *h2ClientConn) closeWithError(err error) {
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return
+	}
+	cc.closed = true
+	cc.stopIdleTimer()
+	for _, cs := range cc.streams {
+		cc.removeStream(cs, err)
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.t.removeConn(cc)
+	cc.conn.Close()
+}
+
+// extendWriteDeadline bounds the next write with writeTimeout, it must be called with
+// wmu held
+func (cc *h2ClientConn) extendWriteDeadline() error {
+	if cc.writeTimeout <= 0 {
+		return nil
+	}
+	return cc.conn.SetWriteDeadline(time.Now().Add(cc.writeTimeout))
+}
+
+// writeControl writes and flushes a frame sent by the connection itself. The write
+// errors end the read loop, as the connection is closed.
+func (cc *h2ClientConn) writeControl(frame *frames.Frame) {
+	defer frames.ReleaseFrame(frame)
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	err := cc.extendWriteDeadline()
+	if err == nil {
+		err = frame.Write(cc.bw)
+	}
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	if err != nil {
+		cc.conn.Close()
+	}
+}
+
+// writeWindowUpdate writes a WINDOW_UPDATE frame without flushing it, it must be called
+// with wmu held
+func (cc *h2ClientConn) writeWindowUpdate(streamID, increment uint32) error {
+	frame := frames.AcquireFrame(frames.FrameWindowUpdate)
+	defer frames.ReleaseFrame(frame)
+	frame.StreamID = streamID
+	frame.Body = binary.BigEndian.AppendUint32(frame.Body[:0], increment)
+	return frame.Write(cc.bw)
+}
+
+// sendWindowUpdates returns the credit of the received data to the server
+func (cc *h2ClientConn) sendWindowUpdates(streamID uint32, streamInc, connInc int32) {
+	if streamInc == 0 && connInc == 0 {
+		return
+	}
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	err := cc.extendWriteDeadline()
+	if err == nil && connInc > 0 {
+		err = cc.writeWindowUpdate(0, uint32(connInc))
+	}
+	if err == nil && streamInc > 0 {
+		err = cc.writeWindowUpdate(streamID, uint32(streamInc))
+	}
+	if err == nil {
+		err = cc.bw.Flush()
+	}
+	if err != nil {
+		cc.conn.Close()
+	}
+}
+
+func (cc *h2ClientConn) writeRSTStream(streamID, errorCode uint32) {
+	frame := frames.AcquireFrame(frames.FrameRSTStream)
+	frame.StreamID = streamID
+	frame.Body = binary.BigEndian.AppendUint32(frame.Body[:0], errorCode)
+	cc.writeControl(frame)
+}
+
+func (cc *h2ClientConn) writeGoAway(errorCode uint32) {
+	frame := frames.AcquireFrame(frames.FrameGoAway)
+	// The server can't open streams, so no stream was processed
+	frame.Body = binary.BigEndian.AppendUint32(frame.Body[:0], 0)
+	frame.Body = binary.BigEndian.AppendUint32(frame.Body, errorCode)
+	cc.writeControl(frame)
+}
+
+// readLoop reads the frames sent by the server until the connection is closed
+func (cc *h2ClientConn) readLoop() {
+	var err error
+	conn := &h2cConn{Conn: cc.conn, r: cc.br}
+	for err == nil {
+		var frame *frames.Frame
+		frame, err = frames.ReadFrame(conn)
+		if err != nil {
+			break
+		}
+		err = cc.processFrame(frame)
+		frames.ReleaseFrame(frame)
+	}
+
+	var connErr h2ConnError
+	if errors.As(err, &connErr) {
+		cc.writeGoAway(connErr.code)
+	}
+	cc.closeWithError(ErrConnectionClosed)
+}
+
+// processFrame handles a frame received from the server. The connection errors are
+// returned as h2ConnError, see RFC 9113 section 5.4.1.
+func (cc *h2ClientConn) processFrame(frame *frames.Frame) error {
+	if len(frame.Body) > DefaultMaxFrameSize {
+		return h2ConnError{code: 0x6, reason: "frame too large"} // FRAME_SIZE_ERROR
+	}
+	if cc.headerStreamID != 0 && (frame.Type != frames.FrameContinuation || frame.StreamID != cc.headerStreamID) {
+		return h2ConnError{code: 0x1, reason: "expected CONTINUATION frame"} // PROTOCOL_ERROR
+	}
+
+	switch frame.Type {
+	case frames.FrameSettings:
+		return cc.processSettings(frame)
+	case frames.FramePing:
+		if len(frame.Body) != 8 {
+			return h2ConnError{code: 0x6, reason: "invalid PING frame size"} // FRAME_SIZE_ERROR
+		}
+		if frame.Flags&frames.FlagAck == 0 {
+			ack := frames.AcquireFrame(frames.FramePing)
+			ack.SetACK(true)
+			ack.Body = append(ack.Body[:0], frame.Body...)
+			cc.writeControl(ack)
+		}
+	case frames.FrameWindowUpdate:
+		return cc.processWindowUpdate(frame)
+	case frames.FrameHeaders, frames.FrameContinuation:
+		return cc.processHeaders(frame)
+	case frames.FrameData:
+		return cc.processData(frame)
+	case frames.FrameRSTStream:
+		if len(frame.Body) != 4 {
+			return h2ConnError{code: 0x6, reason: "invalid RST_STREAM frame size"} // FRAME_SIZE_ERROR
+		}
+		code := binary.BigEndian.Uint32(frame.Body)
+		var err error = h2StreamResetError{code: code}
+		if code == 0x7 { // REFUSED_STREAM
+			err = errH2Unprocessed
+		}
+		cc.mu.Lock()
+		if cs := cc.streams[frame.StreamID]; cs != nil {
+			cc.removeStream(cs, err)
+		}
+		cc.mu.Unlock()
+	case frames.FrameGoAway:
+		return cc.processGoAway(frame)
+	case frames.FramePushPromise:
+		// Push is disabled with SETTINGS_ENABLE_PUSH
+		return h2ConnError{code: 0x1, reason: "unexpected PUSH_PROMISE frame"} // PROTOCOL_ERROR
+	}
+	// The other frames, such as PRIORITY, are ignored
+	return nil
+}
+
+func (cc *h2ClientConn) processSettings(frame *frames.Frame) error {
+	if frame.StreamID != 0 {
+		return h2ConnError{code: 0x1, reason: "SETTINGS frame on a stream"} // PROTOCOL_ERROR
+	}
+	if frame.Flags&frames.FlagAck != 0 {
+		return nil
+	}
+
+	cc.mu.Lock()
+	oldWindow := cc.peerSettings.Get(SettingInitialWindowSize)
+	if !cc.settingsReceived {
+		// There is no limit until the server announces one
+		cc.peerSettings.Set(SettingMaxConcurrentStreams, math.MaxUint32)
+	}
+	if err := applySettings(frame, &cc.peerSettings); err != nil {
+		cc.mu.Unlock()
+		return err
+	}
+	delta := int32(cc.peerSettings.Get(SettingInitialWindowSize) - oldWindow)
+	for _, cs := range cc.streams {
+		if !cs.flow.add(delta) {
+			cc.mu.Unlock()
+			return h2ConnError{code: 0x3, reason: "stream flow control window overflow"} // FLOW_CONTROL_ERROR
+		}
+	}
+	cc.settingsReceived = true
+	tableSize := cc.peerSettings.Get(SettingHeaderTableSize)
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.wmu.Lock()
+	cc.enc.SetMaxDynamicTableSizeLimit(tableSize)
+	cc.wmu.Unlock()
+
+	ack := frames.AcquireFrame(frames.FrameSettings)
+	ack.SetACK(true)
+	cc.writeControl(ack)
+	return nil
+}
+
+func (cc *h2ClientConn) processWindowUpdate(frame *frames.Frame) error {
+	if len(frame.Body) != 4 {
+		return h2ConnError{code: 0x6, reason: "invalid WINDOW_UPDATE frame size"} // FRAME_SIZE_ERROR
+	}
+	inc := binary.BigEndian.Uint32(frame.Body) & 0x7fffffff
+
+	cc.mu.Lock()
+	if frame.StreamID == 0 {
+		defer cc.mu.Unlock()
+		if inc == 0 {
+			return h2ConnError{code: 0x1, reason: "WINDOW_UPDATE with zero increment"} // PROTOCOL_ERROR
+		}
+		if !cc.flow.add(int32(inc)) {
+			return h2ConnError{code: 0x3, reason: "connection flow control window overflow"} // FLOW_CONTROL_ERROR
+		}
+		cc.cond.Broadcast()
+		return nil
+	}
+
+	cs := cc.streams[frame.StreamID]
+	if cs == nil {
+		cc.mu.Unlock()
+		return nil
+	}
+	if inc == 0 || !cs.flow.add(int32(inc)) {
+		cc.mu.Unlock()
+		code := uint32(0x3) // FLOW_CONTROL_ERROR
+		if inc == 0 {
+			code = 0x1 // PROTOCOL_ERROR
+		}
+		cc.streamError(cs, code, h2StreamResetError{code: code})
+		return nil
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	return nil
+}
+
+// processHeaders collects a header block, which may span CONTINUATION frames, and
+// applies it to the response once complete
+func (cc *h2ClientConn) processHeaders(frame *frames.Frame) error {
+	if frame.Type == frames.FrameHeaders {
+		if frame.StreamID == 0 {
+			return h2ConnError{code: 0x1, reason: "HEADERS frame without stream"} // PROTOCOL_ERROR
+		}
+		payload, err := frame.Payload()
+		if err != nil {
+			return h2ConnError{code: 0x1, reason: err.Error()} // PROTOCOL_ERROR
+		}
+		cc.headerBlock = append(cc.headerBlock[:0], payload...)
+		cc.headerStreamID = frame.StreamID
+		cc.headerEndStream = frame.Flags&frames.FlagEndStream != 0
+	} else {
+		if cc.headerStreamID == 0 {
+			return h2ConnError{code: 0x1, reason: "unexpected CONTINUATION frame"} // PROTOCOL_ERROR
+		}
+		cc.headerBlock = append(cc.headerBlock, frame.Body...)
+	}
+	if frame.Flags&frames.FlagEndHeaders == 0 {
+		return nil
+	}
+
+	streamID := cc.headerStreamID
+	cc.headerStreamID = 0
+
+	// The header block is decoded even if the stream was cancelled, to keep the
+	// decoder in sync with the server's encoder
+	fields, err := cc.dec.DecodeFields(cc.headerBlock)
+	if err != nil {
+		return h2ConnError{code: 0x9, reason: err.Error()} // COMPRESSION_ERROR
+	}
+
+	cc.mu.Lock()
+	if streamID >= cc.nextStreamID {
+		cc.mu.Unlock()
+		return h2ConnError{code: 0x1, reason: "HEADERS frame on an idle stream"} // PROTOCOL_ERROR
+	}
+	cs := cc.streams[streamID]
+	if cs == nil {
+		cc.mu.Unlock()
+		return nil
+	}
+
+	if cs.gotResponse {
+		if !cc.headerEndStream {
+			cc.mu.Unlock()
+			cc.streamError(cs, 0x1, errors.New("trailers without END_STREAM")) // PROTOCOL_ERROR
+			return nil
+		}
+		for _, f := range fields {
+			if len(f.Name) > 0 && f.Name[0] != ':' && !isBadTrailer(s2b(f.Name)) {
+				cs.resp.Header.Add(f.Name, f.Value)
+			}
+		}
+		err := cc.finishResponse(cs)
+		cc.mu.Unlock()
+		if err != nil {
+			cc.streamError(cs, 0x1, err) // PROTOCOL_ERROR
+		}
+		return nil
+	}
+
+	status := -1
+	for _, f := range fields {
+		if f.Name == ":status" {
+			if n, err := strconv.Atoi(f.Value); err == nil && n >= 100 && n <= 999 {
+				status = n
+			}
+		}
+	}
+	if status < 0 || (status < 200 && cc.headerEndStream) {
+		cc.mu.Unlock()
+		cc.streamError(cs, 0x1, fmt.Errorf("invalid response status %d", status)) // PROTOCOL_ERROR
+		return nil
+	}
+	if status < 200 {
+		// The informational responses are skipped
+		cc.mu.Unlock()
+		return nil
+	}
+
+	cs.gotResponse = true
+	cs.resp.Header.SetStatusCode(status)
+	for _, f := range fields {
+		if len(f.Name) == 0 || f.Name[0] == ':' {
+			continue
+		}
+		if f.Name == "content-length" {
+			if n, err := strconv.Atoi(f.Value); err == nil && n >= 0 {
+				cs.contentLength = n
+			}
+		}
+		cs.resp.Header.Add(f.Name, f.Value)
+	}
+	if cc.headerEndStream {
+		err = cc.finishResponse(cs)
+	}
+	cc.mu.Unlock()
+	if err != nil {
+		cc.streamError(cs, 0x1, err) // PROTOCOL_ERROR
+	}
+	return nil
+}
+
+func (cc *h2ClientConn) processData(frame *frames.Frame) error {
+	if frame.StreamID == 0 {
+		return h2ConnError{code: 0x1, reason: "DATA frame without stream"} // PROTOCOL_ERROR
+	}
+	payload, err := frame.Payload()
+	if err != nil {
+		return h2ConnError{code: 0x1, reason: err.Error()} // PROTOCOL_ERROR
+	}
+	n := uint32(len(frame.Body))
+
+	cc.mu.Lock()
+	if frame.StreamID >= cc.nextStreamID {
+		cc.mu.Unlock()
+		return h2ConnError{code: 0x1, reason: "DATA frame on an idle stream"} // PROTOCOL_ERROR
+	}
+	if !cc.inflow.take(n) {
+		cc.mu.Unlock()
+		return h2ConnError{code: 0x3, reason: "connection flow control window exceeded"} // FLOW_CONTROL_ERROR
+	}
+
+	// The response bodies are buffered, so the credit is returned right away
+	connInc := cc.inflow.add(int(n))
+	cs := cc.streams[frame.StreamID]
+	if cs == nil {
+		cc.mu.Unlock()
+		cc.sendWindowUpdates(0, 0, connInc)
+		return nil
+	}
+
+	var streamErr error
+	errorCode := uint32(0x1) // PROTOCOL_ERROR
+	switch {
+	case !cs.gotResponse:
+		streamErr = errors.New("DATA frame before the response headers")
+	case !cs.inflow.take(n):
+		streamErr, errorCode = errors.New("stream flow control window exceeded"), 0x3 // FLOW_CONTROL_ERROR
+	case !cs.skipBody:
+		buf := cs.resp.bodyBuffer()
+		if cs.maxBodySize > 0 && buf.Len()+len(payload) > cs.maxBodySize {
+			streamErr, errorCode = ErrBodyTooLarge, 0x8 // CANCEL
+		} else {
+			buf.Write(payload) //nolint:errcheck
+		}
+	}
+
+	var streamInc int32
+	if streamErr == nil {
+		if frame.Flags&frames.FlagEndStream != 0 {
+			if err := cc.finishResponse(cs); err != nil {
+				streamErr = err
+			}
+		} else {
+			streamInc = cs.inflow.add(int(n))
+		}
+	}
+	cc.mu.Unlock()
+
+	if streamErr != nil {
+		cc.streamError(cs, errorCode, streamErr)
+	}
+	cc.sendWindowUpdates(frame.StreamID, streamInc, connInc)
+	return nil
+}
+
+// finishResponse completes a stream once the server ended it, checking that the body
+// matches the content-length response header, see RFC 9113 section 8.1.1. It must be
+// called with mu held.
+func (cc *h2ClientConn) finishResponse(cs *h2ClientStream) error {
+	if !cs.skipBody {
+		bodyLen := cs.resp.bodyBuffer().Len()
+		if cs.contentLength >= 0 && cs.contentLength != bodyLen {
+			return fmt.Errorf("content-length %d doesn't match the body length %d", cs.contentLength, bodyLen)
+		}
+		cs.resp.Header.SetContentLength(bodyLen)
+	}
+	cc.removeStream(cs, nil)
+	return nil
+}
+
+func (cc *h2ClientConn) processGoAway(frame *frames.Frame) error {
+	if len(frame.Body) < 8 {
+		return h2ConnError{code: 0x6, reason: "invalid GOAWAY frame size"} // FRAME_SIZE_ERROR
+	}
+	lastStreamID := binary.BigEndian.Uint32(frame.Body) & 0x7fffffff
+
+	cc.mu.Lock()
+	cc.goAway = true
+	for id, cs := range cc.streams {
+		// The streams above the last one processed can be sent again, see RFC 9113
+		// section 6.8
+		if id > lastStreamID {
+			cc.removeStream(cs, errH2Unprocessed)
+		}
+	}
+	cc.cond.Broadcast()
+	idle := len(cc.streams) == 0
+	cc.mu.Unlock()
+
+	cc.t.removeConn(cc)
+	if idle {
+		cc.conn.Close()
+	}
+	return nil
+}
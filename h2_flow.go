@@ -0,0 +1,85 @@
+package fns
+
+// maxWindowSize is the largest flow-control window allowed by RFC 9113 section 6.9.1
+const maxWindowSize = 1<<31 - 1
+
+// inflowMinRefresh is the smallest amount of credit returned with a WINDOW_UPDATE frame,
+// unless the peer would otherwise run out of window
+const inflowMinRefresh = 4 << 10
+
+// outflow is the flow-control window for the data we send. A stream window is always
+// checked together with the connection window, as both limit what can be sent.
+type outflow struct {
+	n int32
+
+	// conn is the connection-level window, nil for the connection window itself
+	conn *outflow
+}
+
+// available returns the number of bytes that can be sent right now
+func (f *outflow) available() int32 {
+	n := f.n
+	if f.conn != nil && f.conn.n < n {
+		n = f.conn.n
+	}
+	return n
+}
+
+// take consumes n bytes of the window, which must not be more than available returns
+func (f *outflow) take(n int32) {
+	f.n -= n
+	if f.conn != nil {
+		f.conn.n -= n
+	}
+}
+
+// add increases the window by n, which may be negative when SETTINGS_INITIAL_WINDOW_SIZE
+// is lowered. It reports false if the window would exceed maxWindowSize.
+func (f *outflow) add(n int32) bool {
+	sum := int64(f.n) + int64(n)
+	if sum > maxWindowSize {
+		return false
+	}
+	f.n = int32(sum)
+	return true
+}
+
+// inflow is the flow-control window for the data the peer sends us
+type inflow struct {
+	// avail is the window the peer can still use
+	avail int32
+
+	// unsent is the consumed credit not returned with a WINDOW_UPDATE frame yet
+	unsent int32
+}
+
+func (f *inflow) init(n int32) {
+	f.avail = n
+}
+
+// take consumes n bytes received from the peer. It reports false if the peer
+// exceeded the window it was granted.
+func (f *inflow) take(n uint32) bool {
+	if n > uint32(f.avail) {
+		return false
+	}
+	f.avail -= int32(n)
+	return true
+}
+
+// add returns n bytes of credit once the received data has been consumed. It returns
+// the window increment to send to the peer, or 0 if the update should be batched
+// with later ones to avoid flooding the peer with tiny WINDOW_UPDATE frames.
+func (f *inflow) add(n int) int32 {
+	if n <= 0 {
+		return 0
+	}
+	f.unsent += int32(n)
+	if f.unsent < inflowMinRefresh && f.unsent < f.avail {
+		return 0
+	}
+	inc := f.unsent
+	f.avail += inc
+	f.unsent = 0
+	return inc
+}
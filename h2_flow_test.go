@@ -0,0 +1,222 @@
+package fns
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// expectNoFrame checks that the server has nothing else to send, using a PING
+// round trip as the frames are written in order.
+func (cl *h2TestClient) expectNoFrame() {
+	cl.t.Helper()
+
+	data := [8]byte{'n', 'o', 'f', 'r', 'a', 'm', 'e'}
+	if err := cl.fr.WritePing(false, data); err != nil {
+		cl.t.Fatalf("unexpected error: %v", err)
+	}
+	f := cl.readFrame()
+	if pf, ok := f.(*http2.PingFrame); !ok || !pf.IsAck() || pf.Data != data {
+		cl.t.Fatalf("expected PING ACK, got %v", f)
+	}
+}
+
+// readData reads DATA frames of streamID until n bytes are received
+func (cl *h2TestClient) readData(streamID uint32, n int) (data []byte, endStream bool) {
+	cl.t.Helper()
+
+	for len(data) < n {
+		f := cl.readFrame()
+		df, ok := f.(*http2.DataFrame)
+		if !ok || df.StreamID != streamID {
+			cl.t.Fatalf("expected DATA frame on stream %d, got %v", streamID, f)
+		}
+		data = append(data, df.Data()...)
+		endStream = df.StreamEnded()
+	}
+	if len(data) != n {
+		cl.t.Fatalf("expected %d bytes, got %d", n, len(data))
+	}
+	return data, endStream
+}
+
+func (cl *h2TestClient) readHeaders(streamID uint32) {
+	cl.t.Helper()
+
+	f := cl.readFrame()
+	hf, ok := f.(*http2.HeadersFrame)
+	if !ok || hf.StreamID != streamID {
+		cl.t.Fatalf("expected HEADERS frame on stream %d, got %v", streamID, f)
+	}
+	if _, err := cl.dec.DecodeFull(hf.HeaderBlockFragment()); err != nil {
+		cl.t.Fatalf("unexpected error decoding headers: %v", err)
+	}
+}
+
+func TestH2FlowControlUpload(t *testing.T) {
+	t.Parallel()
+
+	// The protocol default windows are used, so the upload requires several WINDOW_UPDATE frames
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		ctx.SetBodyString(strconv.Itoa(len(ctx.PostBody())))
+	}}
+	cl := newH2TestClientConfig(t, s, ServerConfig{
+		InitialWindowSize:     DefaultInitialWindowSize,
+		InitialConnWindowSize: DefaultInitialWindowSize,
+	})
+	if v, ok := cl.settings[http2.SettingInitialWindowSize]; ok {
+		t.Fatalf("unexpected SETTINGS_INITIAL_WINDOW_SIZE %d", v)
+	}
+
+	body := bytes.Repeat([]byte("u"), 300000)
+	cl.writeRequest(1, false, ":method", "POST", ":scheme", "https", ":authority", "localhost", ":path", "/",
+		"content-length", strconv.Itoa(len(body)))
+
+	connWindow, streamWindow := DefaultInitialWindowSize, DefaultInitialWindowSize
+	for len(body) > 0 {
+		n := len(body)
+		if n > DefaultMaxFrameSize {
+			n = DefaultMaxFrameSize
+		}
+		if n > connWindow {
+			n = connWindow
+		}
+		if n > streamWindow {
+			n = streamWindow
+		}
+		if n == 0 {
+			f := cl.readFrame()
+			wf, ok := f.(*http2.WindowUpdateFrame)
+			if !ok {
+				t.Fatalf("expected WINDOW_UPDATE frame, got %v", f)
+			}
+			if wf.StreamID == 0 {
+				connWindow += int(wf.Increment)
+			} else {
+				streamWindow += int(wf.Increment)
+			}
+			continue
+		}
+
+		if err := cl.fr.WriteData(1, n == len(body), body[:n]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		body = body[n:]
+		connWindow -= n
+		streamWindow -= n
+	}
+
+	resp := cl.readResponse(1)
+	if string(resp.body) != "300000" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2FlowControlStreamWindow(t *testing.T) {
+	t.Parallel()
+
+	body := bytes.Repeat([]byte("s"), 1000)
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetBody(body)
+	}, http2.Setting{ID: http2.SettingInitialWindowSize, Val: 100})
+
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	cl.readHeaders(1)
+
+	// Only the initial window is sent
+	data, endStream := cl.readData(1, 100)
+	if endStream {
+		t.Fatalf("unexpected END_STREAM")
+	}
+	cl.expectNoFrame()
+
+	// A WINDOW_UPDATE frame releases more data
+	if err := cl.fr.WriteWindowUpdate(1, 500); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	more, endStream := cl.readData(1, 500)
+	if endStream {
+		t.Fatalf("unexpected END_STREAM")
+	}
+	data = append(data, more...)
+	cl.expectNoFrame()
+
+	// Raising SETTINGS_INITIAL_WINDOW_SIZE applies to the open stream. The SETTINGS ACK
+	// is a control frame, so it is written before the released data.
+	if err := cl.fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1000}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f := cl.readFrame()
+	if sf, ok := f.(*http2.SettingsFrame); !ok || !sf.IsAck() {
+		t.Fatalf("expected SETTINGS ACK frame, got %v", f)
+	}
+	more, endStream = cl.readData(1, 400)
+	if !endStream {
+		t.Fatalf("expected END_STREAM")
+	}
+	data = append(data, more...)
+	if !bytes.Equal(data, body) {
+		t.Fatalf("unexpected body")
+	}
+}
+
+func TestH2FlowControlConnWindow(t *testing.T) {
+	t.Parallel()
+
+	body := bytes.Repeat([]byte("c"), 100000)
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetBody(body)
+	}, http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20})
+
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	cl.readHeaders(1)
+
+	// The connection window is exhausted before the stream window
+	data, _ := cl.readData(1, DefaultInitialWindowSize)
+	cl.expectNoFrame()
+
+	if err := cl.fr.WriteWindowUpdate(0, uint32(len(body)-DefaultInitialWindowSize)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	more, endStream := cl.readData(1, len(body)-DefaultInitialWindowSize)
+	if !endStream {
+		t.Fatalf("expected END_STREAM")
+	}
+	if !bytes.Equal(append(data, more...), body) {
+		t.Fatalf("unexpected body")
+	}
+}
+
+func TestH2FlowControlErrors(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClientConfig(t, &Server{Handler: func(ctx *RequestCtx) {}}, ServerConfig{
+		InitialWindowSize: 100,
+	})
+
+	// Sending more data than the stream window resets the stream
+	cl.writeRequest(1, false, ":method", "POST", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	if err := cl.fr.WriteData(1, false, make([]byte, 101)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f := cl.readFrame()
+	if rf, ok := f.(*http2.RSTStreamFrame); !ok || rf.StreamID != 1 || rf.ErrCode != http2.ErrCodeFlowControl {
+		t.Fatalf("expected RST_STREAM with FLOW_CONTROL_ERROR, got %v", f)
+	}
+
+	// Overflowing the connection window is a connection error
+	if err := cl.fr.WriteWindowUpdate(0, 1<<31-1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for {
+		f = cl.readFrame()
+		if _, ok := f.(*http2.WindowUpdateFrame); !ok {
+			break
+		}
+	}
+	if gf, ok := f.(*http2.GoAwayFrame); !ok || gf.ErrCode != http2.ErrCodeFlowControl {
+		t.Fatalf("expected GOAWAY with FLOW_CONTROL_ERROR, got %v", f)
+	}
+}
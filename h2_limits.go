@@ -0,0 +1,74 @@
+package fns
+
+import (
+	"fmt"
+	"time"
+)
+
+// h2RateLimit counts the events of a kind over windows of one second
+type h2RateLimit struct {
+	start time.Time
+	count uint32
+}
+
+// allow counts an event and reports whether limit events per second are not exceeded
+func (rl *h2RateLimit) allow(limit uint32, now time.Time) bool {
+	if now.Sub(rl.start) >= time.Second {
+		rl.start = now
+		rl.count = 0
+	}
+	rl.count++
+	return rl.count <= limit
+}
+
+// The abuses detected on HTTP/2 connections, each closing the connection with an
+// ENHANCE_YOUR_CALM GOAWAY frame
+const (
+	h2CalmResetStreams = iota
+	h2CalmControlFrames
+	h2CalmHeaderBlock
+	h2CalmEmptyFrames
+)
+
+// enhanceYourCalm closes a connection abusing the server, see RFC 9113 section 10.5
+func (sc *h2ServerConn) enhanceYourCalm(trigger int, err error) {
+	incrementCalm(trigger)
+	sc.connError(err, 0xb) // ENHANCE_YOUR_CALM
+}
+
+// resetStreamReceived counts a stream cancelled by the client
+func (sc *h2ServerConn) resetStreamReceived() bool {
+	if sc.resetStreams.allow(sc.conf.maxResetStreamsPerSecond(), time.Now()) {
+		return true
+	}
+	sc.enhanceYourCalm(h2CalmResetStreams, fmt.Errorf("too many streams reset by the client"))
+	return false
+}
+
+// controlFrameReceived counts a control frame, see ServerConfig.MaxControlFramesPerSecond
+func (sc *h2ServerConn) controlFrameReceived() bool {
+	if sc.controlFrames.allow(sc.conf.maxControlFramesPerSecond(), time.Now()) {
+		return true
+	}
+	sc.enhanceYourCalm(h2CalmControlFrames, fmt.Errorf("too many control frames"))
+	return false
+}
+
+// emptyFrameReceived counts a frame without payload that doesn't end anything
+func (sc *h2ServerConn) emptyFrameReceived() bool {
+	if sc.emptyFrames.allow(sc.conf.maxEmptyFramesPerSecond(), time.Now()) {
+		return true
+	}
+	sc.enhanceYourCalm(h2CalmEmptyFrames, fmt.Errorf("too many empty frames"))
+	return false
+}
+
+// checkHeaderBlockSize reports whether the header block being received, growing by n
+// bytes, stays within ServerConfig.MaxHeaderBlockSize
+func (sc *h2ServerConn) checkHeaderBlockSize(n int) bool {
+	if uint64(len(sc.headerBlock))+uint64(n) <= uint64(sc.conf.maxHeaderBlockSize()) {
+		return true
+	}
+	sc.enhanceYourCalm(h2CalmHeaderBlock, fmt.Errorf("header block of stream %d too large", sc.headerStreamID))
+	return false
+}
@@ -0,0 +1,172 @@
+package fns
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// expectCalm reads frames until the GOAWAY frame closing the connection with
+// ENHANCE_YOUR_CALM
+func (cl *h2TestClient) expectCalm() {
+	cl.t.Helper()
+
+	for {
+		f := cl.readFrame()
+		if gf, ok := f.(*http2.GoAwayFrame); ok {
+			if gf.ErrCode != http2.ErrCodeEnhanceYourCalm {
+				cl.t.Fatalf("expected GOAWAY with %v, got %v", http2.ErrCodeEnhanceYourCalm, gf)
+			}
+			return
+		}
+	}
+}
+
+// expectNoGoAway checks that the connection is still open with a PING round trip, the
+// frames read before the PING ACK are skipped
+func (cl *h2TestClient) expectNoGoAway() {
+	cl.t.Helper()
+
+	data := [8]byte{'n', 'o', 'g', 'o', 'a', 'w', 'a', 'y'}
+	if err := cl.fr.WritePing(false, data); err != nil {
+		cl.t.Fatalf("unexpected error: %v", err)
+	}
+	for {
+		switch f := cl.readFrame().(type) {
+		case *http2.GoAwayFrame:
+			cl.t.Fatalf("unexpected GOAWAY with %v", f.ErrCode)
+		case *http2.PingFrame:
+			if f.IsAck() && f.Data == data {
+				return
+			}
+		}
+	}
+}
+
+func TestH2ServerFloods(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		conf    ServerConfig
+		counter func(m MetricsSnapshot) int64
+		send    func(cl *h2TestClient, n int) error
+	}{
+		{"rapid reset", ServerConfig{MaxResetStreamsPerSecond: 10}, func(m MetricsSnapshot) int64 { return m.RapidResets }, func(cl *h2TestClient, n int) error {
+			for i := 0; i < n; i++ {
+				id := uint32(2*i + 1)
+				cl.writeRequest(id, false, h2TestRequest...)
+				if err := cl.fr.WriteRSTStream(id, http2.ErrCodeCancel); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"PING flood", ServerConfig{MaxControlFramesPerSecond: 10}, func(m MetricsSnapshot) int64 { return m.ControlFrameFloods }, func(cl *h2TestClient, n int) error {
+			// The handshake SETTINGS frame counts too
+			for i := 0; i < n-1; i++ {
+				if err := cl.fr.WritePing(false, [8]byte{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"SETTINGS flood", ServerConfig{MaxControlFramesPerSecond: 10}, func(m MetricsSnapshot) int64 { return m.ControlFrameFloods }, func(cl *h2TestClient, n int) error {
+			for i := 0; i < n-1; i++ {
+				if err := cl.fr.WriteSettings(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"empty DATA flood", ServerConfig{MaxEmptyFramesPerSecond: 10}, func(m MetricsSnapshot) int64 { return m.EmptyFrameFloods }, func(cl *h2TestClient, n int) error {
+			cl.writeRequest(1, false, append(h2TestRequest, "content-length", "1")...)
+			for i := 0; i < n; i++ {
+				if err := cl.fr.WriteData(1, false, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"empty CONTINUATION flood", ServerConfig{MaxEmptyFramesPerSecond: 10}, func(m MetricsSnapshot) int64 { return m.EmptyFrameFloods }, func(cl *h2TestClient, n int) error {
+			err := cl.fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: cl.encodeHeaders(h2TestRequest...),
+				EndStream:     true,
+			})
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := cl.fr.WriteContinuation(1, false, nil); err != nil {
+					return err
+				}
+			}
+			return cl.fr.WriteContinuation(1, true, nil)
+		}},
+		{"large header block", ServerConfig{MaxHeaderBlockSize: 10 * 1024}, func(m MetricsSnapshot) int64 { return m.HeaderBlockFloods }, func(cl *h2TestClient, n int) error {
+			// The value doesn't shrink with Huffman coding, the block is split in
+			// fragments of 1KiB
+			block := cl.encodeHeaders(append(h2TestRequest, "x-large", strings.Repeat("~", n*1024-100))...)
+			err := cl.fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: block[:1024],
+				EndStream:     true,
+			})
+			if err != nil {
+				return err
+			}
+			for block = block[1024:]; len(block) > 1024; block = block[1024:] {
+				if err := cl.fr.WriteContinuation(1, false, block[:1024]); err != nil {
+					return err
+				}
+			}
+			return cl.fr.WriteContinuation(1, true, block)
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Up to the limit, the connection is still usable
+			s := &Server{Handler: func(ctx *RequestCtx) {}}
+			cl := newH2TestClientConfig(t, s, tc.conf)
+			cl.fr.AllowIllegalWrites = true
+			if err := tc.send(cl, 9); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.expectNoGoAway()
+
+			before := tc.counter(ReadMetrics())
+			cl = newH2TestClientConfig(t, s, tc.conf)
+			cl.fr.AllowIllegalWrites = true
+			if err := tc.send(cl, 11); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.expectCalm()
+			if tc.counter(ReadMetrics()) == before {
+				t.Fatalf("expected the metric to be incremented")
+			}
+		})
+	}
+}
+
+func TestH2ServerResetStreamHandlers(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		<-release
+	}}
+	cl := newH2TestClientConfig(t, s, ServerConfig{MaxConcurrentStreams: 1})
+	cl.writeRequest(1, true, h2TestRequest...)
+	if err := cl.fr.WriteRSTStream(1, http2.ErrCodeCancel); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The handler of the reset stream still holds the slot
+	cl.writeRequest(3, true, h2TestRequest...)
+	cl.expectRSTStream(3, http2.ErrCodeRefusedStream)
+}
@@ -11,10 +11,45 @@ type Metrics struct {
 	activeConnections int64
 	totalStreams      int64
 	activeStreams     int64
+
+	// The connections closed with ENHANCE_YOUR_CALM, by abuse detected
+	rapidResets        int64
+	controlFrameFloods int64
+	headerBlockFloods  int64
+	emptyFrameFloods   int64
 }
 
 var metrics = &Metrics{}
 
+// MetricsSnapshot holds the values of the HTTP/2 metrics at a given time
+type MetricsSnapshot struct {
+	TotalConnections  int64
+	ActiveConnections int64
+	TotalStreams      int64
+	ActiveStreams     int64
+
+	// The connections closed with ENHANCE_YOUR_CALM, by abuse detected: streams reset
+	// too fast, floods of control frames or empty frames, and oversized header blocks
+	RapidResets        int64
+	ControlFrameFloods int64
+	HeaderBlockFloods  int64
+	EmptyFrameFloods   int64
+}
+
+// ReadMetrics returns the current values of the HTTP/2 metrics
+func ReadMetrics() MetricsSnapshot {
+	return MetricsSnapshot{
+		TotalConnections:   atomic.LoadInt64(&metrics.totalConnections),
+		ActiveConnections:  atomic.LoadInt64(&metrics.activeConnections),
+		TotalStreams:       atomic.LoadInt64(&metrics.totalStreams),
+		ActiveStreams:      atomic.LoadInt64(&metrics.activeStreams),
+		RapidResets:        atomic.LoadInt64(&metrics.rapidResets),
+		ControlFrameFloods: atomic.LoadInt64(&metrics.controlFrameFloods),
+		HeaderBlockFloods:  atomic.LoadInt64(&metrics.headerBlockFloods),
+		EmptyFrameFloods:   atomic.LoadInt64(&metrics.emptyFrameFloods),
+	}
+}
+
 // IncrementConnections increments the total and active connections count
 func IncrementConnections() {
 	atomic.AddInt64(&metrics.totalConnections, 1)
@@ -37,13 +72,27 @@ func DecrementStreams() {
 	atomic.AddInt64(&metrics.activeStreams, -1)
 }
 
+// incrementCalm counts a connection closed with ENHANCE_YOUR_CALM for trigger
+func incrementCalm(trigger int) {
+	switch trigger {
+	case h2CalmResetStreams:
+		atomic.AddInt64(&metrics.rapidResets, 1)
+	case h2CalmControlFrames:
+		atomic.AddInt64(&metrics.controlFrameFloods, 1)
+	case h2CalmHeaderBlock:
+		atomic.AddInt64(&metrics.headerBlockFloods, 1)
+	case h2CalmEmptyFrames:
+		atomic.AddInt64(&metrics.emptyFrameFloods, 1)
+	}
+}
+
 // LogMetrics logs the current metrics periodically
 func LogMetrics(interval time.Duration) {
 	for range time.Tick(interval) {
-		log.Printf("Metrics - Total Connections: %d, Active Connections: %d, Total Streams: %d, Active Streams: %d",
-			atomic.LoadInt64(&metrics.totalConnections),
-			atomic.LoadInt64(&metrics.activeConnections),
-			atomic.LoadInt64(&metrics.totalStreams),
-			atomic.LoadInt64(&metrics.activeStreams))
+		m := ReadMetrics()
+		log.Printf("Metrics - Total Connections: %d, Active Connections: %d, Total Streams: %d, Active Streams: %d, "+
+			"Rapid Resets: %d, Control Frame Floods: %d, Header Block Floods: %d, Empty Frame Floods: %d",
+			m.TotalConnections, m.ActiveConnections, m.TotalStreams, m.ActiveStreams,
+			m.RapidResets, m.ControlFrameFloods, m.HeaderBlockFloods, m.EmptyFrameFloods)
 	}
 }
@@ -0,0 +1,194 @@
+package fns
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pablolagos/fns/internal/hpack"
+)
+
+// Priority holds the priority parameters of a stream, see RFC 9218 section 4. They are
+// signaled by the client with the priority request header and PRIORITY_UPDATE frames.
+type Priority struct {
+	// Urgency ranges from 0, the most urgent, to 7. The responses of lower urgency
+	// are only sent when the more urgent ones can't make progress.
+	Urgency uint8
+
+	// Incremental is set if the client can process the response as it arrives. The
+	// incremental responses of the same urgency share the bandwidth, the others are
+	// sent one after another.
+	Incremental bool
+}
+
+// DefaultPriorityUrgency is the urgency of the streams without priority signal
+const DefaultPriorityUrgency = 3
+
+// defaultPriority is the priority of the streams without priority signal
+var defaultPriority = Priority{Urgency: DefaultPriorityUrgency}
+
+// maxPriorityUrgency is the lowest urgency
+const maxPriorityUrgency = 7
+
+// parsePriority parses the value of a priority header or PRIORITY_UPDATE frame, a
+// structured field dictionary as defined by RFC 8941. The parameters that are missing,
+// invalid or unknown keep their default value, see RFC 9218 section 4.
+func parsePriority(v string) Priority {
+	p := defaultPriority
+	for len(v) > 0 {
+		var member string
+		member, v, _ = strings.Cut(v, ",")
+
+		// The parameters of the members are ignored
+		member, _, _ = strings.Cut(member, ";")
+		key, value, hasValue := strings.Cut(strings.Trim(member, " \t"), "=")
+		switch key {
+		case "u":
+			if len(value) == 1 && value[0] >= '0' && value[0] <= '0'+maxPriorityUrgency {
+				p.Urgency = value[0] - '0'
+			}
+		case "i":
+			// A bare key is the boolean true
+			switch {
+			case !hasValue || value == "?1":
+				p.Incremental = true
+			case value == "?0":
+				p.Incremental = false
+			}
+		}
+	}
+	return p
+}
+
+// rfc7540Priority holds the deprecated priority fields of PRIORITY frames and HEADERS
+// frames with the PRIORITY flag, see RFC 7540 section 5.3
+type rfc7540Priority struct {
+	dependency uint32
+	exclusive  bool
+
+	// weight is the encoded weight, the actual weight is one more
+	weight uint8
+}
+
+// parseRFC7540Priority parses the 5 bytes of priority fields
+func parseRFC7540Priority(b []byte) rfc7540Priority {
+	v := binary.BigEndian.Uint32(b)
+	return rfc7540Priority{
+		dependency: v & 0x7fffffff,
+		exclusive:  v&0x80000000 != 0,
+		weight:     b[4],
+	}
+}
+
+// priority approximates the RFC 7540 priority with an urgency, the heaviest streams
+// being the most urgent. The dependencies are not honored.
+func (p rfc7540Priority) priority() Priority {
+	return Priority{Urgency: (255 - p.weight) / 32}
+}
+
+// idlePriority is a priority signal received before its stream was opened
+type idlePriority struct {
+	p          Priority
+	extensible bool
+}
+
+// initPriority sets the priority of a new client stream. A PRIORITY_UPDATE frame
+// received before the request takes precedence over its priority header, and the
+// RFC 7540 signals are only used without RFC 9218 signal. prio holds the priority
+// fields of the HEADERS frame, if any.
+func (sc *h2ServerConn) initPriority(stream *Stream, fields []hpack.HeaderField, prio *rfc7540Priority) {
+	idle, hasIdle := sc.idlePriorities[stream.ID]
+	delete(sc.idlePriorities, stream.ID)
+	header, hasHeader := priorityHeader(fields)
+
+	p, extensible := defaultPriority, false
+	switch {
+	case hasIdle && idle.extensible:
+		p, extensible = idle.p, true
+	case hasHeader:
+		p, extensible = parsePriority(header), true
+	case prio != nil && sc.rfc7540PrioritiesEnabled():
+		p = prio.priority()
+	case hasIdle:
+		p = idle.p
+	}
+	sc.setStreamPriority(stream, p, extensible)
+}
+
+// priorityHeader returns the value of the priority request header, the values of
+// several fields are combined as a single list
+func priorityHeader(fields []hpack.HeaderField) (string, bool) {
+	var v string
+	found := false
+	for _, f := range fields {
+		if f.Name != "priority" {
+			continue
+		}
+		if found {
+			v += "," + f.Value
+		} else {
+			v = f.Value
+		}
+		found = true
+	}
+	return v, found
+}
+
+// rfc7540PrioritiesEnabled reports whether the RFC 7540 priority signals are used,
+// see ServerConfig.RFC7540Priorities
+func (sc *h2ServerConn) rfc7540PrioritiesEnabled() bool {
+	return sc.conf.RFC7540Priorities && sc.clientSettings.Get(SettingNoRFC7540Priorities) == 0
+}
+
+// rfc7540PriorityReceived applies the priority fields of a PRIORITY or HEADERS frame
+// to the stream, which is nil if it is idle
+func (sc *h2ServerConn) rfc7540PriorityReceived(streamID uint32, stream *Stream, prio rfc7540Priority) {
+	if !sc.rfc7540PrioritiesEnabled() {
+		return
+	}
+	if stream != nil {
+		sc.setStreamPriority(stream, prio.priority(), false)
+	} else {
+		sc.setIdlePriority(streamID, prio.priority(), false)
+	}
+}
+
+// setStreamPriority changes the priority of the stream, unless an RFC 7540 signal
+// would override an RFC 9218 one
+func (sc *h2ServerConn) setStreamPriority(stream *Stream, p Priority, extensible bool) {
+	stream.mu.Lock()
+	if stream.extensiblePriority && !extensible {
+		stream.mu.Unlock()
+		return
+	}
+	stream.Priority = p
+	stream.extensiblePriority = stream.extensiblePriority || extensible
+	stream.mu.Unlock()
+
+	sc.sched.setPriority(stream.ID, p)
+}
+
+// setIdlePriority keeps the priority signaled for an idle client stream until it is
+// opened. The signals are bounded by SETTINGS_MAX_CONCURRENT_STREAMS, the ones received
+// beyond are dropped.
+func (sc *h2ServerConn) setIdlePriority(streamID uint32, p Priority, extensible bool) {
+	if old, ok := sc.idlePriorities[streamID]; ok && old.extensible && !extensible {
+		return
+	}
+	if sc.idlePriorities == nil {
+		sc.idlePriorities = make(map[uint32]idlePriority)
+	}
+
+	limit := int(sc.serverSettings.Get(SettingMaxConcurrentStreams))
+	if _, ok := sc.idlePriorities[streamID]; !ok && len(sc.idlePriorities) >= limit {
+		// Forget the streams that were never opened
+		for id := range sc.idlePriorities {
+			if id <= sc.maxClientStreamID {
+				delete(sc.idlePriorities, id)
+			}
+		}
+		if len(sc.idlePriorities) >= limit {
+			return
+		}
+	}
+	sc.idlePriorities[streamID] = idlePriority{p: p, extensible: extensible}
+}
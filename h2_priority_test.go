@@ -0,0 +1,176 @@
+package fns
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestParsePriority(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		v string
+		p Priority
+	}{
+		{"", Priority{Urgency: 3}},
+		{"u=0", Priority{Urgency: 0}},
+		{"u=7, i", Priority{Urgency: 7, Incremental: true}},
+		{"i=?1,u=1", Priority{Urgency: 1, Incremental: true}},
+		{"u=2, i=?0", Priority{Urgency: 2}},
+		{"u=1;foo=bar, x=y", Priority{Urgency: 1}},
+		{"u=8", Priority{Urgency: 3}},
+		{"u=-1, i=1", Priority{Urgency: 3}},
+		{"u=12", Priority{Urgency: 3}},
+	} {
+		if p := parsePriority(tc.v); p != tc.p {
+			t.Fatalf("unexpected priority %+v for %q, expected %+v", p, tc.v, tc.p)
+		}
+	}
+}
+
+func TestParseRFC7540Priority(t *testing.T) {
+	t.Parallel()
+
+	b := []byte{0x80, 0, 0, 3, 255}
+	p := parseRFC7540Priority(b)
+	if p.dependency != 3 || !p.exclusive || p.weight != 255 {
+		t.Fatalf("unexpected priority fields %+v", p)
+	}
+	if u := p.priority().Urgency; u != 0 {
+		t.Fatalf("unexpected urgency %d for the heaviest weight", u)
+	}
+	if u := (rfc7540Priority{weight: 0}).priority().Urgency; u != 7 {
+		t.Fatalf("unexpected urgency %d for the lightest weight", u)
+	}
+}
+
+func TestH2WriteSchedulerPriority(t *testing.T) {
+	t.Parallel()
+
+	ws := newTestWriteScheduler(1 << 20)
+	ws.addConnWindow(1 << 20)
+	data := make([]byte, 2*DefaultMaxFrameSize)
+	for _, id := range []uint32{1, 3, 5, 7, 9} {
+		ws.openStream(id)
+		ws.writeData(id, data, true)
+	}
+	ws.setPriority(3, Priority{Urgency: 3, Incremental: true})
+	ws.setPriority(5, Priority{Urgency: 0})
+	ws.setPriority(9, Priority{Urgency: 3, Incremental: true})
+
+	// The most urgent stream goes first, then the non-incremental streams of the
+	// default urgency one after another, then the incremental ones take turns
+	for i, id := range []uint32{5, 5, 1, 1, 7, 7, 3, 9, 3, 9} {
+		if w := nextTestWrite(t, ws); w.streamID != id {
+			t.Fatalf("write %d: expected stream %d, got stream %d", i, id, w.streamID)
+		}
+	}
+	if _, ok := ws.next(false); ok {
+		t.Fatalf("unexpected write")
+	}
+}
+
+func TestH2ServerPriority(t *testing.T) {
+	t.Parallel()
+
+	priorityUpdate := func(cl *h2TestClient, streamID uint32, v string) {
+		payload := binary.BigEndian.AppendUint32(nil, streamID)
+		if err := cl.fr.WriteRawFrame(0x10, 0, 0, append(payload, v...)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	heaviest := http2.PriorityParam{Weight: 255}
+
+	for _, tc := range []struct {
+		name    string
+		conf    ServerConfig
+		header  string
+		before  func(cl *h2TestClient)
+		after   func(cl *h2TestClient)
+		firstID uint32
+	}{
+		{name: "no signal", firstID: 1},
+		{name: "priority header", header: "u=0", firstID: 3},
+		{name: "PRIORITY_UPDATE", after: func(cl *h2TestClient) {
+			priorityUpdate(cl, 3, "u=0")
+		}, firstID: 3},
+		{name: "PRIORITY_UPDATE before the request", before: func(cl *h2TestClient) {
+			priorityUpdate(cl, 3, "u=0")
+		}, firstID: 3},
+		{name: "PRIORITY_UPDATE replaces the header", header: "u=0", after: func(cl *h2TestClient) {
+			priorityUpdate(cl, 3, "i")
+		}, firstID: 1},
+		{name: "RFC 7540 PRIORITY ignored", after: func(cl *h2TestClient) {
+			cl.fr.WritePriority(3, heaviest) //nolint:errcheck
+		}, firstID: 1},
+		{name: "RFC 7540 PRIORITY", conf: ServerConfig{RFC7540Priorities: true}, after: func(cl *h2TestClient) {
+			cl.fr.WritePriority(3, heaviest) //nolint:errcheck
+		}, firstID: 3},
+		{name: "RFC 7540 PRIORITY after the priority header", conf: ServerConfig{RFC7540Priorities: true}, header: "u=7", after: func(cl *h2TestClient) {
+			cl.fr.WritePriority(3, heaviest) //nolint:errcheck
+		}, firstID: 1},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{Handler: func(ctx *RequestCtx) {
+				if string(ctx.Path()) == "/bulk" {
+					ctx.SetBodyString(strings.Repeat("b", 3*DefaultMaxFrameSize))
+					return
+				}
+				ctx.SetBodyString("critical")
+			}}
+			// The responses are held back by flow control until both are queued
+			cl := newH2TestClientConfig(t, s, tc.conf, http2.Setting{ID: http2.SettingInitialWindowSize, Val: 0})
+			wantNoRFC7540 := uint32(1)
+			if tc.conf.RFC7540Priorities {
+				wantNoRFC7540 = 0
+			}
+			if v := cl.settings[0x9]; v != wantNoRFC7540 {
+				t.Fatalf("unexpected SETTINGS_NO_RFC7540_PRIORITIES %d", v)
+			}
+
+			if tc.before != nil {
+				tc.before(cl)
+			}
+			cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/bulk")
+			critical := []string{":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/critical"}
+			if tc.header != "" {
+				critical = append(critical, "priority", tc.header)
+			}
+			cl.writeRequest(3, true, critical...)
+			for i := 0; i < 2; i++ {
+				f := cl.readFrame()
+				hf, ok := f.(*http2.HeadersFrame)
+				if !ok {
+					t.Fatalf("expected HEADERS frame, got %v", f)
+				}
+				if _, err := cl.dec.DecodeFull(hf.HeaderBlockFragment()); err != nil {
+					t.Fatalf("unexpected error decoding headers: %v", err)
+				}
+			}
+			if tc.after != nil {
+				tc.after(cl)
+				cl.expectNoFrame()
+			}
+
+			// Both streams can now send their body at once
+			if err := cl.fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for {
+				f := cl.readFrame()
+				if df, ok := f.(*http2.DataFrame); ok {
+					if df.StreamID != tc.firstID {
+						t.Fatalf("expected the first DATA frame on stream %d, got stream %d", tc.firstID, df.StreamID)
+					}
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package fns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pablolagos/fns/internal/hpack"
+)
+
+// Reasons for RequestCtx.Push to fail, besides ErrPushNotSupported and ErrPushDisabled
+var (
+	errH2PushRecursive   = errors.New("cannot push from a pushed stream")
+	errH2PushInvalidPath = errors.New("pushed path must start with '/'")
+	errH2PushHeaders     = errors.New("pushed headers must be name/value pairs")
+	errH2PushLimit       = errors.New("too many pushed streams")
+	errH2PushGoingAway   = errors.New("connection is going away")
+)
+
+// push promises the response to a GET request for path on the parent stream with a
+// PUSH_PROMISE frame, then serves the request on the promised stream, see RFC 9113
+// section 8.4. It is called by the handler of the parent stream and returns once the
+// PUSH_PROMISE frame is handed to the writer.
+func (sc *h2ServerConn) push(parent *Stream, ctx *RequestCtx, path string, headers []string) error {
+	// Only the client streams can carry promises
+	if parent.ID%2 == 0 {
+		return errH2PushRecursive
+	}
+	if !strings.HasPrefix(path, "/") {
+		return errH2PushInvalidPath
+	}
+	if len(headers)%2 != 0 {
+		return errH2PushHeaders
+	}
+
+	// Promised requests must be safe and cacheable, and carry no body
+	fields := make([]hpack.HeaderField, 0, 4+len(headers)/2)
+	fields = append(fields,
+		hpack.HeaderField{Name: ":method", Value: MethodGet},
+		hpack.HeaderField{Name: ":scheme", Value: string(ctx.URI().Scheme())},
+		hpack.HeaderField{Name: ":authority", Value: string(ctx.Host())},
+		hpack.HeaderField{Name: ":path", Value: path},
+	)
+	for i := 0; i < len(headers); i += 2 {
+		fields = append(fields, hpack.HeaderField{Name: strings.ToLower(headers[i]), Value: headers[i+1]})
+	}
+	if contentLength, err := checkH2RequestHeaders(fields, false); err != nil || contentLength > 0 {
+		if err == nil {
+			err = errH2ContentLength
+		}
+		return fmt.Errorf("invalid pushed request: %w", err)
+	}
+
+	parent.mu.Lock()
+	state := parent.State
+	parent.mu.Unlock()
+	if state != StreamOpen && state != StreamHalfClosedRemote {
+		return errH2StreamClosed
+	}
+
+	promisedID, err := sc.reservePushID()
+	if err != nil {
+		return err
+	}
+
+	stream := sc.streamManager.CreateStream(promisedID, sc)
+	stream.mu.Lock()
+	stream.Headers = fields
+	stream.active = true
+	stream.setState(StreamReservedLocal)
+	stream.handled = true
+	stream.mu.Unlock()
+	sc.startStreamTimers(stream, false)
+
+	// The response of the promised stream must not be written before the promise
+	written := make(chan struct{})
+	if sc.sched.writePushPromise(parent.ID, promisedID, fields, written) {
+		select {
+		case <-written:
+			sc.startHandler(stream)
+			return nil
+		case <-parent.done:
+			select {
+			case <-written:
+				// The client was promised the response anyway
+				sc.startHandler(stream)
+				return nil
+			default:
+			}
+		}
+	}
+	sc.closeStream(stream)
+	return errH2StreamClosed
+}
+
+// reservePushID allocates the ID of a pushed stream, counting it against the
+// SETTINGS_MAX_CONCURRENT_STREAMS of the client, not ours
+func (sc *h2ServerConn) reservePushID() (uint32, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	switch {
+	case !sc.pushEnabled:
+		return 0, ErrPushDisabled
+	case sc.goingAway || sc.clientGoingAway || sc.nextPushID > maxStreamID:
+		return 0, errH2PushGoingAway
+	case sc.pushedStreams >= sc.maxPushedStreams:
+		return 0, errH2PushLimit
+	}
+
+	id := sc.nextPushID
+	sc.nextPushID += 2
+	sc.pushedStreams++
+	sc.activeStreams++
+	if sc.activeStreams == 1 {
+		sc.setState(StateActive)
+	}
+	return id, nil
+}
+
+// nextPushStreamID returns the ID of the next pushed stream, the pushed streams
+// with lower IDs were all opened
+func (sc *h2ServerConn) nextPushStreamID() uint32 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.nextPushID
+}
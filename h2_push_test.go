@@ -0,0 +1,144 @@
+package fns
+
+import (
+	"testing"
+
+	"golang.org/x/net/http2"
+	xhpack "golang.org/x/net/http2/hpack"
+)
+
+func pushTestHandler(ctx *RequestCtx) {
+	switch string(ctx.Path()) {
+	case "/":
+		if err := ctx.Push("/style.css", "Accept", "text/css"); err != nil {
+			ctx.SetBodyString(err.Error())
+			return
+		}
+		ctx.SetBodyString("index")
+	case "/style.css":
+		// Pushed requests can't push again
+		if err := ctx.Push("/other.css"); err != errH2PushRecursive {
+			ctx.SetBodyString("unexpected error: " + err.Error())
+			return
+		}
+		ctx.SetBodyString(string(ctx.Method()) + " " + string(ctx.Request.Header.Peek("Accept")))
+	}
+}
+
+func TestH2ServerPush(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClient(t, pushTestHandler)
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	resps := cl.readResponses(1, 2)
+
+	resp := resps[1]
+	if string(resp.body) != "index" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+	if _, ok := resp.frames[0].(*http2.PushPromiseFrame); !ok {
+		t.Fatalf("expected the PUSH_PROMISE frame before the response, got %v", resp.frames[0])
+	}
+	if len(resp.promises) != 1 || resp.promises[0].streamID != 2 {
+		t.Fatalf("expected a promise of stream 2, got %v", resp.promises)
+	}
+	expected := []xhpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: ":path", Value: "/style.css"},
+		{Name: "accept", Value: "text/css"},
+	}
+	if got := resp.promises[0].headers; len(got) != len(expected) {
+		t.Fatalf("unexpected promised headers %v", got)
+	} else {
+		for i := range expected {
+			if got[i].Name != expected[i].Name || got[i].Value != expected[i].Value {
+				t.Fatalf("unexpected promised header %v, expected %v", got[i], expected[i])
+			}
+		}
+	}
+
+	pushed := resps[2]
+	if v := pushed.header(":status"); v != "200" {
+		t.Fatalf("unexpected :status %q", v)
+	}
+	if string(pushed.body) != "GET text/css" {
+		t.Fatalf("unexpected pushed body %q", pushed.body)
+	}
+
+	// The connection is still usable, the next push uses the next even stream ID
+	cl.writeRequest(3, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	resps = cl.readResponses(3, 4)
+	if string(resps[4].body) != "GET text/css" {
+		t.Fatalf("unexpected pushed body %q", resps[4].body)
+	}
+}
+
+func TestH2ServerPushRefused(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		settings []http2.Setting
+		err      error
+	}{
+		{"disabled", []http2.Setting{{ID: http2.SettingEnablePush, Val: 0}}, ErrPushDisabled},
+		{"no concurrent streams", []http2.Setting{{ID: http2.SettingMaxConcurrentStreams, Val: 0}}, errH2PushLimit},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cl := newH2TestClient(t, pushTestHandler, tc.settings...)
+			cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+			resp := cl.readResponse(1)
+			if string(resp.body) != tc.err.Error() {
+				t.Fatalf("unexpected body %q, expected %q", resp.body, tc.err)
+			}
+			if len(resp.promises) != 0 {
+				t.Fatalf("unexpected promises %v", resp.promises)
+			}
+		})
+	}
+}
+
+func TestH2ServerPushConcurrentStreams(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/":
+			if err := ctx.Push("/slow"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			ctx.SetBodyString("index")
+		case "/slow":
+			<-release
+		default:
+			ctx.SetBodyString("next")
+		}
+	}}
+	cl := newH2TestClientConfig(t, s, ServerConfig{MaxConcurrentStreams: 1})
+	cl.writeRequest(1, true, h2TestRequest...)
+	if resp := cl.readResponse(1); string(resp.body) != "index" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+
+	// The pushed stream, still active, doesn't take the slot of the client
+	cl.writeRequest(3, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/next")
+	if resp := cl.readResponse(3); string(resp.body) != "next" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestRequestCtxPushHTTP1(t *testing.T) {
+	t.Parallel()
+
+	var ctx RequestCtx
+	if err := ctx.Push("/style.css"); err != ErrPushNotSupported {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrPushNotSupported)
+	}
+}
@@ -0,0 +1,143 @@
+package fns
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// errH2StreamClosed is returned when reading the request body or writing the response
+// of a stream that was closed before its end, usually because the client reset it
+var errH2StreamClosed = errors.New("stream closed")
+
+// h2RequestBody streams the request body of an HTTP/2 stream to the handler when
+// Server.StreamRequestBody is set. The read loop appends the DATA payloads, and the
+// flow-control credit is only returned to the client as the handler reads them, so
+// the data buffered is bounded by the stream window.
+type h2RequestBody struct {
+	stream *Stream
+
+	// header receives the request trailers once the body is read
+	header *RequestHeader
+
+	mu   sync.Mutex
+	cond sync.Cond
+	buf  []byte
+
+	// err is returned once buf is drained: io.EOF after the END_STREAM flag, or the
+	// reason the stream was closed
+	err error
+
+	// closed is set once the handler returned, the data received afterwards is dropped
+	closed bool
+
+	// deadline makes Read fail once passed, it is only set on tunnels
+	deadline      time.Time
+	deadlineTimer *time.Timer
+}
+
+func newH2RequestBody(stream *Stream) *h2RequestBody {
+	b := &h2RequestBody{stream: stream}
+	b.cond.L = &b.mu
+	return b
+}
+
+// Read reads the data received so far, blocking until some data is available
+func (b *h2RequestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for len(b.buf) == 0 && b.err == nil {
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			b.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	if len(b.buf) == 0 {
+		err := b.err
+		header := b.header
+		if err == io.EOF {
+			b.header = nil
+		}
+		b.mu.Unlock()
+
+		if err == io.EOF && header != nil {
+			b.stream.mu.Lock()
+			trailers := b.stream.Trailers
+			b.stream.mu.Unlock()
+			addH2RequestTrailers(header, trailers)
+		}
+		return 0, err
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.mu.Unlock()
+
+	// The data was consumed, the client can send more
+	b.stream.conn.returnInflow(b.stream, n)
+	return n, nil
+}
+
+// write appends data received on the stream. It reports false if nobody will read
+// it anymore, the caller must then return the credit right away.
+func (b *h2RequestBody) write(data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed || b.err != nil {
+		return false
+	}
+	b.buf = append(b.buf, data...)
+	b.cond.Signal()
+	return true
+}
+
+// closeWithError ends the body, err is returned once the data buffered is read
+func (b *h2RequestBody) closeWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Signal()
+	b.mu.Unlock()
+}
+
+// setReadDeadline sets the deadline of the reads, a zero t means none
+func (b *h2RequestBody) setReadDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadline = t
+	if b.deadlineTimer != nil {
+		b.deadlineTimer.Stop()
+		b.deadlineTimer = nil
+	}
+	if d := time.Until(t); !t.IsZero() && d > 0 {
+		b.deadlineTimer = time.AfterFunc(d, func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// closeRead drops the data the handler didn't read. It returns the number
+// of bytes dropped, whose credit is still to be returned.
+func (b *h2RequestBody) closeRead() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.buf)
+	b.buf = nil
+	b.closed = true
+	if b.err == nil {
+		b.err = io.ErrClosedPipe
+	}
+	if b.deadlineTimer != nil {
+		b.deadlineTimer.Stop()
+	}
+	b.cond.Broadcast()
+	return n
+}
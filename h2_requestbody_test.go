@@ -0,0 +1,170 @@
+package fns
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2ServerRequestBodyTooLarge(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		send func(cl *h2TestClient)
+	}{
+		{"content-length", func(cl *h2TestClient) {
+			cl.writeRequest(1, false, append(h2TestRequest, "content-length", "20")...)
+		}},
+		{"DATA frames", func(cl *h2TestClient) {
+			cl.writeRequest(1, false, h2TestRequest...)
+			for i := 0; i < 2; i++ {
+				if err := cl.fr.WriteData(1, false, []byte("12345678")); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{
+				Handler: func(ctx *RequestCtx) {
+					t.Errorf("unexpected call to the handler")
+				},
+				MaxRequestBodySize: 10,
+			}
+			cl := newH2TestClientConfig(t, s, ServerConfig{})
+			tc.send(cl)
+
+			// The client is told to stop sending the body once the response is complete
+			resp := cl.readResponse(1)
+			if v := resp.header(":status"); v != "413" {
+				t.Fatalf("unexpected :status %q", v)
+			}
+			cl.expectRSTStream(1, http2.ErrCodeNo)
+		})
+	}
+}
+
+func TestH2ServerRequestBodyLimit(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.SetBodyString(strconv.Itoa(len(ctx.PostBody())))
+		},
+		MaxRequestBodySize: 10,
+	}
+	cl := newH2TestClientConfig(t, s, ServerConfig{})
+
+	cl.writeRequest(1, false, h2TestRequest...)
+	if err := cl.fr.WriteData(1, true, []byte("0123456789")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp := cl.readResponse(1); string(resp.body) != "10" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2ServerStreamRequestBody(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	read := make(chan int)
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			close(started)
+			var body bytes.Buffer
+			buf := make([]byte, 16)
+			for {
+				n, err := ctx.RequestBodyStream().Read(buf)
+				body.Write(buf[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				read <- n
+			}
+			ctx.SetBody(body.Bytes())
+		},
+		StreamRequestBody: true,
+		// The body is streamed regardless of the limit
+		MaxRequestBodySize: 16,
+	}
+	cl := newH2TestClientConfig(t, s, ServerConfig{InitialWindowSize: 16})
+
+	// The handler runs before the body is complete
+	cl.writeRequest(1, false, h2TestRequest...)
+	<-started
+
+	chunk := bytes.Repeat([]byte("a"), 16)
+	var want []byte
+	for i := 0; i < 3; i++ {
+		if err := cl.fr.WriteData(1, false, chunk); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want = append(want, chunk...)
+
+		// The window is only refilled as the handler reads
+		if n := <-read; n != len(chunk) {
+			t.Fatalf("unexpected read of %d bytes", n)
+		}
+		for {
+			f := cl.readFrame()
+			if wu, ok := f.(*http2.WindowUpdateFrame); ok && wu.StreamID == 1 {
+				if wu.Increment != 16 {
+					t.Fatalf("unexpected window increment %d", wu.Increment)
+				}
+				break
+			}
+		}
+	}
+	if err := cl.fr.WriteData(1, true, []byte("end")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = append(want, "end"...)
+	if n := <-read; n != 3 {
+		t.Fatalf("unexpected read of %d bytes", n)
+	}
+
+	if resp := cl.readResponse(1); !bytes.Equal(resp.body, want) {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2ServerStreamRequestBodyContentLength(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.SetBodyString(strconv.Itoa(ctx.Request.Header.ContentLength()))
+		},
+		StreamRequestBody: true,
+	}
+	cl := newH2TestClientConfig(t, s, ServerConfig{})
+
+	// A streamed body without content-length has an unknown size
+	cl.writeRequest(1, false, h2TestRequest...)
+	if err := cl.fr.WriteData(1, true, []byte("body")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp := cl.readResponse(1); string(resp.body) != "-1" {
+		t.Fatalf("unexpected content length %q", resp.body)
+	}
+
+	cl.writeRequest(3, false, append(h2TestRequest, "content-length", "4")...)
+	if err := cl.fr.WriteData(3, true, []byte("body")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp := cl.readResponse(3); string(resp.body) != "4" {
+		t.Fatalf("unexpected content length %q", resp.body)
+	}
+}
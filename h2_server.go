@@ -2,17 +2,217 @@ package fns
 
 import (
 	"log"
+	"math"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/pablolagos/fns/internal/debuglog"
 )
 
+// DefaultH2MaxHeaderListSize is the maximum size of a request header list accepted
+// by the HTTP/2 server when ServerConfig.MaxHeaderListSize is not set.
+const DefaultH2MaxHeaderListSize = 64 * 1024
+
+// DefaultH2MaxConcurrentStreams is the maximum number of concurrent streams per
+// HTTP/2 connection when ServerConfig.MaxConcurrentStreams is not set.
+const DefaultH2MaxConcurrentStreams = 100
+
+// Default flow-control windows of the HTTP/2 server, used when ServerConfig.InitialWindowSize
+// and ServerConfig.InitialConnWindowSize are not set. They are larger than the protocol
+// default of 64KiB so uploads are not throttled by the round-trip time.
+const (
+	DefaultH2InitialWindowSize     = 1 << 20
+	DefaultH2InitialConnWindowSize = 1 << 20
+)
+
+// DefaultH2PingTimeout is how long the HTTP/2 server waits for the client to answer a
+// keepalive PING when ServerConfig.PingTimeout is not set
+const DefaultH2PingTimeout = 15 * time.Second
+
+// Default limits protecting the HTTP/2 server against clients flooding it with frames
+// that are cheap to send but costly to process, used when the corresponding
+// ServerConfig fields are not set. The rates are counted over one second.
+const (
+	DefaultH2MaxResetStreamsPerSecond  = 100
+	DefaultH2MaxControlFramesPerSecond = 1000
+	DefaultH2MaxEmptyFramesPerSecond   = 100
+)
+
 // ServerConfig stores the configuration for the HTTP/2 server
 type ServerConfig struct {
-	Addr         string
-	ReadTimeout  int  // in seconds
-	WriteTimeout int  // in seconds
-	Debug        bool // True to log debug messages
+	Addr  string
+	Debug bool // True to log debug messages
+
+	// Tracer receives the frames read and written on each connection, the stream
+	// state changes and the errors, see NewH2TraceLogger for logging them. Tracing
+	// costs nothing if not set.
+	Tracer H2Tracer
+
+	// ReadTimeout is the time allowed to receive a request on a stream, from its
+	// headers to the end of its body. WriteTimeout is the time allowed to send the
+	// response, from the request headers to the end of the response, and to write
+	// each frame to the connection. A stream exceeding them is reset with CANCEL,
+	// the other streams of the connection go on.
+	//
+	// Server.ReadTimeout and Server.WriteTimeout are used if not set.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout is how long a connection without active streams is kept open. It
+	// is then closed gracefully with a GOAWAY frame.
+	//
+	// Server.IdleTimeout is used if not set, or Server.ReadTimeout if that is not
+	// set either.
+	IdleTimeout time.Duration
+
+	// PingInterval enables keepalive PINGs: a PING frame is sent once nothing was
+	// received from the client for PingInterval, and the connection is closed if
+	// the client stays silent for PingTimeout after that.
+	//
+	// DefaultH2PingTimeout is used if PingTimeout is not set.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// MaxHeaderListSize is the maximum size of the decoded request headers, as
+	// defined for SETTINGS_MAX_HEADER_LIST_SIZE. Requests exceeding it are
+	// answered with 431 Request Header Fields Too Large.
+	//
+	// DefaultH2MaxHeaderListSize is used if not set.
+	MaxHeaderListSize uint32
+
+	// InitialWindowSize is the flow-control window granted to the client for
+	// sending request data on each stream, announced with SETTINGS_INITIAL_WINDOW_SIZE.
+	//
+	// DefaultH2InitialWindowSize is used if not set.
+	InitialWindowSize uint32
+
+	// InitialConnWindowSize is the flow-control window granted to the client for
+	// sending request data on the whole connection.
+	//
+	// DefaultH2InitialConnWindowSize is used if not set.
+	InitialConnWindowSize uint32
+
+	// MaxConcurrentStreams is the maximum number of streams the client may have open
+	// at the same time, announced with SETTINGS_MAX_CONCURRENT_STREAMS. Each stream
+	// is handled in its own goroutine, the streams beyond the limit are refused.
+	//
+	// DefaultH2MaxConcurrentStreams is used if not set.
+	MaxConcurrentStreams uint32
+
+	// H2C enables HTTP/2 over cleartext connections. Clients may either start
+	// with the HTTP/2 connection preface (prior knowledge) or upgrade an HTTP/1.1
+	// request with the Upgrade: h2c header, see RFC 7540 section 3.2.
+	//
+	// TLS connections still negotiate HTTP/2 with ALPN.
+	H2C bool
+
+	// RFC7540Priorities makes the responses follow the deprecated priority signals of
+	// RFC 7540, sent in PRIORITY frames and HEADERS frames, for the streams without
+	// RFC 9218 signal. The weight of a stream is mapped onto an urgency, the stream
+	// dependencies are ignored.
+	//
+	// Otherwise SETTINGS_NO_RFC7540_PRIORITIES is announced, and the responses are only
+	// scheduled after the priority request header and the PRIORITY_UPDATE frames.
+	RFC7540Priorities bool
+
+	// EnableConnectProtocol announces SETTINGS_ENABLE_CONNECT_PROTOCOL, so that the
+	// clients may send extended CONNECT requests to bootstrap other protocols on a
+	// stream, such as WebSockets, see RFC 8441. The protocol is told by
+	// RequestCtx.ConnectProtocol, and the handler takes the stream over with
+	// RequestCtx.Hijack.
+	EnableConnectProtocol bool
+
+	// MaxResetStreamsPerSecond is the number of streams the client may cancel with
+	// RST_STREAM frames per second. Opening and immediately cancelling streams makes
+	// the server start handlers for nothing, without counting against
+	// MaxConcurrentStreams (CVE-2023-44487, rapid reset).
+	//
+	// DefaultH2MaxResetStreamsPerSecond is used if not set.
+	MaxResetStreamsPerSecond uint32
+
+	// MaxControlFramesPerSecond is the number of SETTINGS, PING, PRIORITY and
+	// PRIORITY_UPDATE frames the client may send per second. SETTINGS and PING
+	// frames are each answered with an acknowledgement.
+	//
+	// DefaultH2MaxControlFramesPerSecond is used if not set.
+	MaxControlFramesPerSecond uint32
+
+	// MaxHeaderBlockSize is the maximum size of an encoded header block, made of a
+	// HEADERS frame and its CONTINUATION frames. The block is buffered until
+	// complete, so the limit applies before the decoded size can be checked against
+	// MaxHeaderListSize.
+	//
+	// Twice the max header list size is used if not set.
+	MaxHeaderBlockSize uint32
+
+	// MaxEmptyFramesPerSecond is the number of DATA, HEADERS and CONTINUATION frames
+	// without payload the client may send per second, apart from the ones ending the
+	// stream or the header block.
+	//
+	// DefaultH2MaxEmptyFramesPerSecond is used if not set.
+	MaxEmptyFramesPerSecond uint32
+}
+
+func (conf *ServerConfig) initialWindowSize() uint32 {
+	if conf.InitialWindowSize == 0 {
+		return DefaultH2InitialWindowSize
+	}
+	if conf.InitialWindowSize > maxWindowSize {
+		return maxWindowSize
+	}
+	return conf.InitialWindowSize
+}
+
+func (conf *ServerConfig) initialConnWindowSize() uint32 {
+	if conf.InitialConnWindowSize == 0 {
+		return DefaultH2InitialConnWindowSize
+	}
+	if conf.InitialConnWindowSize > maxWindowSize {
+		return maxWindowSize
+	}
+	return conf.InitialConnWindowSize
+}
+
+func (conf *ServerConfig) pingTimeout() time.Duration {
+	if conf.PingTimeout <= 0 {
+		return DefaultH2PingTimeout
+	}
+	return conf.PingTimeout
+}
+
+func (conf *ServerConfig) maxResetStreamsPerSecond() uint32 {
+	if conf.MaxResetStreamsPerSecond == 0 {
+		return DefaultH2MaxResetStreamsPerSecond
+	}
+	return conf.MaxResetStreamsPerSecond
+}
+
+func (conf *ServerConfig) maxControlFramesPerSecond() uint32 {
+	if conf.MaxControlFramesPerSecond == 0 {
+		return DefaultH2MaxControlFramesPerSecond
+	}
+	return conf.MaxControlFramesPerSecond
+}
+
+func (conf *ServerConfig) maxHeaderBlockSize() uint32 {
+	if conf.MaxHeaderBlockSize != 0 {
+		return conf.MaxHeaderBlockSize
+	}
+	if conf.MaxHeaderListSize > math.MaxUint32/2 {
+		return math.MaxUint32
+	}
+	if conf.MaxHeaderListSize != 0 {
+		return 2 * conf.MaxHeaderListSize
+	}
+	return 2 * DefaultH2MaxHeaderListSize
+}
+
+func (conf *ServerConfig) maxEmptyFramesPerSecond() uint32 {
+	if conf.MaxEmptyFramesPerSecond == 0 {
+		return DefaultH2MaxEmptyFramesPerSecond
+	}
+	return conf.MaxEmptyFramesPerSecond
 }
 
 // Server represents the HTTP/2 server
@@ -31,14 +231,17 @@ func EnableHTTP2(s *Server, conf ServerConfig) {
 	}
 	// Assign handler for HTTP/2 connections
 	s.NextProto("h2", h2s.HandleHTTP2Conn)
+	if conf.H2C {
+		s.h2c = h2s
+	}
 }
 
 // DefaultH2Config defaults sets default values for HTTP/2 server
 func DefaultH2Config() ServerConfig {
 	return ServerConfig{
 		Addr:         ":443",
-		ReadTimeout:  10,
-		WriteTimeout: 10,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
 	}
 }
 
@@ -47,14 +250,56 @@ func (h2 *H2Server) HandleHTTP2Conn(conn net.Conn) error {
 	serverConn := &h2ServerConn{
 		conn:  conn,
 		s:     h2.s,
+		conf:  h2.conf,
 		debug: h2.debug,
 	}
 
 	// Serve the HTTP/2 connection
 	if err := serverConn.Serve(); err != nil {
-		log.Printf("Error serving connection: %v", err)
+		h2.debug.Errorf("Error serving connection: %v", err)
 		return err
 	}
 
 	return nil
 }
+
+// trackH2Conn registers an HTTP/2 connection, so it can be drained by Shutdown. A connection
+// served while shutting down starts draining right away.
+func (s *Server) trackH2Conn(sc *h2ServerConn) {
+	s.h2ConnsMu.Lock()
+	defer s.h2ConnsMu.Unlock()
+
+	if s.h2Conns == nil {
+		s.h2Conns = make(map[*h2ServerConn]struct{})
+	}
+	s.h2Conns[sc] = struct{}{}
+	if atomic.LoadInt32(&s.stop) == 1 {
+		sc.startGracefulShutdown()
+	}
+}
+
+func (s *Server) untrackH2Conn(sc *h2ServerConn) {
+	s.h2ConnsMu.Lock()
+	delete(s.h2Conns, sc)
+	s.h2ConnsMu.Unlock()
+}
+
+// shutdownH2Conns starts the graceful shutdown of all the HTTP/2 connections
+func (s *Server) shutdownH2Conns() {
+	s.h2ConnsMu.Lock()
+	defer s.h2ConnsMu.Unlock()
+
+	for sc := range s.h2Conns {
+		sc.startGracefulShutdown()
+	}
+}
+
+// closeH2Conns closes all the HTTP/2 connections, aborting their in-flight streams
+func (s *Server) closeH2Conns() {
+	s.h2ConnsMu.Lock()
+	defer s.h2ConnsMu.Unlock()
+
+	for sc := range s.h2Conns {
+		_ = sc.conn.Close()
+	}
+}
@@ -0,0 +1,712 @@
+package fns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	xhpack "golang.org/x/net/http2/hpack"
+)
+
+// h2TestClient drives an HTTP/2 server connection frame by frame
+type h2TestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	fr     *http2.Framer
+	enc    *xhpack.Encoder
+	encBuf bytes.Buffer
+	dec    *xhpack.Decoder
+
+	// settings holds the parameters announced by the server
+	settings map[http2.SettingID]uint32
+}
+
+type h2TestResponse struct {
+	headers []xhpack.HeaderField
+	body    []byte
+	frames  []http2.Frame
+
+	// promises holds the PUSH_PROMISE frames received on the stream
+	promises []h2TestPromise
+}
+
+type h2TestPromise struct {
+	streamID uint32
+	headers  []xhpack.HeaderField
+}
+
+func (r *h2TestResponse) header(name string) string {
+	for _, hf := range r.headers {
+		if hf.Name == name {
+			return hf.Value
+		}
+	}
+	return ""
+}
+
+func newH2TestServer(t *testing.T, s *Server, conf ServerConfig) net.Conn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	EnableHTTP2(s, conf)
+	go func() {
+		c, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		s.nextProtos["h2"](c) //nolint:errcheck
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func newH2TestClient(t *testing.T, handler RequestHandler, settings ...http2.Setting) *h2TestClient {
+	t.Helper()
+
+	return newH2TestClientConfig(t, &Server{Handler: handler}, ServerConfig{}, settings...)
+}
+
+func newH2TestClientConfig(t *testing.T, s *Server, conf ServerConfig, settings ...http2.Setting) *h2TestClient {
+	t.Helper()
+
+	return newH2TestClientConn(t, newH2TestServer(t, s, conf), settings...)
+}
+
+// newH2TestClientConn performs the client side of the HTTP/2 handshake on c
+func newH2TestClientConn(t *testing.T, c net.Conn, settings ...http2.Setting) *h2TestClient {
+	t.Helper()
+
+	cl := &h2TestClient{
+		t:        t,
+		conn:     c,
+		fr:       http2.NewFramer(c, c),
+		dec:      xhpack.NewDecoder(4096, nil),
+		settings: make(map[http2.SettingID]uint32),
+	}
+	cl.enc = xhpack.NewEncoder(&cl.encBuf)
+
+	if _, err := c.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.fr.WriteSettings(settings...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The server starts with its own SETTINGS frame and then acknowledges ours.
+	// WINDOW_UPDATE frames enlarging the connection window may come in between.
+	f := cl.readFrame()
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok || sf.IsAck() {
+		t.Fatalf("expected SETTINGS frame, got %v", f)
+	}
+	sf.ForeachSetting(func(s http2.Setting) error { //nolint:errcheck
+		cl.settings[s.ID] = s.Val
+		return nil
+	})
+	if err := cl.fr.WriteSettingsAck(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for {
+		f = cl.readFrame()
+		if _, ok := f.(*http2.WindowUpdateFrame); ok {
+			continue
+		}
+		if sf, ok := f.(*http2.SettingsFrame); !ok || !sf.IsAck() {
+			t.Fatalf("expected SETTINGS ACK frame, got %v", f)
+		}
+		return cl
+	}
+}
+
+func (cl *h2TestClient) readFrame() http2.Frame {
+	cl.t.Helper()
+
+	if err := cl.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		cl.t.Fatalf("unexpected error: %v", err)
+	}
+	f, err := cl.fr.ReadFrame()
+	if err != nil {
+		cl.t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	return f
+}
+
+func (cl *h2TestClient) encodeHeaders(fields ...string) []byte {
+	cl.encBuf.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := cl.enc.WriteField(xhpack.HeaderField{Name: fields[i], Value: fields[i+1]}); err != nil {
+			cl.t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return append([]byte(nil), cl.encBuf.Bytes()...)
+}
+
+// writeRequest sends a request on streamID. fields are name/value pairs.
+func (cl *h2TestClient) writeRequest(streamID uint32, endStream bool, fields ...string) {
+	cl.t.Helper()
+
+	err := cl.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: cl.encodeHeaders(fields...),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		cl.t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// readResponse reads frames until the stream is ended by the server
+func (cl *h2TestClient) readResponse(streamID uint32) *h2TestResponse {
+	cl.t.Helper()
+
+	return cl.readResponses(streamID)[streamID]
+}
+
+// readResponses reads frames until all the streams are ended by the server. The header
+// blocks of the other streams are decoded too, to keep the HPACK state in sync.
+func (cl *h2TestClient) readResponses(streamIDs ...uint32) map[uint32]*h2TestResponse {
+	cl.t.Helper()
+
+	resps := make(map[uint32]*h2TestResponse, len(streamIDs))
+	for _, id := range streamIDs {
+		resps[id] = &h2TestResponse{}
+	}
+	for pending := len(streamIDs); pending > 0; {
+		f := cl.readFrame()
+		resp := resps[f.Header().StreamID]
+		if hf, ok := f.(*http2.HeadersFrame); ok && resp == nil {
+			if _, err := cl.dec.DecodeFull(hf.HeaderBlockFragment()); err != nil {
+				cl.t.Fatalf("unexpected error decoding headers: %v", err)
+			}
+		}
+		if pf, ok := f.(*http2.PushPromiseFrame); ok {
+			hfs, err := cl.dec.DecodeFull(pf.HeaderBlockFragment())
+			if err != nil {
+				cl.t.Fatalf("unexpected error decoding headers: %v", err)
+			}
+			if resp != nil {
+				resp.promises = append(resp.promises, h2TestPromise{streamID: pf.PromiseID, headers: hfs})
+			}
+		}
+		if resp == nil {
+			continue
+		}
+
+		resp.frames = append(resp.frames, f)
+		ended := false
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			hfs, err := cl.dec.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				cl.t.Fatalf("unexpected error decoding headers: %v", err)
+			}
+			resp.headers = append(resp.headers, hfs...)
+			ended = f.StreamEnded()
+		case *http2.DataFrame:
+			resp.body = append(resp.body, f.Data()...)
+			ended = f.StreamEnded()
+		case *http2.RSTStreamFrame:
+			cl.t.Fatalf("unexpected RST_STREAM with code %v", f.ErrCode)
+		}
+		if ended {
+			pending--
+		}
+	}
+	return resps
+}
+
+func TestH2ServerResponse(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.Response.Header.Set("X-Path", string(ctx.Path()))
+		ctx.Response.Header.Set("Connection", "keep-alive")
+		ctx.Success("text/plain", []byte("Hello, world!"))
+	})
+
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/hello")
+	resp := cl.readResponse(1)
+
+	if resp.headers[0].Name != ":status" || resp.headers[0].Value != "200" {
+		t.Fatalf("expected :status 200 as first field, got %v", resp.headers)
+	}
+	if v := resp.header("content-type"); v != "text/plain" {
+		t.Fatalf("unexpected content-type %q", v)
+	}
+	if v := resp.header("content-length"); v != "13" {
+		t.Fatalf("unexpected content-length %q", v)
+	}
+	if v := resp.header("x-path"); v != "/hello" {
+		t.Fatalf("unexpected x-path %q", v)
+	}
+	if v := resp.header("connection"); v != "" {
+		t.Fatalf("connection-specific header must not be sent, got %q", v)
+	}
+	if string(resp.body) != "Hello, world!" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2ServerResponseLargeBody(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("a", 3*DefaultMaxFrameSize+100)
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetBodyString(body)
+	}, http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20})
+
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	resp := cl.readResponse(1)
+
+	if string(resp.body) != body {
+		t.Fatalf("unexpected body length %d, expected %d", len(resp.body), len(body))
+	}
+	for _, f := range resp.frames {
+		if f.Header().Length > DefaultMaxFrameSize {
+			t.Fatalf("frame exceeds max frame size: %d", f.Header().Length)
+		}
+	}
+}
+
+func TestH2ServerResponseNoBody(t *testing.T) {
+	t.Parallel()
+
+	handler := func(ctx *RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/204":
+			ctx.SetStatusCode(StatusNoContent)
+			ctx.SetBodyString("ignored")
+		case "/304":
+			ctx.NotModified()
+		default:
+			ctx.SetBodyString("head body")
+		}
+	}
+
+	// All the requests share a connection, so the HPACK dynamic tables are reused
+	cl := newH2TestClient(t, handler)
+	for i, tc := range []struct {
+		method, path  string
+		status        string
+		contentLength string
+	}{
+		{"HEAD", "/", "200", "9"},
+		{"GET", "/204", "204", ""},
+		{"GET", "/304", "304", ""},
+	} {
+		streamID := uint32(2*i + 1)
+		cl.writeRequest(streamID, true, ":method", tc.method, ":scheme", "https", ":authority", "localhost", ":path", tc.path)
+		resp := cl.readResponse(streamID)
+
+		if len(resp.frames) != 1 {
+			t.Fatalf("%s %s: expected a single HEADERS frame with END_STREAM, got %d frames", tc.method, tc.path, len(resp.frames))
+		}
+		if v := resp.header(":status"); v != tc.status {
+			t.Fatalf("%s %s: unexpected status %q", tc.method, tc.path, v)
+		}
+		if v := resp.header("content-length"); v != tc.contentLength {
+			t.Fatalf("%s %s: unexpected content-length %q", tc.method, tc.path, v)
+		}
+	}
+}
+
+func TestH2ServerHeaderListTooLarge(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClientConfig(t, &Server{Handler: func(ctx *RequestCtx) {
+		ctx.SetBodyString("ok")
+	}}, ServerConfig{MaxHeaderListSize: 1024})
+
+	// The limit is announced in the server SETTINGS frame
+	if v := cl.settings[http2.SettingMaxHeaderListSize]; v != 1024 {
+		t.Fatalf("unexpected SETTINGS_MAX_HEADER_LIST_SIZE %d", v)
+	}
+
+	// The same indexed field repeated expands past the limit
+	fields := []string{":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/"}
+	for i := 0; i < 20; i++ {
+		fields = append(fields, "x-big", strings.Repeat("b", 100))
+	}
+	cl.writeRequest(1, true, fields...)
+	resp := cl.readResponse(1)
+	if v := resp.header(":status"); v != "431" {
+		t.Fatalf("unexpected status %q", v)
+	}
+
+	// The connection is still usable
+	cl.writeRequest(3, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	resp = cl.readResponse(3)
+	if v := resp.header(":status"); v != "200" || string(resp.body) != "ok" {
+		t.Fatalf("unexpected response %q %q", v, resp.body)
+	}
+}
+
+func TestH2ServerConcurrentStreams(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		if string(ctx.Path()) == "/slow" {
+			<-release
+		}
+		ctx.SetBodyString(strconv.FormatUint(ctx.ConnRequestNum(), 10))
+	})
+
+	// The slow handler doesn't block the other streams nor the control frames
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/slow")
+	cl.writeRequest(3, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/fast")
+	resp := cl.readResponse(3)
+	if string(resp.body) != "2" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+	cl.expectNoFrame()
+
+	close(release)
+	resp = cl.readResponse(1)
+	if string(resp.body) != "1" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2ServerMaxConcurrentStreams(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	cl := newH2TestClientConfig(t, &Server{Handler: func(ctx *RequestCtx) {
+		if string(ctx.Path()) == "/slow" {
+			<-release
+		}
+		ctx.SetBodyString("ok")
+	}}, ServerConfig{MaxConcurrentStreams: 1})
+
+	if v := cl.settings[http2.SettingMaxConcurrentStreams]; v != 1 {
+		t.Fatalf("unexpected SETTINGS_MAX_CONCURRENT_STREAMS %d", v)
+	}
+
+	// The second stream is refused while the first one is active
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/slow")
+	cl.writeRequest(3, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	f := cl.readFrame()
+	if rf, ok := f.(*http2.RSTStreamFrame); !ok || rf.StreamID != 3 || rf.ErrCode != http2.ErrCodeRefusedStream {
+		t.Fatalf("expected RST_STREAM with REFUSED_STREAM, got %v", f)
+	}
+
+	close(release)
+	resp := cl.readResponse(1)
+	if string(resp.body) != "ok" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+
+	// The refused header block was decoded, so the HPACK state is still in sync
+	cl.writeRequest(5, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/")
+	resp = cl.readResponse(5)
+	if string(resp.body) != "ok" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+// newH2TLSTestClient serves s on a TLS listener, negotiating HTTP/2 with ALPN
+// like a real client does
+func newH2TLSTestClient(t *testing.T, s *Server) *h2TestClient {
+	t.Helper()
+
+	return newH2TestClientConn(t, newH2TLSTestConn(t, s))
+}
+
+// newH2TLSTestConn returns a TLS connection to s which negotiated h2, before the
+// HTTP/2 handshake
+func newH2TLSTestConn(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+
+	certData, keyData, err := GenerateTestCertificate("localhost")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	EnableHTTP2(s, ServerConfig{})
+	go s.ServeTLSEmbed(ln, certData, keyData) //nolint:errcheck
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestH2ServerShutdown(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		states []ConnState
+	)
+	release := make(chan struct{})
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			<-release
+			ctx.SetBodyString("done")
+		},
+		ConnState: func(c net.Conn, state ConnState) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		},
+	}
+	cl := newH2TLSTestClient(t, s)
+	cl.writeRequest(1, true, h2TestRequest...)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.ShutdownWithContext(context.Background())
+	}()
+
+	// The first GOAWAY frame doesn't refuse any stream yet
+	f := cl.readFrame()
+	if gf, ok := f.(*http2.GoAwayFrame); !ok || gf.ErrCode != http2.ErrCodeNo || gf.LastStreamID != 1<<31-1 {
+		t.Fatalf("expected GOAWAY with the max stream ID, got %v", f)
+	}
+	f = cl.readFrame()
+	pf, ok := f.(*http2.PingFrame)
+	if !ok || pf.IsAck() {
+		t.Fatalf("expected PING frame, got %v", f)
+	}
+
+	// A stream sent before the client sees the GOAWAY frame is still processed
+	cl.writeRequest(3, true, h2TestRequest...)
+	if err := cl.fr.WritePing(true, pf.Data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f = cl.readFrame()
+	if gf, ok := f.(*http2.GoAwayFrame); !ok || gf.ErrCode != http2.ErrCodeNo || gf.LastStreamID != 3 {
+		t.Fatalf("expected GOAWAY with last stream 3, got %v", f)
+	}
+
+	// Streams opened after the final GOAWAY frame are ignored
+	cl.writeRequest(5, true, h2TestRequest...)
+	cl.expectNoFrame()
+
+	// The in-flight streams complete, then the connection is closed
+	close(release)
+	for _, resp := range cl.readResponses(1, 3) {
+		if string(resp.body) != "done" {
+			t.Fatalf("unexpected body %q", resp.body)
+		}
+	}
+	if _, err := cl.fr.ReadFrame(); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for Shutdown")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []ConnState{StateNew, StateIdle, StateActive, StateIdle, StateClosed}
+	if len(states) != len(expected) {
+		t.Fatalf("unexpected connection states %v, expected %v", states, expected)
+	}
+	for i := range states {
+		if states[i] != expected[i] {
+			t.Fatalf("unexpected connection states %v, expected %v", states, expected)
+		}
+	}
+}
+
+func TestH2ServerShutdownHandshake(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Handler: func(ctx *RequestCtx) {}}
+	c := newH2TLSTestConn(t, s)
+
+	// Shutdown while the server waits for the client preface
+	time.Sleep(100 * time.Millisecond)
+	go s.Shutdown() //nolint:errcheck
+	for atomic.LoadInt32(&s.stop) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The connection is drained once the handshake is done, SETTINGS is sent first
+	cl := newH2TestClientConn(t, c)
+	for {
+		f := cl.readFrame()
+		if gf, ok := f.(*http2.GoAwayFrame); ok {
+			if gf.ErrCode != http2.ErrCodeNo || gf.LastStreamID != 1<<31-1 {
+				t.Fatalf("expected GOAWAY with the max stream ID, got %v", f)
+			}
+			break
+		}
+	}
+}
+
+func TestH2ServerShutdownDeadline(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		<-release
+	}}
+	cl := newH2TLSTestClient(t, s)
+	cl.writeRequest(1, true, h2TestRequest...)
+	cl.expectNoFrame()
+
+	// The client keeps answering the PING frame while the handler is stuck
+	go func() {
+		for {
+			f, err := cl.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if pf, ok := f.(*http2.PingFrame); ok && !pf.IsAck() {
+				cl.fr.WritePing(true, pf.Data) //nolint:errcheck
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.ShutdownWithContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The connection is closed once the deadline is exceeded
+	if err := cl.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cl.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+}
+
+func TestH2ServerClientGoAway(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		<-release
+		ctx.SetBodyString("done")
+	})
+	cl.writeRequest(1, true, h2TestRequest...)
+	cl.expectNoFrame()
+	if err := cl.fr.WriteGoAway(1, http2.ErrCodeNo, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The streams opened after the GOAWAY of the client are refused
+	cl.writeRequest(3, true, h2TestRequest...)
+	cl.expectRSTStream(3, http2.ErrCodeRefusedStream)
+
+	// The stream in flight completes, then the connection is closed
+	close(release)
+	if resp := cl.readResponse(1); string(resp.body) != "done" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+	for {
+		if _, err := cl.fr.ReadFrame(); err != nil {
+			break
+		}
+	}
+}
+
+func TestH2ServerResponseTrailers(t *testing.T) {
+	t.Parallel()
+
+	for _, unbuffered := range []bool{false, true} {
+		unbuffered := unbuffered
+		t.Run("unbuffered="+strconv.FormatBool(unbuffered), func(t *testing.T) {
+			t.Parallel()
+
+			cl := newH2TestClient(t, func(ctx *RequestCtx) {
+				if err := ctx.Response.Header.SetTrailer("X-Checksum"); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if unbuffered {
+					ctx.DisableBuffering()
+				}
+				ctx.WriteString("body") //nolint:errcheck
+				ctx.Response.Header.Set("X-Checksum", "abc")
+			})
+
+			cl.writeRequest(1, true, h2TestRequest...)
+			resp := cl.readResponse(1)
+			if v := resp.header("trailer"); v != "X-Checksum" {
+				t.Fatalf("unexpected trailer header %q", v)
+			}
+			if string(resp.body) != "body" {
+				t.Fatalf("unexpected body %q", resp.body)
+			}
+
+			// The trailers are sent in a final HEADERS frame ending the stream
+			last := resp.frames[len(resp.frames)-1]
+			if hf, ok := last.(*http2.HeadersFrame); !ok || !hf.StreamEnded() {
+				t.Fatalf("expected HEADERS frame ending the stream, got %v", last)
+			}
+			trailer := resp.headers[len(resp.headers)-1]
+			if trailer.Name != "x-checksum" || trailer.Value != "abc" {
+				t.Fatalf("unexpected trailer %v", trailer)
+			}
+		})
+	}
+}
+
+func TestH2ServerRequestTrailers(t *testing.T) {
+	t.Parallel()
+
+	for _, streamBody := range []bool{false, true} {
+		streamBody := streamBody
+		t.Run("stream="+strconv.FormatBool(streamBody), func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{
+				Handler: func(ctx *RequestCtx) {
+					body := ctx.PostBody()
+					ctx.SetBodyString(string(body) + " " + string(ctx.Request.Header.Peek("X-Checksum")) +
+						" " + string(ctx.Request.Header.Peek("Authorization")))
+				},
+				StreamRequestBody: streamBody,
+			}
+			cl := newH2TestClientConfig(t, s, ServerConfig{})
+
+			cl.writeRequest(1, false, append(h2TestRequest, "te", "trailers")...)
+			if err := cl.fr.WriteData(1, false, []byte("data")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.writeRequest(1, true, "x-checksum", "abc", "authorization", "forbidden")
+			if resp := cl.readResponse(1); string(resp.body) != "data abc " {
+				t.Fatalf("unexpected body %q", resp.body)
+			}
+		})
+	}
+}
@@ -1,12 +1,18 @@
 package fns
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pablolagos/fns/internal/debuglog"
 	"github.com/pablolagos/fns/internal/frames"
@@ -17,29 +23,145 @@ import (
 var defaultServerSettings = Settings{
 	headerTableSize:      ProtocolDefaultSettings[SettingHeaderTableSize],
 	enablePush:           ProtocolDefaultSettings[SettingEnablePush],
-	maxConcurrentStreams: 100,
+	maxConcurrentStreams: DefaultH2MaxConcurrentStreams,
 	initialWindowSize:    ProtocolDefaultSettings[SettingInitialWindowSize],
 	maxFrameSize:         ProtocolDefaultSettings[SettingMaxFrameSize],
-	maxHeaderListSize:    100,
+	maxHeaderListSize:    DefaultH2MaxHeaderListSize,
 }
 
 const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 
 var ErrInvalidPreface = errors.New("invalid client preface")
 
+// goAwayTimeout is how long the writer may take to flush a GOAWAY frame before
+// the connection is closed
+const goAwayTimeout = time.Second
+
+// shutdownPingTimeout is how long a graceful shutdown waits for the PING ACK confirming
+// the client has received the first GOAWAY frame
+const shutdownPingTimeout = time.Second
+
+// maxStreamID is the largest stream ID, announced by the first GOAWAY frame of a graceful shutdown
+const maxStreamID = 1<<31 - 1
+
+// shutdownPingData is the payload of the PING frame sent during a graceful shutdown
+var shutdownPingData = [8]byte{'s', 'h', 'u', 't', 'd', 'o', 'w', 'n'}
+
 // h2ServerConn represents a single HTTP/2 connection
 type h2ServerConn struct {
 	conn            net.Conn
 	serverSettings  Settings
 	clientSettings  Settings
 	streamManager   *StreamManager
-	flowWindow      int32
 	mu              sync.Mutex
 	encoder         *hpack.Encoder
 	decoder         *hpack.Decoder
 	streamProcessor *StreamProcessor
 	s               *Server
+	conf            ServerConfig
 	debug           *debuglog.Logger
+
+	// headerBuf holds the header block being encoded for an outgoing HEADERS frame
+	headerBuf bytes.Buffer
+
+	// inflow is the connection-level window granted to the client, guarded by mu
+	// as the handlers streaming the request body return the credit
+	inflow inflow
+
+	// sched orders the frames written by writeLoop, which is the only
+	// goroutine writing to conn once the connection is served
+	sched      *h2WriteScheduler
+	writerDone chan struct{}
+
+	// connID and connTime are exposed to the handlers through RequestCtx.
+	// requestNum counts the streams handed to a handler.
+	connID     uint64
+	connTime   time.Time
+	requestNum uint64
+
+	// activeStreams is the number of active streams, pushed or not, which tells whether
+	// the connection is idle. clientStreams is the number of those opened by the client,
+	// counting against our SETTINGS_MAX_CONCURRENT_STREAMS. The handlers of the client
+	// streams count against it too until they return, clientHandlers, even once their
+	// stream is reset. They are all guarded by mu.
+	activeStreams  uint32
+	clientStreams  uint32
+	clientHandlers uint32
+
+	// handlers tracks the goroutines running the stream handlers
+	handlers sync.WaitGroup
+
+	// maxClientStreamID is the highest stream ID opened by the client. It is only
+	// modified by the read loop, with mu held.
+	maxClientStreamID uint32
+
+	// nextPushID is the ID of the next pushed stream and pushedStreams the number of
+	// pushed streams still active. pushEnabled and maxPushedStreams follow the client
+	// settings. They are all guarded by mu, as handlers push from their goroutine.
+	nextPushID       uint32
+	pushedStreams    uint32
+	pushEnabled      bool
+	maxPushedStreams uint32
+
+	// goingAway is set, with mu held, once the final GOAWAY frame of a graceful shutdown
+	// is sent, and clientGoingAway once the client sent a GOAWAY frame. The connection is
+	// closed as soon as there are no active streams.
+	goingAway       bool
+	clientGoingAway bool
+	shutdownOnce    sync.Once
+	shutdownPingAck chan struct{}
+
+	// headerStreamID is the stream of the header block being received, or 0 if none.
+	// The block is collected in headerBlock until the END_HEADERS flag.
+	headerStreamID    uint32
+	headerEndStream   bool
+	headerHasPriority bool
+	headerPriority    rfc7540Priority
+	headerBlock       []byte
+
+	// idlePriorities holds the priority signals received for streams not opened
+	// yet, applied when they are. It is only used by the read loop.
+	idlePriorities map[uint32]idlePriority
+
+	// resetStreams, controlFrames and emptyFrames count the frames limited by
+	// ServerConfig to protect the server from floods. They are only used by the
+	// read loop.
+	resetStreams  h2RateLimit
+	controlFrames h2RateLimit
+	emptyFrames   h2RateLimit
+
+	// idleTimer shuts the connection down once it has been idle for the idle timeout,
+	// it is guarded by mu. idleTimerStopped is set once the connection is closed.
+	idleTimer        *time.Timer
+	idleTimerStopped bool
+
+	// lastFrameTime is the time the last frame was received in Unix nanoseconds, only
+	// kept with keepalive PINGs
+	lastFrameTime int64
+
+	// closeErr is the reason the connection was closed by another goroutine than the
+	// read loop, guarded by mu
+	closeErr error
+
+	// upgradeRequest is the HTTP/1.1 request that upgraded the connection to h2c, which
+	// is answered on stream 1, and upgradeSettings the payload of its HTTP2-Settings header.
+	// The request is valid until Serve returns.
+	upgradeRequest  *Request
+	upgradeSettings []byte
+
+	// done stops the read loop, connErr is the connection error that caused it, if any
+	done    bool
+	connErr error
+}
+
+// h2ConnError is a connection error along with the error code sent in the GOAWAY frame
+type h2ConnError struct {
+	code   uint32
+	reason string
+}
+
+func (e h2ConnError) Error() string {
+	return e.reason
 }
 
 // Serve handles the HTTP/2 connection
@@ -48,83 +170,237 @@ func (sc *h2ServerConn) Serve() error {
 	IncrementConnections()
 	defer func() {
 		sc.debug.Infof("Closing connection from %v", sc.conn.RemoteAddr())
+		sc.stopWriter()
 		sc.conn.Close()
+
+		// Nothing will be written anymore, let the handlers release their contexts
+		if sc.streamManager != nil {
+			sc.streamManager.Clear()
+		}
+		sc.handlers.Wait()
+		sc.stopIdleTimer()
 		DecrementConnections()
 	}()
 
+	sc.connID = nextConnID()
+	sc.connTime = time.Now()
+	sc.shutdownPingAck = make(chan struct{})
+
+	// The connection is drained by Shutdown instead of being closed as an idle
+	// HTTP/1 connection. ConnState reports whether streams are being served.
+	sc.s.trackConn(sc.conn, StateActive)
+
 	sc.encoder = hpack.NewEncoder()
 	sc.decoder = hpack.NewDecoder()
 	sc.streamProcessor = NewStreamProcessor()
 	sc.serverSettings = defaultServerSettings
+	if sc.conf.MaxHeaderListSize > 0 {
+		sc.serverSettings.Set(SettingMaxHeaderListSize, sc.conf.MaxHeaderListSize)
+	}
+	sc.serverSettings.Set(SettingInitialWindowSize, sc.conf.initialWindowSize())
+	if sc.conf.MaxConcurrentStreams > 0 {
+		sc.serverSettings.Set(SettingMaxConcurrentStreams, sc.conf.MaxConcurrentStreams)
+	}
+	if !sc.conf.RFC7540Priorities {
+		sc.serverSettings.Set(SettingNoRFC7540Priorities, 1)
+	}
+	if sc.conf.EnableConnectProtocol {
+		sc.serverSettings.Set(SettingEnableConnectProtocol, 1)
+	}
 	sc.clientSettings = NewSettings()
+	sc.clientSettings.Set(SettingMaxConcurrentStreams, math.MaxUint32) // no limit until announced
+	sc.nextPushID = 2
+
+	// The decoder enforces the limits announced in our SETTINGS frame
+	sc.decoder.SetMaxDynamicTableSizeLimit(sc.serverSettings.Get(SettingHeaderTableSize))
+	sc.decoder.SetMaxHeaderListSize(sc.serverSettings.Get(SettingMaxHeaderListSize))
 
 	// Initialize stream manager
 	sc.streamManager = NewStreamManager()
-	sc.flowWindow = int32(sc.serverSettings.Get(SettingInitialWindowSize))
+
+	// The connection windows start at the protocol default, ours is enlarged
+	// with a WINDOW_UPDATE frame during the handshake
+	sc.inflow.init(DefaultInitialWindowSize)
+
+	// Start the writer, every frame is written by it from now on
+	sc.sched = newH2WriteScheduler(&sc.clientSettings)
+	sc.writerDone = make(chan struct{})
+	go sc.writeLoop()
+
+	// The settings of an upgraded connection are announced in the HTTP2-Settings
+	// header, the 101 response acknowledges them
+	if sc.upgradeRequest != nil {
+		if err := sc.applyUpgradeSettings(); err != nil {
+			sc.debug.Errorf("Invalid HTTP2-Settings: %v", err)
+			return sc.connErr
+		}
+	}
 
 	// Send initial SETTINGS frame
 	if err := sc.handshake(); err != nil {
 		sc.debug.Errorf("Handshake error: %v", err)
-		sc.handleError(err, 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
+		sc.connError(err, 0x1) // PROTOCOL_ERROR
 		return err
 	}
 
+	// Shutdown drains the connection once our SETTINGS frame is sent, right away if it
+	// was called during the handshake
+	sc.s.trackH2Conn(sc)
+	defer sc.s.untrackH2Conn(sc)
+
+	// The idle timeout and the keepalive PINGs start once the preface is exchanged, so
+	// the first frame sent is always our SETTINGS frame, see RFC 9113 section 3.4
+	sc.setState(StateIdle)
+	if sc.conf.PingInterval > 0 {
+		sc.frameReceived()
+		go sc.keepalive()
+	}
+
+	if sc.upgradeRequest != nil {
+		sc.openUpgradeStream()
+	}
+
 	// Main loop to handle frames
 	for {
 		frame, err := frames.ReadFrame(sc.conn)
 		if err != nil {
-			sc.handleError(err, 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
+			if closeErr := sc.closeError(); closeErr != nil {
+				return closeErr
+			}
+			if sc.isGoingAway() {
+				// The connection was closed by a graceful shutdown
+				return nil
+			}
+			sc.connError(err, 0x1) // PROTOCOL_ERROR
 			return err
 		}
 
-		// Handle the frame based on its type
-		switch frame.Type {
-		case frames.FrameData:
-			sc.handleDataFrame(frame)
-		case frames.FrameHeaders, frames.FrameContinuation:
-			sc.handleHeadersFrame(frame)
-		case frames.FrameSettings:
-			sc.handleSettingsFrame(frame)
-		case frames.FramePing:
-			sc.handlePingFrame(frame)
-		case frames.FrameGoAway:
-			sc.handleGoAwayFrame(frame)
-			return nil
-		case frames.FrameWindowUpdate:
-			sc.handleWindowUpdateFrame(frame)
-		case frames.FrameRSTStream:
-			sc.handleRSTStreamFrame(frame)
-		case frames.FramePriority:
-			sc.handlePriorityFrame(frame)
-		case frames.FramePushPromise:
-			sc.handlePushPromiseFrame(frame)
-		default:
-			sc.handleError(fmt.Errorf("unhandled frame type: %v", frame.Type), 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
-			return fmt.Errorf("unhandled frame type: %v", frame.Type)
+		sc.frameReceived()
+		if sc.conf.Tracer != nil {
+			sc.traceFrame(frame, false)
 		}
+		sc.processFrame(frame)
 
 		// Release the frame after handling it
 		frames.ReleaseFrame(frame)
+		if sc.done {
+			return sc.connErr
+		}
 	}
 }
 
-// handleError handles errors by logging, sending appropriate frames, and closing the connection if necessary
-func (sc *h2ServerConn) handleError(err error, streamID uint32, frameType uint8, errorCode uint32) {
-	log.Println("Error:", err)
-	if frameType == frames.FrameGoAway {
-		sc.sendGoAway(streamID, errorCode)
-		sc.closeConnection()
-	} else if frameType == frames.FrameRSTStream {
-		sc.sendRSTStream(streamID, errorCode)
+// processFrame handles a frame received from the client. Connection errors stop the
+// read loop, stream errors only reset the stream.
+func (sc *h2ServerConn) processFrame(frame *frames.Frame) {
+	// No frame can exceed the SETTINGS_MAX_FRAME_SIZE we announced
+	if len(frame.Body) > int(sc.serverSettings.Get(SettingMaxFrameSize)) {
+		sc.connError(fmt.Errorf("frame size %d exceeds the max frame size", len(frame.Body)), 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+
+	// A header block is a contiguous sequence of frames, nothing can be interleaved
+	// until END_HEADERS, see RFC 9113 section 6.10
+	if sc.headerStreamID != 0 && (frame.Type != frames.FrameContinuation || frame.StreamID != sc.headerStreamID) {
+		sc.connError(fmt.Errorf("expected CONTINUATION frame for stream %d, got frame type %d for stream %d",
+			sc.headerStreamID, frame.Type, frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	// Handle the frame based on its type
+	switch frame.Type {
+	case frames.FrameData:
+		sc.handleDataFrame(frame)
+	case frames.FrameHeaders:
+		sc.handleHeadersFrame(frame)
+	case frames.FrameContinuation:
+		sc.handleContinuationFrame(frame)
+	case frames.FrameSettings:
+		sc.handleSettingsFrame(frame)
+	case frames.FramePing:
+		sc.handlePingFrame(frame)
+	case frames.FrameGoAway:
+		sc.handleGoAwayFrame(frame)
+	case frames.FrameWindowUpdate:
+		sc.handleWindowUpdateFrame(frame)
+	case frames.FrameRSTStream:
+		sc.handleRSTStreamFrame(frame)
+	case frames.FramePriority:
+		sc.handlePriorityFrame(frame)
+	case frames.FramePushPromise:
+		sc.handlePushPromiseFrame(frame)
+	case frames.FramePriorityUpdate:
+		sc.handlePriorityUpdateFrame(frame)
+	default:
+		// Frames of unknown types are ignored, see RFC 9113 section 5.5
+		sc.debug.Infof("Ignoring frame of unknown type %d", frame.Type)
 	}
 }
 
+// connError reports a connection error: a GOAWAY frame carrying errorCode is sent and the
+// connection is closed, see RFC 9113 section 5.4.1
+func (sc *h2ServerConn) connError(err error, errorCode uint32) {
+	if sc.done {
+		return
+	}
+	sc.debug.Errorf("Connection error: %v", err)
+	sc.traceError(0, errorCode, err)
+	sc.connErr = err
+	sc.done = true
+	sc.sendGoAway(sc.maxClientStreamID, errorCode)
+	sc.closeConnection()
+}
+
+// streamError reports a stream error with a RST_STREAM frame carrying errorCode, see
+// RFC 9113 section 5.4.2. stream is nil if the stream is not tracked anymore.
+func (sc *h2ServerConn) streamError(streamID uint32, stream *Stream, errorCode uint32) {
+	sc.debug.Errorf("Stream error on stream %d: error code %d", streamID, errorCode)
+	sc.traceError(streamID, errorCode, nil)
+	if stream != nil {
+		sc.resetStream(stream, errorCode)
+		return
+	}
+	sc.sendRSTStream(streamID, errorCode)
+	if state, _ := sc.state(streamID); state == StreamClosed {
+		sc.streamManager.StreamReset(streamID)
+	}
+}
+
+// state returns the state of a stream, along with the stream if it is still open. The
+// client streams with an ID up to the last one opened are closed, as opening a stream
+// implicitly closes the idle streams with lower IDs, see RFC 9113 section 5.1.1.
+func (sc *h2ServerConn) state(streamID uint32) (StreamState, *Stream) {
+	if stream, ok := sc.streamManager.GetStream(streamID); ok {
+		stream.mu.Lock()
+		state := stream.State
+		stream.mu.Unlock()
+		return state, stream
+	}
+	if streamID%2 == 1 && streamID <= sc.maxClientStreamID {
+		return StreamClosed, nil
+	}
+	if streamID%2 == 0 && streamID < sc.nextPushStreamID() {
+		return StreamClosed, nil
+	}
+	return StreamIdle, nil
+}
+
+// resetRecently reports whether a closed stream was recently reset by the server. The
+// frames the client sent before receiving the RST_STREAM frame are ignored, see RFC 9113
+// section 5.1. stream is the stream returned by state, if any.
+func (sc *h2ServerConn) resetRecently(streamID uint32, stream *Stream) bool {
+	if stream != nil {
+		return false
+	}
+	recent, reset := sc.streamManager.Closed(streamID)
+	return recent && reset
+}
+
 // handshake performs the HTTP/2 connection handshake
 func (sc *h2ServerConn) handshake() error {
 	// Read the client preface
 	sc.debug.Info("Reading client preface")
 	preface := make([]byte, len(ClientPreface))
-	if _, err := sc.conn.Read(preface); err != nil {
+	if _, err := io.ReadFull(sc.conn, preface); err != nil {
 		return fmt.Errorf("error reading client preface: %v", err)
 	}
 	if string(preface) != ClientPreface {
@@ -133,268 +409,1162 @@ func (sc *h2ServerConn) handshake() error {
 
 	// Send our initial SETTINGS frame
 	sc.debug.Info("Sending initial SETTINGS frame")
-	if err := sendSettings(sc.conn, sc.serverSettings); err != nil {
+	if err := sc.sendSettings(); err != nil {
 		return fmt.Errorf("error sending initial SETTINGS frame: %v", err)
 	}
 
-	// Receive SETTINGS frame from client
+	// SETTINGS_INITIAL_WINDOW_SIZE only applies to streams, the connection window
+	// can only be enlarged with a WINDOW_UPDATE frame
+	if connWindow := sc.conf.initialConnWindowSize(); connWindow > DefaultInitialWindowSize {
+		sc.inflow.init(int32(connWindow))
+		sc.sendWindowUpdate(0, connWindow-DefaultInitialWindowSize)
+	}
+
+	// Receive SETTINGS frame from client, the preface is not complete without it
 	sc.debug.Info("Reading initial SETTINGS frame")
 	frame, err := frames.ReadFrame(sc.conn)
 	if err != nil {
 		return err
 	}
-	if frame.Type != frames.FrameSettings {
+	defer frames.ReleaseFrame(frame)
+	if sc.conf.Tracer != nil {
+		sc.traceFrame(frame, false)
+	}
+	if frame.Type != frames.FrameSettings || frame.Flags&frames.FlagAck != 0 {
 		return fmt.Errorf("expected SETTINGS frame, got %v", frame.Type)
 	}
 
-	// Apply the received serverSettings
-	applySettings(frame, &sc.clientSettings)
-
-	// Send SETTINGS ACK
-	sc.debug.Info("Sending SETTINGS ACK")
-	if err := sendSettingsAck(sc.conn); err != nil {
-		return fmt.Errorf("error sending SETTINGS ACK: %v", err)
-	}
-	return nil
+	// Apply the received settings and acknowledge them
+	sc.handleSettingsFrame(frame)
+	return sc.connErr
 }
 
 // handleSettingsFrame handles SETTINGS frames
 func (sc *h2ServerConn) handleSettingsFrame(frame *frames.Frame) {
-	// Apply the received serverSettings
-	applySettings(frame, &sc.serverSettings)
+	if frame.StreamID != 0 {
+		sc.connError(fmt.Errorf("SETTINGS frame on stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
 
-	// Send SETTINGS ACK
-	if err := sendSettingsAck(sc.conn); err != nil {
-		sc.handleError(err, 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
+	// An ACK only confirms our own settings, it must not be acknowledged again
+	if frame.Flags&frames.FlagAck != 0 {
+		if len(frame.Body) != 0 {
+			sc.connError(fmt.Errorf("SETTINGS ACK frame with a payload"), 0x6) // FRAME_SIZE_ERROR
+		}
+		return
+	}
+
+	if !sc.controlFrameReceived() {
+		return
+	}
+
+	// Apply the settings announced by the client
+	if err := sc.applyClientSettings(frame); err != nil {
+		sc.settingsError(err)
+		return
 	}
+
+	// Send SETTINGS ACK
+	sc.sendSettingsAck()
 }
 
-// handleHeadersFrame handles HEADERS and CONTINUATION frames
+// handleHeadersFrame handles HEADERS frames, which start a header block
 func (sc *h2ServerConn) handleHeadersFrame(frame *frames.Frame) {
-	// Create or update the stream
-	stream, exists := sc.streamManager.GetStream(frame.StreamID)
-	if !exists {
-		stream = sc.streamManager.CreateStream(frame.StreamID, sc)
+	// Streams initiated by the client use odd IDs, see RFC 9113 section 5.1.1
+	if frame.StreamID == 0 || frame.StreamID%2 == 0 {
+		sc.connError(fmt.Errorf("HEADERS frame on invalid stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
 	}
 
-	// Process the headers
-	sc.processHeadersFrame(stream, frame)
+	payload, err := frame.Payload()
+	if err != nil {
+		sc.connError(err, 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	// The block is only processed once complete, END_STREAM is only carried by
+	// the HEADERS frame and CONTINUATION frames never set it
+	sc.headerStreamID = frame.StreamID
+	sc.headerEndStream = frame.Flags&frames.FlagEndStream != 0
+	sc.headerHasPriority = frame.Flags&frames.FlagPriority != 0
+	if sc.headerHasPriority {
+		sc.headerPriority = headersPriority(frame)
+	}
+	sc.headerBlock = sc.headerBlock[:0]
+	if !sc.appendHeaderBlock(payload, frame.Flags) {
+		return
+	}
+	if frame.Flags&frames.FlagEndHeaders != 0 {
+		sc.endHeaderBlock()
+	}
 }
 
-func (sc *h2ServerConn) processHeadersFrame(stream *Stream, frame *frames.Frame) {
-	stream.mu.Lock()
-	defer stream.mu.Unlock()
+// appendHeaderBlock adds a fragment to the header block being received, closing the
+// connection if the block grows too large or the client sends empty fragments
+func (sc *h2ServerConn) appendHeaderBlock(fragment []byte, flags uint8) bool {
+	if len(fragment) == 0 && flags&frames.FlagEndHeaders == 0 && !sc.emptyFrameReceived() {
+		return false
+	}
+	if !sc.checkHeaderBlockSize(len(fragment)) {
+		return false
+	}
+	sc.headerBlock = append(sc.headerBlock, fragment...)
+	return true
+}
+
+// headersPriority returns the priority fields of a HEADERS frame with the PRIORITY
+// flag. The frame length has already been validated by Payload.
+func headersPriority(frame *frames.Frame) rfc7540Priority {
+	body := frame.Body
+	if frame.Flags&frames.FlagPadded != 0 {
+		body = body[1:]
+	}
+	return parseRFC7540Priority(body)
+}
 
-	// Append headers data
-	stream.Body = append(stream.Body, frame.Body...)
+// handleContinuationFrame handles CONTINUATION frames. processFrame already checked
+// that the frame continues the header block in progress, if any.
+func (sc *h2ServerConn) handleContinuationFrame(frame *frames.Frame) {
+	if sc.headerStreamID == 0 {
+		sc.connError(fmt.Errorf("CONTINUATION frame without HEADERS frame on stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
 
-	// Check for END_HEADERS flag
+	if !sc.appendHeaderBlock(frame.Body, frame.Flags) {
+		return
+	}
 	if frame.Flags&frames.FlagEndHeaders != 0 {
-		// END_HEADERS flag is set, headers are complete
-		log.Printf("Received complete headers for stream %d\n", stream.ID)
-		headerFields, err := sc.decoder.Decode(stream.Body)
-		if err != nil {
-			sc.handleError(err, stream.ID, frames.FrameRSTStream, 0x1) // PROTOCOL_ERROR
+		sc.endHeaderBlock()
+	}
+}
+
+// endHeaderBlock decodes a complete header block and applies it to its stream. The block
+// is decoded even if the stream is then rejected, to keep the HPACK state in sync.
+func (sc *h2ServerConn) endHeaderBlock() {
+	streamID, endStream := sc.headerStreamID, sc.headerEndStream
+	sc.headerStreamID = 0
+
+	var prio *rfc7540Priority
+	if sc.headerHasPriority {
+		prio = &sc.headerPriority
+	}
+
+	fields, err := sc.decoder.DecodeFields(sc.headerBlock)
+	tooLarge := errors.Is(err, hpack.ErrHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		sc.connError(err, 0x9) // COMPRESSION_ERROR
+		return
+	}
+
+	state, stream := sc.state(streamID)
+	switch state {
+	case StreamIdle:
+		sc.openClientStream(streamID, fields, endStream, tooLarge, prio)
+	case StreamOpen, StreamHalfClosedLocal:
+		if prio != nil && prio.dependency != streamID {
+			sc.rfc7540PriorityReceived(streamID, stream, *prio)
+		}
+		sc.processTrailers(stream, fields, endStream, tooLarge)
+	case StreamHalfClosedRemote:
+		// The client already ended the stream
+		sc.streamError(streamID, stream, 0x5) // STREAM_CLOSED
+	default:
+		if sc.resetRecently(streamID, stream) {
+			// Trailers sent before the client received our RST_STREAM frame
 			return
 		}
-		stream.Headers = headerFields
-		// Reset the body buffer after processing headers
-		stream.Body = nil
-		// If the stream does not have a body or has received the END_STREAM flag, process it
-		if frame.Flags&frames.FlagEndStream != 0 {
-			stream.State = StreamHalfClosedRemote
-			sc.streamProcessor.ProcessStream(stream, sc.s)
-		} else if stream.State == StreamOpen {
-			stream.State = StreamHalfClosedLocal
+		// New streams must use IDs greater than all the previous ones, a closed
+		// stream can't be opened again
+		sc.connError(fmt.Errorf("HEADERS frame on closed stream %d", streamID), 0x1) // PROTOCOL_ERROR
+	}
+}
+
+// openClientStream opens the stream requested by a header block. Header lists exceeding
+// SETTINGS_MAX_HEADER_LIST_SIZE are answered with 431, malformed requests and streams
+// beyond SETTINGS_MAX_CONCURRENT_STREAMS are reset. prio holds the priority fields of
+// the HEADERS frame, if any.
+func (sc *h2ServerConn) openClientStream(streamID uint32, fields []hpack.HeaderField, endStream, tooLarge bool, prio *rfc7540Priority) {
+	sc.mu.Lock()
+	sc.maxClientStreamID = streamID
+	goingAway, clientGoingAway := sc.goingAway, sc.clientGoingAway
+	sc.mu.Unlock()
+
+	// The streams opened after the final GOAWAY frame are ignored, see RFC 9113 section 6.8
+	if goingAway {
+		sc.debug.Infof("Ignoring stream %d opened after GOAWAY", streamID)
+		return
+	}
+	// The client must not open streams after its own GOAWAY frame
+	if clientGoingAway {
+		sc.debug.Errorf("Refusing stream %d opened after the GOAWAY of the client", streamID)
+		sc.streamError(streamID, nil, 0x7) // REFUSED_STREAM
+		return
+	}
+
+	// A stream can't depend on itself, see RFC 9113 section 5.3.1
+	if prio != nil && prio.dependency == streamID {
+		sc.streamError(streamID, nil, 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	if tooLarge {
+		// The block was fully decoded, so the connection is still usable
+		sc.debug.Errorf("Header list too large for stream %d", streamID)
+		stream := sc.streamManager.CreateStream(streamID, sc)
+		stream.mu.Lock()
+		stream.setState(StreamOpen)
+		if endStream {
+			stream.setState(StreamHalfClosedRemote)
 		}
+		stream.handled = true
+		stream.mu.Unlock()
+		sc.writeHeaderListTooLarge(stream)
+		return
+	}
+
+	contentLength, err := checkH2RequestHeaders(fields, sc.conf.EnableConnectProtocol)
+	if err == nil && endStream && contentLength > 0 {
+		err = errH2ContentLength
+	}
+	if err != nil {
+		sc.debug.Errorf("Malformed request on stream %d: %v", streamID, err)
+		sc.streamError(streamID, nil, 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	// The streams beyond the limit are refused, the client may retry them later
+	if !sc.activateStream() {
+		sc.debug.Errorf("Refusing stream %d, too many active streams", streamID)
+		sc.streamError(streamID, nil, 0x7) // REFUSED_STREAM
+		return
+	}
+
+	stream := sc.streamManager.CreateStream(streamID, sc)
+	sc.initPriority(stream, fields, prio)
+	stream.mu.Lock()
+	stream.Headers = fields
+	stream.contentLength = contentLength
+	stream.connectProtocol = h2ConnectProtocol(fields)
+	stream.active = true
+	stream.setState(StreamOpen)
+	switch {
+	case endStream:
+		// The request has no body, it can be processed right away
+		stream.setState(StreamHalfClosedRemote)
+		stream.handled = true
+	case sc.s.StreamRequestBody, stream.connectProtocol != "":
+		// The handler reads the body as it arrives
+		stream.body = newH2RequestBody(stream)
+		stream.handled = true
+	case contentLength > int64(sc.maxRequestBodySize()):
+		sc.debug.Errorf("Request body too large on stream %d", streamID)
+		stream.bodyErr = ErrBodyTooLarge
+		stream.handled = true
+	}
+	start := stream.handled
+	stream.mu.Unlock()
+
+	sc.startStreamTimers(stream, !endStream)
+	if start {
+		sc.startHandler(stream)
+	}
+}
+
+// openUpgradeStream opens stream 1 for the request that upgraded the connection,
+// see RFC 7540 section 3.2. The request is complete, so the stream is half-closed (remote).
+func (sc *h2ServerConn) openUpgradeStream() {
+	sc.mu.Lock()
+	sc.maxClientStreamID = 1
+	sc.mu.Unlock()
+
+	// No other stream is active yet
+	sc.activateStream()
+
+	stream := sc.streamManager.CreateStream(1, sc)
+	stream.mu.Lock()
+	stream.Headers = appendH2RequestHeaders(nil, &sc.upgradeRequest.Header, "http")
+	stream.Body = sc.upgradeRequest.Body()
+	stream.active = true
+	stream.setState(StreamHalfClosedRemote)
+	stream.handled = true
+	stream.mu.Unlock()
+
+	sc.startStreamTimers(stream, false)
+	sc.startHandler(stream)
+}
+
+// processTrailers handles a header block received after the request headers. It must
+// end the stream and can't contain pseudo-header fields, see RFC 9113 section 8.1.
+func (sc *h2ServerConn) processTrailers(stream *Stream, fields []hpack.HeaderField, endStream, tooLarge bool) {
+	if !endStream || tooLarge || checkH2Trailers(fields) != nil {
+		sc.streamError(stream.ID, stream, 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	stream.mu.Lock()
+	stream.Trailers = fields
+	stream.mu.Unlock()
+	sc.endStreamReceived(stream)
+}
+
+// endStreamReceived moves the stream to half-closed (remote) once the client has sent
+// the whole request, and starts the handler. The body must match the content-length.
+func (sc *h2ServerConn) endStreamReceived(stream *Stream) {
+	stream.mu.Lock()
+	if stream.contentLength >= 0 && stream.bodyLength != stream.contentLength {
+		stream.mu.Unlock()
+		sc.streamError(stream.ID, stream, 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if stream.body != nil {
+		stream.body.closeWithError(io.EOF)
+	}
+
+	start := !stream.handled
+	stream.handled = true
+	if stream.State == StreamHalfClosedLocal {
+		// The response has already been sent
+		stream.mu.Unlock()
+		sc.closeStream(stream)
+		return
+	}
+	stream.setState(StreamHalfClosedRemote)
+	stream.mu.Unlock()
+
+	if start {
+		sc.startHandler(stream)
 	}
 }
 
 // handleWindowUpdateFrame handles WINDOW_UPDATE frames
 func (sc *h2ServerConn) handleWindowUpdateFrame(frame *frames.Frame) {
-	// Update the flow control window
+	if len(frame.Body) != 4 {
+		sc.connError(fmt.Errorf("invalid WINDOW_UPDATE frame size"), 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+	increment := binary.BigEndian.Uint32(frame.Body) & 0x7fffffff
+
 	if frame.StreamID == 0 {
 		// Connection-level window update
-		delta := int32(binary.BigEndian.Uint32(frame.Body))
-		sc.flowWindow += delta
-		if sc.flowWindow < 0 {
-			sc.handleError(fmt.Errorf("flow control error"), 0, frames.FrameGoAway, 0x3) // FLOW_CONTROL_ERROR
-		}
-	} else {
-		// Stream-level window update
-		stream, exists := sc.streamManager.GetStream(frame.StreamID)
-		if !exists {
-			sc.handleError(fmt.Errorf("stream closed"), frame.StreamID, frames.FrameRSTStream, 0x5) // STREAM_CLOSED
+		if increment == 0 {
+			sc.connError(fmt.Errorf("WINDOW_UPDATE with 0 increment"), 0x1) // PROTOCOL_ERROR
 			return
 		}
-		stream.AdjustWindow(int32(binary.BigEndian.Uint32(frame.Body)))
+		if !sc.sched.addConnWindow(int32(increment)) {
+			sc.connError(fmt.Errorf("connection flow control window overflow"), 0x3) // FLOW_CONTROL_ERROR
+		}
+		return
+	}
+
+	// Stream-level window update. It may arrive after the stream was closed, in which case it is ignored.
+	state, stream := sc.state(frame.StreamID)
+	if state == StreamIdle {
+		sc.connError(fmt.Errorf("WINDOW_UPDATE frame on idle stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if stream == nil {
+		return
+	}
+	if increment == 0 {
+		sc.streamError(stream.ID, stream, 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if !sc.sched.addStreamWindow(stream.ID, int32(increment)) {
+		sc.streamError(stream.ID, stream, 0x3) // FLOW_CONTROL_ERROR
 	}
 }
 
 // handleDataFrame handles DATA frames
 func (sc *h2ServerConn) handleDataFrame(frame *frames.Frame) {
-	// Retrieve the stream
-	stream, exists := sc.streamManager.GetStream(frame.StreamID)
-	if !exists {
-		sc.handleError(fmt.Errorf("stream closed"), frame.StreamID, frames.FrameRSTStream, 0x5) // Error code: STREAM_CLOSED
+	if frame.StreamID == 0 {
+		sc.connError(fmt.Errorf("DATA frame on stream 0"), 0x1) // PROTOCOL_ERROR
+		return
+	}
+	state, stream := sc.state(frame.StreamID)
+	if state == StreamIdle {
+		sc.connError(fmt.Errorf("DATA frame on idle stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	// The whole frame, including padding, counts against the flow-control windows
+	length := uint32(len(frame.Body))
+	sc.mu.Lock()
+	ok := sc.inflow.take(length)
+	sc.mu.Unlock()
+	if !ok {
+		sc.connError(fmt.Errorf("connection flow control window exceeded"), 0x3) // FLOW_CONTROL_ERROR
+		return
+	}
+
+	payload, err := frame.Payload()
+	if err != nil {
+		sc.connError(err, 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	// Empty DATA frames carry nothing but an END_STREAM flag
+	if len(payload) == 0 && frame.Flags&frames.FlagEndStream == 0 && !sc.emptyFrameReceived() {
+		return
+	}
+
+	// A pushed stream is only written by the server, see RFC 9113 section 5.1
+	if state == StreamReservedLocal {
+		sc.connError(fmt.Errorf("DATA frame on reserved stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
+
+	// Only the streams the client hasn't ended can receive data
+	if state != StreamOpen && state != StreamHalfClosedLocal {
+		// Nobody will consume the data, return the connection-level credit right away
+		sc.returnInflow(nil, int(length))
+		if sc.resetRecently(frame.StreamID, stream) {
+			return
+		}
+		sc.streamError(frame.StreamID, stream, 0x5) // STREAM_CLOSED
 		return
 	}
 
 	// Process the data
 	stream.mu.Lock()
-	defer stream.mu.Unlock()
-
-	// Adjust the flow control window
-	sc.flowWindow -= int32(len(frame.Body))
-	stream.Window -= int32(len(frame.Body))
+	if !stream.inflow.take(length) {
+		stream.mu.Unlock()
+		sc.returnInflow(nil, int(length))
+		sc.streamError(stream.ID, stream, 0x3) // FLOW_CONTROL_ERROR
+		return
+	}
 
-	if sc.flowWindow < 0 || stream.Window < 0 {
-		// Handle window underflow
-		sc.handleWindowUnderflow(stream)
+	// A body longer than the content-length makes the request malformed, see RFC 9113 section 8.1.1
+	stream.bodyLength += int64(len(payload))
+	if stream.contentLength >= 0 && stream.bodyLength > stream.contentLength {
+		stream.mu.Unlock()
+		sc.returnInflow(nil, int(length))
+		sc.streamError(stream.ID, stream, 0x1) // PROTOCOL_ERROR
 		return
 	}
+	endStream := frame.Flags&frames.FlagEndStream != 0
 
-	// Append data to stream body
-	stream.Body = append(stream.Body, frame.Body...)
+	// The data is consumed as soon as it is buffered, so the credit is returned to the
+	// client along with the padding. A streamed body returns it as the handler reads it.
+	consumed := int(length)
+	tooLarge := false
+	switch {
+	case stream.bodyErr != nil:
+		// The request was rejected, the data is discarded
+	case stream.body != nil:
+		if stream.body.write(payload) {
+			consumed -= len(payload)
+		}
+	default:
+		stream.Body = append(stream.Body, payload...)
+		if len(stream.Body) > sc.maxRequestBodySize() {
+			// Only the error response remains to be sent
+			stream.Body = nil
+			stream.bodyErr = ErrBodyTooLarge
+			tooLarge = !stream.handled
+			stream.handled = true
+		}
+	}
+	stream.mu.Unlock()
 
-	// Check for END_STREAM flag
-	if frame.Flags&frames.FlagEndStream != 0 {
-		stream.State = StreamHalfClosedRemote
+	if endStream {
+		// No more data can arrive on the stream, only the connection needs the credit back
+		sc.returnInflow(nil, consumed)
+	} else {
+		sc.returnInflow(stream, consumed)
+	}
+
+	if tooLarge {
+		sc.debug.Errorf("Request body too large on stream %d", stream.ID)
+		sc.startHandler(stream)
+	}
+	if endStream {
+		sc.endStreamReceived(stream)
+	}
+}
+
+// startHandler runs the handler of a complete request in its own goroutine, so the
+// read loop keeps serving the other streams and the control frames. The handlers of
+// the client streams are bounded by SETTINGS_MAX_CONCURRENT_STREAMS until they return,
+// so resetting the streams doesn't let the client start more of them.
+func (sc *h2ServerConn) startHandler(stream *Stream) {
+	// Pushed streams are started by the handlers
+	stream.requestNum = atomic.AddUint64(&sc.requestNum, 1)
+
+	client := stream.ID%2 == 1
+	if client {
+		sc.mu.Lock()
+		sc.clientHandlers++
+		sc.mu.Unlock()
+	}
+
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
 		sc.streamProcessor.ProcessStream(stream, sc.s)
+		if client {
+			sc.mu.Lock()
+			sc.clientHandlers--
+			sc.mu.Unlock()
+		}
+	}()
+}
+
+// returnInflow returns n bytes of consumed credit to the client for the connection
+// and, if not nil, the stream. WINDOW_UPDATE frames are only sent once enough
+// credit has been accumulated. It is called by the read loop and by the handlers
+// reading a streamed body, without holding the stream lock.
+func (sc *h2ServerConn) returnInflow(stream *Stream, n int) {
+	sc.mu.Lock()
+	inc := sc.inflow.add(n)
+	sc.mu.Unlock()
+	if inc > 0 {
+		sc.sendWindowUpdate(0, uint32(inc))
+	}
+	if stream == nil {
+		return
 	}
+
+	stream.mu.Lock()
+	inc = 0
+	if stream.State == StreamOpen || stream.State == StreamHalfClosedLocal {
+		// The client can't send more data on the other states
+		inc = stream.inflow.add(n)
+	}
+	stream.mu.Unlock()
+	if inc > 0 {
+		sc.sendWindowUpdate(stream.ID, uint32(inc))
+	}
+}
+
+// maxRequestBodySize returns the largest request body buffered for the handler,
+// see Server.MaxRequestBodySize
+func (sc *h2ServerConn) maxRequestBodySize() int {
+	if sc.s.MaxRequestBodySize > 0 {
+		return sc.s.MaxRequestBodySize
+	}
+	return DefaultMaxRequestBodySize
 }
 
 // handleRSTStreamFrame handles RST_STREAM frames
 func (sc *h2ServerConn) handleRSTStreamFrame(frame *frames.Frame) {
-	// Log and close the stream
-	log.Printf("Received RST_STREAM frame for stream %d\n", frame.StreamID)
-	sc.streamManager.RemoveStream(frame.StreamID)
+	if frame.StreamID == 0 {
+		sc.connError(fmt.Errorf("RST_STREAM frame on stream 0"), 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if len(frame.Body) != 4 {
+		sc.connError(fmt.Errorf("invalid RST_STREAM frame size"), 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+
+	// Close the stream
+	state, stream := sc.state(frame.StreamID)
+	if state == StreamIdle {
+		sc.connError(fmt.Errorf("RST_STREAM frame on idle stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if stream != nil {
+		sc.closeStream(stream)
+
+		// Cancelled streams don't count against SETTINGS_MAX_CONCURRENT_STREAMS anymore
+		sc.resetStreamReceived()
+	}
 }
 
-// handlePriorityFrame handles PRIORITY frames
+// handlePriorityFrame handles PRIORITY frames, the deprecated priority signal of RFC 7540
 func (sc *h2ServerConn) handlePriorityFrame(frame *frames.Frame) {
-	// PRIORITY frames are used to change the priority of a stream
-	log.Printf("Received PRIORITY frame for stream %d\n", frame.StreamID)
-	stream, exists := sc.streamManager.GetStream(frame.StreamID)
-	if !exists {
-		sc.handleError(fmt.Errorf("stream closed"), frame.StreamID, frames.FrameRSTStream, 0x5) // STREAM_CLOSED
+	if frame.StreamID == 0 {
+		sc.connError(fmt.Errorf("PRIORITY frame on stream 0"), 0x1) // PROTOCOL_ERROR
 		return
 	}
 
-	// Parse the priority value from the frame body
-	if len(frame.Body) < 5 {
-		sc.handleError(fmt.Errorf("priority frame body too short"), 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
+	if !sc.controlFrameReceived() {
 		return
 	}
-	priority := frame.Body[0]
-	stream.UpdatePriority(priority)
-}
 
-// handlePushPromiseFrame handles PUSH_PROMISE frames
-func (sc *h2ServerConn) handlePushPromiseFrame(frame *frames.Frame) {
-	// PUSH_PROMISE frames are used to initiate server push
-	log.Printf("Received PUSH_PROMISE frame, initiating server push\n")
+	// PRIORITY frames can be sent in any stream state, even for idle and closed streams
+	state, stream := sc.state(frame.StreamID)
+	if len(frame.Body) != 5 {
+		sc.streamError(frame.StreamID, stream, 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+	prio := parseRFC7540Priority(frame.Body)
+	if prio.dependency == frame.StreamID {
+		// A stream can't depend on itself
+		sc.streamError(frame.StreamID, stream, 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if stream != nil || (state == StreamIdle && frame.StreamID%2 == 1) {
+		sc.rfc7540PriorityReceived(frame.StreamID, stream, prio)
+	}
+}
 
-	// Parse the PUSH_PROMISE frame and log the promised stream ID
+// handlePriorityUpdateFrame handles PRIORITY_UPDATE frames, which carry the new priority
+// of a stream in the format of the priority header, see RFC 9218 section 7.1
+func (sc *h2ServerConn) handlePriorityUpdateFrame(frame *frames.Frame) {
+	if frame.StreamID != 0 {
+		sc.connError(fmt.Errorf("PRIORITY_UPDATE frame on stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
 	if len(frame.Body) < 4 {
-		sc.handleError(fmt.Errorf("PUSH_PROMISE frame body too short"), 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
+		sc.connError(fmt.Errorf("invalid PRIORITY_UPDATE frame size"), 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+	if !sc.controlFrameReceived() {
+		return
+	}
+
+	streamID := binary.BigEndian.Uint32(frame.Body) & 0x7fffffff
+	state, stream := sc.state(streamID)
+	switch {
+	case streamID == 0:
+		sc.connError(fmt.Errorf("PRIORITY_UPDATE frame for stream 0"), 0x1) // PROTOCOL_ERROR
+		return
+	case streamID%2 == 0 && state == StreamIdle:
+		sc.connError(fmt.Errorf("PRIORITY_UPDATE frame for stream %d, which was not promised", streamID), 0x1) // PROTOCOL_ERROR
 		return
 	}
-	promisedStreamID := binary.BigEndian.Uint32(frame.Body[:4])
-	log.Printf("Promised Stream ID: %d\n", promisedStreamID)
 
-	// Create the promised stream
-	sc.streamManager.CreateStream(promisedStreamID, sc)
+	p := parsePriority(string(frame.Body[4:]))
+	if stream != nil {
+		sc.setStreamPriority(stream, p, true)
+	} else if state == StreamIdle {
+		sc.setIdlePriority(streamID, p, true)
+	}
+}
+
+// handlePushPromiseFrame handles PUSH_PROMISE frames. Only servers can push, so a
+// client sending one is a connection error, see RFC 9113 section 8.4.
+func (sc *h2ServerConn) handlePushPromiseFrame(frame *frames.Frame) {
+	sc.connError(fmt.Errorf("PUSH_PROMISE frame received from the client"), 0x1) // PROTOCOL_ERROR
 }
 
 // handlePingFrame handles PING frames
 func (sc *h2ServerConn) handlePingFrame(frame *frames.Frame) {
-	// Respond with PING ACK
-	frame.Flags |= frames.FlagAck // ACK flag
-	if err := frame.WriteTo(sc.conn); err != nil {
-		sc.handleError(err, 0, frames.FrameGoAway, 0x1) // PROTOCOL_ERROR
+	if frame.StreamID != 0 {
+		sc.connError(fmt.Errorf("PING frame on stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
 	}
+	if len(frame.Body) != 8 {
+		sc.connError(fmt.Errorf("invalid PING frame size"), 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+
+	// An ACK answers one of our PINGs, it must not be answered again
+	if frame.Flags&frames.FlagAck != 0 {
+		if bytes.Equal(frame.Body, shutdownPingData[:]) {
+			select {
+			case <-sc.shutdownPingAck:
+			default:
+				close(sc.shutdownPingAck)
+			}
+		}
+		return
+	}
+
+	if !sc.controlFrameReceived() {
+		return
+	}
+
+	// Respond with PING ACK carrying the same payload
+	ack := frames.AcquireFrame(frames.FramePing)
+	ack.Flags = frames.FlagAck // ACK flag
+	ack.Body = append(ack.Body[:0], frame.Body...)
+	sc.sched.writeControl(ack)
 }
 
 // handleGoAwayFrame handles GOAWAY frames
 func (sc *h2ServerConn) handleGoAwayFrame(frame *frames.Frame) {
-	// Log and close the connection
-	log.Printf("Received GOAWAY frame, closing connection\n")
-	sc.closeConnection()
+	if frame.StreamID != 0 {
+		sc.connError(fmt.Errorf("GOAWAY frame on stream %d", frame.StreamID), 0x1) // PROTOCOL_ERROR
+		return
+	}
+	if len(frame.Body) < 8 {
+		sc.connError(fmt.Errorf("invalid GOAWAY frame size"), 0x6) // FRAME_SIZE_ERROR
+		return
+	}
+
+	// The client opens no more streams, but still reads the responses of the streams in
+	// flight, see RFC 9113 section 6.8. The connection is closed once they are done.
+	sc.debug.Infof("Received GOAWAY frame, closing connection once the active streams are done")
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.clientGoingAway = true
+	if sc.activeStreams == 0 {
+		sc.sched.close(true)
+	}
 }
 
-// handleWindowUnderflow handles flow control window underflow
-func (sc *h2ServerConn) handleWindowUnderflow(stream *Stream) {
-	log.Printf("Flow control window underflow for stream %d\n", stream.ID)
-	// Send RST_STREAM for the affected stream
-	sc.sendRSTStream(stream.ID, 0x3) // Error code: FLOW_CONTROL_ERROR
+// writeResponse sends the response stored in the stream as a HEADERS frame followed by
+// the DATA frames carrying the body. The last frame written carries the END_STREAM flag.
+//
+// The frames are queued for the writer, which sends the body as the client grants
+// flow-control credit and closes the stream once END_STREAM is written.
+func (sc *h2ServerConn) writeResponse(stream *Stream) error {
+	hasTrailers := len(stream.ResponseTrailers) > 0
+	hasBody := len(stream.ResponseBody) > 0
+	sc.sched.writeHeaders(stream.ID, stream.ResponseHeaders, !hasBody && !hasTrailers)
+	if hasBody {
+		sc.sched.writeData(stream.ID, stream.ResponseBody, !hasTrailers)
+	}
+	if hasTrailers {
+		// The trailers end the stream, see RFC 9113 section 8.1
+		sc.sched.writeHeaders(stream.ID, stream.ResponseTrailers, true)
+	}
+	return nil
+}
+
+// openStream registers a new stream with the writer
+func (sc *h2ServerConn) openStream(stream *Stream) {
+	sc.sched.openStream(stream.ID)
+}
+
+// closeStream marks the stream as closed once both sides have sent END_STREAM
+func (sc *h2ServerConn) closeStream(stream *Stream) {
+	if stream.markClosed() {
+		sc.deactivateStream(stream.ID)
+	}
+	stream.stopTimers()
+	sc.sched.closeStream(stream.ID)
 	sc.streamManager.RemoveStream(stream.ID)
 }
 
-// sendRSTStream sends a RST_STREAM frame
+// activateStream counts a new stream against SETTINGS_MAX_CONCURRENT_STREAMS. It reports
+// false if the limit is reached by the active streams or by the running handlers.
+func (sc *h2ServerConn) activateStream() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	maxStreams := sc.serverSettings.Get(SettingMaxConcurrentStreams)
+	if sc.clientStreams >= maxStreams || sc.clientHandlers >= maxStreams {
+		return false
+	}
+	sc.clientStreams++
+	sc.activeStreams++
+	if sc.activeStreams == 1 {
+		sc.setState(StateActive)
+	}
+	return true
+}
+
+// deactivateStream is called once an active stream is closed
+func (sc *h2ServerConn) deactivateStream(streamID uint32) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	// The pushed streams count against the limit of the client
+	if streamID%2 == 0 {
+		sc.pushedStreams--
+	} else {
+		sc.clientStreams--
+	}
+	sc.activeStreams--
+	if sc.activeStreams > 0 {
+		return
+	}
+	sc.setState(StateIdle)
+	if sc.goingAway || sc.clientGoingAway {
+		// The last stream of a graceful shutdown, or since the GOAWAY of the client, is done
+		sc.sched.close(true)
+	}
+}
+
+// setState reports the state of the connection to Server.ConnState. HTTP/2 connections
+// are active while at least one stream is active.
+func (sc *h2ServerConn) setState(state ConnState) {
+	sc.setIdle(state == StateIdle)
+
+	// An upgraded connection was already reported as hijacked
+	if sc.upgradeRequest != nil {
+		return
+	}
+	if hook := sc.s.ConnState; hook != nil {
+		hook(sc.conn, state)
+	}
+}
+
+// startGracefulShutdown drains the connection in the background. It may be called
+// several times and from any goroutine.
+func (sc *h2ServerConn) startGracefulShutdown() {
+	sc.shutdownOnce.Do(func() {
+		go sc.gracefulShutdown()
+	})
+}
+
+// gracefulShutdown drains the connection as suggested by RFC 9113 section 6.8. The first
+// GOAWAY frame announces the shutdown while still accepting the streams the client may
+// have sent meanwhile. Once a PING round trip shows the client has received it, the final
+// GOAWAY frame carries the last stream that is processed. The connection is closed when
+// the remaining streams are done.
+func (sc *h2ServerConn) gracefulShutdown() {
+	sc.sendGoAway(maxStreamID, 0x0) // NO_ERROR
+	sc.sendPing(shutdownPingData)
+
+	timer := time.NewTimer(shutdownPingTimeout)
+	defer timer.Stop()
+	select {
+	case <-sc.shutdownPingAck:
+	case <-timer.C:
+	case <-sc.writerDone:
+		// The connection is already closed
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.goingAway = true
+	sc.sendGoAway(sc.maxClientStreamID, 0x0) // NO_ERROR
+	if sc.activeStreams == 0 {
+		sc.sched.close(true)
+	}
+}
+
+func (sc *h2ServerConn) isGoingAway() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.goingAway || sc.clientGoingAway
+}
+
+// resetStream aborts the stream with a RST_STREAM frame carrying errorCode
+func (sc *h2ServerConn) resetStream(stream *Stream, errorCode uint32) {
+	sc.sendRSTStream(stream.ID, errorCode)
+	stream.mu.Lock()
+	stream.resetSent = true
+	stream.mu.Unlock()
+	sc.closeStream(stream)
+}
+
+// streamEndWritten is called by the writer once END_STREAM has been sent on the stream.
+// If the client is still sending the request, the stream is reset with NO_ERROR as the
+// rest of the request is not needed anymore, see RFC 9113 section 8.1.
+func (sc *h2ServerConn) streamEndWritten(streamID uint32) {
+	stream, exists := sc.streamManager.GetStream(streamID)
+	if !exists {
+		return
+	}
+
+	stream.mu.Lock()
+	open := stream.State == StreamOpen
+	if open {
+		stream.setState(StreamHalfClosedLocal)
+	}
+	stream.mu.Unlock()
+
+	if open {
+		sc.resetStream(stream, 0x0) // NO_ERROR
+		return
+	}
+	sc.closeStream(stream)
+}
+
+// writeHeaderListTooLarge rejects a request whose headers exceed SETTINGS_MAX_HEADER_LIST_SIZE
+// with a 431 response, as allowed by RFC 9113 section 10.5.1
+func (sc *h2ServerConn) writeHeaderListTooLarge(stream *Stream) {
+	stream.Body = nil
+	stream.ResponseHeaders = append(stream.ResponseHeaders[:0], hpack.HeaderField{
+		Name:  ":status",
+		Value: strconv.Itoa(StatusRequestHeaderFieldsTooLarge),
+	})
+	stream.ResponseBody = nil
+	stream.ResponseTrailers = nil
+	if err := sc.writeResponse(stream); err != nil {
+		sc.debug.Errorf("Error writing response for stream %d: %v", stream.ID, err)
+	}
+}
+
+// writeLoop writes the frames handed out by the scheduler until it is closed. Frames are
+// batched in a buffered writer, which is flushed whenever there is nothing else to write.
+func (sc *h2ServerConn) writeLoop() {
+	defer close(sc.writerDone)
+
+	bw := sc.acquireWriter()
+	defer releaseWriter(sc.s, bw)
+
+	for {
+		w, ok := sc.sched.next(false)
+		if !ok {
+			if err := bw.Flush(); err != nil {
+				sc.debug.Errorf("Error writing to connection: %v", err)
+				break
+			}
+			if w, ok = sc.sched.next(true); !ok {
+				break
+			}
+		}
+		sc.extendWriteDeadline()
+		if err := sc.write(bw, &w); err != nil {
+			sc.debug.Errorf("Error writing to connection: %v", err)
+			break
+		}
+	}
+	bw.Flush() //nolint:errcheck
+
+	// Stop further writes and unblock the read loop
+	sc.sched.close(false)
+	sc.conn.Close()
+}
+
+// stopWriter waits for the writer to flush the pending control frames, such as GOAWAY,
+// and stops it
+func (sc *h2ServerConn) stopWriter() {
+	if sc.sched == nil {
+		return
+	}
+	sc.sched.close(true)
+	select {
+	case <-sc.writerDone:
+	case <-time.After(goAwayTimeout):
+		// The client is not reading, give up on the pending frames
+		sc.sched.close(false)
+		sc.conn.Close()
+		<-sc.writerDone
+	}
+}
+
+func (sc *h2ServerConn) acquireWriter() *bufio.Writer {
+	v := sc.s.writerPool.Get()
+	if v == nil {
+		n := sc.s.WriteBufferSize
+		if n <= 0 {
+			n = defaultWriteBufferSize
+		}
+		return bufio.NewWriterSize(sc.conn, n)
+	}
+	w := v.(*bufio.Writer)
+	w.Reset(sc.conn)
+	return w
+}
+
+// write writes a single scheduled write to w
+func (sc *h2ServerConn) write(w io.Writer, wr *h2Write) error {
+	var err error
+	if wr.frame != nil {
+		if sc.conf.Tracer != nil {
+			sc.traceFrame(wr.frame, true)
+		}
+		err = wr.frame.Write(w)
+		frames.ReleaseFrame(wr.frame)
+	} else {
+		// The encoder must not use a dynamic table larger than the client's decoder accepts
+		sc.encoder.SetMaxDynamicTableSizeLimit(wr.headerTableSize)
+		err = sc.writeHeaders(w, wr.streamID, wr.promisedID, wr.headers, wr.endStream, int(wr.maxFrameSize))
+	}
+	if err == nil && wr.endStream {
+		sc.streamEndWritten(wr.streamID)
+	}
+	return err
+}
+
+// writeHeaders encodes the header fields and writes them as a HEADERS frame, followed by
+// as many CONTINUATION frames as required by the peer's SETTINGS_MAX_FRAME_SIZE. If
+// promisedID is not 0, the block is a PUSH_PROMISE frame promising that stream.
+func (sc *h2ServerConn) writeHeaders(w io.Writer, streamID, promisedID uint32, fields []hpack.HeaderField, endStream bool, maxFrameSize int) error {
+	sc.headerBuf.Reset()
+	for _, field := range fields {
+		if err := sc.encoder.EncodeField(&sc.headerBuf, field); err != nil {
+			return err
+		}
+	}
+
+	block := sc.headerBuf.Bytes()
+	frameType := frames.FrameHeaders
+	if promisedID != 0 {
+		frameType = frames.FramePushPromise
+	}
+	for {
+		// The promised stream ID takes the first 4 bytes of a PUSH_PROMISE frame
+		var prefix int
+		if frameType == frames.FramePushPromise {
+			prefix = 4
+		}
+		chunk := block
+		if len(chunk) > maxFrameSize-prefix {
+			chunk = chunk[:maxFrameSize-prefix]
+		}
+		block = block[len(chunk):]
+
+		frame := frames.AcquireFrame(frameType)
+		frame.StreamID = streamID
+		frame.Body = frame.Body[:0]
+		if prefix > 0 {
+			frame.Body = binary.BigEndian.AppendUint32(frame.Body, promisedID)
+		}
+		frame.Body = append(frame.Body, chunk...)
+		if frameType == frames.FrameHeaders && endStream {
+			frame.Flags |= frames.FlagEndStream
+		}
+		if len(block) == 0 {
+			frame.Flags |= frames.FlagEndHeaders
+		}
+		if sc.conf.Tracer != nil {
+			sc.traceFrame(frame, true)
+		}
+		err := frame.Write(w)
+		frames.ReleaseFrame(frame)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		frameType = frames.FrameContinuation
+	}
+}
+
+// sendWindowUpdate sends a WINDOW_UPDATE frame granting increment bytes of credit
+func (sc *h2ServerConn) sendWindowUpdate(streamID uint32, increment uint32) {
+	frame := frames.AcquireFrame(frames.FrameWindowUpdate)
+	frame.StreamID = streamID
+	frame.Body = frame.Body[:4]
+	binary.BigEndian.PutUint32(frame.Body, increment)
+	sc.sched.writeControl(frame)
+}
+
+// sendRSTStream sends a RST_STREAM frame, discarding the pending writes of the stream
 func (sc *h2ServerConn) sendRSTStream(streamID uint32, errorCode uint32) {
 	frame := frames.AcquireFrame(frames.FrameRSTStream)
-	defer frames.ReleaseFrame(frame)
 	frame.StreamID = streamID
-	frame.Body = make([]byte, 4)
+	frame.Body = frame.Body[:4]
 	binary.BigEndian.PutUint32(frame.Body, errorCode)
-	if err := frame.WriteTo(sc.conn); err != nil {
-		log.Println("Error sending RST_STREAM frame:", err)
-	}
+	sc.sched.resetStream(streamID, frame)
+}
+
+// sendPing sends a PING frame, the client answers it with an ACK carrying the same data
+func (sc *h2ServerConn) sendPing(data [8]byte) {
+	frame := frames.AcquireFrame(frames.FramePing)
+	frame.Body = append(frame.Body[:0], data[:]...)
+	sc.sched.writeControl(frame)
 }
 
 // sendGoAway sends a GOAWAY frame
 func (sc *h2ServerConn) sendGoAway(lastStreamID uint32, errorCode uint32) {
 	frame := frames.AcquireFrame(frames.FrameGoAway)
-	defer frames.ReleaseFrame(frame)
-	frame.Body = make([]byte, 8)
+	frame.Body = frame.Body[:8]
 	binary.BigEndian.PutUint32(frame.Body[:4], lastStreamID)
 	binary.BigEndian.PutUint32(frame.Body[4:], errorCode)
-	if err := frame.WriteTo(sc.conn); err != nil {
-		log.Println("Error sending GOAWAY frame:", err)
-	}
+	sc.sched.writeControl(frame)
 }
 
-// closeConnection closes the connection and releases resources
+// closeConnection closes the connection and releases resources. The pending
+// control frames are still written before the connection is closed.
 func (sc *h2ServerConn) closeConnection() {
-	// Close the connection
-	sc.conn.Close()
+	// Stop the writer once it has flushed the control frames, which closes the connection
+	sc.sched.close(true)
 
 	// Clean up resources
-	for current := sc.streamManager.head; current != nil; current = current.next {
-		sc.streamManager.RemoveStream(current.ID)
-	}
-	log.Println("Connection closed and resources released")
+	sc.streamManager.Clear()
 }
 
-// sendSettings sends a SETTINGS frame
-func sendSettings(conn net.Conn, settings Settings) error {
+// sendSettings sends our SETTINGS frame
+func (sc *h2ServerConn) sendSettings() error {
 	frame := frames.AcquireFrame(frames.FrameSettings)
-	defer frames.ReleaseFrame(frame)
 
-	err := settings.PutParams(&frame.Body)
+	err := sc.serverSettings.PutParams(&frame.Body)
 	if err != nil {
+		frames.ReleaseFrame(frame)
 		return fmt.Errorf("error putting serverSettings params: %v", err)
 	}
 
-	return frame.WriteTo(conn)
+	sc.sched.writeControl(frame)
+	return nil
 }
 
-// applySettings applies the received serverSettings
-func applySettings(frame *frames.Frame, settings *Settings) {
-	offset := 0
-	for offset < len(frame.Body) {
+// maxFrameSizeLimit is the largest SETTINGS_MAX_FRAME_SIZE allowed by RFC 9113 section 6.5.2
+const maxFrameSizeLimit = 1<<24 - 1
+
+// applySettings applies the parameters of a SETTINGS frame to settings, validating them
+// as required by RFC 9113 section 6.5.2. Unknown parameters are ignored.
+func applySettings(frame *frames.Frame, settings *Settings) error {
+	if len(frame.Body)%6 != 0 {
+		return h2ConnError{code: 0x6, reason: "invalid SETTINGS frame size"} // FRAME_SIZE_ERROR
+	}
+
+	for offset := 0; offset < len(frame.Body); offset += 6 {
 		id := binary.BigEndian.Uint16(frame.Body[offset : offset+2])
 		value := binary.BigEndian.Uint32(frame.Body[offset+2 : offset+6])
+		switch id {
+		case SettingEnablePush:
+			if value > 1 {
+				return h2ConnError{code: 0x1, reason: fmt.Sprintf("invalid SETTINGS_ENABLE_PUSH: %d", value)} // PROTOCOL_ERROR
+			}
+		case SettingEnableConnectProtocol:
+			if value > 1 {
+				return h2ConnError{code: 0x1, reason: fmt.Sprintf("invalid SETTINGS_ENABLE_CONNECT_PROTOCOL: %d", value)} // PROTOCOL_ERROR
+			}
+		case SettingNoRFC7540Priorities:
+			if value > 1 {
+				return h2ConnError{code: 0x1, reason: fmt.Sprintf("invalid SETTINGS_NO_RFC7540_PRIORITIES: %d", value)} // PROTOCOL_ERROR
+			}
+		case SettingInitialWindowSize:
+			if value > maxWindowSize {
+				return h2ConnError{code: 0x3, reason: fmt.Sprintf("invalid SETTINGS_INITIAL_WINDOW_SIZE: %d", value)} // FLOW_CONTROL_ERROR
+			}
+		case SettingMaxFrameSize:
+			if value < DefaultMaxFrameSize || value > maxFrameSizeLimit {
+				return h2ConnError{code: 0x1, reason: fmt.Sprintf("invalid SETTINGS_MAX_FRAME_SIZE: %d", value)} // PROTOCOL_ERROR
+			}
+		}
 		settings.Set(id, value)
-		offset += 6
 	}
+	return nil
 }
 
-// sendSettingsAck sends a SETTINGS ACK frame
-func sendSettingsAck(conn net.Conn) error {
+// applyClientSettings applies the settings announced by the client and propagates
+// them to the connection state that depends on them
+func (sc *h2ServerConn) applyClientSettings(frame *frames.Frame) error {
+	if err := applySettings(frame, &sc.clientSettings); err != nil {
+		return err
+	}
+
+	// The writer applies the new header table size, frame size and initial window size
+	// to the frames written after the SETTINGS ACK
+	if !sc.sched.applySettings(&sc.clientSettings) {
+		return h2ConnError{code: 0x3, reason: "stream flow control window overflow"} // FLOW_CONTROL_ERROR
+	}
+
+	// The pushed streams count against the client's SETTINGS_MAX_CONCURRENT_STREAMS,
+	// and against ours as they are handled like the client streams
+	maxPushed := sc.clientSettings.Get(SettingMaxConcurrentStreams)
+	if n := sc.serverSettings.Get(SettingMaxConcurrentStreams); n < maxPushed {
+		maxPushed = n
+	}
+	sc.mu.Lock()
+	sc.pushEnabled = sc.clientSettings.Get(SettingEnablePush) == 1
+	sc.maxPushedStreams = maxPushed
+	sc.mu.Unlock()
+	return nil
+}
+
+// applyUpgradeSettings applies the settings of the HTTP2-Settings header as if they
+// were received in a SETTINGS frame
+func (sc *h2ServerConn) applyUpgradeSettings() error {
 	frame := frames.AcquireFrame(frames.FrameSettings)
 	defer frames.ReleaseFrame(frame)
+	frame.Body = append(frame.Body[:0], sc.upgradeSettings...)
+
+	if err := sc.applyClientSettings(frame); err != nil {
+		sc.settingsError(err)
+		return err
+	}
+	return nil
+}
+
+// settingsError closes the connection after invalid settings, with the error code
+// of the h2ConnError returned by applyClientSettings
+func (sc *h2ServerConn) settingsError(err error) {
+	var connErr h2ConnError
+	errorCode := uint32(0x1) // PROTOCOL_ERROR
+	if errors.As(err, &connErr) {
+		errorCode = connErr.code
+	}
+	sc.connError(err, errorCode)
+}
+
+// sendSettingsAck sends a SETTINGS ACK frame
+func (sc *h2ServerConn) sendSettingsAck() {
+	frame := frames.AcquireFrame(frames.FrameSettings)
 	frame.Flags = frames.FlagAck // ACK flag
-	return frame.WriteTo(conn)
+	sc.sched.writeControl(frame)
 }
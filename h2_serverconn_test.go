@@ -0,0 +1,336 @@
+package fns
+
+import (
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func (cl *h2TestClient) expectGoAway(code http2.ErrCode) {
+	cl.t.Helper()
+
+	f := cl.readFrame()
+	if gf, ok := f.(*http2.GoAwayFrame); !ok || gf.ErrCode != code {
+		cl.t.Fatalf("expected GOAWAY with %v, got %v", code, f)
+	}
+}
+
+func (cl *h2TestClient) expectRSTStream(streamID uint32, code http2.ErrCode) {
+	cl.t.Helper()
+
+	f := cl.readFrame()
+	if rf, ok := f.(*http2.RSTStreamFrame); !ok || rf.StreamID != streamID || rf.ErrCode != code {
+		cl.t.Fatalf("expected RST_STREAM on stream %d with %v, got %v", streamID, code, f)
+	}
+}
+
+func newH2StateTestClient(t *testing.T) *h2TestClient {
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetBodyString(strconv.Itoa(len(ctx.PostBody())))
+	})
+	cl.fr.AllowIllegalWrites = true
+	return cl
+}
+
+var h2TestRequest = []string{":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/"}
+
+func TestH2ServerConnectionErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		code http2.ErrCode
+		send func(cl *h2TestClient) error
+	}{
+		{"DATA on idle stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteData(1, true, []byte("data"))
+		}},
+		{"DATA on stream 0", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteData(0, true, []byte("data"))
+		}},
+		{"HEADERS on even stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(2, true, h2TestRequest...)
+			return nil
+		}},
+		{"HEADERS on lower stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(5, true, h2TestRequest...)
+			cl.readResponse(5)
+			cl.writeRequest(3, true, h2TestRequest...)
+			return nil
+		}},
+		{"CONTINUATION without HEADERS", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteContinuation(1, true, cl.encodeHeaders(h2TestRequest...))
+		}},
+		{"frame interleaved in header block", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			err := cl.fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: cl.encodeHeaders(h2TestRequest...),
+				EndStream:     true,
+			})
+			if err != nil {
+				return err
+			}
+			return cl.fr.WritePing(false, [8]byte{})
+		}},
+		{"CONTINUATION on another stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			err := cl.fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: cl.encodeHeaders(h2TestRequest...),
+				EndStream:     true,
+			})
+			if err != nil {
+				return err
+			}
+			return cl.fr.WriteContinuation(3, true, nil)
+		}},
+		{"SETTINGS with invalid size", http2.ErrCodeFrameSize, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FrameSettings, 0, 0, make([]byte, 5))
+		}},
+		{"SETTINGS ACK with payload", http2.ErrCodeFrameSize, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FrameSettings, http2.FlagSettingsAck, 0, make([]byte, 6))
+		}},
+		{"SETTINGS on a stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FrameSettings, 0, 1, nil)
+		}},
+		{"invalid SETTINGS_ENABLE_PUSH", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 2})
+		}},
+		{"invalid SETTINGS_INITIAL_WINDOW_SIZE", http2.ErrCodeFlowControl, func(cl *h2TestClient) error {
+			return cl.fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 31})
+		}},
+		{"invalid SETTINGS_MAX_FRAME_SIZE", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: 16383})
+		}},
+		{"PING with invalid size", http2.ErrCodeFrameSize, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FramePing, 0, 0, make([]byte, 6))
+		}},
+		{"PING on a stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FramePing, 0, 1, make([]byte, 8))
+		}},
+		{"RST_STREAM on idle stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRSTStream(1, http2.ErrCodeCancel)
+		}},
+		{"RST_STREAM on stream 0", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRSTStream(0, http2.ErrCodeCancel)
+		}},
+		{"WINDOW_UPDATE on idle stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteWindowUpdate(1, 1)
+		}},
+		{"PRIORITY on stream 0", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WritePriority(0, http2.PriorityParam{StreamDep: 1})
+		}},
+		{"PRIORITY_UPDATE on a stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(0x10, 0, 1, []byte{0, 0, 0, 1, 'i'})
+		}},
+		{"PRIORITY_UPDATE for stream 0", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(0x10, 0, 0, []byte{0, 0, 0, 0, 'i'})
+		}},
+		{"PRIORITY_UPDATE for unpromised stream", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(0x10, 0, 0, []byte{0, 0, 0, 2, 'i'})
+		}},
+		{"PRIORITY_UPDATE with invalid size", http2.ErrCodeFrameSize, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(0x10, 0, 0, []byte{0, 0, 1})
+		}},
+		{"invalid SETTINGS_NO_RFC7540_PRIORITIES", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WriteSettings(http2.Setting{ID: 0x9, Val: 2})
+		}},
+		{"PUSH_PROMISE from client", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 2, EndHeaders: true})
+		}},
+		{"frame larger than the max frame size", http2.ErrCodeFrameSize, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FramePing, 0, 0, make([]byte, DefaultMaxFrameSize+1))
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cl := newH2StateTestClient(t)
+			if err := tc.send(cl); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.expectGoAway(tc.code)
+		})
+	}
+}
+
+func TestH2ServerStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		code http2.ErrCode
+		send func(cl *h2TestClient) error
+	}{
+		{"DATA on closed stream", http2.ErrCodeStreamClosed, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, h2TestRequest...)
+			cl.readResponse(1)
+			return cl.fr.WriteData(1, true, []byte("data"))
+		}},
+		{"uppercase header name", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, append(h2TestRequest, "X-Upper", "1")...)
+			return nil
+		}},
+		{"missing :path", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost")
+			return nil
+		}},
+		{"empty :path", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "")
+			return nil
+		}},
+		{"duplicate pseudo-header", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, append(h2TestRequest, ":path", "/")...)
+			return nil
+		}},
+		{"unknown pseudo-header", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, append([]string{":status", "200"}, h2TestRequest...)...)
+			return nil
+		}},
+		{"pseudo-header after regular header", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", "x-test", "1", ":path", "/")
+			return nil
+		}},
+		{"connection-specific header", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, append(h2TestRequest, "connection", "keep-alive")...)
+			return nil
+		}},
+		{"TE other than trailers", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, true, append(h2TestRequest, "te", "gzip")...)
+			return nil
+		}},
+		{"body longer than content-length", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, false, append(h2TestRequest, "content-length", "1")...)
+			return cl.fr.WriteData(1, true, []byte("data"))
+		}},
+		{"body shorter than content-length", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, false, append(h2TestRequest, "content-length", "10")...)
+			return cl.fr.WriteData(1, true, []byte("data"))
+		}},
+		{"trailers without END_STREAM", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, false, h2TestRequest...)
+			cl.writeRequest(1, false, "x-trailer", "1")
+			return nil
+		}},
+		{"pseudo-header in trailers", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			cl.writeRequest(1, false, h2TestRequest...)
+			cl.writeRequest(1, true, ":path", "/")
+			return nil
+		}},
+		{"self-dependent PRIORITY", http2.ErrCodeProtocol, func(cl *h2TestClient) error {
+			return cl.fr.WritePriority(1, http2.PriorityParam{StreamDep: 1})
+		}},
+		{"PRIORITY with invalid size", http2.ErrCodeFrameSize, func(cl *h2TestClient) error {
+			return cl.fr.WriteRawFrame(http2.FramePriority, 0, 1, make([]byte, 4))
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cl := newH2StateTestClient(t)
+			if err := tc.send(cl); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.expectRSTStream(1, tc.code)
+
+			// Stream errors leave the connection usable
+			cl.writeRequest(3, true, h2TestRequest...)
+			resp := cl.readResponse(3)
+			if v := resp.header(":status"); v != "200" {
+				t.Fatalf("unexpected status %q", v)
+			}
+		})
+	}
+}
+
+func TestH2ServerFramesAfterReset(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		reset func(cl *h2TestClient) error
+	}{
+		{"malformed request", func(cl *h2TestClient) error {
+			cl.writeRequest(1, false, append(h2TestRequest, "X-Upper", "1")...)
+			return nil
+		}},
+		{"malformed body", func(cl *h2TestClient) error {
+			cl.writeRequest(1, false, append(h2TestRequest, "content-length", "1")...)
+			return cl.fr.WriteData(1, false, []byte("data"))
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cl := newH2StateTestClient(t)
+			if err := tc.reset(cl); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.expectRSTStream(1, http2.ErrCodeProtocol)
+
+			// The client may not have received the RST_STREAM frame yet, the rest of
+			// the request is ignored
+			if err := cl.fr.WriteData(1, false, []byte("more")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cl.writeRequest(1, true, "x-trailer", "1")
+			cl.expectNoFrame()
+
+			cl.writeRequest(3, true, h2TestRequest...)
+			resp := cl.readResponse(3)
+			if v := resp.header(":status"); v != "200" {
+				t.Fatalf("unexpected status %q", v)
+			}
+		})
+	}
+}
+
+func TestH2ServerStreamStates(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2StateTestClient(t)
+
+	// Unknown frame types and PRIORITY frames on idle streams are ignored
+	if err := cl.fr.WriteRawFrame(0xff, 0, 0, []byte("unknown")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.fr.WritePriority(7, http2.PriorityParam{StreamDep: 0, Weight: 15}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.expectNoFrame()
+
+	// A request body followed by trailers
+	cl.writeRequest(1, false, append(h2TestRequest, "content-length", "4")...)
+	if err := cl.fr.WriteData(1, false, []byte("data")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.writeRequest(1, true, "x-trailer", "1")
+	resp := cl.readResponse(1)
+	if string(resp.body) != "4" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+
+	// The header block can be split in CONTINUATION frames
+	block := cl.encodeHeaders(h2TestRequest...)
+	err := cl.fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: block[:2], EndStream: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.fr.WriteContinuation(3, false, block[2:4]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cl.fr.WriteContinuation(3, true, block[4:]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp = cl.readResponse(3)
+	if string(resp.body) != "0" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+
+	// A HEADERS frame on a closed stream can't open it again
+	cl.writeRequest(1, true, h2TestRequest...)
+	cl.expectGoAway(http2.ErrCodeProtocol)
+}
@@ -13,16 +13,26 @@ const (
 	SettingInitialWindowSize    uint16 = 0x4
 	SettingMaxFrameSize         uint16 = 0x5
 	SettingMaxHeaderListSize    uint16 = 0x6
+
+	// SettingEnableConnectProtocol announces the support of the extended CONNECT
+	// method, see RFC 8441 section 3
+	SettingEnableConnectProtocol uint16 = 0x8
+
+	// SettingNoRFC7540Priorities announces that the RFC 7540 priority signals are
+	// ignored, see RFC 9218 section 2.1
+	SettingNoRFC7540Priorities uint16 = 0x9
 )
 
 // Default HTTP/2 serverSettings values as per RFC 9113
 const (
-	DefaultHeaderTableSize      = 4096
-	DefaultEnablePush           = 1
-	DefaultMaxConcurrentStreams = 0
-	DefaultInitialWindowSize    = 65535
-	DefaultMaxFrameSize         = 16384
-	DefaultMaxHeaderListSize    = 0
+	DefaultHeaderTableSize       = 4096
+	DefaultEnablePush            = 1
+	DefaultMaxConcurrentStreams  = 0
+	DefaultInitialWindowSize     = 65535
+	DefaultMaxFrameSize          = 16384
+	DefaultMaxHeaderListSize     = 0
+	DefaultEnableConnectProtocol = 0
+	DefaultNoRFC7540Priorities   = 0
 )
 
 // ProtocolDefaultSettings defines the default values for HTTP/2 serverSettings
@@ -34,16 +44,21 @@ var ProtocolDefaultSettings = [...]uint32{
 	DefaultInitialWindowSize,
 	DefaultMaxFrameSize,
 	DefaultMaxHeaderListSize,
+	0, // Unassigned
+	DefaultEnableConnectProtocol,
+	DefaultNoRFC7540Priorities,
 }
 
 // Settings defines the structure for HTTP/2 serverSettings
 type Settings struct {
-	headerTableSize      uint32
-	enablePush           uint32
-	maxConcurrentStreams uint32
-	initialWindowSize    uint32
-	maxFrameSize         uint32
-	maxHeaderListSize    uint32
+	headerTableSize       uint32
+	enablePush            uint32
+	maxConcurrentStreams  uint32
+	initialWindowSize     uint32
+	maxFrameSize          uint32
+	maxHeaderListSize     uint32
+	enableConnectProtocol uint32
+	noRFC7540Priorities   uint32
 }
 
 var ErrShortBuffer = errors.New("short buffer")
@@ -51,12 +66,14 @@ var ErrShortBuffer = errors.New("short buffer")
 // NewSettings creates a Settings object with protocol default values
 func NewSettings() Settings {
 	return Settings{
-		headerTableSize:      ProtocolDefaultSettings[SettingHeaderTableSize],
-		enablePush:           ProtocolDefaultSettings[SettingEnablePush],
-		maxConcurrentStreams: ProtocolDefaultSettings[SettingMaxConcurrentStreams],
-		initialWindowSize:    ProtocolDefaultSettings[SettingInitialWindowSize],
-		maxFrameSize:         ProtocolDefaultSettings[SettingMaxFrameSize],
-		maxHeaderListSize:    ProtocolDefaultSettings[SettingMaxHeaderListSize],
+		headerTableSize:       ProtocolDefaultSettings[SettingHeaderTableSize],
+		enablePush:            ProtocolDefaultSettings[SettingEnablePush],
+		maxConcurrentStreams:  ProtocolDefaultSettings[SettingMaxConcurrentStreams],
+		initialWindowSize:     ProtocolDefaultSettings[SettingInitialWindowSize],
+		maxFrameSize:          ProtocolDefaultSettings[SettingMaxFrameSize],
+		maxHeaderListSize:     ProtocolDefaultSettings[SettingMaxHeaderListSize],
+		enableConnectProtocol: ProtocolDefaultSettings[SettingEnableConnectProtocol],
+		noRFC7540Priorities:   ProtocolDefaultSettings[SettingNoRFC7540Priorities],
 	}
 }
 
@@ -75,12 +92,16 @@ func (s *Settings) Set(id uint16, value uint32) {
 		s.maxFrameSize = value
 	case SettingMaxHeaderListSize:
 		s.maxHeaderListSize = value
+	case SettingEnableConnectProtocol:
+		s.enableConnectProtocol = value
+	case SettingNoRFC7540Priorities:
+		s.noRFC7540Priorities = value
 	}
 }
 
 // Count returns the number of serverSettings
 func (s *Settings) Count() int {
-	return 6
+	return 8
 }
 
 // Get returns the value of a specific setting by its identifier
@@ -98,6 +119,10 @@ func (s *Settings) Get(id uint16) uint32 {
 		return s.maxFrameSize
 	case SettingMaxHeaderListSize:
 		return s.maxHeaderListSize
+	case SettingEnableConnectProtocol:
+		return s.enableConnectProtocol
+	case SettingNoRFC7540Priorities:
+		return s.noRFC7540Priorities
 	default:
 		return 0
 	}
@@ -105,11 +130,11 @@ func (s *Settings) Get(id uint16) uint32 {
 
 // PutParams puts the non-defaul serverSettings into the body of a frame
 func (s *Settings) PutParams(body *[]byte) error {
-	if cap(*body) < 36 {
+	if cap(*body) < 48 {
 		return ErrShortBuffer
 	}
 
-	*body = (*body)[:36] // Adjust slice to required length
+	*body = (*body)[:48] // Adjust slice to required length
 
 	// Define serverSettings parameters
 	settingsParams := []struct {
@@ -122,6 +147,8 @@ func (s *Settings) PutParams(body *[]byte) error {
 		{SettingInitialWindowSize, s.initialWindowSize},
 		{SettingMaxFrameSize, s.maxFrameSize},
 		{SettingMaxHeaderListSize, s.maxHeaderListSize},
+		{SettingEnableConnectProtocol, s.enableConnectProtocol},
+		{SettingNoRFC7540Priorities, s.noRFC7540Priorities},
 	}
 
 	// Initialize an index
@@ -129,7 +156,7 @@ func (s *Settings) PutParams(body *[]byte) error {
 
 	// Put each setting into frame.Body one-by-one
 	for _, param := range settingsParams {
-		if int(param.id) <= len(ProtocolDefaultSettings) && ProtocolDefaultSettings[param.id] != param.value {
+		if int(param.id) < len(ProtocolDefaultSettings) && ProtocolDefaultSettings[param.id] != param.value {
 			binary.BigEndian.PutUint16((*body)[index:], param.id)
 			index += 2
 			binary.BigEndian.PutUint32((*body)[index:], param.value)
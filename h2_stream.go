@@ -1,9 +1,8 @@
 package fns
 
 import (
-	"log"
-	"sort"
 	"sync"
+	"time"
 
 	"github.com/pablolagos/fns/internal/hpack"
 )
@@ -17,6 +16,10 @@ const (
 	StreamHalfClosedLocal
 	StreamHalfClosedRemote
 	StreamClosed
+
+	// The reserved states are only entered by pushed streams
+	StreamReservedLocal
+	StreamReservedRemote
 )
 
 // Stream represents an HTTP/2 stream
@@ -24,68 +27,126 @@ type Stream struct {
 	ID              uint32
 	State           StreamState
 	Body            []byte
-	Window          int32
-	Priority        uint8
 	Headers         []hpack.HeaderField
 	ResponseHeaders []hpack.HeaderField
 	ResponseBody    []byte
-	next            *Stream
-	prev            *Stream
-	mu              sync.Mutex
-	conn            *h2ServerConn
+
+	// ResponseTrailers are sent in a final HEADERS frame after the response body
+	ResponseTrailers []hpack.HeaderField
+	mu               sync.Mutex
+	conn             *h2ServerConn
+
+	// Trailers holds the trailer fields sent by the client after the request body
+	Trailers []hpack.HeaderField
+
+	// contentLength is the declared length of the request body, or -1 if unknown.
+	// bodyLength is the length received so far.
+	contentLength int64
+	bodyLength    int64
+
+	// handled is true once the handler has been started or a response queued
+	handled bool
+
+	// inflow is the window granted to the client for sending request data
+	inflow inflow
+
+	// active is true while the stream counts against SETTINGS_MAX_CONCURRENT_STREAMS
+	active bool
+
+	// resetSent is set once the server reset the stream with a RST_STREAM frame
+	resetSent bool
+
+	// readTimer and writeTimer enforce the read and write timeouts of the stream
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+
+	// requestNum is the sequence number of the request on the connection
+	requestNum uint64
+
+	// done is closed once the stream is closed, after which the writer no longer
+	// references the response
+	done chan struct{}
+
+	// body streams the request body to the handler if Server.StreamRequestBody is set,
+	// otherwise the body is collected in Body
+	body *h2RequestBody
+
+	// connectProtocol is the :protocol of an extended CONNECT request, see RFC 8441.
+	// Its body is always streamed, as the stream becomes a tunnel once accepted.
+	connectProtocol string
+
+	// bodyErr is set if the request body is rejected, the handler is replaced
+	// by the error response and the data still received is discarded
+	bodyErr error
+
+	// Priority schedules the response among the other streams of the connection.
+	// extensiblePriority is set once it was signaled with RFC 9218, which takes
+	// precedence over the RFC 7540 signals.
+	Priority           Priority
+	extensiblePriority bool
 }
 
-// AdjustWindow adjusts the flow control window for the stream
-func (s *Stream) AdjustWindow(delta int32) {
+// markClosed moves the stream to the closed state. It reports whether the stream was
+// active, and does nothing if the stream is already closed.
+func (s *Stream) markClosed() (wasActive bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.Window += delta
-	if s.Window < 0 {
-		// Handle window underflow
-		s.conn.handleWindowUnderflow(s)
+
+	if s.State == StreamClosed {
+		return false
+	}
+	s.setState(StreamClosed)
+	close(s.done)
+	if s.body != nil {
+		s.body.closeWithError(errH2StreamClosed)
 	}
+	wasActive = s.active
+	s.active = false
+	return wasActive
 }
 
-// UpdatePriority updates the priority of the stream
-func (s *Stream) UpdatePriority(priority uint8) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.Priority = priority
-}
+// maxClosedStreams bounds the number of closed streams remembered by a StreamManager
+const maxClosedStreams = 128
 
-// StreamManager manages active streams
+// StreamManager tracks the streams of a connection until they are closed. It also
+// remembers the most recently closed streams, so that the frames still in flight for a
+// stream reset by the server can be told apart from a client misbehaving.
 type StreamManager struct {
-	mu    sync.Mutex
-	head  *Stream
-	tail  *Stream
-	count int
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+
+	// closed records how the last closed streams ended, keyed by stream ID. closedIDs
+	// holds the same IDs in closing order, as a ring of maxClosedStreams entries.
+	closed     map[uint32]bool
+	closedIDs  []uint32
+	closedNext int
 }
 
 // NewStreamManager creates a new StreamManager
 func NewStreamManager() *StreamManager {
-	return &StreamManager{}
+	return &StreamManager{
+		streams: make(map[uint32]*Stream),
+		closed:  make(map[uint32]bool),
+	}
 }
 
 // CreateStream creates a new stream and adds it to the manager
 func (sm *StreamManager) CreateStream(streamID uint32, conn *h2ServerConn) *Stream {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
 	stream := &Stream{
 		ID:   streamID,
 		conn: conn,
-	}
+		done: make(chan struct{}),
 
-	if sm.tail == nil {
-		sm.head = stream
-		sm.tail = stream
-	} else {
-		sm.tail.next = stream
-		stream.prev = sm.tail
-		sm.tail = stream
+		contentLength: -1,
+		Priority:      defaultPriority,
 	}
+	stream.inflow.init(int32(conn.serverSettings.Get(SettingInitialWindowSize)))
+	conn.openStream(stream)
 
-	sm.count++
+	sm.mu.Lock()
+	sm.streams[streamID] = stream
+	sm.mu.Unlock()
+	IncrementStreams()
 	return stream
 }
 
@@ -94,87 +155,93 @@ func (sm *StreamManager) GetStream(streamID uint32) (*Stream, bool) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for stream := sm.head; stream != nil; stream = stream.next {
-		if stream.ID == streamID {
-			return stream, true
-		}
-	}
-	return nil, false
+	stream, ok := sm.streams[streamID]
+	return stream, ok
 }
 
-// RemoveStream removes a stream by its ID
+// RemoveStream removes a stream by its ID and remembers it as closed
 func (sm *StreamManager) RemoveStream(streamID uint32) {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	for stream := sm.head; stream != nil; stream = stream.next {
-		if stream.ID == streamID {
-			if stream.prev != nil {
-				stream.prev.next = stream.next
-			} else {
-				sm.head = stream.next
-			}
-
-			if stream.next != nil {
-				stream.next.prev = stream.prev
-			} else {
-				sm.tail = stream.prev
-			}
-
-			sm.count--
-			break
-		}
+	stream, ok := sm.streams[streamID]
+	if !ok {
+		sm.mu.Unlock()
+		return
 	}
+	delete(sm.streams, streamID)
+	stream.mu.Lock()
+	reset := stream.resetSent
+	stream.mu.Unlock()
+	sm.recordClosed(streamID, reset)
+	sm.mu.Unlock()
+
+	DecrementStreams()
 }
 
-// UpdateStreamState updates the state of a stream
-func (sm *StreamManager) UpdateStreamState(id uint32, state StreamState) {
+// StreamReset remembers a stream reset by the server before being created, such as a
+// malformed or refused request
+func (sm *StreamManager) StreamReset(streamID uint32) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for current := sm.head; current != nil; current = current.next {
-		if current.ID == id {
-			current.State = state
-			return
-		}
+	if _, ok := sm.streams[streamID]; !ok {
+		sm.recordClosed(streamID, true)
 	}
 }
 
-// ScheduleStreams schedules the streams based on their priority
-func (sm *StreamManager) ScheduleStreams() []*Stream {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	// Gather all streams and sort by priority
-	var streams []*Stream
-	for current := sm.head; current != nil; current = current.next {
-		streams = append(streams, current)
+// recordClosed adds a closed stream, forgetting the oldest one beyond maxClosedStreams.
+// sm.mu must be held.
+func (sm *StreamManager) recordClosed(streamID uint32, reset bool) {
+	if _, ok := sm.closed[streamID]; ok {
+		sm.closed[streamID] = reset
+		return
 	}
+	if len(sm.closedIDs) < maxClosedStreams {
+		sm.closedIDs = append(sm.closedIDs, streamID)
+	} else {
+		delete(sm.closed, sm.closedIDs[sm.closedNext])
+		sm.closedIDs[sm.closedNext] = streamID
+		sm.closedNext = (sm.closedNext + 1) % maxClosedStreams
+	}
+	sm.closed[streamID] = reset
+}
 
-	// Sort streams by priority
-	sort.Slice(streams, func(i, j int) bool {
-		return streams[i].Priority < streams[j].Priority
-	})
+// Closed reports whether the stream is one of the recently closed streams, and whether
+// it was closed by a RST_STREAM frame sent by the server
+func (sm *StreamManager) Closed(streamID uint32) (recent, reset bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	return streams
+	reset, recent = sm.closed[streamID]
+	return recent, reset
 }
 
-// ProcessStreams processes the streams based on their scheduled order
-func (sm *StreamManager) ProcessStreams() {
-	streams := sm.ScheduleStreams()
+// Clear closes and removes all the streams
+func (sm *StreamManager) Clear() {
+	sm.mu.Lock()
+	streams := sm.streams
+	sm.streams = make(map[uint32]*Stream)
+	sm.mu.Unlock()
 
+	// The streams are closed outside of the lock, closing the request bodies wakes up
+	// handlers that may look up streams
 	for _, stream := range streams {
-		// Process each stream based on its priority
-		log.Printf("Processing stream %d with priority %d\n", stream.ID, stream.Priority)
-		// Here you would add the logic to handle the actual stream data,
-		// for example, reading data from the stream, writing data to the stream,
-		// handling flow control, etc.
+		stream.markClosed()
+		DecrementStreams()
+	}
+}
+
+// UpdateStreamState updates the state of a stream
+func (sm *StreamManager) UpdateStreamState(id uint32, state StreamState) {
+	if stream, ok := sm.GetStream(id); ok {
+		stream.mu.Lock()
+		stream.setState(state)
+		stream.mu.Unlock()
 	}
 }
 
-// Count returns the number of active streams
+// Count returns the number of streams not closed yet
 func (sm *StreamManager) Count() int {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	return sm.count
+	return len(sm.streams)
 }
@@ -0,0 +1,75 @@
+package fns
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestStreamManager(t *testing.T) {
+	t.Parallel()
+
+	sc := &h2ServerConn{sched: newTestWriteScheduler(DefaultInitialWindowSize)}
+	sm := NewStreamManager()
+	totalStreams := atomic.LoadInt64(&metrics.totalStreams)
+
+	for id := uint32(1); id <= 5; id += 2 {
+		sm.CreateStream(id, sc)
+	}
+	if n := sm.Count(); n != 3 {
+		t.Fatalf("unexpected stream count %d", n)
+	}
+	if n := atomic.LoadInt64(&metrics.totalStreams) - totalStreams; n < 3 {
+		t.Fatalf("expected the total streams to grow by 3, got %d", n)
+	}
+	stream, ok := sm.GetStream(3)
+	if !ok || stream.ID != 3 {
+		t.Fatalf("expected stream 3, got %v", stream)
+	}
+
+	stream.resetSent = true
+	sm.RemoveStream(3)
+	sm.RemoveStream(1)
+	if _, ok := sm.GetStream(3); ok {
+		t.Fatalf("unexpected stream 3 after its removal")
+	}
+	if recent, reset := sm.Closed(3); !recent || !reset {
+		t.Fatalf("expected stream 3 closed by a reset, got %v %v", recent, reset)
+	}
+	if recent, reset := sm.Closed(1); !recent || reset {
+		t.Fatalf("expected stream 1 closed without reset, got %v %v", recent, reset)
+	}
+	if recent, _ := sm.Closed(5); recent {
+		t.Fatalf("unexpected closed stream 5")
+	}
+
+	// A stream reset before it was created is remembered too
+	sm.StreamReset(7)
+	if recent, reset := sm.Closed(7); !recent || !reset {
+		t.Fatalf("expected stream 7 closed by a reset, got %v %v", recent, reset)
+	}
+
+	// Only the last closed streams are remembered
+	for id := uint32(9); id < 9+2*maxClosedStreams; id += 2 {
+		sm.StreamReset(id)
+	}
+	if recent, _ := sm.Closed(3); recent {
+		t.Fatalf("unexpected closed stream 3 beyond the retention limit")
+	}
+	if recent, _ := sm.Closed(7 + 2*maxClosedStreams); !recent {
+		t.Fatalf("expected the last stream to be remembered")
+	}
+	if n := len(sm.closed); n != maxClosedStreams {
+		t.Fatalf("unexpected number of closed streams %d", n)
+	}
+
+	stream, _ = sm.GetStream(5)
+	sm.Clear()
+	select {
+	case <-stream.done:
+	default:
+		t.Fatalf("expected stream 5 to be closed")
+	}
+	if n := sm.Count(); n != 0 {
+		t.Fatalf("unexpected stream count %d after Clear", n)
+	}
+}
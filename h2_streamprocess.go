@@ -1,7 +1,11 @@
 package fns
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pablolagos/fns/internal/hpack"
 )
@@ -14,87 +18,421 @@ func NewStreamProcessor() *StreamProcessor {
 	return &StreamProcessor{}
 }
 
-// ProcessStream processes a completed HTTP/2 stream
+// ProcessStream processes a completed HTTP/2 stream. It runs in the goroutine
+// started for the stream and returns once the stream is closed.
 func (sp *StreamProcessor) ProcessStream(stream *Stream, s *Server) {
-	// Create a new RequestCtx
-	ctx := &RequestCtx{}
+	sc := stream.conn
+
+	// Take a RequestCtx from the server pool, bound to the connection
+	ctx := s.acquireCtx(sc.conn)
+	ctx.connID = sc.connID
+	ctx.connRequestNum = stream.requestNum
+	ctx.connTime = sc.connTime
+	ctx.time = time.Now()
 
 	// Populate the RequestCtx with the headers and body from the stream
 	sp.populateRequestCtx(ctx, stream)
 
-	// Call the handler
-	s.Handler(ctx)
+	// Unbuffered responses are sent in DATA frames as the handler writes them
+	ctx.SetUnbufferedWriter(func() UnbufferedWriter {
+		return newH2UnbufferedWriter(ctx, &ctx.Response, stream)
+	})
+	ctx.push = func(path string, headers []string) error {
+		return sc.push(stream, ctx, path, headers)
+	}
+
+	// Call the handler, unless the request was already rejected
+	if stream.bodyErr != nil {
+		sp.writeBodyError(ctx, s, stream.bodyErr)
+	} else {
+		s.handle(ctx)
+	}
 
-	// Process the response from the handler
-	sp.processResponse(ctx, stream)
+	// An extended CONNECT request accepted by the handler turns the stream into a tunnel
+	if h := ctx.hijackHandler; h != nil && stream.connectProtocol != "" && sp.acceptTunnel(ctx) {
+		sp.serveTunnel(ctx, stream, h)
+		<-stream.done
+		s.releaseCtx(ctx)
+		return
+	}
+
+	// The data the handler didn't read still holds connection-level credit
+	if stream.body != nil {
+		if n := stream.body.closeRead(); n > 0 {
+			sc.returnInflow(nil, n)
+		}
+	}
+
+	// A timed out handler may still be using ctx, so it can't go back to the pool
+	timedOut := ctx.timeoutResponse != nil
+
+	// Process the response from the handler, an unbuffered response only needs to be
+	// ended if the handler didn't close it
+	if ctx.disableBuffering && !timedOut {
+		_ = ctx.CloseResponse()
+	} else {
+		sp.processResponse(ctx, stream)
+	}
+
+	// The queued response body belongs to ctx until the stream is closed
+	<-stream.done
+	if !timedOut {
+		s.releaseCtx(ctx)
+	}
+}
+
+// Reasons for a request to be malformed, see RFC 9113 section 8.1.1
+var (
+	errH2UppercaseHeader       = errors.New("header field name contains uppercase characters")
+	errH2PseudoHeaderOrder     = errors.New("pseudo-header field after regular header fields")
+	errH2UnknownPseudoHeader   = errors.New("unknown pseudo-header field")
+	errH2DuplicatePseudoHeader = errors.New("duplicate pseudo-header field")
+	errH2MissingPseudoHeader   = errors.New("missing mandatory pseudo-header field")
+	errH2ConnectionHeader      = errors.New("connection-specific header field")
+	errH2ContentLength         = errors.New("invalid content-length")
+	errH2TrailerPseudoHeader   = errors.New("pseudo-header field in trailers")
+	errH2ConnectProtocol       = errors.New(":protocol pseudo-header field without extended CONNECT")
+)
+
+// checkH2RequestHeaders validates the header fields of a request as required by
+// RFC 9113 section 8.3.1. It returns the content-length, or -1 if not set. The
+// :protocol pseudo-header field of RFC 8441 is only accepted if extendedConnect is set.
+func checkH2RequestHeaders(fields []hpack.HeaderField, extendedConnect bool) (int64, error) {
+	var method, scheme, path, authority, protocol string
+	var seen [5]bool
+	regular := false
+	contentLength := int64(-1)
+	for _, f := range fields {
+		if hasUppercase(f.Name) {
+			return 0, errH2UppercaseHeader
+		}
+
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return 0, errH2PseudoHeaderOrder
+			}
+			var i int
+			switch f.Name {
+			case ":method":
+				i, method = 0, f.Value
+			case ":scheme":
+				i, scheme = 1, f.Value
+			case ":path":
+				i, path = 2, f.Value
+			case ":authority":
+				i, authority = 3, f.Value
+			case ":protocol":
+				i, protocol = 4, f.Value
+			default:
+				return 0, errH2UnknownPseudoHeader
+			}
+			if seen[i] {
+				return 0, errH2DuplicatePseudoHeader
+			}
+			seen[i] = true
+			continue
+		}
+
+		regular = true
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return 0, errH2ConnectionHeader
+		case "te":
+			// TE is only allowed to announce support for trailers
+			if f.Value != "trailers" {
+				return 0, errH2ConnectionHeader
+			}
+		case "content-length":
+			n, err := strconv.ParseInt(f.Value, 10, 64)
+			if err != nil || n < 0 || (contentLength >= 0 && n != contentLength) {
+				return 0, errH2ContentLength
+			}
+			contentLength = n
+		}
+	}
+
+	// Extended CONNECT requests carry all the pseudo-header fields, see RFC 8441 section 4
+	if seen[4] {
+		if !extendedConnect || method != "CONNECT" || protocol == "" {
+			return 0, errH2ConnectProtocol
+		}
+		if scheme == "" || path == "" || authority == "" {
+			return 0, errH2MissingPseudoHeader
+		}
+		return contentLength, nil
+	}
+
+	// CONNECT requests only carry the authority, see RFC 9113 section 8.5
+	if method == "CONNECT" {
+		if authority == "" || seen[1] || seen[2] {
+			return 0, errH2MissingPseudoHeader
+		}
+		return contentLength, nil
+	}
+	if method == "" || scheme == "" || path == "" {
+		return 0, errH2MissingPseudoHeader
+	}
+	return contentLength, nil
+}
+
+// h2ConnectProtocol returns the :protocol pseudo-header field of a valid request, empty
+// if it is not an extended CONNECT request
+func h2ConnectProtocol(fields []hpack.HeaderField) string {
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			break
+		}
+		if f.Name == ":protocol" {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// checkH2Trailers validates the trailer fields of a request, which can't
+// contain pseudo-header fields
+func checkH2Trailers(fields []hpack.HeaderField) error {
+	for _, f := range fields {
+		if hasUppercase(f.Name) {
+			return errH2UppercaseHeader
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			return errH2TrailerPseudoHeader
+		}
+	}
+	return nil
+}
+
+func hasUppercase(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			return true
+		}
+	}
+	return false
 }
 
 // populateRequestCtx populates the RequestCtx with data from the stream
 func (sp *StreamProcessor) populateRequestCtx(ctx *RequestCtx, stream *Stream) {
-	// Parse headers from the stream and populate the RequestCtx
+	// Parse headers from the stream and populate the RequestCtx.
+	// Pseudo-header fields map to the request line and are not regular headers.
+	var scheme, authority string
 	for _, headerField := range stream.Headers {
-		ctx.Request.Header.Set(headerField.Name, headerField.Value)
+		switch headerField.Name {
+		case ":method":
+			ctx.Request.Header.SetMethod(headerField.Value)
+		case ":path":
+			ctx.Request.Header.SetRequestURI(headerField.Value)
+		case ":scheme":
+			scheme = headerField.Value
+		case ":authority":
+			authority = headerField.Value
+		case ":protocol":
+			ctx.connectProtocol = headerField.Value
+		default:
+			ctx.Request.Header.Add(headerField.Name, headerField.Value)
+		}
+	}
+
+	// Set the request body, a streamed body is read from the stream as it arrives.
+	// Its trailers are added to the request headers once the whole body is read.
+	if stream.body != nil {
+		stream.body.header = &ctx.Request.Header
+		ctx.Request.bodyStream = stream.body
+		// Without content-length, the size of the body is unknown until it is read
+		if stream.contentLength < 0 {
+			ctx.Request.Header.SetContentLength(-1)
+		}
+	} else {
+		ctx.Request.SetBody(stream.Body)
+		addH2RequestTrailers(&ctx.Request.Header, stream.Trailers)
+	}
+
+	// The authority replaces the Host header, see RFC 9113 section 8.3.1
+	if authority != "" {
+		ctx.Request.Header.SetHost(authority)
+	}
+
+	// Set the scheme
+	if scheme == "" {
+		scheme = "https" // Default to https if not set
 	}
+	ctx.Request.URI().SetScheme(scheme)
+}
+
+// acceptTunnel tells whether the handler accepted an extended CONNECT request with a
+// 2xx response, which may neither be buffered nor have timed out
+func (sp *StreamProcessor) acceptTunnel(ctx *RequestCtx) bool {
+	status := ctx.Response.StatusCode()
+	return status >= 200 && status < 300 && ctx.timeoutResponse == nil && !ctx.disableBuffering
+}
 
-	// Determine the HTTP method
-	method := ctx.Request.Header.Method()
-	if len(method) == 0 {
-		method = []byte("GET") // Default method if not set
+// serveTunnel sends the response headers of an accepted extended CONNECT request, then
+// hands the stream to the hijack handler, see RFC 8441 section 5. The stream is ended
+// when the handler returns.
+func (sp *StreamProcessor) serveTunnel(ctx *RequestCtx, stream *Stream, h HijackHandler) {
+	// The tunnel lasts as long as the handler, the stream timeouts no longer apply
+	stream.stopTimers()
+
+	ctx.Response.SkipBody = true
+	stream.conn.sched.writeHeaders(stream.ID, appendH2ResponseHeaders(nil, &ctx.Response.Header), false)
+
+	c := newH2StreamConn(stream)
+	h(c)
+	c.Close() //nolint:errcheck
+}
+
+// writeBodyError sets the response for a rejected request body. ErrBodyTooLarge is
+// answered with 413 Request Entity Too Large unless Server.ErrorHandler is set.
+func (sp *StreamProcessor) writeBodyError(ctx *RequestCtx, s *Server, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(ctx, err)
+		return
 	}
-	ctx.Request.Header.SetMethodBytes(method)
+	ctx.Error(StatusMessage(StatusRequestEntityTooLarge), StatusRequestEntityTooLarge)
+}
 
-	// Set the request body
-	ctx.Request.SetBody(stream.Body)
+// processResponse processes the response, updates the stream and sends the response to the client
+func (sp *StreamProcessor) processResponse(ctx *RequestCtx, stream *Stream) {
+	response := &ctx.Response
+	if ctx.timeoutResponse != nil {
+		response = ctx.timeoutResponse
+	}
+	if ctx.IsHead() {
+		response.SkipBody = true
+	}
 
-	// Extract the URI from the headers
-	uri := ctx.Request.Header.Peek(":path")
-	if uri != nil {
-		ctx.Request.SetRequestURIBytes(uri)
+	// A body stream is sent as it is read
+	if response.bodyStream != nil && !response.mustSkipBody() {
+		uw := newH2UnbufferedWriter(ctx, response, stream)
+		if err := uw.writeBodyStream(); err != nil {
+			stream.conn.debug.Errorf("Error writing body stream for stream %d: %v", stream.ID, err)
+		}
+		return
 	}
 
-	// Set the host
-	host := ctx.Request.Header.Peek("host")
-	if host != nil {
-		ctx.Request.SetHostBytes(host)
+	// Body() drains any body stream set by the handler
+	body := response.Body()
+	sendBody := !response.mustSkipBody()
+	if sendBody || len(body) > 0 {
+		response.Header.SetContentLength(len(body))
 	}
 
-	// Set the scheme
-	scheme := ctx.Request.Header.Peek(":scheme")
-	if scheme == nil {
-		scheme = []byte("https") // Default to https if not set
+	// Copy the response headers and body from the RequestCtx to the stream
+	stream.ResponseHeaders = appendH2ResponseHeaders(stream.ResponseHeaders[:0], &response.Header)
+	stream.ResponseBody = nil
+	stream.ResponseTrailers = nil
+	if sendBody {
+		stream.ResponseBody = body
+		stream.ResponseTrailers = appendH2ResponseTrailers(stream.ResponseTrailers, &response.Header)
+	}
+
+	if err := stream.conn.writeResponse(stream); err != nil {
+		stream.conn.debug.Errorf("Error writing response for stream %d: %v", stream.ID, err)
+	}
+}
+
+// appendH2ResponseHeaders appends the HTTP/2 representation of h to dst, starting with the
+// :status pseudo-header. Header names are lowercased and connection-specific headers are
+// dropped, as required by RFC 9113 section 8.2.
+func appendH2ResponseHeaders(dst []hpack.HeaderField, h *ResponseHeader) []hpack.HeaderField {
+	statusCode := h.StatusCode()
+	if statusCode < 0 {
+		statusCode = StatusOK
 	}
-	ctx.Request.URI().SetSchemeBytes(scheme)
+	dst = append(dst, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(statusCode)})
 
-	// Set the authority (host:port)
-	authority := ctx.Request.Header.Peek(":authority")
-	if authority != nil {
-		ctx.Request.URI().SetHostBytes(authority)
+	server := h.Server()
+	if len(server) != 0 {
+		dst = appendH2Header(dst, strServer, server)
 	}
 
-	// Set the remote address
-	remoteAddr := stream.conn.conn.RemoteAddr()
-	ctx.Init(&ctx.Request, remoteAddr, ctx.Logger())
+	if !h.noDefaultDate {
+		serverDateOnce.Do(updateServerDate)
+		dst = appendH2Header(dst, strDate, serverDate.Load().([]byte))
+	}
 
-	// Log the populated request context for debugging
-	log.Printf("Request Headers: %s", ctx.Request.Header.String())
-	log.Printf("Request URI: %s", ctx.Request.URI().String())
-	log.Printf("Request Body: %s", string(ctx.Request.Body()))
+	// Append Content-Type only for non-zero responses
+	// or if it is explicitly set, same as for HTTP/1.1.
+	if h.ContentLength() != 0 || len(h.contentType) > 0 {
+		contentType := h.ContentType()
+		if len(contentType) > 0 {
+			dst = appendH2Header(dst, strContentType, contentType)
+		}
+	}
+	contentEncoding := h.ContentEncoding()
+	if len(contentEncoding) > 0 {
+		dst = appendH2Header(dst, strContentEncoding, contentEncoding)
+	}
+
+	if len(h.contentLengthBytes) > 0 {
+		dst = appendH2Header(dst, strContentLength, h.contentLengthBytes)
+	}
+
+	for i, n := 0, len(h.h); i < n; i++ {
+		kv := &h.h[i]
+		if isH2ConnectionHeader(kv.key) {
+			continue
+		}
+
+		// Exclude trailer from header
+		exclude := false
+		for _, t := range h.trailer {
+			if bytes.Equal(kv.key, t.key) {
+				exclude = true
+				break
+			}
+		}
+		if !exclude && (h.noDefaultDate || !bytes.Equal(kv.key, strDate)) {
+			dst = appendH2Header(dst, kv.key, kv.value)
+		}
+	}
+
+	if len(h.trailer) > 0 {
+		dst = appendH2Header(dst, strTrailer, appendArgsKeyBytes(nil, h.trailer, strCommaSpace))
+	}
+
+	for i, n := 0, len(h.cookies); i < n; i++ {
+		dst = appendH2Header(dst, strSetCookie, h.cookies[i].value)
+	}
+
+	return dst
 }
 
-// processResponse processes the response and updates the stream
-func (sp *StreamProcessor) processResponse(ctx *RequestCtx, stream *Stream) {
-	// Copy the response headers and body from the RequestCtx to the stream
-	response := ctx.Response
-	stream.ResponseHeaders = make([]hpack.HeaderField, 0, response.Header.Len())
-	response.Header.VisitAll(func(key, value []byte) {
-		stream.ResponseHeaders = append(stream.ResponseHeaders, hpack.HeaderField{
-			Name:  string(key),
-			Value: string(value),
-		})
-	})
-	stream.ResponseBody = response.Body()
+// appendH2ResponseTrailers appends the trailers declared with ResponseHeader.SetTrailer
+// or AddTrailer to dst, with the values set on h
+func appendH2ResponseTrailers(dst []hpack.HeaderField, h *ResponseHeader) []hpack.HeaderField {
+	for i, n := 0, len(h.trailer); i < n; i++ {
+		key := h.trailer[i].key
+		dst = appendH2Header(dst, key, h.peek(key))
+	}
+	return dst
+}
+
+// addH2RequestTrailers adds the trailers received after the request body to h, as it
+// is done for the trailers of chunked HTTP/1.1 requests. Forbidden trailers are dropped.
+func addH2RequestTrailers(h *RequestHeader, fields []hpack.HeaderField) {
+	for _, f := range fields {
+		if isBadTrailer(s2b(f.Name)) {
+			continue
+		}
+		h.Add(f.Name, f.Value)
+	}
+}
+
+// appendH2Header appends a header field with a lowercased name to dst
+func appendH2Header(dst []hpack.HeaderField, key, value []byte) []hpack.HeaderField {
+	name := []byte(string(key))
+	lowercaseBytes(name)
+	return append(dst, hpack.HeaderField{Name: b2s(name), Value: string(value)})
+}
 
-	// Log the processed response for debugging
-	log.Printf("Response Headers: %s", response.Header.String())
-	log.Printf("Response Body: %s", string(response.Body()))
+// isH2ConnectionHeader reports whether key is a connection-specific header field,
+// which must not be sent over HTTP/2.
+func isH2ConnectionHeader(key []byte) bool {
+	return caseInsensitiveCompare(key, strConnection) ||
+		caseInsensitiveCompare(key, strKeepAlive) ||
+		caseInsensitiveCompare(key, strProxyConnection) ||
+		caseInsensitiveCompare(key, strTransferEncoding) ||
+		caseInsensitiveCompare(key, strUpgrade)
 }
@@ -0,0 +1,190 @@
+package fns
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errH2PingTimeout closes a connection whose client didn't answer a keepalive PING
+var errH2PingTimeout = errors.New("keepalive PING timed out")
+
+// keepalivePingData is the payload of the keepalive PING frames
+var keepalivePingData = [8]byte{'k', 'e', 'e', 'p', 'a', 'l', 'i', 'v'}
+
+func (sc *h2ServerConn) readTimeout() time.Duration {
+	if sc.conf.ReadTimeout > 0 {
+		return sc.conf.ReadTimeout
+	}
+	return sc.s.ReadTimeout
+}
+
+func (sc *h2ServerConn) writeTimeout() time.Duration {
+	if sc.conf.WriteTimeout > 0 {
+		return sc.conf.WriteTimeout
+	}
+	return sc.s.WriteTimeout
+}
+
+func (sc *h2ServerConn) idleTimeout() time.Duration {
+	if sc.conf.IdleTimeout > 0 {
+		return sc.conf.IdleTimeout
+	}
+	return sc.s.idleTimeout()
+}
+
+// setIdle runs the idle timer while no stream is active, the connection is shut down
+// gracefully when it fires. sc.mu must be held once the connection is served.
+func (sc *h2ServerConn) setIdle(idle bool) {
+	timeout := sc.idleTimeout()
+	if timeout <= 0 || sc.idleTimerStopped {
+		return
+	}
+	switch {
+	case !idle:
+		if sc.idleTimer != nil {
+			sc.idleTimer.Stop()
+		}
+	case sc.idleTimer == nil:
+		sc.idleTimer = time.AfterFunc(timeout, sc.startGracefulShutdown)
+	default:
+		sc.idleTimer.Reset(timeout)
+	}
+}
+
+// stopIdleTimer stops the idle timer for good once the connection is closed
+func (sc *h2ServerConn) stopIdleTimer() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.idleTimerStopped = true
+	if sc.idleTimer != nil {
+		sc.idleTimer.Stop()
+	}
+}
+
+// frameReceived records the time a frame was received for the keepalive PINGs
+func (sc *h2ServerConn) frameReceived() {
+	if sc.conf.PingInterval > 0 {
+		atomic.StoreInt64(&sc.lastFrameTime, time.Now().UnixNano())
+	}
+}
+
+// keepalive sends a PING frame whenever the client was silent for PingInterval, and
+// closes the connection if it stays silent for PingTimeout after that. Any frame
+// received, not only the PING ACK, shows the client is alive.
+func (sc *h2ServerConn) keepalive() {
+	interval, timeout := sc.conf.PingInterval, sc.conf.pingTimeout()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	var pingSent time.Time
+	for {
+		select {
+		case <-timer.C:
+		case <-sc.writerDone:
+			return
+		}
+
+		now := time.Now()
+		lastFrame := time.Unix(0, atomic.LoadInt64(&sc.lastFrameTime))
+		if !pingSent.IsZero() {
+			if lastFrame.Before(pingSent) {
+				sc.closeWithError(errH2PingTimeout)
+				return
+			}
+			pingSent = time.Time{}
+		}
+		if silent := now.Sub(lastFrame); silent < interval {
+			timer.Reset(interval - silent)
+			continue
+		}
+		sc.sendPing(keepalivePingData)
+		pingSent = now
+		timer.Reset(timeout)
+	}
+}
+
+// closeWithError closes the connection from another goroutine than the read loop, which
+// then returns err. Nothing is sent to the client, which is not responding.
+func (sc *h2ServerConn) closeWithError(err error) {
+	sc.mu.Lock()
+	sc.closeErr = err
+	sc.mu.Unlock()
+
+	sc.debug.Errorf("Closing connection: %v", err)
+	sc.sched.close(false)
+	sc.conn.Close()
+}
+
+// closeError returns the error passed to closeWithError, if any
+func (sc *h2ServerConn) closeError() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closeErr
+}
+
+// startStreamTimers enforces the read and write timeouts of a new stream, receiving is
+// set if the client has not ended the stream yet
+func (sc *h2ServerConn) startStreamTimers(stream *Stream, receiving bool) {
+	readTimeout, writeTimeout := sc.readTimeout(), sc.writeTimeout()
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if readTimeout > 0 && receiving {
+		stream.readTimer = time.AfterFunc(readTimeout, func() {
+			sc.streamTimedOut(stream, true)
+		})
+	}
+	if writeTimeout > 0 {
+		stream.writeTimer = time.AfterFunc(writeTimeout, func() {
+			sc.streamTimedOut(stream, false)
+		})
+	}
+}
+
+// streamTimedOut resets the stream if it is still receiving the request, for the read
+// timeout, or sending the response, for the write timeout
+func (sc *h2ServerConn) streamTimedOut(stream *Stream, read bool) {
+	stream.mu.Lock()
+	state := stream.State
+	stream.mu.Unlock()
+
+	var timedOut bool
+	if read {
+		timedOut = state == StreamOpen || state == StreamHalfClosedLocal
+	} else {
+		timedOut = state == StreamOpen || state == StreamHalfClosedRemote || state == StreamReservedLocal
+	}
+	if !timedOut {
+		return
+	}
+	if read {
+		sc.debug.Errorf("Read timeout on stream %d", stream.ID)
+	} else {
+		sc.debug.Errorf("Write timeout on stream %d", stream.ID)
+	}
+	sc.resetStream(stream, 0x8) // CANCEL
+}
+
+// stopTimers stops the timers of a closed stream
+func (s *Stream) stopTimers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readTimer != nil {
+		s.readTimer.Stop()
+	}
+	if s.writeTimer != nil {
+		s.writeTimer.Stop()
+	}
+}
+
+// extendWriteDeadline gives the writer WriteTimeout to write the next frame, a client
+// not reading the connection can't block it forever
+func (sc *h2ServerConn) extendWriteDeadline() {
+	if d := sc.writeTimeout(); d > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(d)) //nolint:errcheck
+	}
+}
@@ -0,0 +1,100 @@
+package fns
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2ServerIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Handler: func(ctx *RequestCtx) {}, IdleTimeout: 100 * time.Millisecond}
+	cl := newH2TestClientConfig(t, s, ServerConfig{})
+
+	// The timer is stopped while a stream is active
+	start := time.Now()
+	cl.writeRequest(1, true, h2TestRequest...)
+	cl.readResponse(1)
+
+	cl.expectGoAway(http2.ErrCodeNo)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("the connection was closed after %s", d)
+	}
+}
+
+func TestH2ServerKeepalive(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Handler: func(ctx *RequestCtx) {}}
+	conf := ServerConfig{PingInterval: 200 * time.Millisecond, PingTimeout: 200 * time.Millisecond}
+	cl := newH2TestClientConfig(t, s, conf)
+
+	expectPing := func() *http2.PingFrame {
+		f := cl.readFrame()
+		pf, ok := f.(*http2.PingFrame)
+		if !ok || pf.IsAck() || pf.Data != keepalivePingData {
+			t.Fatalf("expected keepalive PING, got %v", f)
+		}
+		return pf
+	}
+
+	// The connection stays open as long as the client answers
+	for i := 0; i < 2; i++ {
+		pf := expectPing()
+		if err := cl.fr.WritePing(true, pf.Data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	expectPing()
+	if err := cl.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f, err := cl.fr.ReadFrame(); err == nil {
+		t.Fatalf("expected the connection to be closed, got %v", f)
+	}
+}
+
+func TestH2ServerStreamTimeouts(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		conf ServerConfig
+		send func(cl *h2TestClient)
+	}{
+		{"read timeout", ServerConfig{ReadTimeout: 50 * time.Millisecond}, func(cl *h2TestClient) {
+			// The request body never comes
+			cl.writeRequest(1, false, h2TestRequest...)
+		}},
+		{"write timeout", ServerConfig{WriteTimeout: 50 * time.Millisecond}, func(cl *h2TestClient) {
+			cl.writeRequest(1, true, ":method", "GET", ":scheme", "https", ":authority", "localhost", ":path", "/slow")
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{Handler: func(ctx *RequestCtx) {
+				if string(ctx.Path()) == "/slow" {
+					select {
+					case <-ctx.Done():
+					case <-time.After(5 * time.Second):
+					}
+				}
+			}}
+			cl := newH2TestClientConfig(t, s, tc.conf)
+			tc.send(cl)
+			cl.expectRSTStream(1, http2.ErrCodeCancel)
+
+			// Only the stream timed out
+			cl.writeRequest(3, true, h2TestRequest...)
+			resp := cl.readResponse(3)
+			if v := resp.header(":status"); v != "200" {
+				t.Fatalf("unexpected status %q", v)
+			}
+		})
+	}
+}
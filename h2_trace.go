@@ -0,0 +1,324 @@
+package fns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pablolagos/fns/internal/frames"
+)
+
+// H2Tracer receives the events of the HTTP/2 connections served by a Server, see
+// ServerConfig.Tracer. The methods are called synchronously from the goroutines
+// reading and writing the connections, so they must be safe for concurrent use and
+// should return quickly.
+type H2Tracer interface {
+	// FrameRead is called for each frame received from a client
+	FrameRead(e H2FrameEvent)
+
+	// FrameWritten is called for each frame sent to a client, before it is written
+	FrameWritten(e H2FrameEvent)
+
+	// StreamStateChanged is called when a stream moves to a new state, see RFC 9113
+	// section 5.1
+	StreamStateChanged(e H2StreamEvent)
+
+	// Error is called for the connection and stream errors detected by the server,
+	// which are reported to the client with a GOAWAY or RST_STREAM frame
+	Error(e H2ErrorEvent)
+}
+
+// H2FrameEvent describes a frame read or written on an HTTP/2 connection
+type H2FrameEvent struct {
+	ConnID   uint64
+	Type     uint8
+	Flags    uint8
+	StreamID uint32
+	Length   uint32
+
+	// Payload is the frame body. It is only valid during the call and must not be
+	// modified or retained.
+	Payload []byte
+}
+
+// H2StreamEvent describes a stream state change
+type H2StreamEvent struct {
+	ConnID   uint64
+	StreamID uint32
+	From     StreamState
+	To       StreamState
+}
+
+// H2ErrorEvent describes a connection error, with StreamID 0, or a stream error. Code
+// is the HTTP/2 error code sent to the client, see RFC 9113 section 7.
+type H2ErrorEvent struct {
+	ConnID   uint64
+	StreamID uint32
+	Code     uint32
+
+	// Err is the cause of a connection error, it is nil for the stream errors
+	Err error
+}
+
+func (s StreamState) String() string {
+	switch s {
+	case StreamIdle:
+		return "idle"
+	case StreamOpen:
+		return "open"
+	case StreamHalfClosedLocal:
+		return "half-closed (local)"
+	case StreamHalfClosedRemote:
+		return "half-closed (remote)"
+	case StreamClosed:
+		return "closed"
+	case StreamReservedLocal:
+		return "reserved (local)"
+	case StreamReservedRemote:
+		return "reserved (remote)"
+	default:
+		return fmt.Sprintf("StreamState(%d)", int(s))
+	}
+}
+
+var h2FrameTypeNames = [...]string{
+	frames.FrameData:         "DATA",
+	frames.FrameHeaders:      "HEADERS",
+	frames.FramePriority:     "PRIORITY",
+	frames.FrameRSTStream:    "RST_STREAM",
+	frames.FrameSettings:     "SETTINGS",
+	frames.FramePushPromise:  "PUSH_PROMISE",
+	frames.FramePing:         "PING",
+	frames.FrameGoAway:       "GOAWAY",
+	frames.FrameWindowUpdate: "WINDOW_UPDATE",
+	frames.FrameContinuation: "CONTINUATION",
+}
+
+func h2FrameTypeName(t uint8) string {
+	if int(t) < len(h2FrameTypeNames) {
+		return h2FrameTypeNames[t]
+	}
+	if t == frames.FramePriorityUpdate {
+		return "PRIORITY_UPDATE"
+	}
+	return fmt.Sprintf("UNKNOWN(0x%02x)", t)
+}
+
+var h2ErrorCodeNames = [...]string{
+	"NO_ERROR",
+	"PROTOCOL_ERROR",
+	"INTERNAL_ERROR",
+	"FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT",
+	"STREAM_CLOSED",
+	"FRAME_SIZE_ERROR",
+	"REFUSED_STREAM",
+	"CANCEL",
+	"COMPRESSION_ERROR",
+	"CONNECT_ERROR",
+	"ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY",
+	"HTTP_1_1_REQUIRED",
+}
+
+func h2ErrorCodeName(code uint32) string {
+	name := "UNKNOWN"
+	if int(code) < len(h2ErrorCodeNames) {
+		name = h2ErrorCodeNames[code]
+	}
+	return fmt.Sprintf("%s(0x%02x)", name, code)
+}
+
+var h2SettingNames = [...]string{
+	SettingHeaderTableSize:      "SETTINGS_HEADER_TABLE_SIZE",
+	SettingEnablePush:           "SETTINGS_ENABLE_PUSH",
+	SettingMaxConcurrentStreams: "SETTINGS_MAX_CONCURRENT_STREAMS",
+	SettingInitialWindowSize:    "SETTINGS_INITIAL_WINDOW_SIZE",
+	SettingMaxFrameSize:         "SETTINGS_MAX_FRAME_SIZE",
+	SettingMaxHeaderListSize:    "SETTINGS_MAX_HEADER_LIST_SIZE",
+	0x8:                         "SETTINGS_ENABLE_CONNECT_PROTOCOL",
+	SettingNoRFC7540Priorities:  "SETTINGS_NO_RFC7540_PRIORITIES",
+}
+
+func h2SettingName(id uint16) string {
+	if int(id) < len(h2SettingNames) && h2SettingNames[id] != "" {
+		return h2SettingNames[id]
+	}
+	return "UNKNOWN"
+}
+
+// h2TraceLogger is the H2Tracer returned by NewH2TraceLogger
+type h2TraceLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	buf   []byte
+}
+
+// NewH2TraceLogger returns an H2Tracer writing the events to w in the format of the
+// nghttp -v output, each line prefixed with the time elapsed since its creation and
+// the connection ID:
+//
+//	[  0.002] [conn 1] recv SETTINGS frame <length=6, flags=0x00, stream_id=0>
+//	          (niv=1)
+//	          [SETTINGS_ENABLE_PUSH(0x02):0]
+//	[  0.002] [conn 1] send HEADERS frame <length=30, flags=0x05, stream_id=1>
+//	          ; END_STREAM | END_HEADERS
+//
+// The header blocks and the DATA payloads are not logged.
+func NewH2TraceLogger(w io.Writer) H2Tracer {
+	return &h2TraceLogger{w: w, start: time.Now()}
+}
+
+func (l *h2TraceLogger) FrameRead(e H2FrameEvent) {
+	l.frame("recv", e)
+}
+
+func (l *h2TraceLogger) FrameWritten(e H2FrameEvent) {
+	l.frame("send", e)
+}
+
+func (l *h2TraceLogger) StreamStateChanged(e H2StreamEvent) {
+	l.log(e.ConnID, fmt.Sprintf("stream %d: %s -> %s", e.StreamID, e.From, e.To))
+}
+
+func (l *h2TraceLogger) Error(e H2ErrorEvent) {
+	if e.StreamID == 0 {
+		l.log(e.ConnID, fmt.Sprintf("connection error %s: %v", h2ErrorCodeName(e.Code), e.Err))
+		return
+	}
+	l.log(e.ConnID, fmt.Sprintf("stream error on stream %d %s", e.StreamID, h2ErrorCodeName(e.Code)))
+}
+
+func (l *h2TraceLogger) frame(dir string, e H2FrameEvent) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s frame <length=%d, flags=0x%02x, stream_id=%d>", dir, h2FrameTypeName(e.Type), e.Length, e.Flags, e.StreamID)
+	if flags := h2FlagNames(e.Type, e.Flags); flags != "" {
+		sb.WriteString("\n          ; ")
+		sb.WriteString(flags)
+	}
+
+	p := e.Payload
+	switch e.Type {
+	case frames.FrameSettings:
+		if e.Flags&frames.FlagAck != 0 {
+			break
+		}
+		fmt.Fprintf(&sb, "\n          (niv=%d)", len(p)/6)
+		for ; len(p) >= 6; p = p[6:] {
+			id := binary.BigEndian.Uint16(p)
+			fmt.Fprintf(&sb, "\n          [%s(0x%02x):%d]", h2SettingName(id), id, binary.BigEndian.Uint32(p[2:]))
+		}
+	case frames.FrameRSTStream:
+		if len(p) >= 4 {
+			fmt.Fprintf(&sb, "\n          (error_code=%s)", h2ErrorCodeName(binary.BigEndian.Uint32(p)))
+		}
+	case frames.FrameGoAway:
+		if len(p) >= 8 {
+			fmt.Fprintf(&sb, "\n          (last_stream_id=%d, error_code=%s, opaque_data(%d)=[%s])",
+				binary.BigEndian.Uint32(p)&0x7fffffff, h2ErrorCodeName(binary.BigEndian.Uint32(p[4:])), len(p)-8, p[8:])
+		}
+	case frames.FrameWindowUpdate:
+		if len(p) >= 4 {
+			fmt.Fprintf(&sb, "\n          (window_size_increment=%d)", binary.BigEndian.Uint32(p)&0x7fffffff)
+		}
+	case frames.FramePing:
+		fmt.Fprintf(&sb, "\n          (opaque_data=%x)", p)
+	case frames.FramePushPromise:
+		if len(p) >= 4 {
+			fmt.Fprintf(&sb, "\n          (promised_stream_id=%d)", binary.BigEndian.Uint32(p)&0x7fffffff)
+		}
+	case frames.FramePriorityUpdate:
+		if len(p) >= 4 {
+			fmt.Fprintf(&sb, "\n          (prioritized_stream_id=%d, priority_field_value=%s)", binary.BigEndian.Uint32(p)&0x7fffffff, p[4:])
+		}
+	}
+	l.log(e.ConnID, sb.String())
+}
+
+// h2FlagNames returns the names of the flags set on a frame of type t
+func h2FlagNames(t, flags uint8) string {
+	var names []string
+	switch t {
+	case frames.FrameData:
+		if flags&frames.FlagEndStream != 0 {
+			names = append(names, "END_STREAM")
+		}
+		if flags&frames.FlagPadded != 0 {
+			names = append(names, "PADDED")
+		}
+	case frames.FrameHeaders:
+		if flags&frames.FlagEndStream != 0 {
+			names = append(names, "END_STREAM")
+		}
+		if flags&frames.FlagEndHeaders != 0 {
+			names = append(names, "END_HEADERS")
+		}
+		if flags&frames.FlagPadded != 0 {
+			names = append(names, "PADDED")
+		}
+		if flags&frames.FlagPriority != 0 {
+			names = append(names, "PRIORITY")
+		}
+	case frames.FramePushPromise, frames.FrameContinuation:
+		if flags&frames.FlagEndHeaders != 0 {
+			names = append(names, "END_HEADERS")
+		}
+	case frames.FrameSettings, frames.FramePing:
+		if flags&frames.FlagAck != 0 {
+			names = append(names, "ACK")
+		}
+	}
+	return strings.Join(names, " | ")
+}
+
+func (l *h2TraceLogger) log(connID uint64, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = fmt.Appendf(l.buf[:0], "[%8.3f] [conn %d] %s\n", time.Since(l.start).Seconds(), connID, msg)
+	l.w.Write(l.buf) //nolint:errcheck
+}
+
+// traceFrame reports a frame read or written to the tracer, if any
+func (sc *h2ServerConn) traceFrame(frame *frames.Frame, written bool) {
+	e := H2FrameEvent{
+		ConnID:   sc.connID,
+		Type:     frame.Type,
+		Flags:    frame.Flags,
+		StreamID: frame.StreamID,
+		Length:   uint32(len(frame.Body)),
+		Payload:  frame.Body,
+	}
+	if written {
+		sc.conf.Tracer.FrameWritten(e)
+	} else {
+		sc.conf.Tracer.FrameRead(e)
+	}
+}
+
+// setState moves the stream to a new state, reporting the change to the tracer. It
+// must be called with s.mu held.
+func (s *Stream) setState(state StreamState) {
+	if s.conn != nil && s.conn.conf.Tracer != nil && s.State != state {
+		s.conn.conf.Tracer.StreamStateChanged(H2StreamEvent{
+			ConnID:   s.conn.connID,
+			StreamID: s.ID,
+			From:     s.State,
+			To:       state,
+		})
+	}
+	s.State = state
+}
+
+// traceError reports a connection error, with streamID 0, or a stream error to the
+// tracer, if any
+func (sc *h2ServerConn) traceError(streamID uint32, errorCode uint32, err error) {
+	if sc.conf.Tracer == nil {
+		return
+	}
+	sc.conf.Tracer.Error(H2ErrorEvent{ConnID: sc.connID, StreamID: streamID, Code: errorCode, Err: err})
+}
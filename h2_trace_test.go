@@ -0,0 +1,132 @@
+package fns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pablolagos/fns/internal/frames"
+	"golang.org/x/net/http2"
+)
+
+// h2TestTracer records the events as lines of text
+type h2TestTracer struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (tr *h2TestTracer) add(format string, args ...interface{}) {
+	tr.mu.Lock()
+	tr.events = append(tr.events, fmt.Sprintf(format, args...))
+	tr.mu.Unlock()
+}
+
+func (tr *h2TestTracer) FrameRead(e H2FrameEvent) {
+	tr.add("recv %s %d", h2FrameTypeName(e.Type), e.StreamID)
+}
+
+func (tr *h2TestTracer) FrameWritten(e H2FrameEvent) {
+	tr.add("send %s %d", h2FrameTypeName(e.Type), e.StreamID)
+}
+
+func (tr *h2TestTracer) StreamStateChanged(e H2StreamEvent) {
+	tr.add("stream %d %s -> %s", e.StreamID, e.From, e.To)
+}
+
+func (tr *h2TestTracer) Error(e H2ErrorEvent) {
+	tr.add("error %d %s", e.StreamID, h2ErrorCodeName(e.Code))
+}
+
+// expect checks that the expected events were recorded in this order, among others
+func (tr *h2TestTracer) expect(t *testing.T, expected ...string) {
+	t.Helper()
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	i := 0
+	for _, e := range tr.events {
+		if i < len(expected) && e == expected[i] {
+			i++
+		}
+	}
+	if i < len(expected) {
+		t.Fatalf("missing event %q in %q", expected[i], tr.events)
+	}
+}
+
+func TestH2ServerTracer(t *testing.T) {
+	t.Parallel()
+
+	tr := &h2TestTracer{}
+	cl := newH2TestClientConfig(t, &Server{Handler: func(ctx *RequestCtx) {
+		ctx.SetBodyString("ok")
+	}}, ServerConfig{Tracer: tr})
+
+	cl.writeRequest(1, true, h2TestRequest...)
+	cl.readResponse(1)
+	cl.writeRequest(3, true, ":method", "GET", ":path", "/")
+	cl.expectRSTStream(3, http2.ErrCodeProtocol)
+	cl.expectNoFrame()
+
+	tr.expect(t,
+		"recv SETTINGS 0",
+		"send SETTINGS 0",
+		"recv HEADERS 1",
+		"stream 1 idle -> open",
+		"stream 1 open -> half-closed (remote)",
+		"send HEADERS 1",
+		"send DATA 1",
+		"stream 1 half-closed (remote) -> closed",
+		"recv HEADERS 3",
+		"error 3 PROTOCOL_ERROR(0x01)",
+		"send RST_STREAM 3",
+		"recv PING 0",
+		"send PING 0",
+	)
+
+	cl.fr.AllowIllegalWrites = true
+	cl.fr.WriteWindowUpdate(0, 0) //nolint:errcheck
+	cl.expectGoAway(http2.ErrCodeProtocol)
+	tr.expect(t, "error 0 PROTOCOL_ERROR(0x01)", "send GOAWAY 0")
+}
+
+func TestNewH2TraceLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	tr := NewH2TraceLogger(&buf)
+	tr.FrameRead(H2FrameEvent{ConnID: 1, Type: frames.FrameSettings, Length: 12,
+		Payload: []byte{0, 2, 0, 0, 0, 0, 0, 0x42, 0, 0, 0, 1}})
+	tr.FrameWritten(H2FrameEvent{ConnID: 1, Type: frames.FrameHeaders, Flags: frames.FlagEndStream | frames.FlagEndHeaders,
+		StreamID: 1, Length: 3, Payload: []byte{0x82, 0x86, 0x84}})
+	tr.FrameWritten(H2FrameEvent{ConnID: 1, Type: frames.FrameData, StreamID: 1, Length: 6, Payload: []byte("secret")})
+	tr.FrameWritten(H2FrameEvent{ConnID: 1, Type: frames.FrameGoAway, Length: 8, Payload: []byte{0, 0, 0, 1, 0, 0, 0, 0xb}})
+	tr.StreamStateChanged(H2StreamEvent{ConnID: 1, StreamID: 1, From: StreamOpen, To: StreamHalfClosedLocal})
+	tr.Error(H2ErrorEvent{ConnID: 1, Code: 0x1, Err: errors.New("bad frame")})
+
+	expected := `recv SETTINGS frame <length=12, flags=0x00, stream_id=0>
+          (niv=2)
+          [SETTINGS_ENABLE_PUSH(0x02):0]
+          [UNKNOWN(0x42):1]
+send HEADERS frame <length=3, flags=0x05, stream_id=1>
+          ; END_STREAM | END_HEADERS
+send DATA frame <length=6, flags=0x00, stream_id=1>
+send GOAWAY frame <length=8, flags=0x00, stream_id=0>
+          (last_stream_id=1, error_code=ENHANCE_YOUR_CALM(0x0b), opaque_data(0)=[])
+stream 1: open -> half-closed (local)
+connection error PROTOCOL_ERROR(0x01): bad frame
+`
+	// The payloads are not logged
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("unexpected DATA payload in %q", buf.String())
+	}
+	got := regexp.MustCompile(`(?m)^\[ *\d+\.\d{3}\] \[conn 1\] `).ReplaceAllString(buf.String(), "")
+	if got != expected {
+		t.Fatalf("unexpected output\n%s\nexpected\n%s", got, expected)
+	}
+}
@@ -0,0 +1,136 @@
+package fns
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// h2StreamConn is the connection handed to the hijack handler of an extended CONNECT
+// request, see RFC 8441 section 5. It reads the DATA frames received on the stream and
+// writes DATA frames, Close ends the stream with the END_STREAM flag.
+type h2StreamConn struct {
+	stream *Stream
+
+	// writeMu serializes the writes, the scheduler references the data being written
+	// until it is copied into DATA frames
+	writeMu sync.Mutex
+
+	// mu guards closed and writeDeadline
+	mu            sync.Mutex
+	closed        bool
+	writeDeadline time.Time
+}
+
+// Ensure h2StreamConn implements net.Conn.
+var _ net.Conn = &h2StreamConn{}
+
+func newH2StreamConn(stream *Stream) *h2StreamConn {
+	return &h2StreamConn{stream: stream}
+}
+
+// Read reads the data received on the stream. It returns io.EOF once the client ended
+// the stream.
+func (c *h2StreamConn) Read(p []byte) (int, error) {
+	n, err := c.stream.body.Read(p)
+	if err == io.ErrClosedPipe {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+// Write sends p in DATA frames, it blocks until they are handed to the connection
+// writer. A write exceeding the write deadline resets the stream, as the frames may
+// have been partially sent.
+func (c *h2StreamConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	sc := c.stream.conn
+	written := make(chan struct{})
+	if !sc.sched.writeDataNotify(c.stream.ID, p, written) {
+		return 0, errH2StreamClosed
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-written:
+		return len(p), nil
+	case <-c.stream.done:
+		return 0, errH2StreamClosed
+	case <-timeout:
+		// Closing the stream makes the scheduler drop the data
+		sc.resetStream(c.stream, 0x8) // CANCEL
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Close ends the stream. The data not read yet is dropped. A write in progress is
+// aborted by resetting the stream.
+func (c *h2StreamConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	sc := c.stream.conn
+	if n := c.stream.body.closeRead(); n > 0 {
+		sc.returnInflow(nil, n)
+	}
+	if !c.writeMu.TryLock() {
+		sc.resetStream(c.stream, 0x8) // CANCEL
+		return nil
+	}
+	sc.sched.writeData(c.stream.ID, nil, true)
+	c.writeMu.Unlock()
+	return nil
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr {
+	return c.stream.conn.conn.LocalAddr()
+}
+
+func (c *h2StreamConn) RemoteAddr() net.Addr {
+	return c.stream.conn.conn.RemoteAddr()
+}
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)         //nolint:errcheck
+	return c.SetWriteDeadline(t) //nolint:errcheck
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error {
+	c.stream.body.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the following writes
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,289 @@
+package fns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var h2TestExtendedConnect = []string{
+	":method", "CONNECT", ":protocol", "echo", ":scheme", "https", ":authority", "localhost", ":path", "/chat",
+}
+
+// readStreamFrame reads the next HEADERS, DATA or RST_STREAM frame of the stream
+func (cl *h2TestClient) readStreamFrame(streamID uint32) http2.Frame {
+	cl.t.Helper()
+
+	for {
+		f := cl.readFrame()
+		if f.Header().StreamID != streamID {
+			continue
+		}
+		switch f.(type) {
+		case *http2.HeadersFrame, *http2.DataFrame, *http2.RSTStreamFrame:
+			return f
+		}
+	}
+}
+
+// expectStreamData reads the DATA frames of the stream until data is received, and
+// until the END_STREAM flag if endStream is set
+func (cl *h2TestClient) expectStreamData(streamID uint32, data string, endStream bool) {
+	cl.t.Helper()
+
+	var got []byte
+	ended := false
+	for len(got) < len(data) || (endStream && !ended) {
+		f := cl.readStreamFrame(streamID)
+		df, ok := f.(*http2.DataFrame)
+		if !ok {
+			cl.t.Fatalf("expected DATA frame, got %v", f)
+		}
+		got = append(got, df.Data()...)
+		if ended = df.StreamEnded(); ended && !endStream {
+			cl.t.Fatal("unexpected END_STREAM")
+		}
+		if ended {
+			break
+		}
+	}
+	if string(got) != data {
+		cl.t.Fatalf("unexpected data of %d bytes, expecting %d bytes", len(got), len(data))
+	}
+}
+
+func TestH2ServerEnableConnectProtocol(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {})
+	if _, ok := cl.settings[http2.SettingID(SettingEnableConnectProtocol)]; ok {
+		t.Fatal("SETTINGS_ENABLE_CONNECT_PROTOCOL must not be announced by default")
+	}
+
+	// :protocol is only allowed once announced
+	cl.writeRequest(1, false, h2TestExtendedConnect...)
+	cl.expectRSTStream(1, http2.ErrCodeProtocol)
+
+	cl = newH2TestClientConfig(t, &Server{Handler: func(ctx *RequestCtx) {}}, ServerConfig{EnableConnectProtocol: true})
+	if v := cl.settings[http2.SettingID(SettingEnableConnectProtocol)]; v != 1 {
+		t.Fatalf("unexpected SETTINGS_ENABLE_CONNECT_PROTOCOL %d", v)
+	}
+}
+
+func TestH2ServerMalformedExtendedConnect(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		fields []string
+	}{
+		{"GET", []string{":method", "GET", ":protocol", "echo", ":scheme", "https", ":authority", "localhost", ":path", "/"}},
+		{"no path", []string{":method", "CONNECT", ":protocol", "echo", ":scheme", "https", ":authority", "localhost"}},
+		{"empty protocol", []string{":method", "CONNECT", ":protocol", "", ":scheme", "https", ":authority", "localhost", ":path", "/"}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &Server{Handler: func(ctx *RequestCtx) {
+				t.Errorf("unexpected call to the handler")
+			}}
+			cl := newH2TestClientConfig(t, s, ServerConfig{EnableConnectProtocol: true})
+			cl.writeRequest(1, false, tc.fields...)
+			cl.expectRSTStream(1, http2.ErrCodeProtocol)
+		})
+	}
+}
+
+func TestH2ServerTunnel(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan error, 1)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		if p := ctx.ConnectProtocol(); p != "echo" {
+			t.Errorf("unexpected protocol %q", p)
+		}
+		if p := string(ctx.Path()); p != "/chat" {
+			t.Errorf("unexpected path %q", p)
+		}
+		ctx.Response.Header.Set("X-Tunnel", "yes")
+		ctx.Hijack(func(c net.Conn) {
+			_, err := io.Copy(c, c)
+			done <- err
+		})
+	}}
+
+	// The tunnel outlives the stream timeouts
+	conf := ServerConfig{EnableConnectProtocol: true, ReadTimeout: 50 * time.Millisecond, WriteTimeout: 50 * time.Millisecond}
+	cl := newH2TestClientConfig(t, s, conf)
+	cl.writeRequest(1, false, h2TestExtendedConnect...)
+
+	f := cl.readStreamFrame(1)
+	hf, ok := f.(*http2.HeadersFrame)
+	if !ok || hf.StreamEnded() {
+		t.Fatalf("expected HEADERS frame without END_STREAM, got %v", f)
+	}
+	fields, err := cl.dec.DecodeFull(hf.HeaderBlockFragment())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp := &h2TestResponse{headers: fields}
+	if v := resp.header(":status"); v != "200" {
+		t.Fatalf("unexpected :status %q", v)
+	}
+	if v := resp.header("x-tunnel"); v != "yes" {
+		t.Fatalf("unexpected x-tunnel %q", v)
+	}
+	if v := resp.header("content-length"); v != "" {
+		t.Fatalf("unexpected content-length %q", v)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := cl.fr.WriteData(1, false, []byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.expectStreamData(1, "hello", false)
+
+	// Ending the stream ends the copy, then the stream is ended by the server. The
+	// data fits in the window of the client, which sends no WINDOW_UPDATE.
+	big := bytes.Repeat([]byte("x"), 50000)
+	for i := 0; i < len(big); i += 10000 {
+		if err := cl.fr.WriteData(1, false, big[i:i+10000]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := cl.fr.WriteData(1, true, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.expectStreamData(1, string(big), true)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the hijack handler")
+	}
+}
+
+func TestH2ServerTunnelRejected(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		ctx.Hijack(func(c net.Conn) {
+			t.Errorf("unexpected call to the hijack handler")
+		})
+		ctx.Error("forbidden", StatusForbidden)
+	}}
+	cl := newH2TestClientConfig(t, s, ServerConfig{EnableConnectProtocol: true})
+	cl.writeRequest(1, false, h2TestExtendedConnect...)
+
+	resp := cl.readResponse(1)
+	if v := resp.header(":status"); v != "403" {
+		t.Fatalf("unexpected :status %q", v)
+	}
+	cl.expectRSTStream(1, http2.ErrCodeNo)
+}
+
+func TestH2ServerTunnelDeadlines(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 2)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		ctx.Hijack(func(c net.Conn) {
+			c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)) //nolint:errcheck
+			var b [8]byte
+			_, err := c.Read(b[:])
+			errs <- err
+
+			// The stream is still usable, the client doesn't read the connection
+			c.SetReadDeadline(time.Time{})                                          //nolint:errcheck
+			c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))              //nolint:errcheck
+			_, err = c.Write(bytes.Repeat([]byte("x"), 2*DefaultInitialWindowSize)) //nolint:errcheck
+			errs <- err
+		})
+	}}
+	cl := newH2TestClientConfig(t, s, ServerConfig{EnableConnectProtocol: true})
+	cl.writeRequest(1, false, h2TestExtendedConnect...)
+
+	if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected write error %v", err)
+	}
+
+	// The timed out write reset the stream
+	for {
+		f := cl.readStreamFrame(1)
+		if rf, ok := f.(*http2.RSTStreamFrame); ok {
+			if rf.ErrCode != http2.ErrCodeCancel {
+				t.Fatalf("unexpected RST_STREAM code %v", rf.ErrCode)
+			}
+			break
+		}
+	}
+}
+
+func TestH2ServerTunnelClientReset(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		ctx.Hijack(func(c net.Conn) {
+			var b [8]byte
+			_, err := c.Read(b[:])
+			errs <- err
+		})
+	}}
+	cl := newH2TestClientConfig(t, s, ServerConfig{EnableConnectProtocol: true})
+	cl.writeRequest(1, false, h2TestExtendedConnect...)
+	if _, ok := cl.readStreamFrame(1).(*http2.HeadersFrame); !ok {
+		t.Fatal("expected HEADERS frame")
+	}
+	if err := cl.fr.WriteRSTStream(1, http2.ErrCodeCancel); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != errH2StreamClosed {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the hijack handler")
+	}
+}
+
+func TestRouterExtendedConnect(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	r.Get("/chat", func(ctx *RequestCtx) {
+		ctx.SetStatusCode(StatusOK)
+	})
+
+	var ctx RequestCtx
+	ctx.Request.Header.SetMethod(MethodConnect)
+	ctx.Request.SetRequestURI("/chat")
+	ctx.connectProtocol = "websocket"
+	r.Handler(&ctx)
+	if sc := ctx.Response.StatusCode(); sc != StatusOK {
+		t.Fatalf("unexpected status %d", sc)
+	}
+
+	// A plain CONNECT request isn't routed to GET
+	ctx.Response.Reset()
+	ctx.connectProtocol = ""
+	r.Handler(&ctx)
+	if sc := ctx.Response.StatusCode(); sc != StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", sc)
+	}
+}
@@ -0,0 +1,135 @@
+package fns
+
+import (
+	"fmt"
+	"io"
+)
+
+// h2UnbufferedWriter is the UnbufferedWriter of HTTP/2 streams. The response headers
+// are sent in a HEADERS frame and every write in DATA frames, as the flow-control
+// windows allow. Close ends the stream, after sending the trailers if any.
+type h2UnbufferedWriter struct {
+	ctx    *RequestCtx
+	resp   *Response
+	stream *Stream
+
+	headersWritten bool
+	skipBody       bool
+	closed         bool
+}
+
+// Ensure h2UnbufferedWriter implements UnbufferedWriter.
+var _ UnbufferedWriter = &h2UnbufferedWriter{}
+
+func newH2UnbufferedWriter(ctx *RequestCtx, resp *Response, stream *Stream) *h2UnbufferedWriter {
+	return &h2UnbufferedWriter{ctx: ctx, resp: resp, stream: stream}
+}
+
+// Write sends p in DATA frames. It blocks until p is handed to the connection writer,
+// so a slow client slows down the handler instead of filling the memory.
+func (uw *h2UnbufferedWriter) Write(p []byte) (int, error) {
+	if uw.closed {
+		return 0, ErrClosedUnbufferedWriter
+	}
+
+	// Write headers if not already sent
+	if !uw.headersWritten {
+		if _, err := uw.WriteHeaders(); err != nil {
+			return 0, fmt.Errorf("error writing headers: %w", err)
+		}
+	}
+	if uw.skipBody || len(p) == 0 {
+		return len(p), nil
+	}
+
+	written := make(chan struct{})
+	if !uw.stream.conn.sched.writeDataNotify(uw.stream.ID, p, written) {
+		return 0, errH2StreamClosed
+	}
+	select {
+	case <-written:
+	case <-uw.stream.done:
+		// The data may still be referenced by the scheduler until it is closed
+		return 0, errH2StreamClosed
+	}
+	uw.ctx.bytesSent += len(p)
+	return len(p), nil
+}
+
+// WriteHeaders sends the response headers. The content-length is only sent if it
+// was set by the handler, the end of the body is marked by the END_STREAM flag.
+func (uw *h2UnbufferedWriter) WriteHeaders() (int, error) {
+	if uw.closed {
+		return 0, ErrClosedUnbufferedWriter
+	}
+
+	if !uw.headersWritten {
+		uw.skipBody = uw.resp.SkipBody || uw.resp.mustSkipBody() || uw.ctx.IsHead()
+		fields := appendH2ResponseHeaders(nil, &uw.resp.Header)
+		uw.stream.conn.sched.writeHeaders(uw.stream.ID, fields, uw.skipBody)
+		uw.headersWritten = true
+	}
+	return 0, nil
+}
+
+// Close ends the stream, with a HEADERS frame carrying the trailers if any were declared.
+// The headers are sent first if nothing was written.
+func (uw *h2UnbufferedWriter) Close() error {
+	if uw.closed {
+		return ErrClosedUnbufferedWriter
+	}
+
+	hasTrailers := len(uw.resp.Header.trailer) > 0
+	if !uw.headersWritten {
+		// Without a body nor trailers, the stream is ended by the HEADERS frame
+		if !hasTrailers {
+			uw.resp.SkipBody = true
+		}
+		if _, err := uw.WriteHeaders(); err != nil {
+			return fmt.Errorf("error writing headers: %w", err)
+		}
+	}
+	if !uw.skipBody {
+		if hasTrailers {
+			uw.stream.conn.sched.writeHeaders(uw.stream.ID, appendH2ResponseTrailers(nil, &uw.resp.Header), true)
+		} else {
+			uw.stream.conn.sched.writeData(uw.stream.ID, nil, true)
+		}
+	}
+	uw.closed = true
+	return nil
+}
+
+// writeBodyStream sends the body stream of the response as it is read, so the
+// responses set with SetBodyStream or SetBodyStreamWriter are not buffered.
+func (uw *h2UnbufferedWriter) writeBodyStream() error {
+	r := uw.resp.bodyStream
+	if n := uw.resp.Header.ContentLength(); n >= 0 {
+		r = io.LimitReader(r, int64(n))
+	}
+	_, err := copyZeroAlloc(uw, r)
+	if closeErr := uw.resp.closeBodyStream(); err == nil {
+		err = closeErr
+	}
+	if err != nil && err != io.EOF {
+		uw.closed = true
+		if err != errH2StreamClosed {
+			// The stream can't be ended normally after a partial body
+			uw.stream.conn.resetStream(uw.stream, 0x2) // INTERNAL_ERROR
+		}
+		return err
+	}
+	return uw.Close()
+}
+
+// closeNotify returns a channel closed once the stream is closed, by the end of the
+// response, a reset or the loss of the connection
+func (uw *h2UnbufferedWriter) closeNotify() <-chan struct{} {
+	return uw.stream.done
+}
+
+// stopTimeouts stops the read and write timeouts of the stream, for the responses
+// lasting as long as the client is connected
+func (uw *h2UnbufferedWriter) stopTimeouts() {
+	uw.stream.stopTimers()
+}
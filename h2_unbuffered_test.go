@@ -0,0 +1,155 @@
+package fns
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// expectData reads frames until a DATA frame is received on the stream
+func (cl *h2TestClient) expectData(streamID uint32, data string, endStream bool) {
+	cl.t.Helper()
+
+	for {
+		f := cl.readFrame()
+		df, ok := f.(*http2.DataFrame)
+		if !ok || df.StreamID != streamID {
+			continue
+		}
+		if string(df.Data()) != data || df.StreamEnded() != endStream {
+			cl.t.Fatalf("unexpected DATA frame %q with END_STREAM %v, expected %q with %v", df.Data(), df.StreamEnded(), data, endStream)
+		}
+		return
+	}
+}
+
+func (cl *h2TestClient) expectResponseHeaders(streamID uint32) *h2TestResponse {
+	cl.t.Helper()
+
+	f := cl.readFrame()
+	hf, ok := f.(*http2.HeadersFrame)
+	if !ok || hf.StreamID != streamID || hf.StreamEnded() {
+		cl.t.Fatalf("expected HEADERS frame on stream %d, got %v", streamID, f)
+	}
+	fields, err := cl.dec.DecodeFull(hf.HeaderBlockFragment())
+	if err != nil {
+		cl.t.Fatalf("unexpected error decoding headers: %v", err)
+	}
+	return &h2TestResponse{headers: fields}
+}
+
+func TestH2ServerUnbufferedResponse(t *testing.T) {
+	t.Parallel()
+
+	next := make(chan struct{})
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetContentType("text/plain")
+		ctx.DisableBuffering()
+		if _, err := ctx.WriteString("part1"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		<-next
+		if _, err := ctx.WriteString("part2"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	cl.writeRequest(1, true, h2TestRequest...)
+	resp := cl.expectResponseHeaders(1)
+	if v := resp.header("content-type"); v != "text/plain" {
+		t.Fatalf("unexpected content-type %q", v)
+	}
+	if v := resp.header("content-length"); v != "" {
+		t.Fatalf("unexpected content-length %q", v)
+	}
+
+	// Each write is sent before the handler returns
+	cl.expectData(1, "part1", false)
+	close(next)
+	cl.expectData(1, "part2", false)
+	cl.expectData(1, "", true)
+}
+
+func TestH2ServerUnbufferedFlowControl(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.DisableBuffering()
+		if _, err := ctx.WriteString("0123456789"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		close(done)
+		if err := ctx.CloseResponse(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}, http2.Setting{ID: http2.SettingInitialWindowSize, Val: 4})
+
+	cl.writeRequest(1, true, h2TestRequest...)
+	cl.expectResponseHeaders(1)
+	cl.expectData(1, "0123", false)
+
+	// The write blocks until the client grants more credit
+	select {
+	case <-done:
+		t.Fatalf("write returned before the data was sent")
+	default:
+	}
+	if err := cl.fr.WriteWindowUpdate(1, 6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.expectData(1, "456789", false)
+	<-done
+	cl.expectData(1, "", true)
+}
+
+func TestH2ServerBodyStreamWriter(t *testing.T) {
+	t.Parallel()
+
+	next := make(chan struct{})
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetContentType("text/event-stream")
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			for i := 0; i < 2; i++ {
+				w.WriteString("data: event\n\n") //nolint:errcheck
+				if err := w.Flush(); err != nil {
+					return
+				}
+				if i == 0 {
+					<-next
+				}
+			}
+		})
+	})
+
+	cl.writeRequest(1, true, h2TestRequest...)
+	resp := cl.expectResponseHeaders(1)
+	if v := resp.header("transfer-encoding"); v != "" {
+		t.Fatalf("connection-specific header must not be sent, got %q", v)
+	}
+
+	// The flushed events are sent while the writer is still running
+	cl.expectData(1, "data: event\n\n", false)
+	close(next)
+	cl.expectData(1, "data: event\n\n", false)
+	cl.expectData(1, "", true)
+}
+
+func TestH2ServerBodyStream(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClient(t, func(ctx *RequestCtx) {
+		ctx.SetBodyStream(bytes.NewReader([]byte("hello world")), 5)
+	})
+
+	cl.writeRequest(1, true, h2TestRequest...)
+	resp := cl.readResponse(1)
+	if v := resp.header("content-length"); v != "5" {
+		t.Fatalf("unexpected content-length %q", v)
+	}
+	if string(resp.body) != "hello" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
@@ -0,0 +1,438 @@
+package fns
+
+import (
+	"sync"
+
+	"github.com/pablolagos/fns/internal/frames"
+	"github.com/pablolagos/fns/internal/hpack"
+)
+
+// h2Write is a unit of work for the connection writer: a control frame, a header
+// block or a DATA frame of a stream
+type h2Write struct {
+	// frame is a control or DATA frame ready to be written, released by the writer
+	frame *frames.Frame
+
+	streamID  uint32
+	headers   []hpack.HeaderField
+	isHeaders bool
+	data      []byte
+	endStream bool
+
+	// promisedID is the stream promised by a PUSH_PROMISE header block, or 0
+	promisedID uint32
+
+	// written, if not nil, is closed once the header block is handed to the writer or
+	// the last of data is copied into a DATA frame
+	written chan struct{}
+
+	// maxFrameSize and headerTableSize are the peer settings in force
+	// when the write was scheduled
+	maxFrameSize    uint32
+	headerTableSize uint32
+}
+
+// h2StreamWrites holds the pending writes and the send window of a stream
+type h2StreamWrites struct {
+	id      uint32
+	outflow outflow
+	queue   []h2Write
+
+	// ready is true while the stream is in the round-robin queue
+	ready bool
+
+	// ended is true once a write ending the stream is queued
+	ended bool
+
+	priority Priority
+}
+
+// h2WriteScheduler decides the order of the frames written to an HTTP/2 connection.
+//
+// Control frames, such as SETTINGS and PING acknowledgements, WINDOW_UPDATE, RST_STREAM
+// and GOAWAY, are written before any stream frame. The stream frames follow the priorities
+// of RFC 9218 section 10: the streams of the lowest urgency value go first, and among them
+// the non-incremental streams are sent one after another in the order of their IDs, while
+// the incremental ones take turns, one frame each. DATA frames are only handed out when the
+// stream and connection flow-control windows allow it, a blocked stream lets the next one
+// make progress.
+//
+// All the methods are safe for concurrent use. The header blocks are encoded by the
+// writer in the order it gets them, which keeps the HPACK state in sync with the peer.
+type h2WriteScheduler struct {
+	mu   sync.Mutex
+	cond sync.Cond
+
+	control []*frames.Frame
+	streams map[uint32]*h2StreamWrites
+
+	// ready is the round-robin queue of the streams with pending writes
+	ready []*h2StreamWrites
+
+	// outflow is the connection-level send window
+	outflow outflow
+
+	maxFrameSize      uint32
+	headerTableSize   uint32
+	initialWindowSize uint32
+
+	// closing stops the scheduling of stream frames, the control frames are still written.
+	// closed stops the writer right away.
+	closing bool
+	closed  bool
+}
+
+func newH2WriteScheduler(peer *Settings) *h2WriteScheduler {
+	ws := &h2WriteScheduler{
+		streams:           make(map[uint32]*h2StreamWrites),
+		outflow:           outflow{n: DefaultInitialWindowSize},
+		maxFrameSize:      peer.Get(SettingMaxFrameSize),
+		headerTableSize:   peer.Get(SettingHeaderTableSize),
+		initialWindowSize: peer.Get(SettingInitialWindowSize),
+	}
+	ws.cond.L = &ws.mu
+	return ws
+}
+
+// openStream registers a stream, so it can receive window updates before its first write
+func (ws *h2WriteScheduler) openStream(streamID uint32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if _, ok := ws.streams[streamID]; ok {
+		return
+	}
+	ws.streams[streamID] = &h2StreamWrites{
+		id: streamID,
+		outflow: outflow{
+			n:    int32(ws.initialWindowSize),
+			conn: &ws.outflow,
+		},
+		priority: defaultPriority,
+	}
+}
+
+// setPriority changes the priority of a stream, it applies to the next frames written
+func (ws *h2WriteScheduler) setPriority(streamID uint32, p Priority) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if st, ok := ws.streams[streamID]; ok {
+		st.priority = p
+	}
+}
+
+// closeStream forgets a stream and discards its pending writes
+func (ws *h2WriteScheduler) closeStream(streamID uint32) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if st, ok := ws.streams[streamID]; ok {
+		st.queue = nil
+		delete(ws.streams, streamID)
+	}
+}
+
+// writeControl queues a control frame. The frame is released once written.
+func (ws *h2WriteScheduler) writeControl(frame *frames.Frame) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		frames.ReleaseFrame(frame)
+		return
+	}
+	ws.control = append(ws.control, frame)
+	ws.cond.Signal()
+}
+
+// resetStream discards the pending writes of the stream and queues the RST_STREAM frame
+func (ws *h2WriteScheduler) resetStream(streamID uint32, frame *frames.Frame) {
+	ws.mu.Lock()
+	if st, ok := ws.streams[streamID]; ok {
+		st.queue = nil
+		delete(ws.streams, streamID)
+	}
+	ws.mu.Unlock()
+
+	ws.writeControl(frame)
+}
+
+// writeHeaders queues a header block for the stream
+func (ws *h2WriteScheduler) writeHeaders(streamID uint32, fields []hpack.HeaderField, endStream bool) {
+	ws.push(streamID, h2Write{streamID: streamID, headers: fields, isHeaders: true, endStream: endStream})
+}
+
+// writeData queues data for the stream. The data is split into DATA frames as the
+// flow-control windows and SETTINGS_MAX_FRAME_SIZE allow. It must not be modified
+// until the stream is closed, after which the scheduler no longer references it.
+func (ws *h2WriteScheduler) writeData(streamID uint32, data []byte, endStream bool) {
+	ws.push(streamID, h2Write{streamID: streamID, data: data, endStream: endStream})
+}
+
+// writeDataNotify queues data like writeData, without ending the stream. written is
+// closed once the data is copied into DATA frames, after which it can be modified.
+// It reports false if the stream can't be written anymore.
+func (ws *h2WriteScheduler) writeDataNotify(streamID uint32, data []byte, written chan struct{}) bool {
+	return ws.push(streamID, h2Write{streamID: streamID, data: data, written: written})
+}
+
+// writePushPromise queues a PUSH_PROMISE header block for the stream, promising
+// promisedID. written is closed once it is handed to the writer, so the frames of
+// the promised stream queued afterwards are written after it. It reports false if
+// the stream can't be written anymore or was already ended.
+func (ws *h2WriteScheduler) writePushPromise(streamID, promisedID uint32, fields []hpack.HeaderField, written chan struct{}) bool {
+	return ws.push(streamID, h2Write{streamID: streamID, headers: fields, isHeaders: true, promisedID: promisedID, written: written})
+}
+
+func (ws *h2WriteScheduler) push(streamID uint32, w h2Write) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	st, ok := ws.streams[streamID]
+	if !ok || ws.closing || ws.closed {
+		// The stream has been reset or the connection is going away
+		return false
+	}
+	if w.promisedID != 0 && st.ended {
+		// Nothing can be promised after the end of the stream
+		return false
+	}
+	st.ended = st.ended || w.endStream
+	st.queue = append(st.queue, w)
+	if !st.ready {
+		st.ready = true
+		ws.ready = append(ws.ready, st)
+	}
+	ws.cond.Signal()
+	return true
+}
+
+// addConnWindow adds flow-control credit to the connection. It reports false if
+// the window would overflow.
+func (ws *h2WriteScheduler) addConnWindow(increment int32) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if !ws.outflow.add(increment) {
+		return false
+	}
+	ws.cond.Signal()
+	return true
+}
+
+// addStreamWindow adds flow-control credit to the stream. It reports false if the
+// window would overflow. Updates for unknown streams are ignored.
+func (ws *h2WriteScheduler) addStreamWindow(streamID uint32, increment int32) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	st, ok := ws.streams[streamID]
+	if !ok {
+		return true
+	}
+	if !st.outflow.add(increment) {
+		return false
+	}
+	ws.cond.Signal()
+	return true
+}
+
+// applySettings updates the peer settings used for the next writes. A new initial window
+// size applies to all the open streams, see RFC 9113 section 6.9.2. It reports false if
+// a stream window would overflow.
+func (ws *h2WriteScheduler) applySettings(peer *Settings) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.maxFrameSize = peer.Get(SettingMaxFrameSize)
+	ws.headerTableSize = peer.Get(SettingHeaderTableSize)
+
+	newWindowSize := peer.Get(SettingInitialWindowSize)
+	delta := int32(newWindowSize) - int32(ws.initialWindowSize)
+	ws.initialWindowSize = newWindowSize
+	if delta == 0 {
+		return true
+	}
+	for _, st := range ws.streams {
+		if !st.outflow.add(delta) {
+			return false
+		}
+	}
+	ws.cond.Signal()
+	return true
+}
+
+// close stops the writer. If flush is true, the queued control frames are written
+// first, which allows a GOAWAY frame to be sent before closing the connection.
+func (ws *h2WriteScheduler) close(flush bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.closing = true
+	if !flush {
+		ws.closed = true
+	}
+	ws.cond.Signal()
+}
+
+// next returns the next write. If there is nothing to write and wait is true, it blocks
+// until there is. It returns false when the writer must stop, or if wait is false and
+// there is nothing to write.
+func (ws *h2WriteScheduler) next(wait bool) (h2Write, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for {
+		if ws.closed {
+			ws.releaseControl()
+			return h2Write{}, false
+		}
+		if len(ws.control) > 0 {
+			frame := ws.control[0]
+			ws.control[0] = nil
+			ws.control = ws.control[1:]
+			return h2Write{frame: frame}, true
+		}
+		if ws.closing {
+			return h2Write{}, false
+		}
+		if w, ok := ws.nextStreamWrite(); ok {
+			return w, true
+		}
+		if !wait {
+			return h2Write{}, false
+		}
+		ws.cond.Wait()
+	}
+}
+
+// nextStreamWrite pops the next write of the ready stream of highest priority that can
+// make progress, then moves the stream to the back of the queue, so the incremental
+// streams of the same priority take turns
+func (ws *h2WriteScheduler) nextStreamWrite() (h2Write, bool) {
+	best := -1
+	for i, st := range ws.ready {
+		if !ws.canWrite(st) {
+			continue
+		}
+		if best < 0 || writesBefore(st, ws.ready[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		ws.compactReady()
+		return h2Write{}, false
+	}
+
+	st := ws.ready[best]
+	w, _ := ws.popWrite(st)
+
+	// Rotate the queue, dropping the streams with nothing left to write
+	n := copy(ws.ready[best:], ws.ready[best+1:])
+	ws.ready = ws.ready[:best+n]
+	if len(st.queue) > 0 {
+		ws.ready = append(ws.ready, st)
+	} else {
+		st.ready = false
+	}
+	w.maxFrameSize = ws.maxFrameSize
+	w.headerTableSize = ws.headerTableSize
+	return w, true
+}
+
+// canWrite reports whether the next write of the stream isn't blocked by flow control
+func (ws *h2WriteScheduler) canWrite(st *h2StreamWrites) bool {
+	if len(st.queue) == 0 {
+		return false
+	}
+	w := &st.queue[0]
+	return w.isHeaders || len(w.data) == 0 || st.outflow.available() > 0
+}
+
+// writesBefore reports whether stream a is written before stream b, which is ahead of
+// a in the queue. Incremental streams of the same urgency keep their turn.
+func writesBefore(a, b *h2StreamWrites) bool {
+	if a.priority.Urgency != b.priority.Urgency {
+		return a.priority.Urgency < b.priority.Urgency
+	}
+	if a.priority.Incremental != b.priority.Incremental {
+		return !a.priority.Incremental
+	}
+	return !a.priority.Incremental && a.id < b.id
+}
+
+// popWrite takes the next frame from the stream queue. DATA is consumed up to the
+// available flow-control credit and the max frame size, and copied into a DATA frame,
+// so the queued data is no longer referenced once the stream is closed.
+func (ws *h2WriteScheduler) popWrite(st *h2StreamWrites) (h2Write, bool) {
+	w := st.queue[0]
+	if !w.isHeaders {
+		n := st.outflow.available()
+		if n > int32(ws.maxFrameSize) {
+			n = int32(ws.maxFrameSize)
+		}
+		if int(n) < len(w.data) {
+			if n <= 0 {
+				return h2Write{}, false
+			}
+			// Send a part of the data, the rest stays queued
+			st.queue[0].data = w.data[n:]
+			st.outflow.take(n)
+			return dataWrite(w.streamID, w.data[:n], false), true
+		}
+		st.outflow.take(int32(len(w.data)))
+		// The data is copied before notifying the writer, which may reuse it
+		written := w.written
+		w = dataWrite(w.streamID, w.data, w.endStream)
+		if written != nil {
+			close(written)
+		}
+	} else if w.written != nil {
+		close(w.written)
+	}
+
+	st.queue[0] = h2Write{}
+	st.queue = st.queue[1:]
+	if len(st.queue) == 0 {
+		st.queue = nil
+	}
+	return w, true
+}
+
+// dataWrite returns a write with a DATA frame carrying a copy of data
+func dataWrite(streamID uint32, data []byte, endStream bool) h2Write {
+	frame := frames.AcquireFrame(frames.FrameData)
+	frame.StreamID = streamID
+	frame.Body = append(frame.Body[:0], data...)
+	if endStream {
+		frame.Flags |= frames.FlagEndStream
+	}
+	return h2Write{frame: frame, streamID: streamID, endStream: endStream}
+}
+
+// compactReady removes the streams without pending writes from the round-robin queue
+func (ws *h2WriteScheduler) compactReady() {
+	n := 0
+	for _, st := range ws.ready {
+		if len(st.queue) == 0 {
+			st.ready = false
+			continue
+		}
+		ws.ready[n] = st
+		n++
+	}
+	for i := n; i < len(ws.ready); i++ {
+		ws.ready[i] = nil
+	}
+	ws.ready = ws.ready[:n]
+}
+
+// releaseControl releases the control frames that will never be written
+func (ws *h2WriteScheduler) releaseControl() {
+	for i, frame := range ws.control {
+		frames.ReleaseFrame(frame)
+		ws.control[i] = nil
+	}
+	ws.control = nil
+}
@@ -0,0 +1,153 @@
+package fns
+
+import (
+	"testing"
+
+	"github.com/pablolagos/fns/internal/frames"
+)
+
+func newTestWriteScheduler(windowSize uint32) *h2WriteScheduler {
+	peer := NewSettings()
+	peer.Set(SettingInitialWindowSize, windowSize)
+	return newH2WriteScheduler(&peer)
+}
+
+func nextTestWrite(t *testing.T, ws *h2WriteScheduler) h2Write {
+	t.Helper()
+
+	w, ok := ws.next(false)
+	if !ok {
+		t.Fatalf("expected a scheduled write")
+	}
+	return w
+}
+
+func TestH2WriteSchedulerControlFirst(t *testing.T) {
+	t.Parallel()
+
+	ws := newTestWriteScheduler(DefaultInitialWindowSize)
+	ws.openStream(1)
+	ws.writeHeaders(1, nil, false)
+	ws.writeData(1, []byte("data"), true)
+	ws.writeControl(frames.AcquireFrame(frames.FramePing))
+	ws.writeControl(frames.AcquireFrame(frames.FrameSettings))
+
+	if w := nextTestWrite(t, ws); w.frame == nil || w.frame.Type != frames.FramePing {
+		t.Fatalf("expected the PING frame first, got %+v", w)
+	}
+	if w := nextTestWrite(t, ws); w.frame == nil || w.frame.Type != frames.FrameSettings {
+		t.Fatalf("expected the SETTINGS frame, got %+v", w)
+	}
+	if w := nextTestWrite(t, ws); !w.isHeaders || w.streamID != 1 {
+		t.Fatalf("expected the headers of stream 1, got %+v", w)
+	}
+	if w := nextTestWrite(t, ws); w.frame == nil || string(w.frame.Body) != "data" || !w.endStream {
+		t.Fatalf("expected the data of stream 1, got %+v", w)
+	}
+	if _, ok := ws.next(false); ok {
+		t.Fatalf("unexpected write")
+	}
+}
+
+func TestH2WriteSchedulerRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	ws := newTestWriteScheduler(1 << 20)
+	ws.addConnWindow(1 << 20)
+	data := make([]byte, 3*DefaultMaxFrameSize)
+	for _, id := range []uint32{1, 3, 5} {
+		ws.openStream(id)
+		ws.setPriority(id, Priority{Urgency: DefaultPriorityUrgency, Incremental: true})
+		ws.writeData(id, data, true)
+	}
+
+	// The incremental streams take turns, one frame each
+	for i := 0; i < 3; i++ {
+		for _, id := range []uint32{1, 3, 5} {
+			w := nextTestWrite(t, ws)
+			if w.streamID != id || len(w.frame.Body) != DefaultMaxFrameSize {
+				t.Fatalf("round %d: expected a full frame of stream %d, got stream %d with %d bytes", i, id, w.streamID, len(w.frame.Body))
+			}
+			if w.endStream != (i == 2) {
+				t.Fatalf("round %d: unexpected END_STREAM %v", i, w.endStream)
+			}
+		}
+	}
+	if _, ok := ws.next(false); ok {
+		t.Fatalf("unexpected write")
+	}
+}
+
+func TestH2WriteSchedulerFlowControl(t *testing.T) {
+	t.Parallel()
+
+	ws := newTestWriteScheduler(10)
+	ws.openStream(1)
+	ws.openStream(3)
+	ws.writeHeaders(1, nil, false)
+	ws.writeData(1, make([]byte, 25), true)
+
+	nextTestWrite(t, ws) // HEADERS
+	if w := nextTestWrite(t, ws); len(w.frame.Body) != 10 || w.endStream {
+		t.Fatalf("expected 10 bytes without END_STREAM, got %d bytes", len(w.frame.Body))
+	}
+
+	// Blocked by the stream window, other streams can still write their headers
+	ws.writeHeaders(3, nil, true)
+	if w := nextTestWrite(t, ws); w.streamID != 3 || !w.isHeaders {
+		t.Fatalf("expected the headers of stream 3, got %+v", w)
+	}
+	if _, ok := ws.next(false); ok {
+		t.Fatalf("unexpected write while blocked by flow control")
+	}
+
+	// A new initial window size applies to the open streams
+	peer := NewSettings()
+	peer.Set(SettingInitialWindowSize, 20)
+	if !ws.applySettings(&peer) {
+		t.Fatalf("unexpected window overflow")
+	}
+	if w := nextTestWrite(t, ws); len(w.frame.Body) != 10 || w.endStream {
+		t.Fatalf("expected 10 bytes without END_STREAM, got %d bytes", len(w.frame.Body))
+	}
+
+	if !ws.addStreamWindow(1, 100) {
+		t.Fatalf("unexpected window overflow")
+	}
+	if w := nextTestWrite(t, ws); len(w.frame.Body) != 5 || !w.endStream {
+		t.Fatalf("expected the last 5 bytes with END_STREAM, got %d bytes", len(w.frame.Body))
+	}
+	if ws.addStreamWindow(1, maxWindowSize) {
+		t.Fatalf("expected a window overflow")
+	}
+}
+
+func TestH2WriteSchedulerReset(t *testing.T) {
+	t.Parallel()
+
+	ws := newTestWriteScheduler(DefaultInitialWindowSize)
+	ws.openStream(1)
+	ws.writeHeaders(1, nil, false)
+	ws.writeData(1, []byte("data"), true)
+	ws.resetStream(1, frames.AcquireFrame(frames.FrameRSTStream))
+
+	// The pending writes of the stream are discarded
+	if w := nextTestWrite(t, ws); w.frame == nil || w.frame.Type != frames.FrameRSTStream {
+		t.Fatalf("expected the RST_STREAM frame, got %+v", w)
+	}
+	if _, ok := ws.next(false); ok {
+		t.Fatalf("unexpected write")
+	}
+
+	// Writes after closing are ignored, but control frames are flushed
+	ws.openStream(3)
+	ws.writeControl(frames.AcquireFrame(frames.FrameGoAway))
+	ws.close(true)
+	ws.writeHeaders(3, nil, true)
+	if w := nextTestWrite(t, ws); w.frame == nil || w.frame.Type != frames.FrameGoAway {
+		t.Fatalf("expected the GOAWAY frame, got %+v", w)
+	}
+	if _, ok := ws.next(true); ok {
+		t.Fatalf("unexpected write after closing")
+	}
+}
@@ -0,0 +1,147 @@
+package fns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pablolagos/fns/internal/hpack"
+)
+
+var (
+	strH2C           = []byte("h2c")
+	strHTTP2Settings = []byte("HTTP2-Settings")
+)
+
+// h2cConn replays the bytes already read from a cleartext connection before
+// reading from it again
+type h2cConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *h2cConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// prefaceReader replays the bytes read by peekPreface, then reads from the connection
+type prefaceReader struct {
+	c net.Conn
+	b []byte
+}
+
+func (r *prefaceReader) reset() {
+	r.c = nil
+	r.b = nil
+}
+
+func (r *prefaceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return r.c.Read(p)
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// peekPreface reads the beginning of a cleartext connection to find out whether the
+// client speaks HTTP/2 with prior knowledge, see RFC 9113 section 3.3. It stops reading
+// at the first byte not matching the connection preface, so it never waits for more
+// of an HTTP/1 request. It returns the bytes read, which must be replayed.
+func (h2 *H2Server) peekPreface(c net.Conn) ([]byte, bool) {
+	if h2.s.ReadTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(h2.s.ReadTimeout)); err != nil {
+			panic(fmt.Sprintf("BUG: error in SetReadDeadline(%v): %v", h2.s.ReadTimeout, err))
+		}
+	}
+
+	buf := make([]byte, len(ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := c.Read(buf[n:])
+		n += m
+		if string(buf[:n]) != ClientPreface[:n] || err != nil {
+			break
+		}
+	}
+
+	return buf[:n], string(buf[:n]) == ClientPreface
+}
+
+// upgrade switches the connection of an HTTP/1.1 request with the Upgrade: h2c header
+// to HTTP/2, see RFC 7540 section 3.2. The request is answered on stream 1 once the
+// 101 Switching Protocols response is sent.
+//
+// It returns false if the request can't upgrade the connection, it is then handled as
+// a regular HTTP/1.1 request.
+func (h2 *H2Server) upgrade(ctx *RequestCtx) bool {
+	h := &ctx.Request.Header
+	if ctx.IsTLS() || !h.IsHTTP11() ||
+		!hasHeaderValue(h.Peek(HeaderUpgrade), strH2C) ||
+		!h.ConnectionUpgrade() || !hasHeaderValue(h.Peek(HeaderConnection), strHTTP2Settings) {
+		return false
+	}
+
+	// The header holds the payload of a SETTINGS frame
+	settings, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimRight(h.Peek("HTTP2-Settings"), "=")))
+	if err != nil || len(settings)%6 != 0 {
+		return false
+	}
+
+	// The body is read before switching protocols, the connection carries
+	// HTTP/2 frames afterwards
+	ctx.Request.Body()
+
+	ctx.Response.SetStatusCode(StatusSwitchingProtocols)
+	ctx.Response.Header.Set(HeaderConnection, "Upgrade")
+	ctx.Response.Header.Set(HeaderUpgrade, "h2c")
+	ctx.Hijack(func(c net.Conn) {
+		// The hijacked connection can't be closed by the HTTP/2 server, which needs
+		// to close it to stop reading. The bytes buffered by the HTTP/1 parser are
+		// still read first.
+		var conn net.Conn = &h2cConn{Conn: c, r: c}
+		if hjc, ok := c.(*hijackConn); ok {
+			conn = &h2cConn{Conn: hjc.Conn, r: hjc}
+		}
+
+		serverConn := &h2ServerConn{
+			conn:            conn,
+			s:               h2.s,
+			conf:            h2.conf,
+			debug:           h2.debug,
+			upgradeRequest:  &ctx.Request,
+			upgradeSettings: settings,
+		}
+		if err := serverConn.Serve(); err != nil {
+			h2.debug.Errorf("Error serving upgraded connection: %v", err)
+		}
+	})
+	return true
+}
+
+// appendH2RequestHeaders appends the header fields of an HTTP/1.1 request to dst,
+// mapping the request line, the scheme and the Host header to pseudo-header fields
+func appendH2RequestHeaders(dst []hpack.HeaderField, h *RequestHeader, scheme string) []hpack.HeaderField {
+	dst = append(dst,
+		hpack.HeaderField{Name: ":method", Value: string(h.Method())},
+		hpack.HeaderField{Name: ":scheme", Value: scheme},
+		hpack.HeaderField{Name: ":path", Value: string(h.RequestURI())},
+	)
+	if host := h.Host(); len(host) > 0 {
+		dst = append(dst, hpack.HeaderField{Name: ":authority", Value: string(host)})
+	}
+
+	h.VisitAll(func(key, value []byte) {
+		if isH2ConnectionHeader(key) ||
+			caseInsensitiveCompare(key, strHost) ||
+			caseInsensitiveCompare(key, strHTTP2Settings) ||
+			caseInsensitiveCompare(key, strTE) {
+			return
+		}
+		dst = appendH2Header(dst, key, value)
+	})
+	return dst
+}
@@ -0,0 +1,175 @@
+package fns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cTestConn reads the bytes buffered while reading the 101 response first
+type h2cTestConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *h2cTestConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func newH2CTestServer(t *testing.T) net.Conn {
+	t.Helper()
+
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.Response.Header.Set("X-Method", string(ctx.Method()))
+			ctx.Response.Header.Set("X-Host", string(ctx.Host()))
+			ctx.Response.Header.Set("X-Upgrade", string(ctx.Request.Header.Peek(HeaderUpgrade)))
+			ctx.Response.Header.Set("X-Foo", string(ctx.Request.Header.Peek("Foo")))
+			ctx.Response.Header.Set("X-Conn", fmt.Sprintf("%T", ctx.Conn()))
+			ctx.SetBodyString(fmt.Sprintf("%s %s", ctx.Path(), ctx.PostBody()))
+		},
+		ReadTimeout: time.Second,
+	}
+	EnableHTTP2(s, ServerConfig{H2C: true})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.Serve(ln) //nolint:errcheck
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	t.Parallel()
+
+	cl := newH2TestClientConn(t, newH2CTestServer(t))
+	cl.writeRequest(1, true, ":method", "GET", ":scheme", "http", ":authority", "localhost", ":path", "/hello")
+	resp := cl.readResponse(1)
+
+	if v := resp.header(":status"); v != "200" {
+		t.Fatalf("unexpected :status %q", v)
+	}
+	if v := resp.header("x-host"); v != "localhost" {
+		t.Fatalf("unexpected x-host %q", v)
+	}
+	if string(resp.body) != "/hello " {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	t.Parallel()
+
+	c := newH2CTestServer(t)
+
+	// The client announces a tiny window, the response body is split by flow control
+	settings := make([]byte, 6)
+	binary.BigEndian.PutUint16(settings, uint16(http2.SettingInitialWindowSize))
+	binary.BigEndian.PutUint32(settings[2:], 4)
+	req := "POST /upload HTTP/1.1\r\nHost: localhost\r\nFoo: bar\r\nContent-Length: 5\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n" +
+		"HTTP2-Settings: " + base64.RawURLEncoding.EncodeToString(settings) + "\r\n\r\nhello"
+	if _, err := c.Write([]byte(req)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	br := bufio.NewReader(c)
+	var resp Response
+	resp.SkipBody = true
+	if err := resp.Header.Read(br); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode() != StatusSwitchingProtocols {
+		t.Fatalf("unexpected status code %d", resp.StatusCode())
+	}
+	if v := string(resp.Header.Peek(HeaderUpgrade)); v != "h2c" {
+		t.Fatalf("unexpected Upgrade header %q", v)
+	}
+
+	// The upgrading request is answered on stream 1
+	cl := newH2TestClientConn(t, &h2cTestConn{Conn: c, r: br})
+	f := cl.readFrame()
+	hf, ok := f.(*http2.HeadersFrame)
+	if !ok || hf.StreamID != 1 {
+		t.Fatalf("expected HEADERS frame on stream 1, got %v", f)
+	}
+	fields, err := cl.dec.DecodeFull(hf.HeaderBlockFragment())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h2resp := &h2TestResponse{headers: fields}
+	for name, want := range map[string]string{":status": "200", "x-method": "POST", "x-host": "localhost", "x-upgrade": "", "x-foo": "bar"} {
+		if v := h2resp.header(name); v != want {
+			t.Fatalf("unexpected %s %q, expected %q", name, v, want)
+		}
+	}
+
+	f = cl.readFrame()
+	df, ok := f.(*http2.DataFrame)
+	if !ok || string(df.Data()) != "/upl" {
+		t.Fatalf("expected DATA frame limited by the HTTP2-Settings window, got %v", f)
+	}
+	if err := cl.fr.WriteWindowUpdate(1, 100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp := cl.readResponse(1); string(resp.body) != "oad hello" {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+
+	// The connection carries new streams afterwards
+	if err := cl.fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 16}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cl.writeRequest(3, true, ":method", "GET", ":scheme", "http", ":authority", "localhost", ":path", "/next")
+	if resp := cl.readResponse(3); string(resp.body) != "/next " {
+		t.Fatalf("unexpected body %q", resp.body)
+	}
+}
+
+func TestH2CHTTP1(t *testing.T) {
+	t.Parallel()
+
+	c := newH2CTestServer(t)
+	br := bufio.NewReader(c)
+
+	// Requests which can't upgrade the connection are served over HTTP/1.1, on the
+	// connection itself once the bytes peeked are replayed
+	for i, req := range []string{
+		"POST /post HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nfoo",
+		"GET /plain HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"GET /invalid HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAE\r\n\r\n",
+		"GET /noconn HTTP/1.1\r\nHost: localhost\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n",
+	} {
+		if _, err := c.Write([]byte(req)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var resp Response
+		if err := resp.Read(br); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.StatusCode() != StatusOK {
+			t.Fatalf("unexpected status code %d", resp.StatusCode())
+		}
+		if len(resp.Body()) == 0 || resp.Body()[0] != '/' || (i == 0 && string(resp.Body()) != "/post foo") {
+			t.Fatalf("unexpected body %q", resp.Body())
+		}
+		if v := string(resp.Header.Peek("X-Conn")); v != "*net.TCPConn" {
+			t.Fatalf("unexpected connection type %q", v)
+		}
+	}
+}
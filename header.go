@@ -302,6 +302,10 @@ func (h *RequestHeader) SetContentLength(contentLength int) {
 
 func (h *ResponseHeader) isCompressibleContentType() bool {
 	contentType := h.ContentType()
+	// The event streams are sent event by event, compressing them holds the events back
+	if bytes.HasPrefix(contentType, strTextEventStream) {
+		return false
+	}
 	return bytes.HasPrefix(contentType, strTextSlash) ||
 		bytes.HasPrefix(contentType, strApplicationSlash) ||
 		bytes.HasPrefix(contentType, strImageSVG) ||
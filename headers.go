@@ -85,6 +85,7 @@ const (
 	HeaderXForwardedFor   = "X-Forwarded-For"
 	HeaderXForwardedHost  = "X-Forwarded-Host"
 	HeaderXForwardedProto = "X-Forwarded-Proto"
+	HeaderXRealIP         = "X-Real-IP"
 
 	// Redirects
 	HeaderLocation = "Location"
@@ -95,6 +96,7 @@ const (
 	HeaderReferer        = "Referer"
 	HeaderReferrerPolicy = "Referrer-Policy"
 	HeaderUserAgent      = "User-Agent"
+	HeaderXRequestID     = "X-Request-ID"
 
 	// Response context
 	HeaderAllow  = "Allow"
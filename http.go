@@ -1549,6 +1549,41 @@ func (req *Request) onlyMultipartForm() bool {
 //
 // See also WriteTo.
 func (req *Request) Write(w *bufio.Writer) error {
+	if err := req.prepareWrite(); err != nil {
+		return err
+	}
+
+	if req.bodyStream != nil {
+		return req.writeBodyStream(w)
+	}
+
+	body, err := req.bodyToWrite()
+	if err != nil {
+		return err
+	}
+
+	hasBody := false
+	if len(body) != 0 || !req.Header.ignoreBody() {
+		hasBody = true
+		req.Header.SetContentLength(len(body))
+	}
+	if err = req.Header.Write(w); err != nil {
+		return err
+	}
+	if hasBody {
+		_, err = w.Write(body)
+	} else if len(body) > 0 {
+		if req.secureErrorLogMessage {
+			return fmt.Errorf("non-zero body for non-POST request")
+		}
+		return fmt.Errorf("non-zero body for non-POST request. body=%q", body)
+	}
+	return err
+}
+
+// prepareWrite sets the Host header, the request URI and the basic authentication
+// credentials from the request URI before the request is sent
+func (req *Request) prepareWrite() error {
 	if len(req.Header.Host()) == 0 || req.parsedURI {
 		uri := req.URI()
 		host := uri.Host()
@@ -1582,41 +1617,25 @@ func (req *Request) Write(w *bufio.Writer) error {
 			req.Header.SetBytesKV(strAuthorization, buf[nl:tl])
 		}
 	}
+	return nil
+}
 
-	if req.bodyStream != nil {
-		return req.writeBodyStream(w)
-	}
-
+// bodyToWrite returns the body to send, marshaling the multipart form or the post
+// args if the body is empty
+func (req *Request) bodyToWrite() ([]byte, error) {
 	body := req.bodyBytes()
-	var err error
 	if req.onlyMultipartForm() {
+		var err error
 		body, err = marshalMultipartForm(req.multipartForm, req.multipartFormBoundary)
 		if err != nil {
-			return fmt.Errorf("error when marshaling multipart form: %w", err)
+			return nil, fmt.Errorf("error when marshaling multipart form: %w", err)
 		}
 		req.Header.SetMultipartFormBoundary(req.multipartFormBoundary)
 	}
-
-	hasBody := false
 	if len(body) == 0 {
 		body = req.postArgs.QueryString()
 	}
-	if len(body) != 0 || !req.Header.ignoreBody() {
-		hasBody = true
-		req.Header.SetContentLength(len(body))
-	}
-	if err = req.Header.Write(w); err != nil {
-		return err
-	}
-	if hasBody {
-		_, err = w.Write(body)
-	} else if len(body) > 0 {
-		if req.secureErrorLogMessage {
-			return fmt.Errorf("non-zero body for non-POST request")
-		}
-		return fmt.Errorf("non-zero body for non-POST request. body=%q", body)
-	}
-	return err
+	return body, nil
 }
 
 // WriteGzip writes response with gzipped body to w.
@@ -2,6 +2,7 @@ package frames
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -21,6 +22,9 @@ const (
 	FrameWindowUpdate = 0x8
 	FrameContinuation = 0x9
 
+	// FramePriorityUpdate is defined by RFC 9218 section 7
+	FramePriorityUpdate = 0x10
+
 	// Default body size
 	DefaultFrameBodySize = 16384
 )
@@ -29,9 +33,16 @@ const (
 const (
 	FlagEndStream  = 0x1
 	FlagEndHeaders = 0x4
+	FlagPadded     = 0x8
+	FlagPriority   = 0x20
 	FlagAck        = 0x1
 )
 
+var (
+	ErrInvalidPadding = errors.New("padding length exceeds frame payload")
+	ErrShortFrame     = errors.New("frame payload too short")
+)
+
 // Frame represents an HTTP/2 frame
 type Frame struct {
 	rawHeader [9]byte
@@ -103,8 +114,8 @@ func ReadFrame(conn net.Conn) (*Frame, error) {
 	return f, nil
 }
 
-// WriteTo writes a frame to the connection
-func (f *Frame) WriteTo(conn net.Conn) error {
+// Write writes a frame to the connection
+func (f *Frame) Write(conn io.Writer) error {
 	// Write the length of the frame in the first 24 bits
 	length := uint32(len(f.Body))
 	f.rawHeader[0] = byte(length >> 16)
@@ -134,6 +145,36 @@ func (f *Frame) WriteTo(conn net.Conn) error {
 	return nil
 }
 
+// Payload returns the frame body stripped of padding and, for HEADERS frames, of the
+// priority fields. The returned slice shares memory with the frame body.
+func (f *Frame) Payload() ([]byte, error) {
+	body := f.Body
+	switch f.Type {
+	case FrameData, FrameHeaders, FramePushPromise:
+	default:
+		return body, nil
+	}
+
+	padLength := 0
+	if f.Flags&FlagPadded != 0 {
+		if len(body) < 1 {
+			return nil, ErrShortFrame
+		}
+		padLength = int(body[0])
+		body = body[1:]
+	}
+	if f.Type == FrameHeaders && f.Flags&FlagPriority != 0 {
+		if len(body) < 5 {
+			return nil, ErrShortFrame
+		}
+		body = body[5:]
+	}
+	if padLength > len(body) {
+		return nil, ErrInvalidPadding
+	}
+	return body[:len(body)-padLength], nil
+}
+
 func (f *Frame) Length() uint32 {
 	return uint32(len(f.Body))
 }
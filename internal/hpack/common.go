@@ -29,7 +29,7 @@ var buffer256Pool = sync.Pool{
 }
 
 func acquireBuffer256() []byte {
-	return buffer1KPool.Get().([]byte)[:0]
+	return buffer256Pool.Get().([]byte)[:0]
 }
 
 func releaseBuffer256(buf []byte) {
@@ -2,74 +2,170 @@ package hpack
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
 )
 
-// Decoder decodes header fields using HPACK
+// ErrHeaderListTooLarge is returned when the decoded header list exceeds the limit set
+// with SetMaxHeaderListSize. The whole header block is still processed, so the decoder
+// stays in sync with the peer encoder and the connection can be kept.
+var ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+
+// Decoder decodes header fields using HPACK, as defined in RFC 7541.
+//
+// Decoder maintains the state of the dynamic table shared with the peer encoder,
+// so all the header blocks of a connection must be decoded with the same Decoder
+// in the order they were received.
 type Decoder struct {
 	dynamicTable dynamicTable
+
+	// maxSizeLimit is the largest dynamic table size the peer encoder may set,
+	// as announced with SETTINGS_HEADER_TABLE_SIZE
+	maxSizeLimit uint32
+
+	// maxHeaderListSize is the largest accepted header list size, 0 means unlimited
+	maxHeaderListSize uint32
 }
 
 // NewDecoder creates a new HPACK decoder
 func NewDecoder() *Decoder {
 	return &Decoder{
 		dynamicTable: newDynamicTable(),
+		maxSizeLimit: DefaultDynamicTableSize,
 	}
 }
 
+// SetMaxDynamicTableSizeLimit sets the upper bound for the dynamic table size updates sent
+// by the peer. It must be called with the value of SETTINGS_HEADER_TABLE_SIZE announced to the peer.
+func (d *Decoder) SetMaxDynamicTableSizeLimit(v uint32) {
+	d.maxSizeLimit = v
+}
+
+// SetMaxHeaderListSize sets the largest header list size accepted, computed as described
+// in RFC 9113 section 6.5.2. It protects against header blocks that expand to huge header
+// lists when decoded. 0 means unlimited.
+func (d *Decoder) SetMaxHeaderListSize(v uint32) {
+	d.maxHeaderListSize = v
+}
+
 // Decode decodes header fields using HPACK into http/1.1 header buffer
 // Each call to Decode appends a key: value<CRLF> pair to the buffer
 func (d *Decoder) Decode(dst *[]byte, data []byte) error {
-	buf := bytes.NewBuffer(data)
 	dstBuf := bytes.NewBuffer(*dst)
+	err := d.decode(data, func(key, val []byte, sensitive bool) {
+		d.writeHeader(dstBuf, key, val)
+	})
+	*dst = dstBuf.Bytes()
+	return err
+}
 
+// DecodeFields decodes a complete header block and returns the decoded header fields
+// in the order they appear in the block.
+func (d *Decoder) DecodeFields(data []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	err := d.decode(data, func(key, val []byte, sensitive bool) {
+		fields = append(fields, HeaderField{Name: string(key), Value: string(val), Sensitive: sensitive})
+	})
+	return fields, err
+}
+
+// decode walks the header block and calls emit for each decoded field.
+// emit must not retain key or val after returning.
+func (d *Decoder) decode(data []byte, emit func(key, val []byte, sensitive bool)) error {
 	key := acquireBuffer1K()
 	val := acquireBuffer1K()
 
-	defer releaseBuffer1K(key)
-	defer releaseBuffer1K(val)
+	defer func() {
+		releaseBuffer1K(key)
+		releaseBuffer1K(val)
+	}()
 
-	for buf.Len() > 0 {
-		prefix := buf.Next(1)[0]
+	var listSize uint64
+	tooLarge := false
+	fieldSeen := false
+	for len(data) > 0 {
+		var err error
+		sensitive := false
+		prefix := data[0]
 		switch {
 		case prefix&0x80 == 0x80:
 			// Indexed Header Field Representation
-			index := int(prefix & 0x7f)
-			err := d.dynamicTable.get(&key, &val, index)
+			var index uint64
+			index, data, err = readInt(data, 7)
 			if err != nil {
 				return err
 			}
-			d.writeHeader(dstBuf, key, val)
+			if err = d.dynamicTable.get(&key, &val, int(index)); err != nil {
+				return err
+			}
 		case prefix&0xc0 == 0x40:
 			// Literal Header Field with Incremental Indexing
-			index := int(prefix & 0x3f)
-			err := d.dynamicTable.get(&key, &val, index)
-			if err != nil {
+			if data, err = d.readLiteral(data, 6, &key, &val); err != nil {
 				return err
 			}
-			err = readDecoded(&val, buf)
-			if err != nil {
-				return err
+			d.dynamicTable.add(key, val)
+		case prefix&0xe0 == 0x20:
+			// Dynamic Table Size Update, only allowed at the beginning of a header block
+			if fieldSeen {
+				return ErrInvalidTableSizeUpdate
 			}
-			d.writeHeader(dstBuf, key, val)
-		case prefix&0xf0 == 0x00:
-			// Literal Header Field without Indexing
-			err := readDecoded(&key, buf)
+			var size uint64
+			size, data, err = readInt(data, 5)
 			if err != nil {
 				return err
 			}
-			err = readDecoded(&val, buf)
-			if err != nil {
+			if size > uint64(d.maxSizeLimit) {
+				return ErrInvalidTableSizeUpdate
+			}
+			d.dynamicTable.setMaxSize(uint32(size))
+			continue
+		case prefix&0xf0 == 0x10:
+			// Literal Header Field Never Indexed
+			if data, err = d.readLiteral(data, 4, &key, &val); err != nil {
 				return err
 			}
-			d.writeHeader(dstBuf, key, val)
+			sensitive = true
 		default:
-			return fmt.Errorf("unsupported HPACK prefix: 0x%x", prefix)
+			// Literal Header Field without Indexing
+			if data, err = d.readLiteral(data, 4, &key, &val); err != nil {
+				return err
+			}
+		}
+		fieldSeen = true
+
+		// Keep decoding an oversized header list to track the dynamic table updates,
+		// but stop handing out fields
+		listSize += uint64(len(key)+len(val)) + entryOverhead
+		if d.maxHeaderListSize > 0 && listSize > uint64(d.maxHeaderListSize) {
+			tooLarge = true
 		}
+		if !tooLarge {
+			emit(key, val, sensitive)
+		}
+	}
+	if tooLarge {
+		return ErrHeaderListTooLarge
 	}
 	return nil
 }
 
+// readLiteral reads a literal header field representation whose name index has an
+// n-bit prefix, and returns the remaining data
+func (d *Decoder) readLiteral(data []byte, n uint8, key, val *[]byte) ([]byte, error) {
+	index, data, err := readInt(data, n)
+	if err != nil {
+		return data, err
+	}
+	if index == 0 {
+		data, err = readString(key, data)
+	} else {
+		err = d.dynamicTable.get(key, val, int(index))
+	}
+	if err != nil {
+		return data, err
+	}
+	return readString(val, data)
+}
+
 // writeHeader writes a header field to the buffer. The keys are sanitized to prevent header smuggling.
 func (d *Decoder) writeHeader(dstBuf *bytes.Buffer, key, val []byte) {
 	d.fixSmuggling(key)
@@ -0,0 +1,314 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type decoderTestBlock struct {
+	input  string
+	fields []HeaderField
+	size   uint32
+}
+
+func testDecoderBlocks(t *testing.T, d *Decoder, blocks []decoderTestBlock) {
+	t.Helper()
+
+	for i, block := range blocks {
+		data, err := hex.DecodeString(block.input)
+		if err != nil {
+			t.Fatalf("Invalid test input: %v", err)
+		}
+		fields, err := d.DecodeFields(data)
+		if err != nil {
+			t.Fatalf("Block %d: unexpected error: %v", i+1, err)
+		}
+		if len(fields) != len(block.fields) {
+			t.Fatalf("Block %d: expected %d fields, but got %d: %v", i+1, len(block.fields), len(fields), fields)
+		}
+		for j, f := range block.fields {
+			if fields[j] != f {
+				t.Errorf("Block %d: expected field %v, but got %v", i+1, f, fields[j])
+			}
+		}
+		if d.dynamicTable.size != block.size {
+			t.Errorf("Block %d: expected table size %d, but got %d", i+1, block.size, d.dynamicTable.size)
+		}
+	}
+}
+
+func TestDecoderFieldExamples(t *testing.T) {
+	// Header field representation examples from RFC 7541 appendix C.2
+	testCases := []struct {
+		name  string
+		block decoderTestBlock
+	}{
+		{
+			name: "literal with indexing",
+			block: decoderTestBlock{
+				input:  "400a637573746f6d2d6b65790d637573746f6d2d686561646572",
+				fields: []HeaderField{{Name: "custom-key", Value: "custom-header"}},
+				size:   55,
+			},
+		},
+		{
+			name: "literal without indexing",
+			block: decoderTestBlock{
+				input:  "040c2f73616d706c652f70617468",
+				fields: []HeaderField{{Name: ":path", Value: "/sample/path"}},
+			},
+		},
+		{
+			name: "literal never indexed",
+			block: decoderTestBlock{
+				input:  "100870617373776f726406736563726574",
+				fields: []HeaderField{{Name: "password", Value: "secret", Sensitive: true}},
+			},
+		},
+		{
+			name: "indexed",
+			block: decoderTestBlock{
+				input:  "82",
+				fields: []HeaderField{{Name: ":method", Value: "GET"}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testDecoderBlocks(t, NewDecoder(), []decoderTestBlock{tc.block})
+		})
+	}
+}
+
+func TestDecoderRequestExamples(t *testing.T) {
+	request1 := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}
+	request2 := append(request1[:4:4], HeaderField{Name: "cache-control", Value: "no-cache"})
+	request3 := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}
+
+	t.Run("without Huffman", func(t *testing.T) {
+		// RFC 7541 appendix C.3
+		testDecoderBlocks(t, NewDecoder(), []decoderTestBlock{
+			{"828684410f7777772e6578616d706c652e636f6d", request1, 57},
+			{"828684be58086e6f2d6361636865", request2, 110},
+			{"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565", request3, 164},
+		})
+	})
+
+	t.Run("with Huffman", func(t *testing.T) {
+		// RFC 7541 appendix C.4
+		testDecoderBlocks(t, NewDecoder(), []decoderTestBlock{
+			{"828684418cf1e3c2e5f23a6ba0ab90f4ff", request1, 57},
+			{"828684be5886a8eb10649cbf", request2, 110},
+			{"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf", request3, 164},
+		})
+	})
+}
+
+func TestDecoderResponseExamples(t *testing.T) {
+	response1 := []HeaderField{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}
+	response2 := append([]HeaderField{{Name: ":status", Value: "307"}}, response1[1:]...)
+	response3 := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	}
+
+	// The response examples use a 256 bytes dynamic table, so entries are evicted
+	t.Run("without Huffman", func(t *testing.T) {
+		// RFC 7541 appendix C.5
+		d := NewDecoder()
+		d.dynamicTable.setMaxSize(256)
+		testDecoderBlocks(t, d, []decoderTestBlock{
+			{"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d54" +
+				"6e1768747470733a2f2f7777772e6578616d706c652e636f6d", response1, 222},
+			{"4803333037c1c0bf", response2, 222},
+			{"88c1611d4d6f6e2c203231204f637420323031332032303a31333a323220474d54c05a04677a69707738666f6f" +
+				"3d4153444a4b48514b425a584f5157454f50495541585157454f49553b206d61782d6167653d333630303b207665" +
+				"7273696f6e3d31", response3, 215},
+		})
+	})
+
+	t.Run("with Huffman", func(t *testing.T) {
+		// RFC 7541 appendix C.6
+		d := NewDecoder()
+		d.dynamicTable.setMaxSize(256)
+		testDecoderBlocks(t, d, []decoderTestBlock{
+			{"488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3",
+				response1, 222},
+			{"4883640effc1c0bf", response2, 222},
+			{"88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7821dd7f2e6c7b335dfdfcd5b3960d5af2708" +
+				"7f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007", response3, 215},
+		})
+	})
+}
+
+func TestDecoderTableSizeUpdate(t *testing.T) {
+	d := NewDecoder()
+	d.SetMaxDynamicTableSizeLimit(1024)
+
+	// Add an entry, then shrink the table to 0 and grow it again in the next block
+	if _, err := d.DecodeFields([]byte{0x40, 0x01, 'a', 0x01, 'b'}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fields, err := d.DecodeFields([]byte{0x20, 0x3f, 0xe1, 0x07, 0x82})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(fields) != 1 || fields[0].Name != ":method" {
+		t.Fatalf("Unexpected fields %v", fields)
+	}
+	if d.dynamicTable.maxSize != 1024 || len(d.dynamicTable.entries) != 0 {
+		t.Fatalf("Expected an empty table of 1024 bytes, got %d entries of %d bytes",
+			len(d.dynamicTable.entries), d.dynamicTable.maxSize)
+	}
+
+	testCases := []struct {
+		name  string
+		input []byte
+	}{
+		{"after a header field", []byte{0x82, 0x20}},
+		{"above the limit", []byte{0x3f, 0xe2, 0x1f}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewDecoder().DecodeFields(tc.input)
+			if !errors.Is(err, ErrInvalidTableSizeUpdate) {
+				t.Fatalf("Expected %v, but got %v", ErrInvalidTableSizeUpdate, err)
+			}
+		})
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"index zero", []byte{0x80}, ErrInvalidIndex},
+		{"index out of range", []byte{0xbe}, ErrInvalidIndex},
+		{"truncated integer", []byte{0xff, 0x80}, ErrTruncated},
+		{"integer overflow", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0f}, ErrIntegerOverflow},
+		{"truncated string", []byte{0x00, 0x05, 'a'}, ErrTruncated},
+		{"missing value", []byte{0x00, 0x01, 'a'}, ErrTruncated},
+		{"invalid Huffman", []byte{0x00, 0x81, 0x18, 0x00}, ErrInvalidHuffman},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewDecoder().DecodeFields(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected %v, but got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestDecoderMaxHeaderListSize(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder()
+	d.SetMaxHeaderListSize(1024)
+
+	var buf bytes.Buffer
+	encode := func(fields ...string) []byte {
+		buf.Reset()
+		for i := 0; i+1 < len(fields); i += 2 {
+			if err := e.Encode(&buf, []byte(fields[i]), []byte(fields[i+1])); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	// A single indexed entry referenced many times expands to a large header list
+	bomb := []string{"x-bomb", strings.Repeat("b", 100)}
+	for i := 0; i < 100; i++ {
+		bomb = append(bomb, "x-bomb", strings.Repeat("b", 100))
+	}
+	block := encode(bomb...)
+	if len(block) > 256 {
+		t.Fatalf("Expected a compact header block, got %d bytes", len(block))
+	}
+	fields, err := d.DecodeFields(block)
+	if !errors.Is(err, ErrHeaderListTooLarge) {
+		t.Fatalf("Expected %v, but got %v", ErrHeaderListTooLarge, err)
+	}
+	if len(fields) > 1024/(32+6+100) {
+		t.Fatalf("Expected decoding to stop at the limit, got %d fields", len(fields))
+	}
+
+	// The decoder is still in sync with the encoder
+	fields, err = d.DecodeFields(encode("x-bomb", strings.Repeat("b", 100), "x-other", "value"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(fields) != 2 || fields[0].Name != "x-bomb" || fields[1].Value != "value" {
+		t.Fatalf("Unexpected fields %v", fields)
+	}
+}
+
+func TestDecoderEncoderRoundTrip(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder()
+
+	var buf bytes.Buffer
+	for i := 0; i < 50; i++ {
+		fields := []HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "text/plain"},
+			{Name: "x-request", Value: strings.Repeat("r", i*10)},
+			{Name: "set-cookie", Value: "id=" + strings.Repeat("c", i)},
+		}
+		if i == 25 {
+			e.SetMaxDynamicTableSize(100)
+		}
+
+		buf.Reset()
+		for _, f := range fields {
+			if err := e.EncodeField(&buf, f); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		decoded, err := d.DecodeFields(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Block %d: unexpected error: %v", i, err)
+		}
+		if len(decoded) != len(fields) {
+			t.Fatalf("Block %d: expected %d fields, but got %d", i, len(fields), len(decoded))
+		}
+		for j, f := range fields {
+			if decoded[j].Name != f.Name || decoded[j].Value != f.Value {
+				t.Fatalf("Block %d: expected field %v, but got %v", i, f, decoded[j])
+			}
+		}
+		if !decoded[3].Sensitive {
+			t.Fatalf("Block %d: expected set-cookie to be never indexed", i)
+		}
+	}
+	if d.dynamicTable.maxSize != 100 {
+		t.Fatalf("Expected decoder table size 100, but got %d", d.dynamicTable.maxSize)
+	}
+}
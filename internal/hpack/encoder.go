@@ -0,0 +1,147 @@
+package hpack
+
+import (
+	"bytes"
+)
+
+// Encoder encodes header fields using HPACK, as defined in RFC 7541.
+//
+// Encoder maintains the state of the dynamic table shared with the peer decoder,
+// so all the header blocks of a connection must be encoded with the same Encoder
+// and sent in the same order they were encoded.
+type Encoder struct {
+	dynamicTable dynamicTable
+
+	// maxSizeLimit is the largest dynamic table size the peer decoder accepts,
+	// as announced with SETTINGS_HEADER_TABLE_SIZE
+	maxSizeLimit uint32
+
+	// minSize is the smallest table size set since the last dynamic table size update was sent
+	minSize uint32
+
+	// sizeUpdate is true when a dynamic table size update must start the next header block
+	sizeUpdate bool
+
+	buf []byte
+}
+
+// NewEncoder creates a new HPACK encoder
+func NewEncoder() *Encoder {
+	return &Encoder{
+		dynamicTable: newDynamicTable(),
+		maxSizeLimit: DefaultDynamicTableSize,
+	}
+}
+
+// SetMaxDynamicTableSizeLimit sets the upper bound for the dynamic table size. It must be
+// called with the value of SETTINGS_HEADER_TABLE_SIZE received from the peer.
+// The dynamic table is shrunk if it is larger than the new limit.
+func (e *Encoder) SetMaxDynamicTableSizeLimit(v uint32) {
+	e.maxSizeLimit = v
+	if e.dynamicTable.maxSize > v {
+		e.SetMaxDynamicTableSize(v)
+	}
+}
+
+// SetMaxDynamicTableSize changes the dynamic table size, capped by the limit set with
+// SetMaxDynamicTableSizeLimit. The change is signaled to the peer at the beginning of the
+// next header block, so it must not be called while a header block is being encoded.
+func (e *Encoder) SetMaxDynamicTableSize(v uint32) {
+	if v > e.maxSizeLimit {
+		v = e.maxSizeLimit
+	}
+	if !e.sizeUpdate || v < e.minSize {
+		e.minSize = v
+	}
+	e.sizeUpdate = true
+	e.dynamicTable.setMaxSize(v)
+}
+
+// MaxDynamicTableSize returns the current dynamic table size
+func (e *Encoder) MaxDynamicTableSize() uint32 {
+	return e.dynamicTable.maxSize
+}
+
+// Encode encodes raw header fields using HPACK.
+//
+// Well known sensitive headers, such as Authorization and Set-Cookie, are encoded as
+// never indexed literals. Use EncodeField to mark other fields as sensitive.
+func (e *Encoder) Encode(buf *bytes.Buffer, key, value []byte) error {
+	e.buf = e.appendField(e.buf[:0], key, value, isSensitiveHeader(key))
+	_, err := buf.Write(e.buf)
+	return err
+}
+
+// EncodeField encodes a header field using HPACK. The field is encoded as a never
+// indexed literal if it is marked as sensitive or it is a well known sensitive header.
+func (e *Encoder) EncodeField(buf *bytes.Buffer, f HeaderField) error {
+	key := []byte(f.Name)
+	e.buf = e.appendField(e.buf[:0], key, []byte(f.Value), f.Sensitive || isSensitiveHeader(key))
+	_, err := buf.Write(e.buf)
+	return err
+}
+
+func (e *Encoder) appendField(dst, key, value []byte, sensitive bool) []byte {
+	dst = e.appendTableSizeUpdate(dst)
+
+	index, nameOnly := e.dynamicTable.find(key, value)
+	switch {
+	case sensitive:
+		// Literal Header Field Never Indexed, RFC 7541 section 6.2.3
+		return appendLiteral(dst, 0x10, 4, index, key, value)
+	case index != 0 && !nameOnly:
+		// Indexed Header Field, RFC 7541 section 6.1
+		return appendInt(dst, 0x80, 7, uint64(index))
+	case e.shouldIndex(key, value):
+		// Literal Header Field with Incremental Indexing, RFC 7541 section 6.2.1
+		dst = appendLiteral(dst, 0x40, 6, index, key, value)
+		e.dynamicTable.add(key, value)
+		return dst
+	default:
+		// Literal Header Field without Indexing, RFC 7541 section 6.2.2
+		return appendLiteral(dst, 0, 4, index, key, value)
+	}
+}
+
+// appendTableSizeUpdate appends the pending dynamic table size updates. When the size
+// was lowered and raised again, the smallest size is signaled first, see RFC 7541 section 4.2.
+func (e *Encoder) appendTableSizeUpdate(dst []byte) []byte {
+	if !e.sizeUpdate {
+		return dst
+	}
+	e.sizeUpdate = false
+	if e.minSize < e.dynamicTable.maxSize {
+		dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+	}
+	return appendInt(dst, 0x20, 5, uint64(e.dynamicTable.maxSize))
+}
+
+// shouldIndex reports whether the field is worth adding to the dynamic table.
+// Fields larger than the table would only flush it.
+func (e *Encoder) shouldIndex(key, value []byte) bool {
+	return uint32(len(key)+len(value))+entryOverhead <= e.dynamicTable.maxSize
+}
+
+// appendLiteral appends a literal header field representation. The name is referenced
+// by index if it is not 0, otherwise it is sent as a string literal.
+func appendLiteral(dst []byte, first byte, n uint8, index int, key, value []byte) []byte {
+	dst = appendInt(dst, first, n, uint64(index))
+	if index == 0 {
+		dst = appendString(dst, key)
+	}
+	return appendString(dst, value)
+}
+
+// isSensitiveHeader reports whether the header carries credentials that must never be
+// added to a compression table, see RFC 7541 section 7.1.3
+func isSensitiveHeader(key []byte) bool {
+	switch len(key) {
+	case len("set-cookie"):
+		return bytes.EqualFold(key, []byte("set-cookie"))
+	case len("authorization"):
+		return bytes.EqualFold(key, []byte("authorization"))
+	case len("proxy-authorization"):
+		return bytes.EqualFold(key, []byte("proxy-authorization"))
+	}
+	return false
+}
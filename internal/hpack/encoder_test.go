@@ -0,0 +1,224 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestAppendInt(t *testing.T) {
+	// Examples from RFC 7541 appendix C.1
+	testCases := []struct {
+		name     string
+		n        uint8
+		i        uint64
+		expected []byte
+	}{
+		{"10 with 5-bit prefix", 5, 10, []byte{0x0a}},
+		{"1337 with 5-bit prefix", 5, 1337, []byte{0x1f, 0x9a, 0x0a}},
+		{"42 with 8-bit prefix", 8, 42, []byte{0x2a}},
+		{"31 with 5-bit prefix", 5, 31, []byte{0x1f, 0x00}},
+		{"127 with 7-bit prefix", 7, 127, []byte{0x7f, 0x00}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := appendInt(nil, 0, tc.n, tc.i)
+			if !bytes.Equal(result, tc.expected) {
+				t.Errorf("Expected %x, but got %x", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestHuffmanEncode(t *testing.T) {
+	inputs := []string{
+		"",
+		"a",
+		"no-cache",
+		"www.example.com",
+		"custom-value",
+		"Mon, 21 Oct 2013 20:13:21 GMT",
+		"foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+	}
+	var all []byte
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i))
+	}
+	inputs = append(inputs, string(all))
+
+	for _, input := range inputs {
+		expected := hpack.AppendHuffmanString(nil, input)
+		result := appendHuffman(nil, []byte(input))
+		if !bytes.Equal(result, expected) {
+			t.Errorf("Huffman encoding of %q: expected %x, but got %x", input, expected, result)
+		}
+		if n := huffmanEncodedLength([]byte(input)); n != len(expected) {
+			t.Errorf("Huffman encoded length of %q: expected %d, but got %d", input, len(expected), n)
+		}
+	}
+}
+
+func encodeHeaderBlock(t *testing.T, e *Encoder, fields ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := e.Encode(&buf, []byte(fields[i]), []byte(fields[i+1])); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestEncoderRequestExamples(t *testing.T) {
+	// Request examples with Huffman coding from RFC 7541 appendix C.4
+	e := NewEncoder()
+	blocks := []struct {
+		fields   []string
+		expected string
+		size     uint32
+	}{
+		{
+			fields:   []string{":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"},
+			expected: "828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			size:     57,
+		},
+		{
+			fields:   []string{":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"},
+			expected: "828684be5886a8eb10649cbf",
+			size:     110,
+		},
+		{
+			fields:   []string{":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"},
+			expected: "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+			size:     164,
+		},
+	}
+
+	for i, block := range blocks {
+		result := hex.EncodeToString(encodeHeaderBlock(t, e, block.fields...))
+		if result != block.expected {
+			t.Errorf("Request %d: expected %s, but got %s", i+1, block.expected, result)
+		}
+		if e.dynamicTable.size != block.size {
+			t.Errorf("Request %d: expected table size %d, but got %d", i+1, block.size, e.dynamicTable.size)
+		}
+	}
+}
+
+func TestEncoderResponseExamplesEviction(t *testing.T) {
+	// Response examples with Huffman coding from RFC 7541 appendix C.6,
+	// using a 256 bytes dynamic table so entries are evicted
+	e := NewEncoder()
+	e.dynamicTable.setMaxSize(256)
+
+	blocks := []struct {
+		fields   []string
+		expected string
+		size     uint32
+		entries  int
+	}{
+		{
+			fields: []string{":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT",
+				"location", "https://www.example.com"},
+			expected: "488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3",
+			size:     222,
+			entries:  4,
+		},
+		{
+			fields: []string{":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT",
+				"location", "https://www.example.com"},
+			expected: "4883640effc1c0bf",
+			size:     222,
+			entries:  4,
+		},
+	}
+
+	for i, block := range blocks {
+		result := hex.EncodeToString(encodeHeaderBlock(t, e, block.fields...))
+		if result != block.expected {
+			t.Errorf("Response %d: expected %s, but got %s", i+1, block.expected, result)
+		}
+		if e.dynamicTable.size != block.size {
+			t.Errorf("Response %d: expected table size %d, but got %d", i+1, block.size, e.dynamicTable.size)
+		}
+		if len(e.dynamicTable.entries) != block.entries {
+			t.Errorf("Response %d: expected %d entries, but got %d", i+1, block.entries, len(e.dynamicTable.entries))
+		}
+	}
+
+	// ":status: 302" was the oldest entry and has been evicted
+	if index, nameOnly := e.dynamicTable.find([]byte(":status"), []byte("302")); !nameOnly || index != 8 {
+		t.Errorf("Expected evicted entry to match the static name only, got index %d", index)
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	e := NewEncoder()
+	d := hpack.NewDecoder(DefaultDynamicTableSize, nil)
+
+	blocks := [][]HeaderField{
+		{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "text/html; charset=utf-8"},
+			{Name: "x-long", Value: strings.Repeat("x", 300)},
+			{Name: "set-cookie", Value: "session=secret"},
+		},
+		{
+			{Name: ":status", Value: "404"},
+			{Name: "content-type", Value: "text/html; charset=utf-8"},
+			{Name: "x-token", Value: "secret", Sensitive: true},
+			{Name: "authorization", Value: "Bearer secret"},
+		},
+		{
+			{Name: ":status", Value: "200"},
+			{Name: "x-huge", Value: strings.Repeat("y", 5000)},
+			{Name: "content-type", Value: "text/html; charset=utf-8"},
+		},
+	}
+
+	for i, block := range blocks {
+		switch i {
+		case 1:
+			// Shrink and grow the table between blocks, both updates are signaled
+			e.SetMaxDynamicTableSize(0)
+			e.SetMaxDynamicTableSize(1024)
+		case 2:
+			// The peer lowers SETTINGS_HEADER_TABLE_SIZE
+			e.SetMaxDynamicTableSizeLimit(128)
+			d.SetAllowedMaxDynamicTableSize(128)
+		}
+
+		var buf bytes.Buffer
+		for _, f := range block {
+			if err := e.EncodeField(&buf, f); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		if e.dynamicTable.size > e.dynamicTable.maxSize {
+			t.Fatalf("Block %d: table size %d exceeds max size %d", i, e.dynamicTable.size, e.dynamicTable.maxSize)
+		}
+
+		decoded, err := d.DecodeFull(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Block %d: unexpected decoding error: %v", i, err)
+		}
+		if len(decoded) != len(block) {
+			t.Fatalf("Block %d: expected %d fields, but got %d", i, len(block), len(decoded))
+		}
+		for j, f := range block {
+			sensitive := f.Sensitive || f.Name == "set-cookie" || f.Name == "authorization"
+			if decoded[j].Name != f.Name || decoded[j].Value != f.Value || decoded[j].Sensitive != sensitive {
+				t.Errorf("Block %d: expected field %q: %q (sensitive %v), but got %q: %q (sensitive %v)", i,
+					f.Name, f.Value, sensitive, decoded[j].Name, decoded[j].Value, decoded[j].Sensitive)
+			}
+		}
+	}
+	if e.MaxDynamicTableSize() != 128 {
+		t.Errorf("Expected dynamic table size 128, but got %d", e.MaxDynamicTableSize())
+	}
+}
@@ -1,124 +1,260 @@
 package hpack
 
 import (
-	"bytes"
-	"fmt"
+	"errors"
 )
 
-// Encoder encodes header fields using HPACK
-type Encoder struct {
-	dynamicTable dynamicTable
+// HeaderField is a name-value pair of a header list.
+type HeaderField struct {
+	Name  string
+	Value string
+
+	// Sensitive marks the field as never indexed, so intermediaries
+	// must not add it to their compression tables either
+	Sensitive bool
 }
 
-// NewEncoder creates a new HPACK encoder
-func NewEncoder() *Encoder {
-	return &Encoder{
-		dynamicTable: newDynamicTable(),
+// Errors returned when decoding a malformed header block. All of them are
+// connection errors of type COMPRESSION_ERROR, see RFC 9113 section 4.3.
+var (
+	ErrTruncated              = errors.New("hpack: truncated header block")
+	ErrIntegerOverflow        = errors.New("hpack: integer overflow")
+	ErrInvalidIndex           = errors.New("hpack: invalid index")
+	ErrInvalidTableSizeUpdate = errors.New("hpack: invalid dynamic table size update")
+	ErrInvalidHuffman         = errors.New("hpack: invalid Huffman-encoded data")
+)
+
+// maxInt is the largest integer accepted by readInt. No valid index, string length
+// or table size comes close to it.
+const maxInt = 1<<32 - 1
+
+// readInt reads an integer with an n-bit prefix, as described in RFC 7541 section 5.1,
+// and returns it along with the remaining data.
+func readInt(data []byte, n uint8) (uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, data, ErrTruncated
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(data[0]) & max
+	data = data[1:]
+	if i < max {
+		return i, data, nil
+	}
+
+	var m uint
+	for len(data) > 0 {
+		b := data[0]
+		data = data[1:]
+		i += uint64(b&0x7f) << m
+		if i > maxInt {
+			return 0, data, ErrIntegerOverflow
+		}
+		if b&0x80 == 0 {
+			return i, data, nil
+		}
+		m += 7
 	}
+	return 0, data, ErrTruncated
 }
 
-// Encode encodes raw header fields using HPACK
-func (e *Encoder) Encode(buf *bytes.Buffer, key, value []byte) error {
-	// Check if the field is in the static table
-	index := e.dynamicTable.find(key, value)
-	if index > 0 {
-		// Indexed Header Field
-		buf.WriteByte(0x80 | byte(index))
-	} else {
-		// Literal Header Field with Incremental Indexing
-		buf.WriteByte(0x40)
-		buf.Write(key)
-		writeData(buf, value)
-		field := acquireNameValueBytes()
-		field.name = append(field.name[:0], key...)
-		field.value = append(field.value[:0], value...)
-		e.dynamicTable.entries = append(e.dynamicTable.entries, field)
+// readString reads a string literal into dst, decoding it if it is Huffman encoded,
+// and returns the remaining data. See RFC 7541 section 5.2.
+func readString(dst *[]byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, ErrTruncated
+	}
+	huffmanEncoded := data[0]&0x80 != 0 // The most significant bit indicates Huffman encoding
+	length, data, err := readInt(data, 7)
+	if err != nil {
+		return data, err
+	}
+	if uint64(len(data)) < length {
+		return data, ErrTruncated
 	}
 
-	return nil
+	strData := data[:length]
+	if huffmanEncoded {
+		if err := huffmanDecode(dst, strData); err != nil {
+			return data, err
+		}
+	} else {
+		// Copy the string as-is if not Huffman encoded
+		*dst = append((*dst)[:0], strData...)
+	}
+	return data[length:], nil
 }
 
-func writeData(buf *bytes.Buffer, data []byte) {
-	length := len(data)
-	buf.WriteByte(byte(length))
-	buf.Write(data)
-}
+// DefaultDynamicTableSize is the initial size of the dynamic table, as defined by the
+// SETTINGS_HEADER_TABLE_SIZE default in RFC 9113 section 6.5.2
+const DefaultDynamicTableSize = 4096
 
-// readDecoded reads a string from the buffer into dst, decoding it if necessary
-func readDecoded(dst *[]byte, buf *bytes.Buffer) error {
-	if buf.Len() < 1 {
-		return fmt.Errorf("buffer too short to read length")
-	}
+// entryOverhead is the per entry overhead accounted in the dynamic table size, see RFC 7541 section 4.1
+const entryOverhead = 32
 
-	lengthByte := buf.Next(1)[0]
-	length := int(lengthByte & 0x7F)       // The length is the lower 7 bits of the length byte
-	huffmanEncoded := lengthByte&0x80 != 0 // The most significant bit indicates Huffman encoding
+// appendInt appends i encoded as an integer with an n-bit prefix, as described in
+// RFC 7541 section 5.1. first holds the representation bits above the prefix.
+func appendInt(dst []byte, first byte, n uint8, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 0x80 {
+		dst = append(dst, byte(i&0x7f)|0x80)
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
 
-	if buf.Len() < length {
-		return fmt.Errorf("buffer too short to read string of length %d", length)
+// appendString appends s as a string literal, as described in RFC 7541 section 5.2.
+// The Huffman encoding is used unless it is longer than the raw string.
+func appendString(dst []byte, s []byte) []byte {
+	if n := huffmanEncodedLength(s); n <= len(s) && len(s) > 0 {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return appendHuffman(dst, s)
 	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
 
-	strData := buf.Next(length)
+// staticName indexes the static table entries sharing a header name
+type staticName struct {
+	// index is the lowest index with this name
+	index int
+	// values maps the values stored for this name to their index
+	values map[string]int
+}
 
-	if huffmanEncoded {
-		// Huffman decoding
-		err := huffmanDecode(dst, strData)
-		if err != nil {
-			return err
+// staticTableIndex maps header names to their static table entries
+var staticTableIndex = func() map[string]staticName {
+	names := make(map[string]staticName, len(staticTable))
+	for i := len(staticTable) - 1; i >= 0; i-- {
+		f := staticTable[i]
+		sn, ok := names[f.name]
+		if !ok {
+			sn.values = make(map[string]int, 1)
 		}
-		return nil
+		sn.index = i + 1
+		sn.values[f.value] = i + 1
+		names[f.name] = sn
 	}
+	return names
+}()
 
-	// Return the string as-is if not Huffman encoded
-	return nil
-}
-
+// dynamicTable is the HPACK dynamic table. Entries are stored oldest first, so the most
+// recently inserted entry has the lowest index, as required by RFC 7541 section 2.3.3.
 type dynamicTable struct {
 	entries []nameValueBytes
+	size    uint32
+	maxSize uint32
 }
 
 func newDynamicTable() dynamicTable {
-	return dynamicTable{}
+	return dynamicTable{maxSize: DefaultDynamicTableSize}
+}
+
+// entry returns the entry at the given HPACK index, which must be greater than the static table length
+func (dt *dynamicTable) entry(index int) (*nameValueBytes, bool) {
+	i := index - len(staticTable)
+	if i < 1 || i > len(dt.entries) {
+		return nil, false
+	}
+	return &dt.entries[len(dt.entries)-i], true
 }
 
 func (dt *dynamicTable) get(name, value *[]byte, index int) error {
 	if index <= 0 {
-		return fmt.Errorf("invalid index: %d", index)
+		return ErrInvalidIndex
 	}
 	if index <= len(staticTable) {
 		*name = append((*name)[:0], staticTable[index-1].name...)
 		*value = append((*value)[:0], staticTable[index-1].value...)
 		return nil
 	}
-	if index-len(staticTable) > len(dt.entries) {
-		return fmt.Errorf("invalid index: %d", index)
+	entry, ok := dt.entry(index)
+	if !ok {
+		return ErrInvalidIndex
 	}
 
 	// copy from dynamic table
-	*name = append((*name)[:0], dt.entries[index-len(staticTable)-1].name...)
-	*value = append((*value)[:0], dt.entries[index-len(staticTable)-1].value...)
+	*name = append((*name)[:0], entry.name...)
+	*value = append((*value)[:0], entry.value...)
 
 	return nil
 }
 
+// add inserts a new entry, evicting the oldest entries until it fits. An entry larger
+// than the table empties it and is not inserted, see RFC 7541 section 4.4.
 func (dt *dynamicTable) add(name, value []byte) {
-	kv := acquireNameValueBytes()
+	size := uint32(len(name)+len(value)) + entryOverhead
+	if size > dt.maxSize {
+		dt.evict(len(dt.entries))
+		return
+	}
+	dt.evictTo(dt.maxSize - size)
 
+	kv := acquireNameValueBytes()
 	kv.name = append(kv.name[:0], name...)
 	kv.value = append(kv.value[:0], value...)
-	dt.entries = append([]nameValueBytes{kv}, dt.entries...)
+	dt.entries = append(dt.entries, kv)
+	dt.size += size
 }
 
-func (dt *dynamicTable) find(key, value []byte) int {
-	for i, f := range staticTable {
-		if f.name == string(key) && f.value == string(value) {
-			return i + 1
-		}
+// setMaxSize changes the maximum size of the table, evicting entries as needed
+func (dt *dynamicTable) setMaxSize(maxSize uint32) {
+	dt.maxSize = maxSize
+	dt.evictTo(maxSize)
+}
+
+// evictTo evicts the oldest entries until the table size is not greater than size
+func (dt *dynamicTable) evictTo(size uint32) {
+	n := 0
+	for cur := dt.size; cur > size && n < len(dt.entries); n++ {
+		kv := &dt.entries[n]
+		cur -= uint32(len(kv.name)+len(kv.value)) + entryOverhead
+	}
+	dt.evict(n)
+}
+
+// evict removes the n oldest entries from the table
+func (dt *dynamicTable) evict(n int) {
+	if n == 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		kv := dt.entries[i]
+		dt.size -= uint32(len(kv.name)+len(kv.value)) + entryOverhead
+		releaseNameValueBytes(kv)
 	}
-	for i, f := range dt.entries {
-		if string(f.name) == string(key) && string(f.value) == string(value) {
-			return len(staticTable) + i + 1
+	m := copy(dt.entries, dt.entries[n:])
+	for i := m; i < len(dt.entries); i++ {
+		dt.entries[i] = nameValueBytes{}
+	}
+	dt.entries = dt.entries[:m]
+}
+
+// find searches the static and dynamic tables for the header field. It returns the index
+// of a matching name-value pair if there is one, otherwise the index of an entry with a
+// matching name and nameOnly set to true. The returned index is 0 if the name is unknown.
+// Static entries are preferred over dynamic ones.
+func (dt *dynamicTable) find(key, value []byte) (index int, nameOnly bool) {
+	sn := staticTableIndex[string(key)]
+	if i, ok := sn.values[string(value)]; ok {
+		return i, false
+	}
+	nameIndex := sn.index
+	for i := len(dt.entries) - 1; i >= 0; i-- {
+		entry := &dt.entries[i]
+		if string(entry.name) != string(key) {
+			continue
+		}
+		if string(entry.value) == string(value) {
+			return len(staticTable) + len(dt.entries) - i, false
+		}
+		if nameIndex == 0 {
+			nameIndex = len(staticTable) + len(dt.entries) - i
 		}
 	}
-	return 0
+	return nameIndex, nameIndex != 0
 }
@@ -1,7 +1,6 @@
 package hpack
 
 import (
-	"fmt"
 	"sync"
 )
 
@@ -74,53 +73,71 @@ func addHuffmanCode(node *huffmanNode, code uint32, length int, value int32) {
 	node.value = value
 }
 
+// huffmanDecode decodes the Huffman encoded src into dst. As required by RFC 7541
+// section 5.2, the padding must be shorter than 8 bits and made of the most
+// significant bits of the EOS symbol, which must not appear in the data.
 func huffmanDecode(dst *[]byte, src []byte) error {
 	initTrieOnce.Do(initHuffmanTrie)
 
-	if len(src) == 0 {
-		*dst = (*dst)[:0]
-		return nil
-	}
+	*dst = (*dst)[:0]
 
 	node := huffmanTrie
-	buf := uint32(0)
-	bits := uint8(0)
-	writeIndex := 0
-
-	for i := 0; i < len(src); i++ {
-		buf = (buf << 8) | uint32(src[i])
-		bits += 8
-
-		for bits >= 8 || (i == len(src)-1 && bits > 0) {
-			bit := (buf >> (bits - 1)) & 1
-			bits--
-
+	pending := 0 // bits read since the last decoded symbol
+	ones := true // whether all the pending bits are set
+	for _, c := range src {
+		for shift := 7; shift >= 0; shift-- {
+			bit := (c >> shift) & 1
 			node = node.children[bit]
 			if node == nil {
-				fmt.Printf("Error: Invalid Huffman code at index %d\n", i)
-				return fmt.Errorf("invalid Huffman code at index %d", i)
+				return ErrInvalidHuffman
 			}
+			pending++
+			ones = ones && bit == 1
 
 			if node.value != -1 {
-				if writeIndex >= len(*dst) {
-					*dst = append(*dst, byte(node.value))
-				} else {
-					(*dst)[writeIndex] = byte(node.value)
+				if node.value == huffmanEOI {
+					return ErrInvalidHuffman
 				}
-				writeIndex++
-				node = huffmanTrie // Restablecer al nodo raíz para el siguiente código
+				*dst = append(*dst, byte(node.value))
+				node = huffmanTrie
+				pending = 0
+				ones = true
 			}
 		}
 	}
 
-	// Verificar padding al final
-	if bits > 0 {
-		paddingMask := (1 << bits) - 1
-		if (buf & uint32(paddingMask)) != uint32(paddingMask) {
-			return fmt.Errorf("invalid padding")
-		}
+	if pending > 7 || !ones {
+		return ErrInvalidHuffman
 	}
-
-	*dst = (*dst)[:writeIndex]
 	return nil
 }
+
+// huffmanEncodedLength returns the number of bytes needed to Huffman encode s
+func huffmanEncodedLength(s []byte) int {
+	bits := 0
+	for _, c := range s {
+		bits += int(huffmanCodes[c][1])
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends the Huffman encoding of s to dst. The last byte is padded
+// with the most significant bits of the EOS symbol, as required by RFC 7541 section 5.2.
+func appendHuffman(dst []byte, s []byte) []byte {
+	var acc uint64 // pending bits, only the lowest n are meaningful
+	var n uint
+	for _, c := range s {
+		code := huffmanCodes[c]
+		acc = acc<<code[1] | uint64(code[0])
+		n += uint(code[1])
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		pad := 8 - n
+		dst = append(dst, byte(acc<<pad)|byte(1<<pad-1))
+	}
+	return dst
+}
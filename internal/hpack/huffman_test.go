@@ -69,8 +69,13 @@ func TestHuffmanDecode(t *testing.T) {
 			err:      false,
 		},
 		{
-			name:     "all ASCII printable characters",
-			input:    []byte{0x99, 0xcb, 0xaa, 0xfc, 0x8d, 0x5c, 0x28, 0xd9, 0x61, 0x3d, 0x76, 0x3d, 0x10, 0x1c, 0x9d, 0x24, 0xcb, 0x61, 0x8c, 0x89, 0x6d, 0x3d, 0x76, 0x3d, 0xf7, 0x01, 0xab, 0x90, 0xc2, 0x62, 0x29, 0x0a, 0x77, 0x37, 0x30, 0xba, 0x7c, 0x1f},
+			name: "all ASCII printable characters",
+			input: []byte{0x53, 0xf8, 0xfe, 0x7f, 0xeb, 0xff, 0x2a, 0xfc, 0x7f, 0xaf, 0xeb, 0xfb, 0xf9, 0xff, 0x7f, 0x4b,
+				0x2e, 0xc0, 0x02, 0x26, 0x5a, 0x6d, 0xc7, 0x5e, 0x7e, 0xe7, 0xdf, 0xff, 0xc8, 0x3f, 0xef, 0xfc, 0xff, 0xd4,
+				0x37, 0x6f, 0x5f, 0xc1, 0x87, 0x16, 0x3c, 0x99, 0x73, 0x67, 0xd1, 0xa7, 0x56, 0xbd, 0x9b, 0x77, 0x6f, 0xe1,
+				0xc7, 0x97, 0xe7, 0x3f, 0xdf, 0xfd, 0xff, 0xff, 0x0f, 0xfe, 0x7f, 0xf9, 0x17, 0xff, 0xd1, 0xc6, 0x49, 0x0b,
+				0x2c, 0xd3, 0x9b, 0xa7, 0x5a, 0x29, 0xa8, 0xf5, 0xf6, 0xb1, 0x09, 0xb7, 0xbf, 0x8f, 0x3e, 0xbd, 0xff, 0xfe,
+				0xff, 0x9f, 0xfe, 0xff, 0xf7},
 			expected: " !\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~",
 			err:      false,
 		},
@@ -88,7 +93,19 @@ func TestHuffmanDecode(t *testing.T) {
 		},
 		{
 			name:     "invalid padding",
-			input:    []byte{0x40, 0x7f}, // "a" with invalid padding
+			input:    []byte{0x18}, // "a" padded with zeros instead of the EOS prefix
+			expected: "",
+			err:      true,
+		},
+		{
+			name:     "padding too long",
+			input:    []byte{0x1f, 0xff}, // "a" followed by more than 7 padding bits
+			expected: "",
+			err:      true,
+		},
+		{
+			name:     "EOS symbol",
+			input:    []byte{0xff, 0xff, 0xff, 0xfc}, // EOS must not appear in the data
 			expected: "",
 			err:      true,
 		},
@@ -97,13 +114,15 @@ func TestHuffmanDecode(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 
-			var correctEncoded []byte
-			correctEncoded = make([]byte, 0, 1024)
+			if !tc.err {
+				var correctEncoded []byte
+				correctEncoded = make([]byte, 0, 1024)
 
-			correctEncoded = hpack.AppendHuffmanString(correctEncoded, string(tc.expected))
-			if string(correctEncoded) != string(tc.input) {
-				t.Errorf("Expected encoded string %q, but got %q", hex.EncodeToString(correctEncoded), hex.EncodeToString(tc.input))
-				t.Logf("Decoded Length: %d, Enmcoded Length: %d", len(tc.expected), len(correctEncoded))
+				correctEncoded = hpack.AppendHuffmanString(correctEncoded, string(tc.expected))
+				if string(correctEncoded) != string(tc.input) {
+					t.Errorf("Expected encoded string %q, but got %q", hex.EncodeToString(correctEncoded), hex.EncodeToString(tc.input))
+					t.Logf("Decoded Length: %d, Enmcoded Length: %d", len(tc.expected), len(correctEncoded))
+				}
 			}
 
 			var result []byte
@@ -0,0 +1,20 @@
+package fns
+
+// Middleware wraps a RequestHandler, running code before or after it, or replying
+// instead of calling it. The middlewares of the middleware package are ready to use.
+type Middleware func(RequestHandler) RequestHandler
+
+// Chain returns a Middleware applying the middlewares in order, the first one being
+// the outermost: Chain(a, b, c)(h) is a(b(c(h))). It may wrap a whole server or
+// single routes:
+//
+//	r.Post("/upload", fns.Chain(middleware.BodyLimit(10<<20))(upload))
+//	s := &fns.Server{Handler: fns.Chain(middleware.RequestID(), middleware.Recover())(r.Handler)}
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h RequestHandler) RequestHandler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"io"
+
+	"github.com/pablolagos/fns"
+)
+
+// BodyLimit returns a Middleware replying 413 Request Entity Too Large to the requests
+// with a body larger than limit bytes, without calling the handler. It lowers
+// Server.MaxRequestBodySize for the routes it wraps.
+//
+// With Server.StreamRequestBody, the bodies of unknown size, sent chunked or over
+// HTTP/2 without Content-Length, are read in memory up to the limit to check their
+// size. The bodies with a known size are checked without reading them.
+func BodyLimit(limit int) fns.Middleware {
+	return func(h fns.RequestHandler) fns.RequestHandler {
+		return func(ctx *fns.RequestCtx) {
+			tooLarge, err := bodyTooLarge(ctx, limit)
+			switch {
+			case err != nil:
+				ctx.Error(fns.StatusMessage(fns.StatusBadRequest), fns.StatusBadRequest)
+				ctx.SetConnectionClose()
+				return
+			case tooLarge:
+				ctx.Error(fns.StatusMessage(fns.StatusRequestEntityTooLarge), fns.StatusRequestEntityTooLarge)
+				// The rest of the body is still to be read
+				ctx.SetConnectionClose()
+				return
+			}
+			h(ctx)
+		}
+	}
+}
+
+// bodyTooLarge tells whether the request body is larger than limit
+func bodyTooLarge(ctx *fns.RequestCtx, limit int) (bool, error) {
+	req := &ctx.Request
+	contentLength := req.Header.ContentLength()
+	if contentLength > limit {
+		return true, nil
+	}
+	if !req.IsBodyStream() {
+		return len(req.Body()) > limit, nil
+	}
+	// A stream without Content-Length has an unknown size, whatever its length says
+	if contentLength >= 0 && len(req.Header.Peek(fns.HeaderContentLength)) > 0 {
+		return false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.BodyStream(), int64(limit)+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > limit {
+		return true, nil
+	}
+	req.SetBody(body)
+	return false, nil
+}
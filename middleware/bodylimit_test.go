@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pablolagos/fns"
+	"github.com/pablolagos/fns/fasthttputil"
+	"golang.org/x/net/http2"
+)
+
+func TestBodyLimit(t *testing.T) {
+	t.Parallel()
+
+	h := BodyLimit(10)(func(ctx *fns.RequestCtx) {
+		ctx.SetBody(ctx.PostBody())
+	})
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		stream bool
+		size   int
+		code   int
+	}{
+		{"small", "0123456789", false, 0, fns.StatusOK},
+		{"large", "0123456789a", false, 0, fns.StatusRequestEntityTooLarge},
+		{"stream with size", "0123456789", true, 10, fns.StatusOK},
+		{"large stream with size", "0123456789abc", true, 13, fns.StatusRequestEntityTooLarge},
+		{"stream without size", "0123456789", true, -1, fns.StatusOK},
+		{"large stream without size", "0123456789abc", true, -1, fns.StatusRequestEntityTooLarge},
+	} {
+		ctx := newTestCtx(fns.MethodPost, "/", "127.0.0.1")
+		if tc.stream {
+			ctx.Request.SetBodyStream(strings.NewReader(tc.body), tc.size)
+		} else {
+			ctx.Request.SetBodyString(tc.body)
+		}
+		h(ctx)
+
+		if code := ctx.Response.StatusCode(); code != tc.code {
+			t.Errorf("%s: unexpected status %d, expected %d", tc.name, code, tc.code)
+			continue
+		}
+		if tc.code == fns.StatusOK && string(ctx.Response.Body()) != tc.body {
+			t.Errorf("%s: unexpected body %q seen by the handler", tc.name, ctx.Response.Body())
+		}
+		if tc.code != fns.StatusOK && !ctx.Response.ConnectionClose() {
+			t.Errorf("%s: expected the connection to be closed", tc.name)
+		}
+	}
+}
+
+func TestBodyLimitHTTP2StreamWithoutSize(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fns.Server{
+		Handler: BodyLimit(10)(func(ctx *fns.RequestCtx) {
+			ctx.SetBody(ctx.PostBody())
+		}),
+		StreamRequestBody: true,
+	}
+	fns.EnableHTTP2(s, fns.ServerConfig{H2C: true})
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}}
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{"0123456789", fns.StatusOK},
+		{"0123456789abc", fns.StatusRequestEntityTooLarge},
+	} {
+		// The body is sent without content-length, its size is unknown to the server
+		req, err := http.NewRequest(fns.MethodPost, "http://example.com/", io.NopCloser(strings.NewReader(tc.body)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req.ContentLength = -1
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Fatalf("unexpected status %d for %q, expected %d", resp.StatusCode, tc.body, tc.code)
+		}
+		if tc.code == fns.StatusOK && string(body) != tc.body {
+			t.Fatalf("unexpected body %q seen by the handler", body)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablolagos/fns"
+)
+
+// CORSConfig configures the CORS middleware
+type CORSConfig struct {
+	// AllowOrigins are the origins allowed to make cross-origin requests, such as
+	// "https://example.com". "*" allows all the origins.
+	AllowOrigins []string
+
+	// AllowOriginFunc decides whether origin is allowed, in place of AllowOrigins
+	AllowOriginFunc func(origin string) bool
+
+	// AllowMethods are the methods allowed in the cross-origin requests.
+	//
+	// GET, HEAD, POST, PUT, PATCH and DELETE are allowed if not set.
+	AllowMethods []string
+
+	// AllowHeaders are the request headers allowed in the cross-origin requests.
+	//
+	// The headers asked for in the preflight requests are allowed if not set.
+	AllowHeaders []string
+
+	// ExposeHeaders are the response headers exposed to the scripts besides the
+	// CORS-safelisted ones
+	ExposeHeaders []string
+
+	// AllowCredentials allows the requests with credentials, such as cookies. The
+	// origin is then sent back in place of "*" when all the origins are allowed.
+	AllowCredentials bool
+
+	// MaxAge is how long the clients may cache the result of a preflight request.
+	//
+	// It isn't sent if not set.
+	MaxAge time.Duration
+}
+
+var defaultCORSMethods = []string{
+	fns.MethodGet,
+	fns.MethodHead,
+	fns.MethodPost,
+	fns.MethodPut,
+	fns.MethodPatch,
+	fns.MethodDelete,
+}
+
+// CORS returns a Middleware implementing Cross-Origin Resource Sharing. It replies
+// to the preflight requests of the allowed origins without calling the handler, and
+// adds the CORS headers to the responses to the other requests of these origins.
+//
+// The requests of the origins not allowed are passed to the handler as is, the
+// browsers block them for lack of CORS headers.
+func CORS(config CORSConfig) fns.Middleware {
+	methods := config.AllowMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(config.AllowHeaders, ", ")
+	exposeHeaders := strings.Join(config.ExposeHeaders, ", ")
+	var maxAge string
+	if config.MaxAge > 0 {
+		maxAge = strconv.Itoa(int(config.MaxAge / time.Second))
+	}
+
+	allowAll := false
+	for _, o := range config.AllowOrigins {
+		if o == "*" {
+			allowAll = true
+		}
+	}
+	allowed := func(origin string) bool {
+		if config.AllowOriginFunc != nil {
+			return config.AllowOriginFunc(origin)
+		}
+		if allowAll {
+			return true
+		}
+		for _, o := range config.AllowOrigins {
+			if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// setOrigin sets the headers common to the preflight and the actual requests
+	setOrigin := func(ctx *fns.RequestCtx, origin string) {
+		h := &ctx.Response.Header
+		if allowAll && !config.AllowCredentials && config.AllowOriginFunc == nil {
+			h.Set(fns.HeaderAccessControlAllowOrigin, "*")
+		} else {
+			h.Set(fns.HeaderAccessControlAllowOrigin, origin)
+			h.Add(fns.HeaderVary, fns.HeaderOrigin)
+		}
+		if config.AllowCredentials {
+			h.Set(fns.HeaderAccessControlAllowCredentials, "true")
+		}
+	}
+
+	// setActual sets the headers of the actual requests
+	setActual := func(ctx *fns.RequestCtx, origin string) {
+		setOrigin(ctx, origin)
+		if exposeHeaders != "" {
+			ctx.Response.Header.Set(fns.HeaderAccessControlExposeHeaders, exposeHeaders)
+		}
+	}
+
+	return func(next fns.RequestHandler) fns.RequestHandler {
+		return func(ctx *fns.RequestCtx) {
+			origin := string(ctx.Request.Header.Peek(fns.HeaderOrigin))
+			if origin == "" || !allowed(origin) {
+				next(ctx)
+				return
+			}
+
+			reqMethod := ctx.Request.Header.Peek(fns.HeaderAccessControlRequestMethod)
+			if !ctx.IsOptions() || len(reqMethod) == 0 {
+				setActual(ctx, origin)
+				next(ctx)
+				if len(ctx.Response.Header.Peek(fns.HeaderAccessControlAllowOrigin)) == 0 {
+					setActual(ctx, origin)
+				}
+				return
+			}
+
+			// Preflight request
+			h := &ctx.Response.Header
+			setOrigin(ctx, origin)
+			h.Add(fns.HeaderVary, fns.HeaderAccessControlRequestMethod)
+			h.Add(fns.HeaderVary, fns.HeaderAccessControlRequestHeaders)
+			h.Set(fns.HeaderAccessControlAllowMethods, allowMethods)
+			if allowHeaders != "" {
+				h.Set(fns.HeaderAccessControlAllowHeaders, allowHeaders)
+			} else if reqHeaders := ctx.Request.Header.Peek(fns.HeaderAccessControlRequestHeaders); len(reqHeaders) > 0 {
+				h.SetBytesV(fns.HeaderAccessControlAllowHeaders, reqHeaders)
+			}
+			if maxAge != "" {
+				h.Set(fns.HeaderAccessControlMaxAge, maxAge)
+			}
+			ctx.SetStatusCode(fns.StatusNoContent)
+		}
+	}
+}
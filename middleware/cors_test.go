@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pablolagos/fns"
+)
+
+func TestCORS(t *testing.T) {
+	t.Parallel()
+
+	mw := CORS(CORSConfig{
+		AllowOrigins:     []string{"https://example.com"},
+		ExposeHeaders:    []string{"X-Total"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	})
+	called := false
+	h := mw(func(ctx *fns.RequestCtx) {
+		called = true
+		okHandler(ctx)
+	})
+
+	// Preflight
+	ctx := newTestCtx(fns.MethodOptions, "/items", "127.0.0.1",
+		fns.HeaderOrigin, "https://example.com",
+		fns.HeaderAccessControlRequestMethod, fns.MethodPut,
+		fns.HeaderAccessControlRequestHeaders, "Content-Type, X-Token")
+	h(ctx)
+	if called {
+		t.Fatal("unexpected handler call for a preflight request")
+	}
+	for name, expected := range map[string]string{
+		fns.HeaderAccessControlAllowOrigin:      "https://example.com",
+		fns.HeaderAccessControlAllowMethods:     "GET, HEAD, POST, PUT, PATCH, DELETE",
+		fns.HeaderAccessControlAllowHeaders:     "Content-Type, X-Token",
+		fns.HeaderAccessControlAllowCredentials: "true",
+		fns.HeaderAccessControlMaxAge:           "3600",
+	} {
+		if v := string(ctx.Response.Header.Peek(name)); v != expected {
+			t.Errorf("unexpected %s %q, expected %q", name, v, expected)
+		}
+	}
+	if code := ctx.Response.StatusCode(); code != fns.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	// Actual request
+	ctx = newTestCtx(fns.MethodGet, "/items", "127.0.0.1", fns.HeaderOrigin, "https://example.com")
+	h(ctx)
+	if !called {
+		t.Fatal("handler not called")
+	}
+	if v := string(ctx.Response.Header.Peek(fns.HeaderAccessControlAllowOrigin)); v != "https://example.com" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", v)
+	}
+	if v := string(ctx.Response.Header.Peek(fns.HeaderAccessControlExposeHeaders)); v != "X-Total" {
+		t.Fatalf("unexpected Access-Control-Expose-Headers %q", v)
+	}
+	if v := string(ctx.Response.Header.Peek(fns.HeaderVary)); v != fns.HeaderOrigin {
+		t.Fatalf("unexpected Vary %q", v)
+	}
+
+	// Other origins and same-origin requests
+	for _, origin := range []string{"https://evil.example", ""} {
+		ctx = newTestCtx(fns.MethodOptions, "/items", "127.0.0.1",
+			fns.HeaderOrigin, origin,
+			fns.HeaderAccessControlRequestMethod, fns.MethodPut)
+		called = false
+		h(ctx)
+		if !called {
+			t.Fatalf("%q: handler not called", origin)
+		}
+		if v := ctx.Response.Header.Peek(fns.HeaderAccessControlAllowOrigin); len(v) > 0 {
+			t.Fatalf("%q: unexpected Access-Control-Allow-Origin %q", origin, v)
+		}
+	}
+}
+
+func TestCORSAllowAll(t *testing.T) {
+	t.Parallel()
+
+	ctx := newTestCtx(fns.MethodGet, "/", "127.0.0.1", fns.HeaderOrigin, "https://any.example")
+	CORS(CORSConfig{AllowOrigins: []string{"*"}})(okHandler)(ctx)
+	if v := string(ctx.Response.Header.Peek(fns.HeaderAccessControlAllowOrigin)); v != "*" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", v)
+	}
+	if v := ctx.Response.Header.Peek(fns.HeaderVary); len(v) > 0 {
+		t.Fatalf("unexpected Vary %q", v)
+	}
+
+	ctx = newTestCtx(fns.MethodGet, "/", "127.0.0.1", fns.HeaderOrigin, "https://any.example")
+	CORS(CORSConfig{AllowOriginFunc: func(origin string) bool {
+		return origin == "https://any.example"
+	}})(okHandler)(ctx)
+	if v := string(ctx.Response.Header.Peek(fns.HeaderAccessControlAllowOrigin)); v != "https://any.example" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", v)
+	}
+}
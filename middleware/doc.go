@@ -0,0 +1,25 @@
+// Package middleware provides the fns.Middleware commonly wrapped around the
+// handlers of a server: panic recovery, request IDs, client IP extraction
+// behind proxies, CORS, security headers and request body size limits.
+//
+// They are composed with fns.Chain, for a whole server or for single routes. Recover
+// comes last, so that the headers set by the others are sent with its 500 responses:
+//
+//	r := fns.NewRouter()
+//	r.Post("/upload", fns.Chain(middleware.BodyLimit(32<<20))(upload))
+//
+//	s := &fns.Server{
+//		Handler: fns.Chain(
+//			middleware.RealIP("10.0.0.0/8"),
+//			middleware.RequestID(),
+//			middleware.CORS(middleware.CORSConfig{AllowOrigins: []string{"https://example.com"}}),
+//			middleware.SecurityHeaders(middleware.DefaultSecurityConfig),
+//			middleware.Recover(),
+//		)(r.Handler),
+//	}
+//
+// RequestID, CORS and SecurityHeaders set their response headers before calling the
+// handler, so they are also sent with the responses written unbuffered or streamed by
+// the handler, and set them again once it returns if it reset the response, with
+// RequestCtx.Error for instance.
+package middleware
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pablolagos/fns"
+	"github.com/pablolagos/fns/fasthttputil"
+)
+
+// testLogger records the logged messages
+type testLogger struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.buf, format, args...)
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// newTestCtx returns a context for a request from remoteIP, with headers given as
+// name and value pairs
+func newTestCtx(method, uri, remoteIP string, headers ...string) *fns.RequestCtx {
+	var req fns.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	ctx := &fns.RequestCtx{}
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: 1234}, &testLogger{})
+	return ctx
+}
+
+func okHandler(ctx *fns.RequestCtx) {
+	ctx.SetBodyString("ok")
+}
+
+func TestChainedMiddlewares(t *testing.T) {
+	t.Parallel()
+
+	h := fns.Chain(
+		RealIP("10.0.0.1"),
+		RequestID(),
+		SecurityHeaders(DefaultSecurityConfig),
+		Recover(),
+	)(func(ctx *fns.RequestCtx) {
+		if ip := ctx.RemoteIP().String(); ip != "192.0.2.1" {
+			t.Errorf("unexpected remote IP %s", ip)
+		}
+		if GetRequestID(ctx) == "" {
+			t.Errorf("missing request ID")
+		}
+		panic("boom")
+	})
+
+	ctx := newTestCtx(fns.MethodGet, "/", "10.0.0.1", fns.HeaderXForwardedFor, "192.0.2.1")
+	h(ctx)
+	if code := ctx.Response.StatusCode(); code != fns.StatusInternalServerError {
+		t.Fatalf("unexpected status %d", code)
+	}
+	// The headers are set again after the recovery reset the response
+	if v := string(ctx.Response.Header.Peek(fns.HeaderXContentTypeOptions)); v != "nosniff" {
+		t.Fatalf("unexpected X-Content-Type-Options %q", v)
+	}
+	if v := ctx.Response.Header.Peek(fns.HeaderXRequestID); len(v) == 0 {
+		t.Fatal("missing X-Request-ID")
+	}
+}
+
+func TestMiddlewaresUnbuffered(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fns.Server{
+		Handler: fns.Chain(
+			RequestID(),
+			CORS(CORSConfig{AllowOrigins: []string{"https://example.com"}}),
+			SecurityHeaders(DefaultSecurityConfig),
+		)(func(ctx *fns.RequestCtx) {
+			// The headers are sent with the first write
+			ctx.DisableBuffering()
+			ctx.WriteString("ok") //nolint:errcheck
+		}),
+	}
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}}
+	req, err := http.NewRequest(fns.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req.Header.Set(fns.HeaderOrigin, "https://example.com")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if resp.Header.Get(fns.HeaderXRequestID) == "" {
+		t.Fatal("missing X-Request-ID")
+	}
+	if v := resp.Header.Get(fns.HeaderAccessControlAllowOrigin); v != "https://example.com" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", v)
+	}
+	if v := resp.Header.Get(fns.HeaderXContentTypeOptions); v != "nosniff" {
+		t.Fatalf("unexpected X-Content-Type-Options %q", v)
+	}
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pablolagos/fns"
+)
+
+// RealIP returns a Middleware replacing the remote address of the requests sent
+// through trusted proxies with the address of the client, as reported by the
+// proxies in the Forwarded, X-Forwarded-For or X-Real-IP header, the first one
+// present. RequestCtx.RemoteAddr and RemoteIP then return the client address.
+//
+// trustedProxies are IP addresses or CIDR ranges such as "10.0.0.0/8". The requests
+// from the other addresses are left as is, since anyone can send these headers. The
+// addresses listed in the headers are read from the closest one to the farthest one,
+// the client is the first one that isn't a trusted proxy.
+//
+// RealIP panics if a trusted proxy can't be parsed.
+func RealIP(trustedProxies ...string) fns.Middleware {
+	trusted := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				panic("middleware: cannot parse trusted proxy " + p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			panic("middleware: cannot parse trusted proxy " + p + ": " + err.Error())
+		}
+		trusted = append(trusted, n)
+	}
+
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(h fns.RequestHandler) fns.RequestHandler {
+		return func(ctx *fns.RequestCtx) {
+			if isTrusted(ctx.RemoteIP()) {
+				if ip := forwardedClientIP(ctx, isTrusted); ip != nil {
+					ctx.SetRemoteAddr(&net.TCPAddr{IP: ip})
+				}
+			}
+			h(ctx)
+		}
+	}
+}
+
+// forwardedClientIP returns the client address reported by the proxies, nil if
+// there is none or it can't be parsed
+func forwardedClientIP(ctx *fns.RequestCtx, isTrusted func(net.IP) bool) net.IP {
+	var addrs []string
+	if v := ctx.Request.Header.Peek(fns.HeaderForwarded); len(v) > 0 {
+		addrs = forwardedFor(string(v))
+	} else if v := ctx.Request.Header.Peek(fns.HeaderXForwardedFor); len(v) > 0 {
+		addrs = strings.Split(string(v), ",")
+	} else if v := ctx.Request.Header.Peek(fns.HeaderXRealIP); len(v) > 0 {
+		addrs = []string{string(v)}
+	}
+
+	var ip net.IP
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip = parseForwardedIP(addrs[i])
+		if ip == nil || !isTrusted(ip) {
+			// The addresses further away can't be trusted
+			return ip
+		}
+	}
+	// All the addresses are trusted proxies, the farthest one is the client
+	return ip
+}
+
+// forwardedFor returns the "for" parameters of a Forwarded header, see RFC 7239
+func forwardedFor(v string) []string {
+	var addrs []string
+	for _, elem := range strings.Split(v, ",") {
+		for _, pair := range strings.Split(elem, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				addrs = append(addrs, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return addrs
+}
+
+// parseForwardedIP parses an address with an optional port, the IPv6 addresses
+// being enclosed in brackets if there is a port
+func parseForwardedIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/pablolagos/fns"
+)
+
+func TestRealIP(t *testing.T) {
+	t.Parallel()
+
+	mw := RealIP("10.0.0.0/8", "2001:db8::1")
+	for _, tc := range []struct {
+		name     string
+		remote   string
+		headers  []string
+		expected string
+	}{
+		{"untrusted remote", "192.0.2.9", []string{fns.HeaderXForwardedFor, "198.51.100.1"}, "192.0.2.9"},
+		{"no header", "10.1.1.1", nil, "10.1.1.1"},
+		{"x-forwarded-for", "10.1.1.1", []string{fns.HeaderXForwardedFor, "198.51.100.1"}, "198.51.100.1"},
+		{"forged x-forwarded-for", "10.1.1.1", []string{fns.HeaderXForwardedFor, "1.2.3.4, 198.51.100.1, 10.2.2.2"}, "198.51.100.1"},
+		{"all trusted", "10.1.1.1", []string{fns.HeaderXForwardedFor, "10.3.3.3, 10.2.2.2"}, "10.3.3.3"},
+		{"x-real-ip", "10.1.1.1", []string{fns.HeaderXRealIP, "198.51.100.2"}, "198.51.100.2"},
+		{"forwarded", "2001:db8::1", []string{fns.HeaderForwarded, `for=192.0.2.43, for="[2001:db8:cafe::17]:4711";proto=https`}, "2001:db8:cafe::17"},
+		{"forwarded preferred", "10.1.1.1", []string{fns.HeaderForwarded, "for=198.51.100.3", fns.HeaderXForwardedFor, "198.51.100.1"}, "198.51.100.3"},
+		{"obfuscated", "10.1.1.1", []string{fns.HeaderForwarded, "for=_hidden"}, "10.1.1.1"},
+		{"invalid", "10.1.1.1", []string{fns.HeaderXForwardedFor, "not-an-ip"}, "10.1.1.1"},
+	} {
+		ctx := newTestCtx(fns.MethodGet, "/", tc.remote, tc.headers...)
+		var ip string
+		mw(func(ctx *fns.RequestCtx) {
+			ip = ctx.RemoteIP().String()
+		})(ctx)
+		if ip != tc.expected {
+			t.Errorf("%s: unexpected remote IP %s, expected %s", tc.name, ip, tc.expected)
+		}
+	}
+}
+
+func TestRealIPInvalidProxy(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	RealIP("10.0.0.0/33")
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"runtime/debug"
+
+	"github.com/pablolagos/fns"
+)
+
+// PanicHandler replies to a request whose handler panicked with v
+type PanicHandler func(ctx *fns.RequestCtx, v interface{})
+
+// Recover returns a Middleware recovering from the panics of the handlers. The panic
+// value and the stack trace are logged with RequestCtx.Logger, and 500 Internal Server
+// Error is sent in place of the response.
+func Recover() fns.Middleware {
+	return RecoverWith(nil)
+}
+
+// RecoverWith is like Recover, calling onPanic to reply instead. The panic is only
+// logged if onPanic is nil.
+func RecoverWith(onPanic PanicHandler) fns.Middleware {
+	return func(h fns.RequestHandler) fns.RequestHandler {
+		return func(ctx *fns.RequestCtx) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if onPanic != nil {
+					onPanic(ctx, v)
+					return
+				}
+				ctx.Logger().Printf("panic serving %s: %v\n%s", ctx.Path(), v, debug.Stack())
+				ctx.Error(fns.StatusMessage(fns.StatusInternalServerError), fns.StatusInternalServerError)
+			}()
+			h(ctx)
+		}
+	}
+}
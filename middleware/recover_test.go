@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pablolagos/fns"
+)
+
+func TestRecover(t *testing.T) {
+	t.Parallel()
+
+	var logger testLogger
+	var req fns.Request
+	req.SetRequestURI("/panic")
+	var ctx fns.RequestCtx
+	ctx.Init(&req, nil, &logger)
+	ctx.SetBodyString("partial")
+
+	Recover()(func(ctx *fns.RequestCtx) {
+		panic("boom")
+	})(&ctx)
+
+	if code := ctx.Response.StatusCode(); code != fns.StatusInternalServerError {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if body := string(ctx.Response.Body()); body != "Internal Server Error" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if s := logger.String(); !strings.Contains(s, "panic serving /panic: boom") || !strings.Contains(s, "recover_test.go") {
+		t.Fatalf("unexpected log %q", s)
+	}
+
+	// No panic
+	ctx2 := newTestCtx(fns.MethodGet, "/", "127.0.0.1")
+	Recover()(okHandler)(ctx2)
+	if body := string(ctx2.Response.Body()); body != "ok" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestRecoverWith(t *testing.T) {
+	t.Parallel()
+
+	var recovered interface{}
+	ctx := newTestCtx(fns.MethodGet, "/", "127.0.0.1")
+	RecoverWith(func(ctx *fns.RequestCtx, v interface{}) {
+		recovered = v
+		ctx.SetStatusCode(fns.StatusServiceUnavailable)
+	})(func(ctx *fns.RequestCtx) {
+		panic(42)
+	})(ctx)
+
+	if recovered != 42 {
+		t.Fatalf("unexpected panic value %v", recovered)
+	}
+	if code := ctx.Response.StatusCode(); code != fns.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", code)
+	}
+}
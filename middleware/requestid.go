@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/pablolagos/fns"
+)
+
+// RequestIDKey is the user value holding the request ID, see GetRequestID
+const RequestIDKey = "fns.requestID"
+
+// maxRequestIDLen is the longest request ID accepted from the clients
+const maxRequestIDLen = 128
+
+// requestIDPrefix makes the IDs unique across the processes, RequestCtx.ID being
+// only unique within a server
+var requestIDPrefix = func() string {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("BUG: cannot read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}()
+
+// RequestID returns a Middleware identifying each request. The ID is stored in the
+// RequestIDKey user value and sent in the X-Request-ID response header.
+//
+// The ID sent by the client or a proxy in the X-Request-ID request header is kept if
+// it is made of at most 128 letters, digits, '-', '_', '.' and ':'. Otherwise the ID
+// is RequestCtx.ID, in hexadecimal, prefixed with a random value generated when the
+// process starts.
+func RequestID() fns.Middleware {
+	return func(h fns.RequestHandler) fns.RequestHandler {
+		return func(ctx *fns.RequestCtx) {
+			id := ctx.Request.Header.Peek(fns.HeaderXRequestID)
+			var sid string
+			if validRequestID(id) {
+				sid = string(id)
+			} else {
+				b := make([]byte, 0, len(requestIDPrefix)+17)
+				b = append(b, requestIDPrefix...)
+				b = append(b, '-')
+				b = strconv.AppendUint(b, ctx.ID(), 16)
+				sid = string(b)
+			}
+			ctx.SetUserValue(RequestIDKey, sid)
+			ctx.Response.Header.Set(fns.HeaderXRequestID, sid)
+			h(ctx)
+			if len(ctx.Response.Header.Peek(fns.HeaderXRequestID)) == 0 {
+				ctx.Response.Header.Set(fns.HeaderXRequestID, sid)
+			}
+		}
+	}
+}
+
+// GetRequestID returns the ID of the request set by the RequestID middleware, "" if
+// there is none
+func GetRequestID(ctx *fns.RequestCtx) string {
+	id, _ := ctx.UserValue(RequestIDKey).(string)
+	return id
+}
+
+func validRequestID(id []byte) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
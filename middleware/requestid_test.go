@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pablolagos/fns"
+)
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	var seen string
+	h := RequestID()(func(ctx *fns.RequestCtx) {
+		seen = GetRequestID(ctx)
+		// The header is set even if the response is reset
+		ctx.Error("failed", fns.StatusBadGateway)
+	})
+
+	ctx := newTestCtx(fns.MethodGet, "/", "127.0.0.1")
+	h(ctx)
+	id := string(ctx.Response.Header.Peek(fns.HeaderXRequestID))
+	if id == "" || id != seen {
+		t.Fatalf("unexpected request ID %q, handler saw %q", id, seen)
+	}
+	if !strings.HasPrefix(id, requestIDPrefix+"-") {
+		t.Fatalf("unexpected request ID %q without the process prefix %q", id, requestIDPrefix)
+	}
+
+	for _, tc := range []struct {
+		incoming string
+		kept     bool
+	}{
+		{"abc-123_x.y:z", true},
+		{"has space", false},
+		{"<script>", false},
+		{strings.Repeat("a", 129), false},
+	} {
+		ctx := newTestCtx(fns.MethodGet, "/", "127.0.0.1", fns.HeaderXRequestID, tc.incoming)
+		h(ctx)
+		id := string(ctx.Response.Header.Peek(fns.HeaderXRequestID))
+		if kept := id == tc.incoming; kept != tc.kept {
+			t.Errorf("%q: unexpected request ID %q", tc.incoming, id)
+		}
+	}
+
+	if id := GetRequestID(newTestCtx(fns.MethodGet, "/", "127.0.0.1")); id != "" {
+		t.Fatalf("unexpected request ID %q without the middleware", id)
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pablolagos/fns"
+)
+
+// SecurityConfig configures the SecurityHeaders middleware. The headers of the empty
+// fields aren't sent.
+type SecurityConfig struct {
+	// ContentTypeNosniff sends "X-Content-Type-Options: nosniff"
+	ContentTypeNosniff bool
+
+	// FrameOptions is the X-Frame-Options header, "DENY" or "SAMEORIGIN"
+	FrameOptions string
+
+	// ReferrerPolicy is the Referrer-Policy header, such as
+	// "strict-origin-when-cross-origin"
+	ReferrerPolicy string
+
+	// ContentSecurityPolicy is the Content-Security-Policy header
+	ContentSecurityPolicy string
+
+	// CrossOriginResourcePolicy is the Cross-Origin-Resource-Policy header,
+	// "same-site", "same-origin" or "cross-origin"
+	CrossOriginResourcePolicy string
+
+	// XSSProtection is the X-XSS-Protection header. "0" disables the XSS filter of
+	// the legacy browsers, which causes more issues than it solves.
+	XSSProtection string
+
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header, only sent
+	// on TLS connections. HSTSIncludeSubdomains and HSTSPreload add the
+	// includeSubDomains and preload directives.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+}
+
+// DefaultSecurityConfig is a SecurityConfig suitable for most of the sites, without
+// a Content-Security-Policy which depends on the site
+var DefaultSecurityConfig = SecurityConfig{
+	ContentTypeNosniff: true,
+	FrameOptions:       "SAMEORIGIN",
+	ReferrerPolicy:     "strict-origin-when-cross-origin",
+	XSSProtection:      "0",
+	HSTSMaxAge:         365 * 24 * time.Hour,
+}
+
+// SecurityHeaders returns a Middleware adding security headers to the responses, as
+// configured by config. The headers already set by the handler are kept, so that
+// single routes can send other values.
+func SecurityHeaders(config SecurityConfig) fns.Middleware {
+	var headers [][2]string
+	if config.ContentTypeNosniff {
+		headers = append(headers, [2]string{fns.HeaderXContentTypeOptions, "nosniff"})
+	}
+	for _, h := range [][2]string{
+		{fns.HeaderXFrameOptions, config.FrameOptions},
+		{fns.HeaderReferrerPolicy, config.ReferrerPolicy},
+		{fns.HeaderContentSecurityPolicy, config.ContentSecurityPolicy},
+		{fns.HeaderCrossOriginResourcePolicy, config.CrossOriginResourcePolicy},
+		{fns.HeaderXXSSProtection, config.XSSProtection},
+	} {
+		if h[1] != "" {
+			headers = append(headers, h)
+		}
+	}
+
+	var hsts string
+	if config.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(config.HSTSMaxAge/time.Second), 10)
+		if config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if config.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+
+	// setHeaders sets the headers which are not set yet
+	setHeaders := func(ctx *fns.RequestCtx) {
+		rh := &ctx.Response.Header
+		for _, kv := range headers {
+			if len(rh.Peek(kv[0])) == 0 {
+				rh.Set(kv[0], kv[1])
+			}
+		}
+		if hsts != "" && ctx.IsTLS() && len(rh.Peek(fns.HeaderStrictTransportSecurity)) == 0 {
+			rh.Set(fns.HeaderStrictTransportSecurity, hsts)
+		}
+	}
+
+	return func(h fns.RequestHandler) fns.RequestHandler {
+		return func(ctx *fns.RequestCtx) {
+			setHeaders(ctx)
+			h(ctx)
+			setHeaders(ctx)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/pablolagos/fns"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Parallel()
+
+	config := DefaultSecurityConfig
+	config.ContentSecurityPolicy = "default-src 'self'"
+	mw := SecurityHeaders(config)
+
+	ctx := newTestCtx(fns.MethodGet, "/", "127.0.0.1")
+	mw(func(ctx *fns.RequestCtx) {
+		ctx.Response.Header.Set(fns.HeaderXFrameOptions, "DENY")
+	})(ctx)
+
+	for name, expected := range map[string]string{
+		fns.HeaderXContentTypeOptions:   "nosniff",
+		fns.HeaderXFrameOptions:         "DENY",
+		fns.HeaderReferrerPolicy:        "strict-origin-when-cross-origin",
+		fns.HeaderContentSecurityPolicy: "default-src 'self'",
+		fns.HeaderXXSSProtection:        "0",
+		// Only sent over TLS
+		fns.HeaderStrictTransportSecurity:   "",
+		fns.HeaderCrossOriginResourcePolicy: "",
+	} {
+		if v := string(ctx.Response.Header.Peek(name)); v != expected {
+			t.Errorf("unexpected %s %q, expected %q", name, v, expected)
+		}
+	}
+}
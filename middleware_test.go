@@ -0,0 +1,40 @@
+package fns
+
+import "testing"
+
+func TestChain(t *testing.T) {
+	t.Parallel()
+
+	var order []string
+	mw := func(name string) Middleware {
+		return func(h RequestHandler) RequestHandler {
+			return func(ctx *RequestCtx) {
+				order = append(order, name+" in")
+				h(ctx)
+				order = append(order, name+" out")
+			}
+		}
+	}
+
+	h := Chain(mw("a"), mw("b"), Chain(mw("c")))(func(ctx *RequestCtx) {
+		order = append(order, "handler")
+	})
+	h(&RequestCtx{})
+
+	expected := []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected calls %q, expected %q", order, expected)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("unexpected calls %q, expected %q", order, expected)
+		}
+	}
+
+	// No middlewares return the handler as is
+	called := false
+	Chain()(func(ctx *RequestCtx) { called = true })(&RequestCtx{})
+	if !called {
+		t.Fatal("handler not called")
+	}
+}
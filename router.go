@@ -0,0 +1,501 @@
+package fns
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultRouter is the Router used by the Server when its Handler is nil, and by
+// ListenAndServe and friends when called with a nil handler. The package-level Handle,
+// Get, Post... functions register the routes on it.
+var DefaultRouter = NewRouter()
+
+// Router is a RequestHandler dispatching the requests to the handlers registered for
+// their method and path.
+//
+// The paths are matched against patterns made of static parts and parameters:
+//
+//   - `:name` matches a path segment, up to the next '/' or the end of the path.
+//   - `*name` matches the remainder of the path, it must end the pattern.
+//
+// The values of the parameters are stored with RequestCtx.SetUserValue, under their name:
+//
+//	r.Get("/users/:id/files/*path", func(ctx *fns.RequestCtx) {
+//		id := ctx.UserValue("id").(string)
+//		path := ctx.UserValue("path").(string)
+//		...
+//	})
+//
+// The static parts take precedence over the parameters, and the parameters over the
+// catch-all parameters, whatever the registration order. The routes are stored in a
+// radix tree per method, matching a route doesn't allocate besides the parameter values.
+// The HTTP/2 extended CONNECT requests are matched against the GET routes.
+//
+// The routes must be registered before the Router serves requests, the registration
+// is not safe for concurrent use. Registering an invalid or a conflicting pattern panics.
+type Router struct {
+	// RedirectTrailingSlash redirects the requests not matching a route to the same
+	// path with or without a trailing slash, if there is a route for it.
+	RedirectTrailingSlash bool
+
+	// RedirectFixedPath redirects the requests whose path isn't clean, with repeated
+	// slashes or "." and ".." elements, to the path cleaned with CleanPath. They are
+	// otherwise routed with their normalized path.
+	RedirectFixedPath bool
+
+	// HandleMethodNotAllowed replies to the requests matching the routes of other
+	// methods only with 405 Method Not Allowed and the Allow header.
+	HandleMethodNotAllowed bool
+
+	// HandleOPTIONS replies to the OPTIONS requests without a route with the Allow
+	// header, listing the methods of the routes matching the path, or of all the
+	// routes for "*".
+	HandleOPTIONS bool
+
+	// GlobalOPTIONS is called for the automatic replies to the OPTIONS requests, after
+	// the Allow header is set. It may set CORS headers, for example.
+	GlobalOPTIONS RequestHandler
+
+	// NotFound is called for the requests not matching any route.
+	//
+	// 404 Not Found is sent if not set.
+	NotFound RequestHandler
+
+	// MethodNotAllowed is called for the requests matching the routes of other methods
+	// only, after the Allow header is set, see HandleMethodNotAllowed.
+	//
+	// 405 Method Not Allowed is sent if not set.
+	MethodNotAllowed RequestHandler
+
+	trees []routeTree
+
+	// globalAllow is the Allow header for "*"
+	globalAllow string
+}
+
+// routeTree is the radix tree of the routes of a method
+type routeTree struct {
+	method string
+	root   *routeNode
+}
+
+// NewRouter returns a Router with the trailing slash and fixed path redirects, and the
+// automatic 405 and OPTIONS replies enabled.
+func NewRouter() *Router {
+	return &Router{
+		RedirectTrailingSlash:  true,
+		RedirectFixedPath:      true,
+		HandleMethodNotAllowed: true,
+		HandleOPTIONS:          true,
+	}
+}
+
+// Handle registers handler for the requests with method and a path matching pattern
+func (r *Router) Handle(method, pattern string, handler RequestHandler) {
+	if method == "" {
+		panic("fns: router method must not be empty")
+	}
+	if handler == nil {
+		panic("fns: router handler must not be nil")
+	}
+	if len(pattern) == 0 || pattern[0] != '/' {
+		panic("fns: router pattern must begin with '/' in " + strconv.Quote(pattern))
+	}
+
+	root := r.tree(method)
+	if root == nil {
+		root = &routeNode{}
+		r.trees = append(r.trees, routeTree{method: method, root: root})
+	}
+	root.add(newRoute(pattern, handler))
+	r.globalAllow = r.allowed("*", "")
+}
+
+// Get registers handler for the GET requests matching pattern
+func (r *Router) Get(pattern string, handler RequestHandler) {
+	r.Handle(MethodGet, pattern, handler)
+}
+
+// Head registers handler for the HEAD requests matching pattern
+func (r *Router) Head(pattern string, handler RequestHandler) {
+	r.Handle(MethodHead, pattern, handler)
+}
+
+// Post registers handler for the POST requests matching pattern
+func (r *Router) Post(pattern string, handler RequestHandler) {
+	r.Handle(MethodPost, pattern, handler)
+}
+
+// Put registers handler for the PUT requests matching pattern
+func (r *Router) Put(pattern string, handler RequestHandler) {
+	r.Handle(MethodPut, pattern, handler)
+}
+
+// Patch registers handler for the PATCH requests matching pattern
+func (r *Router) Patch(pattern string, handler RequestHandler) {
+	r.Handle(MethodPatch, pattern, handler)
+}
+
+// Delete registers handler for the DELETE requests matching pattern
+func (r *Router) Delete(pattern string, handler RequestHandler) {
+	r.Handle(MethodDelete, pattern, handler)
+}
+
+// Options registers handler for the OPTIONS requests matching pattern
+func (r *Router) Options(pattern string, handler RequestHandler) {
+	r.Handle(MethodOptions, pattern, handler)
+}
+
+// Group returns a RouterGroup registering the routes on r with the patterns prefixed
+// by prefix, which must begin with '/' and not end with '/'.
+func (r *Router) Group(prefix string) *RouterGroup {
+	return newRouterGroup(r, prefix)
+}
+
+// Handler dispatches the request to the handler of the matching route
+func (r *Router) Handler(ctx *RequestCtx) {
+	method := b2s(ctx.Method())
+	path := b2s(ctx.Path())
+
+	// The HTTP/2 extended CONNECT requests stand for the GET upgrade requests of
+	// HTTP/1.1, such as WebSocket handshakes, see RFC 8441 section 4
+	routeMethod := method
+	if ctx.ConnectProtocol() != "" {
+		routeMethod = MethodGet
+	}
+
+	root := r.tree(routeMethod)
+	if root != nil {
+		if rt := root.lookup(path); rt != nil {
+			if r.RedirectFixedPath && method != MethodConnect && r.redirectFixedPath(ctx, method) {
+				return
+			}
+			rt.setParams(ctx, ctx.Path())
+			rt.handler(ctx)
+			return
+		}
+		if r.RedirectTrailingSlash && method != MethodConnect && path != "/" && r.redirectTrailingSlash(ctx, root, method, path) {
+			return
+		}
+	}
+
+	if method == MethodOptions && r.HandleOPTIONS {
+		var allow string
+		if b2s(ctx.Request.Header.RequestURI()) == "*" {
+			allow = r.globalAllow
+		} else {
+			allow = r.allowed(path, MethodOptions)
+		}
+		if allow != "" {
+			ctx.Response.Header.Set(HeaderAllow, allow)
+			if r.GlobalOPTIONS != nil {
+				r.GlobalOPTIONS(ctx)
+			}
+			return
+		}
+	} else if r.HandleMethodNotAllowed {
+		if allow := r.allowed(path, method); allow != "" {
+			if r.MethodNotAllowed != nil {
+				ctx.Response.Header.Set(HeaderAllow, allow)
+				r.MethodNotAllowed(ctx)
+			} else {
+				// Error resets the response headers
+				ctx.Error(StatusMessage(StatusMethodNotAllowed), StatusMethodNotAllowed)
+				ctx.Response.Header.Set(HeaderAllow, allow)
+			}
+			return
+		}
+	}
+
+	if r.NotFound != nil {
+		r.NotFound(ctx)
+	} else {
+		ctx.Error(StatusMessage(StatusNotFound), StatusNotFound)
+	}
+}
+
+// tree returns the root of the routes of method, nil if there are none
+func (r *Router) tree(method string) *routeNode {
+	for i := range r.trees {
+		if r.trees[i].method == method {
+			return r.trees[i].root
+		}
+	}
+	return nil
+}
+
+// redirectFixedPath redirects the request to its cleaned path if it isn't clean. The
+// redirect uses the path as sent, still escaped, since the decoded one may not be a
+// valid URI.
+func (r *Router) redirectFixedPath(ctx *RequestCtx, method string) bool {
+	orig := b2s(ctx.URI().PathOriginal())
+	if len(orig) == 0 || orig[0] != '/' {
+		return false
+	}
+	fixed := CleanPath(orig)
+	if fixed == orig {
+		return false
+	}
+	redirectPath(ctx, method, fixed)
+	return true
+}
+
+// redirectTrailingSlash redirects the request to its path with or without a trailing
+// slash if there is a route for it
+func (r *Router) redirectTrailingSlash(ctx *RequestCtx, root *routeNode, method, path string) bool {
+	if root.lookup(toggleTrailingSlash(path)) == nil {
+		return false
+	}
+	fixed := CleanPath(b2s(ctx.URI().PathOriginal()))
+	if fixed == "/" {
+		return false
+	}
+	redirectPath(ctx, method, toggleTrailingSlash(fixed))
+	return true
+}
+
+// toggleTrailingSlash adds a trailing slash to path, or removes it
+func toggleTrailingSlash(path string) string {
+	if path[len(path)-1] == '/' {
+		return path[:len(path)-1]
+	}
+	return path + "/"
+}
+
+// redirectPath redirects the request permanently to path, keeping the query string.
+// 308 is used for the methods other than GET so that the method and the body are kept.
+func redirectPath(ctx *RequestCtx, method, path string) {
+	code := StatusMovedPermanently
+	if method != MethodGet {
+		code = StatusPermanentRedirect
+	}
+	if q := ctx.URI().QueryString(); len(q) > 0 {
+		path += "?" + string(q)
+	}
+	ctx.Redirect(path, code)
+}
+
+// allowed returns the Allow header for the routes of path in the methods other than
+// reqMethod, or all the methods with a route for "*". It is empty if there are none.
+func (r *Router) allowed(path, reqMethod string) string {
+	var methods []string
+	for i := range r.trees {
+		method := r.trees[i].method
+		if method == reqMethod || method == MethodOptions {
+			continue
+		}
+		if path == "*" || r.trees[i].root.lookup(path) != nil {
+			methods = append(methods, method)
+		}
+	}
+	if len(methods) == 0 {
+		return ""
+	}
+	if r.HandleOPTIONS || r.tree(MethodOptions) != nil {
+		methods = append(methods, MethodOptions)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// RouterGroup registers routes on a Router with their patterns prefixed, see
+// Router.Group.
+type RouterGroup struct {
+	r      *Router
+	prefix string
+}
+
+func newRouterGroup(r *Router, prefix string) *RouterGroup {
+	if len(prefix) == 0 || prefix[0] != '/' {
+		panic("fns: router group prefix must begin with '/' in " + strconv.Quote(prefix))
+	}
+	if prefix == "/" {
+		prefix = ""
+	} else if prefix[len(prefix)-1] == '/' {
+		panic("fns: router group prefix must not end with '/' in " + strconv.Quote(prefix))
+	}
+	return &RouterGroup{r: r, prefix: prefix}
+}
+
+// Group returns a RouterGroup nested in g, with the patterns prefixed by both prefixes
+func (g *RouterGroup) Group(prefix string) *RouterGroup {
+	ng := newRouterGroup(g.r, prefix)
+	ng.prefix = g.prefix + ng.prefix
+	return ng
+}
+
+// Handle registers handler for the requests with method and a path matching the
+// prefixed pattern
+func (g *RouterGroup) Handle(method, pattern string, handler RequestHandler) {
+	g.r.Handle(method, g.prefix+pattern, handler)
+}
+
+// Get registers handler for the GET requests matching the prefixed pattern
+func (g *RouterGroup) Get(pattern string, handler RequestHandler) {
+	g.Handle(MethodGet, pattern, handler)
+}
+
+// Head registers handler for the HEAD requests matching the prefixed pattern
+func (g *RouterGroup) Head(pattern string, handler RequestHandler) {
+	g.Handle(MethodHead, pattern, handler)
+}
+
+// Post registers handler for the POST requests matching the prefixed pattern
+func (g *RouterGroup) Post(pattern string, handler RequestHandler) {
+	g.Handle(MethodPost, pattern, handler)
+}
+
+// Put registers handler for the PUT requests matching the prefixed pattern
+func (g *RouterGroup) Put(pattern string, handler RequestHandler) {
+	g.Handle(MethodPut, pattern, handler)
+}
+
+// Patch registers handler for the PATCH requests matching the prefixed pattern
+func (g *RouterGroup) Patch(pattern string, handler RequestHandler) {
+	g.Handle(MethodPatch, pattern, handler)
+}
+
+// Delete registers handler for the DELETE requests matching the prefixed pattern
+func (g *RouterGroup) Delete(pattern string, handler RequestHandler) {
+	g.Handle(MethodDelete, pattern, handler)
+}
+
+// Options registers handler for the OPTIONS requests matching the prefixed pattern
+func (g *RouterGroup) Options(pattern string, handler RequestHandler) {
+	g.Handle(MethodOptions, pattern, handler)
+}
+
+// Handle registers handler on DefaultRouter for the requests with method and a path
+// matching pattern
+func Handle(method, pattern string, handler RequestHandler) {
+	DefaultRouter.Handle(method, pattern, handler)
+}
+
+// HandleGet registers handler on DefaultRouter for the GET requests matching pattern
+func HandleGet(pattern string, handler RequestHandler) {
+	DefaultRouter.Get(pattern, handler)
+}
+
+// HandleHead registers handler on DefaultRouter for the HEAD requests matching pattern
+func HandleHead(pattern string, handler RequestHandler) {
+	DefaultRouter.Head(pattern, handler)
+}
+
+// HandlePost registers handler on DefaultRouter for the POST requests matching pattern
+func HandlePost(pattern string, handler RequestHandler) {
+	DefaultRouter.Post(pattern, handler)
+}
+
+// HandlePut registers handler on DefaultRouter for the PUT requests matching pattern
+func HandlePut(pattern string, handler RequestHandler) {
+	DefaultRouter.Put(pattern, handler)
+}
+
+// HandlePatch registers handler on DefaultRouter for the PATCH requests matching pattern
+func HandlePatch(pattern string, handler RequestHandler) {
+	DefaultRouter.Patch(pattern, handler)
+}
+
+// HandleDelete registers handler on DefaultRouter for the DELETE requests matching pattern
+func HandleDelete(pattern string, handler RequestHandler) {
+	DefaultRouter.Delete(pattern, handler)
+}
+
+// HandleOptions registers handler on DefaultRouter for the OPTIONS requests matching pattern
+func HandleOptions(pattern string, handler RequestHandler) {
+	DefaultRouter.Options(pattern, handler)
+}
+
+// Group returns a RouterGroup registering the routes on DefaultRouter with the patterns
+// prefixed by prefix
+func Group(prefix string) *RouterGroup {
+	return DefaultRouter.Group(prefix)
+}
+
+// CleanPath returns the canonical form of the URL path p: it begins with '/', the
+// repeated slashes and the "." elements are removed, and the ".." elements are removed
+// along with the element preceding them. A trailing slash is kept.
+//
+// p is returned as is, without allocating, if it is already clean.
+func CleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	// buf is only allocated when p needs to be modified
+	var buf []byte
+	n := len(p)
+	r := 1 // next byte to read from p
+	w := 1 // next byte to write to buf
+
+	if p[0] != '/' {
+		r = 0
+		buf = make([]byte, n+1)
+		buf[0] = '/'
+	}
+	trailing := n > 1 && p[n-1] == '/'
+
+	for r < n {
+		switch {
+		case p[r] == '/':
+			// Repeated slash
+			r++
+		case p[r] == '.' && r+1 == n:
+			// Final "." element
+			trailing = true
+			r++
+		case p[r] == '.' && p[r+1] == '/':
+			// "." element
+			r += 2
+		case p[r] == '.' && p[r+1] == '.' && (r+2 == n || p[r+2] == '/'):
+			// ".." element, remove the previous one
+			r += 3
+			if w > 1 {
+				w--
+				if buf == nil {
+					for w > 1 && p[w] != '/' {
+						w--
+					}
+				} else {
+					for w > 1 && buf[w] != '/' {
+						w--
+					}
+				}
+			}
+		default:
+			// Real element, preceded by a slash unless it's the first one
+			if w > 1 {
+				cleanPathAppend(&buf, p, w, '/')
+				w++
+			}
+			for r < n && p[r] != '/' {
+				cleanPathAppend(&buf, p, w, p[r])
+				w++
+				r++
+			}
+		}
+	}
+
+	if trailing && w > 1 {
+		cleanPathAppend(&buf, p, w, '/')
+		w++
+	}
+
+	if buf == nil {
+		return p[:w]
+	}
+	return string(buf[:w])
+}
+
+// cleanPathAppend writes c at buf[w], allocating buf when it starts differing from s
+func cleanPathAppend(buf *[]byte, s string, w int, c byte) {
+	if *buf == nil {
+		if s[w] == c {
+			return
+		}
+		*buf = make([]byte, len(s)+1)
+		copy(*buf, s[:w])
+	}
+	(*buf)[w] = c
+}
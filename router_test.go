@@ -0,0 +1,385 @@
+package fns
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// routerTestRequest serves a request for method and uri with r, returning the context
+func routerTestRequest(r *Router, method, uri string) *RequestCtx {
+	var ctx RequestCtx
+	var req Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	ctx.Init(&req, nil, nil)
+	r.Handler(&ctx)
+	return &ctx
+}
+
+// routerTestHandler writes the route and the parameter values to the response
+func routerTestHandler(route string, params ...string) RequestHandler {
+	return func(ctx *RequestCtx) {
+		body := route
+		for _, p := range params {
+			body += fmt.Sprintf(" %s=%v", p, ctx.UserValue(p))
+		}
+		ctx.SetBodyString(body)
+	}
+}
+
+func TestRouterLookup(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	for _, route := range []struct {
+		pattern string
+		params  []string
+	}{
+		{"/", nil},
+		{"/users", nil},
+		{"/users/new", nil},
+		{"/users/:id", []string{"id"}},
+		{"/users/:id/files/*path", []string{"id", "path"}},
+		{"/uploads/*path", []string{"path"}},
+		{"/a/:b/c", []string{"b"}},
+		{"/a/b/:c", []string{"c"}},
+		{"/search/", nil},
+		{"/info/:user/public", []string{"user"}},
+		{"/info/:user/project/:project", []string{"user", "project"}},
+	} {
+		r.Get(route.pattern, routerTestHandler(route.pattern, route.params...))
+	}
+
+	for _, tc := range []struct {
+		path string
+		body string
+	}{
+		{"/", "/"},
+		{"/users", "/users"},
+		{"/users/new", "/users/new"},
+		{"/users/42", "/users/:id id=42"},
+		{"/users/newer", "/users/:id id=newer"},
+		{"/users/42/files/", "/users/:id/files/*path id=42 path="},
+		{"/users/42/files/a/b.txt", "/users/:id/files/*path id=42 path=a/b.txt"},
+		{"/uploads/", "/uploads/*path path="},
+		{"/uploads/x/y/", "/uploads/*path path=x/y/"},
+		{"/a/b/c", "/a/b/:c c=c"},
+		{"/a/b/d", "/a/b/:c c=d"},
+		{"/a/x/c", "/a/:b/c b=x"},
+		{"/search/", "/search/"},
+		{"/info/gordon/public", "/info/:user/public user=gordon"},
+		{"/info/gordon/project/go", "/info/:user/project/:project user=gordon project=go"},
+	} {
+		ctx := routerTestRequest(r, MethodGet, tc.path)
+		if code := ctx.Response.StatusCode(); code != StatusOK {
+			t.Errorf("%s: unexpected status %d", tc.path, code)
+			continue
+		}
+		if body := string(ctx.Response.Body()); body != tc.body {
+			t.Errorf("%s: unexpected route %q, expected %q", tc.path, body, tc.body)
+		}
+	}
+
+	for _, path := range []string{"/users/42/other", "/a/b", "/info/gordon", "/nothing"} {
+		ctx := routerTestRequest(r, MethodGet, path)
+		if code := ctx.Response.StatusCode(); code != StatusNotFound {
+			t.Errorf("%s: unexpected status %d, expected %d", path, code, StatusNotFound)
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	r.Get("/users/:id", routerTestHandler("get"))
+	r.Delete("/users/:id", routerTestHandler("delete"))
+	r.Post("/users", routerTestHandler("post"))
+
+	ctx := routerTestRequest(r, MethodPut, "/users/1")
+	if code := ctx.Response.StatusCode(); code != StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d, expected %d", code, StatusMethodNotAllowed)
+	}
+	if allow := string(ctx.Response.Header.Peek(HeaderAllow)); allow != "DELETE, GET, OPTIONS" {
+		t.Fatalf("unexpected Allow %q", allow)
+	}
+
+	r.MethodNotAllowed = func(ctx *RequestCtx) {
+		ctx.SetStatusCode(StatusTeapot)
+	}
+	ctx = routerTestRequest(r, MethodPut, "/users/1")
+	if code := ctx.Response.StatusCode(); code != StatusTeapot {
+		t.Fatalf("unexpected status %d, expected %d", code, StatusTeapot)
+	}
+
+	r.HandleMethodNotAllowed = false
+	ctx = routerTestRequest(r, MethodPut, "/users/1")
+	if code := ctx.Response.StatusCode(); code != StatusNotFound {
+		t.Fatalf("unexpected status %d, expected %d", code, StatusNotFound)
+	}
+}
+
+func TestRouterOptions(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	r.Get("/users", routerTestHandler("get"))
+	r.Post("/users", routerTestHandler("post"))
+	r.Put("/items/:id", routerTestHandler("put"))
+	r.Options("/custom", routerTestHandler("options"))
+
+	for _, tc := range []struct {
+		path  string
+		allow string
+	}{
+		{"/users", "GET, OPTIONS, POST"},
+		{"/items/1", "OPTIONS, PUT"},
+		{"*", "GET, OPTIONS, POST, PUT"},
+	} {
+		ctx := routerTestRequest(r, MethodOptions, tc.path)
+		if code := ctx.Response.StatusCode(); code != StatusOK {
+			t.Errorf("%s: unexpected status %d", tc.path, code)
+		}
+		if allow := string(ctx.Response.Header.Peek(HeaderAllow)); allow != tc.allow {
+			t.Errorf("%s: unexpected Allow %q, expected %q", tc.path, allow, tc.allow)
+		}
+	}
+
+	// The registered OPTIONS routes are preferred
+	ctx := routerTestRequest(r, MethodOptions, "/custom")
+	if body := string(ctx.Response.Body()); body != "options" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	ctx = routerTestRequest(r, MethodOptions, "/nothing")
+	if code := ctx.Response.StatusCode(); code != StatusNotFound {
+		t.Fatalf("unexpected status %d, expected %d", code, StatusNotFound)
+	}
+
+	r.GlobalOPTIONS = func(ctx *RequestCtx) {
+		ctx.Response.Header.Set(HeaderAccessControlAllowOrigin, "*")
+		ctx.SetStatusCode(StatusNoContent)
+	}
+	ctx = routerTestRequest(r, MethodOptions, "/users")
+	if code := ctx.Response.StatusCode(); code != StatusNoContent {
+		t.Fatalf("unexpected status %d, expected %d", code, StatusNoContent)
+	}
+	if v := string(ctx.Response.Header.Peek(HeaderAccessControlAllowOrigin)); v != "*" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin %q", v)
+	}
+}
+
+func TestRouterRedirect(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	r.Get("/users", routerTestHandler("users"))
+	r.Get("/docs/", routerTestHandler("docs"))
+	r.Post("/items", routerTestHandler("items"))
+	r.Get("/static/*path", routerTestHandler("static"))
+
+	for _, tc := range []struct {
+		method   string
+		uri      string
+		code     int
+		location string
+	}{
+		{MethodGet, "/users/", StatusMovedPermanently, "http://example.com/users"},
+		{MethodGet, "/docs?x=1", StatusMovedPermanently, "http://example.com/docs/?x=1"},
+		{MethodPost, "/items/", StatusPermanentRedirect, "http://example.com/items"},
+		{MethodGet, "/static", StatusMovedPermanently, "http://example.com/static/"},
+		{MethodGet, "//users", StatusMovedPermanently, "http://example.com/users"},
+		{MethodGet, "/a/../users", StatusMovedPermanently, "http://example.com/users"},
+		{MethodGet, "/./docs/", StatusMovedPermanently, "http://example.com/docs/"},
+		{MethodGet, "/static/a%2Fb/../c", StatusMovedPermanently, "http://example.com/static/c"},
+		{MethodGet, "/static/a%3Fb//c", StatusMovedPermanently, "http://example.com/static/a%3Fb/c"},
+	} {
+		ctx := routerTestRequest(r, tc.method, "http://example.com"+tc.uri)
+		if code := ctx.Response.StatusCode(); code != tc.code {
+			t.Errorf("%s %s: unexpected status %d, expected %d", tc.method, tc.uri, code, tc.code)
+		}
+		if location := string(ctx.Response.Header.Peek(HeaderLocation)); location != tc.location {
+			t.Errorf("%s %s: unexpected Location %q, expected %q", tc.method, tc.uri, location, tc.location)
+		}
+	}
+
+	r.RedirectTrailingSlash = false
+	r.RedirectFixedPath = false
+	for _, tc := range []struct {
+		uri  string
+		code int
+	}{
+		{"/users/", StatusNotFound},
+		{"//users", StatusOK},
+		{"/a/../users", StatusOK},
+	} {
+		ctx := routerTestRequest(r, MethodGet, "http://example.com"+tc.uri)
+		if code := ctx.Response.StatusCode(); code != tc.code {
+			t.Errorf("%s: unexpected status %d, expected %d", tc.uri, code, tc.code)
+		}
+	}
+}
+
+func TestRouterGroup(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	api := r.Group("/api")
+	api.Get("/status", routerTestHandler("status"))
+	v1 := api.Group("/v1")
+	v1.Post("/users/:id", routerTestHandler("user", "id"))
+	r.Group("/").Get("/root", routerTestHandler("root"))
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{MethodGet, "/api/status", "status"},
+		{MethodPost, "/api/v1/users/7", "user id=7"},
+		{MethodGet, "/root", "root"},
+	} {
+		ctx := routerTestRequest(r, tc.method, tc.path)
+		if body := string(ctx.Response.Body()); body != tc.body {
+			t.Errorf("%s %s: unexpected body %q, expected %q", tc.method, tc.path, body, tc.body)
+		}
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	t.Parallel()
+
+	r := NewRouter()
+	r.NotFound = func(ctx *RequestCtx) {
+		ctx.Error("custom", StatusNotFound)
+	}
+	ctx := routerTestRequest(r, MethodGet, "/nothing")
+	if body := string(ctx.Response.Body()); body != "custom" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	t.Parallel()
+
+	h := routerTestHandler("")
+	for _, tc := range []struct {
+		name string
+		fn   func(r *Router)
+	}{
+		{"no slash", func(r *Router) { r.Get("users", h) }},
+		{"no name", func(r *Router) { r.Get("/users/:", h) }},
+		{"mid-segment parameter", func(r *Router) { r.Get("/users:id", h) }},
+		{"two parameters in a segment", func(r *Router) { r.Get("/users/:a:b", h) }},
+		{"catch-all not last", func(r *Router) { r.Get("/files/*path/x", h) }},
+		{"repeated parameter", func(r *Router) { r.Get("/:id/:id", h) }},
+		{"nil handler", func(r *Router) { r.Get("/users", nil) }},
+		{"duplicate", func(r *Router) { r.Get("/users", h); r.Get("/users", h) }},
+		{"conflicting parameters", func(r *Router) { r.Get("/users/:id", h); r.Get("/users/:name/x", h) }},
+		{"group ending with slash", func(r *Router) { r.Group("/api/") }},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", tc.name)
+				}
+			}()
+			tc.fn(NewRouter())
+		}()
+	}
+}
+
+func TestRouterAllocs(t *testing.T) {
+	r := NewRouter()
+	r.Get("/users/list", func(ctx *RequestCtx) {})
+	r.Get("/users/:id", func(ctx *RequestCtx) {})
+
+	var ctx RequestCtx
+	var req Request
+	req.SetRequestURI("/users/list")
+	ctx.Init(&req, nil, nil)
+
+	n := testing.AllocsPerRun(100, func() {
+		r.Handler(&ctx)
+	})
+	if n != 0 {
+		t.Fatalf("unexpected allocations for a static route: %v", n)
+	}
+}
+
+func TestServerDefaultRouter(t *testing.T) {
+	// DefaultRouter is global, the test is not parallel
+	defer func(r *Router) { DefaultRouter = r }(DefaultRouter)
+	DefaultRouter = NewRouter()
+
+	HandleGet("/hello/:name", func(ctx *RequestCtx) {
+		fmt.Fprintf(ctx, "hello %s", ctx.UserValue("name"))
+	})
+
+	s := &Server{}
+	rw := &readWriter{}
+	rw.r.WriteString("GET /hello/gopher HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if err := s.ServeConn(rw); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var resp Response
+	if err := resp.Read(bufio.NewReader(&rw.w)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if body := string(resp.Body()); body != "hello gopher" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, expected string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/abc", "/abc"},
+		{"/a/b/c", "/a/b/c"},
+		{"/abc/", "/abc/"},
+		{"abc", "/abc"},
+		{"a/b/", "/a/b/"},
+		{"//", "/"},
+		{"/abc//", "/abc/"},
+		{"/abc//def//ghi", "/abc/def/ghi"},
+		{"//abc", "/abc"},
+		{".", "/"},
+		{"./", "/"},
+		{"/abc/./def", "/abc/def"},
+		{"/./abc/def", "/abc/def"},
+		{"/abc/.", "/abc/"},
+		{"..", "/"},
+		{"../", "/"},
+		{"/abc/def/..", "/abc"},
+		{"/abc/def/../", "/abc/"},
+		{"/abc/def/../ghi", "/abc/ghi"},
+		{"/abc/def/../..", "/"},
+		{"/../../abc", "/abc"},
+		{"/abc/./../def", "/def"},
+		{"/abc/..def", "/abc/..def"},
+	} {
+		if got := CleanPath(tc.path); got != tc.expected {
+			t.Errorf("CleanPath(%q) = %q, expected %q", tc.path, got, tc.expected)
+		}
+	}
+
+	n := testing.AllocsPerRun(100, func() {
+		CleanPath("/abc/def/ghi/")
+	})
+	if n != 0 {
+		t.Fatalf("unexpected allocations for a clean path: %v", n)
+	}
+
+	// The result is stable
+	for _, p := range []string{"/a/../b//c/./", "x/y/../../..//z"} {
+		if c := CleanPath(p); CleanPath(c) != c || !strings.HasPrefix(c, "/") {
+			t.Errorf("CleanPath(%q) = %q is not clean", p, c)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package fns
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// routeNodeKind tells how a routeNode matches the path
+type routeNodeKind uint8
+
+const (
+	routeNodeStatic   routeNodeKind = iota // matches its path
+	routeNodeParam                         // matches a non-empty segment, up to the next '/'
+	routeNodeCatchAll                      // matches the remainder of the path
+)
+
+// routeNode is a node of the radix tree of the routes of a method. The static children
+// are indexed by the first byte of their path, a node has at most one parameter and
+// one catch-all child.
+type routeNode struct {
+	kind routeNodeKind
+
+	// path is the static part matched by a static node
+	path string
+
+	// name is the parameter matched by a parameter or catch-all node
+	name string
+
+	indices  string
+	children []*routeNode
+	param    *routeNode
+	catchAll *routeNode
+
+	// route is the route ending at the node, if any
+	route *route
+}
+
+// route is a registered pattern and its handler
+type route struct {
+	pattern  string
+	handler  RequestHandler
+	segments []routeSegment
+	params   bool
+}
+
+// routeSegment is a static part or a parameter of a pattern
+type routeSegment struct {
+	kind routeNodeKind
+
+	// text is the static part, or the parameter name
+	text string
+
+	// key is the parameter name passed to SetUserValue, boxed once for all
+	key interface{}
+}
+
+// newRoute parses pattern, panicking if it is invalid
+func newRoute(pattern string, handler RequestHandler) *route {
+	rt := &route{pattern: pattern, handler: handler}
+	names := make(map[string]struct{})
+
+	for i := 0; i < len(pattern); {
+		j := strings.IndexAny(pattern[i:], ":*")
+		if j < 0 {
+			rt.segments = append(rt.segments, routeSegment{kind: routeNodeStatic, text: pattern[i:]})
+			break
+		}
+		if j > 0 {
+			rt.segments = append(rt.segments, routeSegment{kind: routeNodeStatic, text: pattern[i : i+j]})
+			i += j
+		}
+		if pattern[i-1] != '/' {
+			panic("fns: router parameter must begin a path segment in " + strconv.Quote(pattern))
+		}
+
+		end := strings.IndexByte(pattern[i:], '/')
+		if end < 0 {
+			end = len(pattern)
+		} else {
+			end += i
+		}
+		name := pattern[i+1 : end]
+		if name == "" || strings.ContainsAny(name, ":*") {
+			panic("fns: router parameter must have a name and fill its path segment in " + strconv.Quote(pattern))
+		}
+		if _, ok := names[name]; ok {
+			panic("fns: router parameter " + strconv.Quote(name) + " is repeated in " + strconv.Quote(pattern))
+		}
+		names[name] = struct{}{}
+
+		kind := routeNodeParam
+		if pattern[i] == '*' {
+			if end != len(pattern) {
+				panic("fns: router catch-all parameter must end the pattern in " + strconv.Quote(pattern))
+			}
+			kind = routeNodeCatchAll
+		}
+		rt.segments = append(rt.segments, routeSegment{kind: kind, text: name, key: name})
+		rt.params = true
+		i = end
+	}
+	return rt
+}
+
+// setParams stores the values of the parameters of the route matched by path
+func (rt *route) setParams(ctx *RequestCtx, path []byte) {
+	if !rt.params {
+		return
+	}
+
+	i := 0
+	for _, seg := range rt.segments {
+		switch seg.kind {
+		case routeNodeStatic:
+			i += len(seg.text)
+		case routeNodeParam:
+			end := len(path)
+			if n := bytes.IndexByte(path[i:], '/'); n >= 0 {
+				end = i + n
+			}
+			ctx.SetUserValue(seg.key, string(path[i:end]))
+			i = end
+		case routeNodeCatchAll:
+			ctx.SetUserValue(seg.key, string(path[i:]))
+		}
+	}
+}
+
+// add adds rt to the tree rooted at n, panicking if it conflicts with another route
+func (n *routeNode) add(rt *route) {
+	for _, seg := range rt.segments {
+		switch seg.kind {
+		case routeNodeStatic:
+			n = n.addStatic(seg.text)
+		case routeNodeParam:
+			n.param = n.wildcardChild(n.param, seg, rt.pattern)
+			n = n.param
+		case routeNodeCatchAll:
+			n.catchAll = n.wildcardChild(n.catchAll, seg, rt.pattern)
+			n = n.catchAll
+		}
+	}
+	if n.route != nil {
+		panic("fns: router pattern " + strconv.Quote(rt.pattern) + " conflicts with " + strconv.Quote(n.route.pattern))
+	}
+	n.route = rt
+}
+
+// addStatic returns the node matching path after n, splitting the nodes sharing a
+// prefix with it
+func (n *routeNode) addStatic(path string) *routeNode {
+	for path != "" {
+		i := strings.IndexByte(n.indices, path[0])
+		if i < 0 {
+			child := &routeNode{kind: routeNodeStatic, path: path}
+			n.indices += path[:1]
+			n.children = append(n.children, child)
+			return child
+		}
+
+		child := n.children[i]
+		l := 0
+		for l < len(path) && l < len(child.path) && path[l] == child.path[l] {
+			l++
+		}
+		if l < len(child.path) {
+			tail := *child
+			tail.path = child.path[l:]
+			*child = routeNode{
+				kind:     routeNodeStatic,
+				path:     child.path[:l],
+				indices:  tail.path[:1],
+				children: []*routeNode{&tail},
+			}
+		}
+		n = child
+		path = path[l:]
+	}
+	return n
+}
+
+// wildcardChild returns the parameter or catch-all child for seg, creating it if
+// needed. The routes sharing it must name the parameter the same.
+func (n *routeNode) wildcardChild(child *routeNode, seg routeSegment, pattern string) *routeNode {
+	if child == nil {
+		return &routeNode{kind: seg.kind, name: seg.text}
+	}
+	if child.name != seg.text {
+		panic("fns: router parameter " + strconv.Quote(seg.text) + " in " + strconv.Quote(pattern) +
+			" conflicts with the parameter " + strconv.Quote(child.name) + " of the other routes")
+	}
+	return child
+}
+
+// lookup returns the route matching path in the tree rooted at n, nil if none. The
+// static children are tried first, then the parameter and the catch-all ones.
+func (n *routeNode) lookup(path string) *route {
+	switch n.kind {
+	case routeNodeStatic:
+		if len(path) < len(n.path) || path[:len(n.path)] != n.path {
+			return nil
+		}
+		path = path[len(n.path):]
+	case routeNodeParam:
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		if end == 0 {
+			return nil
+		}
+		path = path[end:]
+	case routeNodeCatchAll:
+		return n.route
+	}
+
+	if path == "" {
+		if n.route != nil {
+			return n.route
+		}
+	} else if i := strings.IndexByte(n.indices, path[0]); i >= 0 {
+		if rt := n.children[i].lookup(path); rt != nil {
+			return rt
+		}
+	}
+	if n.param != nil && path != "" {
+		if rt := n.param.lookup(path); rt != nil {
+			return rt
+		}
+	}
+	if n.catchAll != nil {
+		return n.catchAll.route
+	}
+	return nil
+}
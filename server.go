@@ -81,7 +81,7 @@ func ServeTLSEmbed(ln net.Listener, certData, keyData []byte, handler RequestHan
 }
 
 // ListenAndServe serves HTTP requests from the given TCP addr
-// using the given handler.
+// using the given handler, or DefaultRouter if handler is nil.
 func ListenAndServe(addr string, handler RequestHandler) error {
 	s := &Server{
 		Handler: handler,
@@ -150,7 +150,9 @@ type Server struct {
 	// Handler for processing incoming requests.
 	//
 	// Take into account that no `panic` recovery is done by `fasthttp` (thus any `panic` will take down the entire server).
-	// Instead the user should use `recover` to handle these situations.
+	// Instead the user should use `recover` to handle these situations, or wrap the handler with middleware.Recover.
+	//
+	// DefaultRouter is used if not set.
 	Handler RequestHandler
 
 	// ErrorHandler for returning a response in case of an error while receiving or parsing the request.
@@ -411,6 +413,9 @@ type Server struct {
 
 	nextProtos map[string]ServeHandler
 
+	// h2c serves HTTP/2 on cleartext connections if enabled with ServerConfig.H2C
+	h2c *H2Server
+
 	concurrency      uint32
 	concurrencyCh    chan struct{}
 	perIPConnCounter perIPConnCounter
@@ -426,6 +431,10 @@ type Server struct {
 	idleConns   map[net.Conn]time.Time
 	idleConnsMu sync.Mutex
 
+	// HTTP/2 connections are drained with GOAWAY frames in Shutdown() instead
+	h2Conns   map[*h2ServerConn]struct{}
+	h2ConnsMu sync.Mutex
+
 	mu   sync.Mutex
 	open int32
 	stop int32
@@ -600,6 +609,7 @@ type RequestCtx struct {
 	s      *Server
 	c      net.Conn
 	fbr    firstByteReader
+	pr     prefaceReader
 
 	timeoutResponse *Response
 	timeoutCh       chan struct{}
@@ -613,6 +623,16 @@ type RequestCtx struct {
 	getUnbufferedWriter func() UnbufferedWriter // creates unbuffered writer
 	unbufferedWriter    UnbufferedWriter        // writes directly to underlying connection
 	bytesSent           int                     // number of bytes sent to client using unbuffered operations
+
+	deadline      time.Time     // set by SetDeadline
+	deadlineCh    chan struct{} // closed once the deadline passes
+	deadlineTimer *time.Timer
+
+	push func(path string, headers []string) error // initiates a server push, set by the HTTP/2 server
+
+	connectProtocol string // :protocol of an HTTP/2 extended CONNECT request
+
+	done *doneWatch // closes the channel returned by Done, set by SetDeadline and watchDisconnect
 }
 
 // DisableBuffering modifies fasthttp to disable body buffering for this request.
@@ -659,6 +679,42 @@ func (ctx *RequestCtx) SetUnbufferedWriter(f func() UnbufferedWriter) {
 	ctx.getUnbufferedWriter = f
 }
 
+var (
+	// ErrPushNotSupported is returned by RequestCtx.Push for requests not received over HTTP/2
+	ErrPushNotSupported = errors.New("server push is only supported over HTTP/2")
+
+	// ErrPushDisabled is returned by RequestCtx.Push if the client disabled server push
+	// with SETTINGS_ENABLE_PUSH
+	ErrPushDisabled = errors.New("server push is disabled by the client")
+)
+
+// Push sends the response to a GET request for path along with the response to
+// this request, so the client doesn't have to request it, see RFC 9113 section 8.4.
+// headers holds name/value pairs of request headers, the authority and scheme
+// are those of this request.
+//
+// The pushed request is served by Server.Handler like any other request, once the
+// client has been promised the response. Push must be called before the handler
+// returns, and before the response is closed if buffering is disabled.
+//
+// ErrPushNotSupported is returned over HTTP/1 and ErrPushDisabled if the client
+// doesn't accept pushed responses.
+func (ctx *RequestCtx) Push(path string, headers ...string) error {
+	if ctx.push == nil {
+		return ErrPushNotSupported
+	}
+	return ctx.push(path, headers)
+}
+
+// ConnectProtocol returns the protocol requested by an HTTP/2 extended CONNECT
+// request, such as "websocket", see RFC 8441. It is empty for the other requests.
+//
+// The request is accepted with a 2xx response and Hijack, the hijack handler then
+// gets a connection over the stream.
+func (ctx *RequestCtx) ConnectProtocol() string {
+	return ctx.connectProtocol
+}
+
 // CloseResponse finalizes non-buffered response dispatch.
 // This method must be called after performing non-buffered responses
 // If the handler does not finish the response, it will be called automatically
@@ -705,6 +761,10 @@ type HijackHandler func(c net.Conn)
 //
 //   - WebSocket ( https://en.wikipedia.org/wiki/WebSocket )
 //   - HTTP/2.0 ( https://en.wikipedia.org/wiki/HTTP/2 )
+//
+// Over HTTP/2, only the extended CONNECT requests answered with a 2xx
+// status can be hijacked, see ConnectProtocol. The handler then gets a
+// connection over the stream, which is ended when it returns.
 func (ctx *RequestCtx) Hijack(handler HijackHandler) {
 	ctx.hijackHandler = handler
 }
@@ -858,6 +918,7 @@ func (ctx *RequestCtx) reset() {
 	ctx.Request.Reset()
 	ctx.Response.Reset()
 	ctx.fbr.reset()
+	ctx.pr.reset()
 
 	ctx.connID = 0
 	ctx.connRequestNum = 0
@@ -887,6 +948,24 @@ func (ctx *RequestCtx) reset() {
 	ctx.unbufferedWriter = nil
 	ctx.getUnbufferedWriter = nil
 	ctx.bytesSent = 0
+	ctx.resetDeadline()
+	ctx.push = nil
+	ctx.connectProtocol = ""
+}
+
+// resetDeadline removes the deadline of the request, and ends the watch closing the
+// channel returned by Done
+func (ctx *RequestCtx) resetDeadline() {
+	if ctx.deadlineTimer != nil {
+		ctx.deadlineTimer.Stop()
+		ctx.deadlineTimer = nil
+	}
+	ctx.deadline = zeroTime
+	ctx.deadlineCh = nil
+	if ctx.done != nil {
+		close(ctx.done.stop)
+		ctx.done = nil
+	}
 }
 
 type firstByteReader struct {
@@ -1532,6 +1611,10 @@ func (ctx *RequestCtx) BytesSent() int {
 
 // WriteString appends s to response body.
 func (ctx *RequestCtx) WriteString(s string) (int, error) {
+	if ctx.disableBuffering {
+		return ctx.writeDirect(s2b(s))
+	}
+
 	ctx.Response.AppendBodyString(s)
 	return len(s), nil
 }
@@ -1972,6 +2055,10 @@ func (s *Server) ShutdownWithContext(ctx context.Context) (err error) {
 		close(s.done)
 	}
 
+	// HTTP/2 connections are told to stop opening streams, they are closed
+	// once their in-flight streams are done.
+	s.shutdownH2Conns()
+
 	// Closing the listener will make Serve() call Stop on the worker pool.
 	// Setting .stop to 1 will make serveConn() break out of its loop.
 	// Now we just have to wait until all workers are done or timeout.
@@ -1990,6 +2077,7 @@ END:
 		select {
 		case <-ctx.Done():
 			err = ctx.Err()
+			s.closeH2Conns()
 			break END
 		case <-ticker.C:
 			continue
@@ -2177,6 +2265,15 @@ func (s *Server) idleTimeout() time.Duration {
 	return s.ReadTimeout
 }
 
+// handle calls the Handler, or DefaultRouter if there is none
+func (s *Server) handle(ctx *RequestCtx) {
+	if s.Handler != nil {
+		s.Handler(ctx)
+	} else {
+		DefaultRouter.Handler(ctx)
+	}
+}
+
 func (s *Server) serveConnCleanup() {
 	atomic.AddInt32(&s.open, -1)
 	atomic.AddUint32(&s.concurrency, ^uint32(0))
@@ -2190,7 +2287,20 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 	if proto, err = s.getNextProto(c); err != nil {
 		return
 	}
-	if handler, ok := s.nextProtos[proto]; ok {
+	handler, ok := s.nextProtos[proto]
+	var peeked []byte
+	if !ok && s.h2c != nil {
+		if _, isTLS := c.(connTLSer); !isTLS {
+			// Cleartext HTTP/2 clients with prior knowledge start with the connection preface.
+			// The bytes read are replayed to the HTTP/1 parser otherwise, which keeps using
+			// the connection itself, so that io.ReaderFrom still sends files with sendfile.
+			if peeked, ok = s.h2c.peekPreface(c); ok {
+				c = &h2cConn{Conn: c, r: &prefaceReader{c: c, b: peeked}}
+				handler = s.h2c.HandleHTTP2Conn
+			}
+		}
+	}
+	if ok {
 		// Remove read or write deadlines that might have previously been set.
 		// The next handler is responsible for setting its own deadlines.
 		if s.ReadTimeout > 0 || s.WriteTimeout > 0 {
@@ -2228,6 +2338,12 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 
 		continueReadingRequest = true
 	)
+	if len(peeked) > 0 {
+		ctx.pr.c = c
+		ctx.pr.b = peeked
+		br = acquireReader(ctx)
+		br.Reset(&ctx.pr)
+	}
 	for {
 		connRequestNum++
 
@@ -2438,8 +2554,8 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 		ctx.time = time.Now()
 
 		// If a client denies a request the handler should not be called
-		if continueReadingRequest {
-			s.Handler(ctx)
+		if continueReadingRequest && (s.h2c == nil || !s.h2c.upgrade(ctx)) {
+			s.handle(ctx)
 		}
 
 		if ctx.disableBuffering {
@@ -2553,6 +2669,7 @@ func (s *Server) serveConn(c net.Conn) (err error) {
 
 		s.setState(c, StateIdle)
 		ctx.userValues.Reset()
+		ctx.resetDeadline()
 		ctx.Request.Reset()
 		ctx.Response.Reset()
 
@@ -2794,14 +2911,32 @@ func (ctx *RequestCtx) Init(req *Request, remoteAddr net.Addr, logger Logger) {
 	req.CopyTo(&ctx.Request)
 }
 
+// SetDeadline sets the time when work done on behalf of this request should be
+// canceled, as reported by Deadline, Done and Err. It is used by protocols carrying
+// a deadline with the request, such as the grpc-timeout header of gRPC.
+//
+// SetDeadline must be called before Done is used.
+func (ctx *RequestCtx) SetDeadline(deadline time.Time) {
+	if ctx.deadlineTimer != nil {
+		ctx.deadlineTimer.Stop()
+	}
+	ch := make(chan struct{})
+	w := ctx.watchDone()
+	ctx.deadline = deadline
+	ctx.deadlineCh = ch
+	ctx.deadlineTimer = time.AfterFunc(time.Until(deadline), func() {
+		close(ch)
+		w.cancel()
+	})
+}
+
 // Deadline returns the time when work done on behalf of this context
 // should be canceled. Deadline returns ok==false when no deadline is
 // set. Successive calls to Deadline return the same results.
 //
-// This method always returns 0, false and is only present to make
-// RequestCtx implement the context interface.
+// The deadline is only set with SetDeadline.
 func (ctx *RequestCtx) Deadline() (deadline time.Time, ok bool) {
-	return
+	return ctx.deadline, ctx.deadlineCh != nil
 }
 
 // Done returns a channel that's closed when work done on behalf of this
@@ -2809,8 +2944,14 @@ func (ctx *RequestCtx) Deadline() (deadline time.Time, ok bool) {
 // never be canceled. Successive calls to Done return the same value.
 //
 // Note: Because creating a new channel for every request is just too expensive, so
-// RequestCtx.s.done is only closed when the server is shutting down
+// RequestCtx.s.done is only closed when the server is shutting down. If a deadline
+// is set with SetDeadline, the returned channel is also closed when it passes. Once
+// a Server-Sent Events stream is started with NewSSE, it is also closed when the
+// client disconnects.
 func (ctx *RequestCtx) Done() <-chan struct{} {
+	if ctx.done != nil {
+		return ctx.done.done
+	}
 	return ctx.s.done
 }
 
@@ -2818,8 +2959,8 @@ func (ctx *RequestCtx) Done() <-chan struct{} {
 // successive calls to Err return the same error.
 // If Done is not yet closed, Err returns nil.
 // If Done is closed, Err returns a non-nil error explaining why:
-// Canceled if the context was canceled (via server Shutdown)
-// or DeadlineExceeded if the context's deadline passed.
+// Canceled if the context was canceled (via server Shutdown or the
+// disconnection of the client) or DeadlineExceeded if the context's deadline passed.
 //
 // Note: Because creating a new channel for every request is just too expensive, so
 // RequestCtx.s.done is only closed when the server is shutting down
@@ -2828,8 +2969,73 @@ func (ctx *RequestCtx) Err() error {
 	case <-ctx.s.done:
 		return context.Canceled
 	default:
-		return nil
 	}
+	if ctx.deadlineCh != nil {
+		select {
+		case <-ctx.deadlineCh:
+			return context.DeadlineExceeded
+		default:
+		}
+	}
+	if ctx.done != nil {
+		select {
+		case <-ctx.done.done:
+			return context.Canceled
+		default:
+		}
+	}
+	return nil
+}
+
+// doneWatch closes done once the server shuts down, the deadline of the request
+// passes or the client is gone. stop ends the watch when the request is done.
+type doneWatch struct {
+	done chan struct{}
+	stop chan struct{}
+	once sync.Once
+}
+
+// cancel closes done
+func (w *doneWatch) cancel() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// cancelOn closes done once ch is closed, unless the request is done before
+func (w *doneWatch) cancelOn(ch <-chan struct{}) {
+	go func() {
+		select {
+		case <-ch:
+			w.cancel()
+		case <-w.stop:
+		}
+	}()
+}
+
+// watchDone makes Done return a channel of its own, closed on shutdown like the
+// channel of the server, and by the deadline and the client disconnection once
+// watched
+func (ctx *RequestCtx) watchDone() *doneWatch {
+	if ctx.done == nil {
+		ctx.done = &doneWatch{
+			done: make(chan struct{}),
+			stop: make(chan struct{}),
+		}
+		if ctx.s.done != nil {
+			ctx.done.cancelOn(ctx.s.done)
+		}
+	}
+	return ctx.done
+}
+
+// watchDisconnect makes Done report the disconnection of the client. closed is closed
+// by the protocol once the client is gone, if it can tell without writing, the other
+// disconnections are reported with cancel.
+func (ctx *RequestCtx) watchDisconnect(closed <-chan struct{}) *doneWatch {
+	w := ctx.watchDone()
+	if closed != nil {
+		w.cancelOn(closed)
+	}
+	return w
 }
 
 // Value returns the value associated with this context for key, or nil
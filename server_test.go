@@ -3734,6 +3734,90 @@ func TestShutdownErr(t *testing.T) {
 	verifyResponse(t, br, StatusOK, "aaa/bbb", "real response")
 }
 
+func TestRequestCtxSetDeadline(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			if _, ok := ctx.Deadline(); ok {
+				t.Errorf("unexpected deadline before SetDeadline")
+			}
+			deadline := time.Now().Add(10 * time.Millisecond)
+			ctx.SetDeadline(deadline)
+			if d, ok := ctx.Deadline(); !ok || !d.Equal(deadline) {
+				t.Errorf("unexpected deadline %s, expecting %s", d, deadline)
+			}
+			if err := ctx.Err(); err != nil {
+				t.Errorf("unexpected error before the deadline: %v", err)
+			}
+			<-ctx.Done()
+			if err := ctx.Err(); err != context.DeadlineExceeded {
+				t.Errorf("unexpected error after the deadline: %v", err)
+			}
+			ctx.Success("aaa/bbb", []byte("real response"))
+		},
+	}
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The deadline is reset between the requests of a connection
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: google.com\r\n\r\nGET / HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	verifyResponse(t, br, StatusOK, "aaa/bbb", "real response")
+	verifyResponse(t, br, StatusOK, "aaa/bbb", "real response")
+	if err := s.Shutdown(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRequestCtxSetDeadlineShutdown(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	started := make(chan struct{})
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			ctx.SetDeadline(time.Now().Add(time.Hour))
+			close(started)
+			// The shutdown closes Done before the deadline
+			<-ctx.Done()
+			if err := ctx.Err(); err != context.Canceled {
+				t.Errorf("unexpected error after the shutdown: %v", err)
+			}
+			ctx.Success("aaa/bbb", []byte("real response"))
+		},
+	}
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: google.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-started
+	go func() {
+		if err := s.Shutdown(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	br := bufio.NewReader(conn)
+	verifyResponse(t, br, StatusOK, "aaa/bbb", "real response")
+}
+
 func TestShutdownCloseIdleConns(t *testing.T) {
 	t.Parallel()
 
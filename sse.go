@@ -0,0 +1,313 @@
+package fns
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSSEHeartbeatInterval is the interval of the heartbeats of the Server-Sent
+// Events streams, unless changed with SSE.SetHeartbeatInterval
+const DefaultSSEHeartbeatInterval = 15 * time.Second
+
+var (
+	// ErrSSEClosed is returned when sending to a closed Server-Sent Events stream
+	ErrSSEClosed = errors.New("sse: the event stream is closed")
+
+	errSSEInvalidField = errors.New("sse: the event id and type must not contain line breaks nor NUL")
+)
+
+// sseHeartbeat is a comment line, which keeps the stream alive without dispatching
+// any event
+var sseHeartbeat = []byte(":\n")
+
+// SSEEvent is an event of a Server-Sent Events stream
+type SSEEvent struct {
+	// ID is the last event ID of the client, sent back in the Last-Event-ID
+	// header when it reconnects
+	ID string
+
+	// Event is the type of the event, "message" if not set
+	Event string
+
+	// Data is sent in one data field per line, the client gets it back with
+	// the line breaks normalized to \n
+	Data []byte
+
+	// Retry is the reconnection time of the client, not sent if not set
+	Retry time.Duration
+}
+
+// SSE writes a Server-Sent Events stream, see
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+//
+// The events are sent unbuffered over HTTP/1.1 and HTTP/2. A comment is sent as a
+// heartbeat when no event was sent for the heartbeat interval, so intermediaries
+// don't close an idle stream and a disconnected client is noticed. Once the client is
+// gone, RequestCtx.Done is closed and the events can't be sent anymore:
+//
+//	func events(ctx *fns.RequestCtx) {
+//		sse := fns.NewSSE(ctx)
+//		defer sse.Close()
+//		for {
+//			select {
+//			case ev := <-updates:
+//				if err := sse.Send(ev); err != nil {
+//					return
+//				}
+//			case <-ctx.Done():
+//				return
+//			}
+//		}
+//	}
+//
+// The methods of SSE may be called concurrently, until the request handler returns.
+// The stream is closed after that if Close wasn't called.
+type SSE struct {
+	w           UnbufferedWriter
+	done        *doneWatch
+	lastEventID string
+
+	mu        sync.Mutex
+	buf       []byte
+	err       error
+	heartbeat *time.Ticker
+	interval  time.Duration
+	stop      chan struct{}
+}
+
+// sseStreamWriter is implemented by the UnbufferedWriter of the protocols telling when
+// the client is gone without writing, and ending the responses after a timeout
+type sseStreamWriter interface {
+	closeNotify() <-chan struct{}
+	stopTimeouts()
+}
+
+// NewSSE starts a Server-Sent Events stream as the response to the request. The
+// response headers are sent right away, with the status code and the headers already
+// set, so the client sees the stream open. Buffering is disabled, keeping the
+// unbuffered writer if it already was, and so is compression, which would hold the
+// events back.
+//
+// The client disconnection is noticed as soon as the connection or the HTTP/2 stream is
+// closed. Over HTTP/1.1 the connection is read until then, so the request body must
+// have been read before.
+//
+// NewSSE must be called from the request handler, instead of writing the response.
+func NewSSE(ctx *RequestCtx) *SSE {
+	ctx.Response.Header.SetContentType("text/event-stream")
+	ctx.Response.Header.Set(HeaderCacheControl, "no-cache")
+	ctx.Response.Header.Set("X-Accel-Buffering", "no") // for the proxies buffering responses
+	ctx.Response.Header.Del(HeaderContentEncoding)
+	ctx.Response.Header.SetContentLength(-1)
+	if ctx.unbufferedWriter == nil {
+		ctx.DisableBuffering()
+	}
+
+	e := &SSE{
+		w:           ctx.unbufferedWriter,
+		lastEventID: string(ctx.Request.Header.Peek(HeaderLastEventID)),
+		heartbeat:   time.NewTicker(DefaultSSEHeartbeatInterval),
+		interval:    DefaultSSEHeartbeatInterval,
+		stop:        make(chan struct{}),
+	}
+	var closed <-chan struct{}
+	if sw, ok := e.w.(sseStreamWriter); ok {
+		// The stream lasts as long as the client is connected
+		sw.stopTimeouts()
+		closed = sw.closeNotify()
+	}
+	e.done = ctx.watchDisconnect(closed)
+
+	// The writes of the handler and of the heartbeats are serialized, and the stream is
+	// closed when the response is
+	ctx.unbufferedWriter = &sseUnbufferedWriter{e: e}
+
+	e.mu.Lock()
+	e.write(sseHeartbeat) //nolint:errcheck
+	e.mu.Unlock()
+
+	go e.sendHeartbeats(e.heartbeat.C)
+	return e
+}
+
+// LastEventID returns the Last-Event-ID header of the request, the ID of the last
+// event received by a reconnecting client. It is empty for a new client.
+func (e *SSE) LastEventID() string {
+	return e.lastEventID
+}
+
+// SetHeartbeatInterval changes the heartbeat interval, the heartbeats are disabled if
+// d is not positive
+func (e *SSE) SetHeartbeatInterval(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return
+	}
+	e.interval = d
+	if d <= 0 {
+		e.heartbeat.Stop()
+	} else {
+		e.heartbeat.Reset(d)
+	}
+}
+
+// Send sends the event. The error of a failed write is returned by all the following
+// sends, the client is gone by then.
+func (e *SSE) Send(ev SSEEvent) error {
+	if !validSSEField(ev.ID) || !validSSEField(ev.Event) {
+		return errSSEInvalidField
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return e.err
+	}
+	e.buf = appendSSEEvent(e.buf[:0], &ev)
+	return e.write(e.buf)
+}
+
+// Comment sends a comment, which is ignored by the client. Each line of text is sent
+// in its own comment line.
+func (e *SSE) Comment(text string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return e.err
+	}
+	e.buf = appendSSEField(e.buf[:0], "", []byte(text))
+	return e.write(e.buf)
+}
+
+// Close ends the stream. It is called once the request handler returns if it wasn't
+// before.
+func (e *SSE) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err == ErrSSEClosed {
+		return ErrSSEClosed
+	}
+	e.err = ErrSSEClosed
+	e.heartbeat.Stop()
+	close(e.stop)
+	return e.w.Close()
+}
+
+// write writes p, the client is considered gone if it fails. The next heartbeat is
+// due one interval later. e.mu must be held.
+func (e *SSE) write(p []byte) error {
+	if _, err := e.w.Write(p); err != nil {
+		e.err = err
+		e.done.cancel()
+		return err
+	}
+	if e.interval > 0 {
+		e.heartbeat.Reset(e.interval)
+	}
+	return nil
+}
+
+// sendHeartbeats sends a heartbeat at each tick
+func (e *SSE) sendHeartbeats(tick <-chan time.Time) {
+	for {
+		select {
+		case <-tick:
+		case <-e.stop:
+			return
+		}
+		e.mu.Lock()
+		if e.err == nil {
+			e.write(sseHeartbeat) //nolint:errcheck
+		}
+		e.mu.Unlock()
+	}
+}
+
+// sseUnbufferedWriter replaces the UnbufferedWriter of the request once the stream is
+// started, so the writes to the response are serialized with the heartbeats
+type sseUnbufferedWriter struct {
+	e *SSE
+}
+
+func (w *sseUnbufferedWriter) Write(p []byte) (int, error) {
+	w.e.mu.Lock()
+	defer w.e.mu.Unlock()
+
+	if w.e.err != nil {
+		return 0, w.e.err
+	}
+	if err := w.e.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *sseUnbufferedWriter) WriteHeaders() (int, error) {
+	return 0, nil
+}
+
+func (w *sseUnbufferedWriter) Close() error {
+	return w.e.Close()
+}
+
+// validSSEField tells whether s can be sent in an id or event field
+func validSSEField(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' || s[i] == '\r' || s[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// appendSSEEvent appends the fields of ev and the blank line dispatching it. The data
+// field is left out if there is neither data nor type, so the ID and the reconnection
+// time can be updated without dispatching an event.
+func appendSSEEvent(dst []byte, ev *SSEEvent) []byte {
+	if ev.ID != "" {
+		dst = appendSSEField(dst, "id", s2b(ev.ID))
+	}
+	if ev.Event != "" {
+		dst = appendSSEField(dst, "event", s2b(ev.Event))
+	}
+	if ev.Retry > 0 {
+		dst = append(dst, "retry: "...)
+		dst = strconv.AppendInt(dst, ev.Retry.Milliseconds(), 10)
+		dst = append(dst, '\n')
+	}
+	if len(ev.Data) > 0 || ev.Event != "" {
+		dst = appendSSEField(dst, "data", ev.Data)
+	}
+	return append(dst, '\n')
+}
+
+// appendSSEField appends a field line for each line of value, a comment if name is
+// empty. The lines may be broken by \r\n, \r or \n.
+func appendSSEField(dst []byte, name string, value []byte) []byte {
+	for {
+		line := value
+		i := bytes.IndexAny(value, "\r\n")
+		if i >= 0 {
+			line = value[:i]
+		}
+		dst = append(dst, name...)
+		dst = append(dst, ": "...)
+		dst = append(dst, line...)
+		dst = append(dst, '\n')
+		if i < 0 {
+			return dst
+		}
+		if value[i] == '\r' && i+1 < len(value) && value[i+1] == '\n' {
+			i++
+		}
+		value = value[i+1:]
+	}
+}
@@ -0,0 +1,233 @@
+package fns
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pablolagos/fns/fasthttputil"
+	"golang.org/x/net/http2"
+)
+
+func TestAppendSSEEvent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		ev   SSEEvent
+		want string
+	}{
+		{SSEEvent{Data: []byte("hello")}, "data: hello\n\n"},
+		{SSEEvent{Data: []byte("a\nb\r\nc\rd")}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{SSEEvent{Data: []byte(" a\n")}, "data:  a\ndata: \n\n"},
+		{SSEEvent{ID: "42", Event: "update", Data: []byte("{}")}, "id: 42\nevent: update\ndata: {}\n\n"},
+		{SSEEvent{Event: "ping"}, "event: ping\ndata: \n\n"},
+		{SSEEvent{ID: "7", Retry: 3 * time.Second}, "id: 7\nretry: 3000\n\n"},
+	}
+
+	for _, tt := range tests {
+		if got := string(appendSSEEvent(nil, &tt.ev)); got != tt.want {
+			t.Fatalf("unexpected event %q, expecting %q", got, tt.want)
+		}
+	}
+}
+
+func TestSSEInvalidField(t *testing.T) {
+	t.Parallel()
+
+	for _, ev := range []SSEEvent{{ID: "1\n2"}, {ID: "1\x002"}, {Event: "a\rb"}} {
+		var e SSE
+		if err := e.Send(ev); err != errSSEInvalidField {
+			t.Fatalf("unexpected error %v for %+v", err, ev)
+		}
+	}
+}
+
+func TestSSEHTTP1(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	ln := fasthttputil.NewInmemoryListener()
+	s := &Server{Handler: CompressHandler(func(ctx *RequestCtx) {
+		sse := NewSSE(ctx)
+		defer sse.Close()
+
+		sse.SetHeartbeatInterval(20 * time.Millisecond)
+		err := sse.Send(SSEEvent{ID: "42", Data: []byte("after " + sse.LastEventID())})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		// The client disconnection is noticed by the heartbeats
+		<-ctx.Done()
+		errs <- ctx.Err()
+	})}
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := "GET /events HTTP/1.1\r\nHost: example.com\r\nAccept-Encoding: gzip\r\nLast-Event-ID: 41\r\n\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, value := range map[string]string{
+		"Content-Type":     "text/event-stream",
+		"Cache-Control":    "no-cache",
+		"Content-Encoding": "",
+	} {
+		if v := resp.Header.Get(name); v != value {
+			t.Fatalf("unexpected %s %q, expecting %q", name, v, value)
+		}
+	}
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("unexpected transfer encoding %q", resp.TransferEncoding)
+	}
+
+	body := bufio.NewReader(resp.Body)
+	for _, want := range []string{":", "id: 42", "data: after 41", "", ":", ":"} {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line != want {
+			t.Fatalf("unexpected line %q, expecting %q", line, want)
+		}
+	}
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the disconnection was not reported")
+	}
+}
+
+func TestSSEHTTP1Disconnect(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	ln := fasthttputil.NewInmemoryListener()
+	s := &Server{
+		Handler: func(ctx *RequestCtx) {
+			// The unbuffered writer is reused
+			ctx.DisableBuffering()
+			w := ctx.unbufferedWriter
+			sse := NewSSE(ctx)
+			if sse.w != w {
+				t.Errorf("unexpected writer %v", sse.w)
+			}
+			sse.SetHeartbeatInterval(0)
+
+			// The client disconnection is noticed without writing
+			<-ctx.Done()
+			errs <- ctx.Err()
+		},
+		// The stream outlives the read timeout
+		ReadTimeout: 50 * time.Millisecond,
+	}
+	go s.Serve(ln) //nolint:errcheck
+	defer ln.Close()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.Write([]byte("GET /events HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != ":\n" {
+		t.Fatalf("unexpected line %q, error %v", line, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected disconnection %v", err)
+	default:
+	}
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the disconnection was not reported")
+	}
+}
+
+func TestSSEHTTP2(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 2)
+	s := &Server{Handler: func(ctx *RequestCtx) {
+		sse := NewSSE(ctx)
+		sse.SetHeartbeatInterval(0)
+		errs <- sse.Send(SSEEvent{Event: "update", Data: []byte("1\n2")})
+
+		// The client disconnection is noticed without writing
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}}
+
+	// The stream outlives the write timeout
+	cl := newH2TestClientConfig(t, s, ServerConfig{WriteTimeout: 50 * time.Millisecond})
+	cl.writeRequest(1, true, h2TestRequest...)
+
+	f := cl.readStreamFrame(1)
+	hf, ok := f.(*http2.HeadersFrame)
+	if !ok || hf.StreamEnded() {
+		t.Fatalf("expected HEADERS frame without END_STREAM, got %v", f)
+	}
+	fields, err := cl.dec.DecodeFull(hf.HeaderBlockFragment())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp := &h2TestResponse{headers: fields}
+	for name, value := range map[string]string{
+		":status":           "200",
+		"content-type":      "text/event-stream",
+		"content-length":    "",
+		"transfer-encoding": "",
+	} {
+		if v := resp.header(name); v != value {
+			t.Fatalf("unexpected %s %q, expecting %q", name, v, value)
+		}
+	}
+	cl.expectStreamData(1, ":\nevent: update\ndata: 1\ndata: 2\n\n", false)
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := cl.fr.WriteRSTStream(1, http2.ErrCodeCancel); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the disconnection was not reported")
+	}
+}
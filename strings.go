@@ -92,4 +92,5 @@ var (
 	strFontSlash        = []byte("font/")
 	strMultipartSlash   = []byte("multipart/")
 	strTextSlash        = []byte("text/")
+	strTextEventStream  = []byte("text/event-stream")
 )
@@ -117,3 +117,32 @@ func (uw *unbufferedWriter) Close() error {
 	uw.ctx = nil
 	return nil
 }
+
+// closeNotify returns a channel closed once the client closes the connection. The
+// connection is read in the background, which is safe as it is closed after an
+// unbuffered response, and the request body must have been read already.
+func (uw *unbufferedWriter) closeNotify() <-chan struct{} {
+	c := uw.ctx.c
+	if c == nil {
+		return nil
+	}
+	closed := make(chan struct{})
+	go func() {
+		var b [1]byte
+		for {
+			if _, err := c.Read(b[:]); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// stopTimeouts removes the deadlines of the connection, for the responses lasting as
+// long as the client is connected
+func (uw *unbufferedWriter) stopTimeouts() {
+	if c := uw.ctx.c; c != nil {
+		_ = c.SetDeadline(zeroTime)
+	}
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// Compression levels accepted by Conn.SetCompressionLevel, the same as the fns
+// Compress* constants
+const (
+	minCompressionLevel     = flate.HuffmanOnly
+	maxCompressionLevel     = flate.BestCompression
+	defaultCompressionLevel = flate.BestSpeed
+)
+
+// permessageDeflate is the extension negotiated with the clients offering it. The
+// compression context isn't kept between the messages, so that the compressors are
+// only held while a message is written or read.
+const permessageDeflate = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// deflateTail ends the compressed payload of a message: the empty stored block
+// removed by the sender, see RFC 7692 section 7.2.2, and a final empty block
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// The pools of the fns package can't be shared: the "deflate" content coding uses the
+// zlib format, while the messages are raw DEFLATE data, see RFC 7692 section 7.2.1. A
+// zlib.Writer doesn't give access to the flate.Writer it wraps.
+var (
+	flateWriterPoolMap = func() []*sync.Pool {
+		m := make([]*sync.Pool, maxCompressionLevel-minCompressionLevel+1)
+		for i := range m {
+			m[i] = &sync.Pool{}
+		}
+		return m
+	}()
+	flateReaderPool sync.Pool
+)
+
+func acquireFlateWriter(w io.Writer, level int) *flate.Writer {
+	p := flateWriterPoolMap[level-minCompressionLevel]
+	v := p.Get()
+	if v == nil {
+		fw, err := flate.NewWriter(w, level)
+		if err != nil {
+			panic("BUG: flate.NewWriter failed with a valid level: " + err.Error())
+		}
+		return fw
+	}
+	fw := v.(*flate.Writer)
+	fw.Reset(w)
+	return fw
+}
+
+func releaseFlateWriter(fw *flate.Writer, level int) {
+	flateWriterPoolMap[level-minCompressionLevel].Put(fw)
+}
+
+func acquireFlateReader(r io.Reader) io.ReadCloser {
+	v := flateReaderPool.Get()
+	if v == nil {
+		return flate.NewReader(r)
+	}
+	fr := v.(io.ReadCloser)
+	if err := fr.(flate.Resetter).Reset(r, nil); err != nil {
+		panic("BUG: flate.Resetter failed without a dictionary: " + err.Error())
+	}
+	return fr
+}
+
+func releaseFlateReader(fr io.ReadCloser) {
+	fr.Close()
+	flateReaderPool.Put(fr)
+}
+
+func deflateTailReader() io.Reader {
+	return strings.NewReader(deflateTail)
+}
+
+// truncWriter holds back the last 4 bytes written, which are the empty stored block
+// ending the flushed compressed data
+type truncWriter struct {
+	w *messageWriter
+	n int
+	p [4]byte
+}
+
+func (w *truncWriter) Write(p []byte) (int, error) {
+	n := 0
+	if w.n < len(w.p) {
+		n = copy(w.p[w.n:], p)
+		p = p[n:]
+		w.n += n
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+
+	// Write the bytes held back which are not among the last 4 anymore
+	m := len(p)
+	if m > len(w.p) {
+		m = len(w.p)
+	}
+	if _, err := w.w.write(w.p[:m]); err != nil {
+		return n, err
+	}
+	copy(w.p[:], w.p[m:])
+	copy(w.p[len(w.p)-m:], p[len(p)-m:])
+	if nn, err := w.w.write(p[:len(p)-m]); err != nil {
+		return n + nn, err
+	}
+	return n + len(p), nil
+}
+
+// hasDeflateTail tells whether the bytes held back are the empty stored block
+func (w *truncWriter) hasDeflateTail() bool {
+	return w.n == len(w.p) && string(w.p[:]) == deflateTail[:4]
+}
+
+// negotiatePermessageDeflate tells whether the client offers permessage-deflate with
+// parameters the server supports, see RFC 7692 section 7.1
+func negotiatePermessageDeflate(extensions string) bool {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+
+		ok := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				// The compressor always uses a 32KB window
+				ok = value == "15"
+			default:
+				ok = false
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressedMessages(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []int{minCompressionLevel, 0, defaultCompressionLevel, maxCompressionLevel} {
+		server, client := newTestConns(t, 64)
+		server.compressionNegotiated = true
+		client.compressionNegotiated = true
+		if err := client.SetCompressionLevel(level); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		messages := []string{
+			"",
+			"short",
+			strings.Repeat("compressible ünïcödé text ", 1000),
+		}
+		go func() {
+			for _, m := range messages {
+				client.WriteMessage(TextMessage, []byte(m)) //nolint:errcheck
+			}
+		}()
+		for _, m := range messages {
+			mt, data, err := server.ReadMessage()
+			if err != nil {
+				t.Fatalf("unexpected error at level %d: %v", level, err)
+			}
+			if mt != TextMessage || string(data) != m {
+				t.Fatalf("unexpected message at level %d: %d %.20q, expecting %.20q", level, mt, data, m)
+			}
+		}
+	}
+}
+
+func TestCompressedFrameFormat(t *testing.T) {
+	t.Parallel()
+
+	server, _, raw := newRawTestConn(t)
+	server.compressionNegotiated = true
+	msg := strings.Repeat("hello ", 100)
+	go server.WriteMessage(BinaryMessage, []byte(msg)) //nolint:errcheck
+
+	// A single compressed frame, readable with the standard library
+	var header [4]byte
+	if _, err := io.ReadFull(raw, header[:2]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if header[0] != BinaryMessage|finalBit|rsv1Bit || header[1]&maskBit != 0 || header[1] >= 126 {
+		t.Fatalf("unexpected frame header %x", header[:2])
+	}
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(raw, payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.HasSuffix(payload, []byte(deflateTail[:4])) {
+		t.Fatalf("the payload must not end with the empty stored block: %x", payload)
+	}
+	data, err := io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(payload), strings.NewReader(deflateTail))))
+	if err != nil || string(data) != msg {
+		t.Fatalf("unexpected payload %.20q, error %v", data, err)
+	}
+}
+
+func TestCompressedMessageDisabled(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 0)
+	server.compressionNegotiated = true
+	client.compressionNegotiated = true
+	client.EnableWriteCompression(false)
+	go client.WriteMessage(TextMessage, []byte("plain")) //nolint:errcheck
+
+	if _, data, err := server.ReadMessage(); err != nil || string(data) != "plain" {
+		t.Fatalf("unexpected message %q, error %v", data, err)
+	}
+	if server.readCompressed {
+		t.Fatal("the message must not be compressed")
+	}
+}
+
+func TestCompressedReadLimit(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 0)
+	server.compressionNegotiated = true
+	client.compressionNegotiated = true
+	server.SetReadLimit(1000)
+	go client.WriteMessage(BinaryMessage, make([]byte, 1<<20)) //nolint:errcheck
+
+	if _, _, err := server.ReadMessage(); err != ErrReadLimit {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrReadLimit)
+	}
+}
+
+func TestInvalidCompressedData(t *testing.T) {
+	t.Parallel()
+
+	server, client, raw := newRawTestConn(t)
+	server.compressionNegotiated = true
+	go raw.Write(maskedFrame(BinaryMessage|finalBit|rsv1Bit, []byte{0xff, 0xff, 0xff})) //nolint:errcheck
+
+	if _, _, err := server.ReadMessage(); err == nil {
+		t.Fatal("expecting an error")
+	}
+	if _, _, err := client.ReadMessage(); !IsCloseError(err, CloseProtocolError) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	t.Parallel()
+
+	var c Conn
+	if err := c.SetCompressionLevel(maxCompressionLevel + 1); err == nil {
+		t.Fatal("expecting an error")
+	}
+	if err := c.SetCompressionLevel(minCompressionLevel - 1); err == nil {
+		t.Fatal("expecting an error")
+	}
+}
+
+func TestNegotiatePermessageDeflate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		extensions string
+		ok         bool
+	}{
+		{"", false},
+		{"x-webkit-deflate-frame", false},
+		{"permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", true},
+		{"permessage-deflate; client_no_context_takeover; server_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=15", true},
+		{`permessage-deflate; server_max_window_bits="15"`, true},
+		{"permessage-deflate; server_max_window_bits=10", false},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", true},
+		{"permessage-deflate; unknown_param", false},
+		{"foo, permessage-deflate", true},
+	}
+
+	for _, tt := range tests {
+		if ok := negotiatePermessageDeflate(tt.extensions); ok != tt.ok {
+			t.Fatalf("unexpected result %v for %q", ok, tt.extensions)
+		}
+	}
+}
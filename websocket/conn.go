@@ -0,0 +1,908 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// Message types, which are the frame opcodes of RFC 6455 section 11.8
+const (
+	// TextMessage is a message of UTF-8 text
+	TextMessage = 1
+
+	// BinaryMessage is a message of binary data
+	BinaryMessage = 2
+
+	// CloseMessage is a close control message, its payload is built by
+	// FormatCloseMessage
+	CloseMessage = 8
+
+	// PingMessage is a ping control message
+	PingMessage = 9
+
+	// PongMessage is a pong control message
+	PongMessage = 10
+)
+
+// Close codes, see RFC 6455 section 11.7
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseTLSHandshake            = 1015
+)
+
+const (
+	continuationFrame = 0
+	noFrame           = -1
+
+	finalBit = 1 << 7
+	rsv1Bit  = 1 << 6
+	rsv2Bit  = 1 << 5
+	rsv3Bit  = 1 << 4
+	maskBit  = 1 << 7
+
+	maxFrameHeaderSize         = 2 + 8 + 4
+	maxControlFramePayloadSize = 125
+
+	// writeWait bounds the writes of the automatic pong and close replies
+	writeWait = time.Second
+
+	defaultReadBufferSize  = 4096
+	defaultWriteBufferSize = 4096
+)
+
+var (
+	// ErrCloseSent is returned by the write methods after a close message was sent
+	ErrCloseSent = errors.New("websocket: close sent")
+
+	// ErrReadLimit is returned when a message is larger than the read limit, see
+	// Conn.SetReadLimit
+	ErrReadLimit = errors.New("websocket: read limit exceeded")
+
+	errWriteClosed  = errors.New("websocket: write to closed writer")
+	errInvalidType  = errors.New("websocket: invalid message type")
+	errControlLarge = errors.New("websocket: control frame payload exceeds 125 bytes")
+
+	// errUnexpectedEOF is returned when the connection is closed without a close message
+	errUnexpectedEOF = &CloseError{Code: CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+)
+
+// CloseError is returned by the read methods once the peer sent a close message, or
+// closed the connection without one, with CloseAbnormalClosure.
+type CloseError struct {
+	// Code is the status code sent by the peer, CloseNoStatusReceived if there is none
+	Code int
+
+	// Text is the reason sent by the peer
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	s := "websocket: close " + strconv.Itoa(e.Code)
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+// IsCloseError tells whether err is a CloseError with one of codes
+func IsCloseError(err error, codes ...int) bool {
+	var e *CloseError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnexpectedCloseError tells whether err is a CloseError with a code not among
+// expectedCodes
+func IsUnexpectedCloseError(err error, expectedCodes ...int) bool {
+	var e *CloseError
+	return errors.As(err, &e) && !IsCloseError(err, expectedCodes...)
+}
+
+// FormatCloseMessage returns the payload of a close message with code and text. The
+// payload is empty for CloseNoStatusReceived.
+func FormatCloseMessage(code int, text string) []byte {
+	if code == CloseNoStatusReceived {
+		return []byte{}
+	}
+	b := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	copy(b[2:], text)
+	return b
+}
+
+// validReceivedCloseCode tells whether a peer may send code, see RFC 6455 section 7.4
+func validReceivedCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// Conn is a WebSocket connection, obtained with Upgrader.Upgrade.
+//
+// A Conn supports one concurrent reader and one concurrent writer: the read methods
+// (NextReader, ReadMessage, SetReadDeadline, SetReadLimit and the handler setters)
+// must be called from a single goroutine, and so must the write methods (NextWriter,
+// WriteMessage, SetWriteDeadline, EnableWriteCompression and SetCompressionLevel).
+// Close and WriteControl may be called concurrently with all the other methods.
+//
+// The ping and close messages are replied to while reading, the application must
+// read the connection to process them.
+type Conn struct {
+	conn        net.Conn
+	isServer    bool
+	subprotocol string
+
+	// Write fields. writeMu serializes the frames, so that control frames may be
+	// written between the frames of a message.
+	writeMu       sync.Mutex
+	writeErr      error
+	closeSent     bool
+	writeBuf      []byte
+	writer        *messageWriter
+	writeDeadline time.Time
+
+	compressionNegotiated  bool
+	enableWriteCompression bool
+	compressionLevel       int
+
+	// Read fields
+	br             *bufio.Reader
+	readErr        error
+	readRemaining  int64
+	readFinal      bool
+	readCompressed bool
+	readMaskKey    [4]byte
+	readMaskPos    int
+	readLimit      int64
+	readLength     int64
+	readUTF8       utf8Validator
+	messageReader  *messageReader
+	flateReader    io.ReadCloser
+	controlBuf     [maxControlFramePayloadSize]byte
+
+	handlePing  func(appData string) error
+	handlePong  func(appData string) error
+	handleClose func(code int, text string) error
+}
+
+// newConn returns a Conn over conn, for the server or client side
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool, readBufferSize, writeBufferSize int) *Conn {
+	if readBufferSize <= 0 {
+		readBufferSize = defaultReadBufferSize
+	}
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultWriteBufferSize
+	}
+	if br == nil {
+		br = bufio.NewReaderSize(conn, readBufferSize)
+	}
+
+	c := &Conn{
+		conn:                   conn,
+		isServer:               isServer,
+		writeBuf:               make([]byte, maxFrameHeaderSize+writeBufferSize),
+		br:                     br,
+		readFinal:              true,
+		enableWriteCompression: true,
+		compressionLevel:       defaultCompressionLevel,
+	}
+	c.SetPingHandler(nil)
+	c.SetPongHandler(nil)
+	c.SetCloseHandler(nil)
+	return c
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake, if any
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Close closes the underlying connection without sending a close message. The close
+// handshake is done by writing a close message with WriteControl, then reading until
+// the peer replies with its own.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// SetReadDeadline sets the deadline of the reads. A timed out read corrupts the
+// connection, all the following reads return an error.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the message writes. A timed out write
+// corrupts the connection, all the following writes return an error.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return nil
+}
+
+// SetReadLimit sets the maximum size in bytes of the messages read, after
+// decompression. A larger message is rejected with a close message with
+// CloseMessageTooBig and ErrReadLimit is returned. There is no limit if it is 0.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// EnableWriteCompression enables or disables the compression of the messages
+// written, if permessage-deflate was negotiated. It is enabled by default.
+func (c *Conn) EnableWriteCompression(enable bool) {
+	c.enableWriteCompression = enable
+}
+
+// SetCompressionLevel sets the compression level of the messages written, from
+// fns.CompressHuffmanOnly to fns.CompressBestCompression. It is fns.CompressBestSpeed
+// by default.
+func (c *Conn) SetCompressionLevel(level int) error {
+	if level < minCompressionLevel || level > maxCompressionLevel {
+		return errors.New("websocket: invalid compression level")
+	}
+	c.compressionLevel = level
+	return nil
+}
+
+// SetPingHandler sets the handler of the ping messages. The default handler, used if
+// h is nil, replies with a pong message.
+func (c *Conn) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			err := c.WriteControl(PongMessage, []byte(appData), time.Now().Add(writeWait))
+			var ne net.Error
+			if err == ErrCloseSent || (errors.As(err, &ne) && ne.Timeout()) {
+				return nil
+			}
+			return err
+		}
+	}
+	c.handlePing = h
+}
+
+// SetPongHandler sets the handler of the pong messages. The default handler, used if
+// h is nil, does nothing.
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(string) error { return nil }
+	}
+	c.handlePong = h
+}
+
+// SetCloseHandler sets the handler of the close message. The read methods return a
+// CloseError after calling it. The default handler, used if h is nil, replies with
+// a close message with the same code.
+func (c *Conn) SetCloseHandler(h func(code int, text string) error) {
+	if h == nil {
+		h = func(code int, text string) error {
+			c.WriteControl(CloseMessage, FormatCloseMessage(code, ""), time.Now().Add(writeWait)) //nolint:errcheck
+			return nil
+		}
+	}
+	c.handleClose = h
+}
+
+// WriteControl writes a close, ping or pong message with the given deadline, no
+// deadline if it is zero. The payload is limited to 125 bytes.
+func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != CloseMessage && messageType != PingMessage && messageType != PongMessage {
+		return errInvalidType
+	}
+	if len(data) > maxControlFramePayloadSize {
+		return errControlLarge
+	}
+
+	var buf [maxFrameHeaderSize + maxControlFramePayloadSize]byte
+	frame := c.appendFrameHeader(buf[:0], byte(messageType)|finalBit, len(data))
+	start := len(frame)
+	frame = append(frame, data...)
+	if !c.isServer {
+		maskBytes(c.frameMaskKey(frame), 0, frame[start:])
+	}
+	return c.writeFrame(frame, messageType, deadline)
+}
+
+// frameMaskKey returns the mask key of a client frame, the last 4 bytes of its
+// header
+func (c *Conn) frameMaskKey(frame []byte) (key [4]byte) {
+	n := 2
+	switch frame[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	copy(key[:], frame[n:n+4])
+	return key
+}
+
+// appendFrameHeader appends the header of a frame with the first byte b0 and a
+// payload of length bytes. The client frames get a random mask key.
+func (c *Conn) appendFrameHeader(dst []byte, b0 byte, length int) []byte {
+	var b1 byte
+	if !c.isServer {
+		b1 = maskBit
+	}
+	dst = append(dst, b0)
+	switch {
+	case length <= 125:
+		dst = append(dst, b1|byte(length))
+	case length <= 0xffff:
+		dst = append(dst, b1|126, byte(length>>8), byte(length))
+	default:
+		dst = append(dst, b1|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(length))
+	}
+	if !c.isServer {
+		var key [4]byte
+		rand.Read(key[:]) //nolint:errcheck
+		dst = append(dst, key[:]...)
+	}
+	return dst
+}
+
+// writeFrame writes a whole frame
+func (c *Conn) writeFrame(frame []byte, opcode int, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		c.writeErr = err
+		return err
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.writeErr = err
+		return err
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	return nil
+}
+
+// WriteMessage writes a whole message of messageType. The control messages are
+// written with WriteControl, without deadline.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType == CloseMessage || messageType == PingMessage || messageType == PongMessage {
+		return c.WriteControl(messageType, data, time.Time{})
+	}
+	w, err := c.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// NextWriter returns a writer for the next message of messageType, TextMessage or
+// BinaryMessage. The message is sent when the writer is closed, in several frames if
+// it's larger than the write buffer. The writer of the previous message, if still
+// open, is closed first.
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, errInvalidType
+	}
+	if c.writer != nil {
+		if err := c.writer.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &messageWriter{
+		c:      c,
+		opcode: messageType,
+		pos:    maxFrameHeaderSize,
+	}
+	if c.compressionNegotiated && c.enableWriteCompression {
+		w.compressed = true
+		w.trunc.w = w
+		w.flateWriter = acquireFlateWriter(&w.trunc, c.compressionLevel)
+		w.level = c.compressionLevel
+	}
+	c.writer = w
+	return w, nil
+}
+
+// messageWriter writes a message in frames of the size of the write buffer
+type messageWriter struct {
+	c          *Conn
+	opcode     int
+	pos        int
+	err        error
+	compressed bool
+
+	flateWriter *flate.Writer
+	level       int
+	trunc       truncWriter
+}
+
+// Write writes p to the message, compressing it if needed
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.compressed {
+		return w.flateWriter.Write(p)
+	}
+	return w.write(p)
+}
+
+// write appends p to the frame payload, sending the frame whenever it's full
+func (w *messageWriter) write(p []byte) (int, error) {
+	n := len(p)
+	buf := w.c.writeBuf
+	for len(p) > 0 {
+		if w.pos == len(buf) {
+			if err := w.flushFrame(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := copy(buf[w.pos:], p)
+		w.pos += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// flushFrame sends the payload buffered as a frame, the last one of the message if
+// final is set
+func (w *messageWriter) flushFrame(final bool) error {
+	c := w.c
+	b0 := byte(w.opcode)
+	if final {
+		b0 |= finalBit
+	}
+	if w.compressed && w.opcode != continuationFrame {
+		b0 |= rsv1Bit
+	}
+
+	// The header is put right before the payload, so that the frame is written at once
+	length := w.pos - maxFrameHeaderSize
+	var hbuf [maxFrameHeaderSize]byte
+	header := c.appendFrameHeader(hbuf[:0], b0, length)
+	start := maxFrameHeaderSize - len(header)
+	copy(c.writeBuf[start:], header)
+	if !c.isServer {
+		maskBytes(c.frameMaskKey(header), 0, c.writeBuf[maxFrameHeaderSize:w.pos])
+	}
+
+	err := c.writeFrame(c.writeBuf[start:w.pos], w.opcode, c.writeDeadline)
+	w.pos = maxFrameHeaderSize
+	w.opcode = continuationFrame
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// Close sends the end of the message
+func (w *messageWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.compressed {
+		err := w.flateWriter.Flush()
+		releaseFlateWriter(w.flateWriter, w.level)
+		w.flateWriter = nil
+		if err != nil {
+			w.err = err
+			return err
+		}
+		if !w.trunc.hasDeflateTail() {
+			w.err = errors.New("websocket: unexpected end of the compressed message")
+			return w.err
+		}
+	}
+	err := w.flushFrame(true)
+	if w.c.writer == w {
+		w.c.writer = nil
+	}
+	if err == nil {
+		w.err = errWriteClosed
+	}
+	return err
+}
+
+// ReadMessage reads the next message, returning its type and payload
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	p, err = io.ReadAll(r)
+	return messageType, p, err
+}
+
+// NextReader returns the type of the next message and a reader for its payload. The
+// reader returns io.EOF at the end of the message, and becomes invalid on the next
+// call, which discards the rest of the message.
+//
+// The control messages are processed by the handlers while reading. The errors are
+// permanent, a CloseError is returned once the peer sent a close message.
+func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
+	c.discardMessage()
+
+	for c.readErr == nil {
+		frameType, err := c.advanceFrame()
+		if err != nil {
+			c.readErr = err
+			break
+		}
+		if frameType != TextMessage && frameType != BinaryMessage {
+			continue
+		}
+
+		c.readLength = 0
+		c.readUTF8.reset()
+		mr := &messageReader{c: c}
+		c.messageReader = mr
+		cr := &checkedReader{c: c, r: mr, text: frameType == TextMessage}
+		if c.readCompressed {
+			c.flateReader = acquireFlateReader(io.MultiReader(mr, deflateTailReader()))
+			cr.r = c.flateReader
+			cr.compressed = true
+		}
+		return frameType, cr, nil
+	}
+	return noFrame, nil, c.readErr
+}
+
+// discardMessage skips the rest of the message being read, if any
+func (c *Conn) discardMessage() {
+	if c.flateReader != nil {
+		releaseFlateReader(c.flateReader)
+		c.flateReader = nil
+	}
+	if c.messageReader == nil {
+		return
+	}
+	c.messageReader = nil
+
+	for c.readErr == nil {
+		if c.readRemaining > 0 {
+			n, err := c.br.Discard(int(c.readRemaining))
+			c.readRemaining -= int64(n)
+			if err != nil {
+				c.readErr = readError(err)
+			}
+			continue
+		}
+		if c.readFinal {
+			return
+		}
+		if _, err := c.advanceFrame(); err != nil {
+			c.readErr = err
+		}
+	}
+}
+
+// read returns the next n bytes of the connection, which must fit in the buffer
+func (c *Conn) read(n int) ([]byte, error) {
+	p, err := c.br.Peek(n)
+	if err != nil {
+		return nil, readError(err)
+	}
+	c.br.Discard(n) //nolint:errcheck
+	return p, nil
+}
+
+// readError turns the end of the connection into a CloseError
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errUnexpectedEOF
+	}
+	return err
+}
+
+// advanceFrame reads the header of the next frame. The control frames are read and
+// processed, the data frames are left to be read by the messageReader.
+func (c *Conn) advanceFrame() (int, error) {
+	p, err := c.read(2)
+	if err != nil {
+		return noFrame, err
+	}
+
+	final := p[0]&finalBit != 0
+	frameType := int(p[0] & 0xf)
+	rsv1 := p[0]&rsv1Bit != 0
+	masked := p[1]&maskBit != 0
+	length := int64(p[1] & 0x7f)
+
+	if p[0]&(rsv2Bit|rsv3Bit) != 0 {
+		return noFrame, c.protocolError(CloseProtocolError, "unexpected reserved bits")
+	}
+	switch frameType {
+	case CloseMessage, PingMessage, PongMessage:
+		if length > maxControlFramePayloadSize {
+			return noFrame, c.protocolError(CloseProtocolError, "control frame too long")
+		}
+		if !final {
+			return noFrame, c.protocolError(CloseProtocolError, "fragmented control frame")
+		}
+		if rsv1 {
+			return noFrame, c.protocolError(CloseProtocolError, "unexpected reserved bits")
+		}
+	case TextMessage, BinaryMessage:
+		if !c.readFinal {
+			return noFrame, c.protocolError(CloseProtocolError, "data frame before the end of the previous message")
+		}
+		if rsv1 && !c.compressionNegotiated {
+			return noFrame, c.protocolError(CloseProtocolError, "unexpected reserved bits")
+		}
+		c.readCompressed = rsv1
+		c.readFinal = final
+	case continuationFrame:
+		if c.readFinal {
+			return noFrame, c.protocolError(CloseProtocolError, "continuation frame without a message")
+		}
+		if rsv1 {
+			return noFrame, c.protocolError(CloseProtocolError, "unexpected reserved bits")
+		}
+		c.readFinal = final
+	default:
+		return noFrame, c.protocolError(CloseProtocolError, "unknown opcode "+strconv.Itoa(frameType))
+	}
+
+	switch length {
+	case 126:
+		if p, err = c.read(2); err != nil {
+			return noFrame, err
+		}
+		length = int64(binary.BigEndian.Uint16(p))
+	case 127:
+		if p, err = c.read(8); err != nil {
+			return noFrame, err
+		}
+		length = int64(binary.BigEndian.Uint64(p))
+		if length < 0 {
+			return noFrame, c.protocolError(CloseProtocolError, "invalid frame length")
+		}
+	}
+
+	if masked != c.isServer {
+		if c.isServer {
+			return noFrame, c.protocolError(CloseProtocolError, "unmasked client frame")
+		}
+		return noFrame, c.protocolError(CloseProtocolError, "masked server frame")
+	}
+	if masked {
+		if p, err = c.read(4); err != nil {
+			return noFrame, err
+		}
+		copy(c.readMaskKey[:], p)
+		c.readMaskPos = 0
+	}
+
+	if frameType == continuationFrame || frameType == TextMessage || frameType == BinaryMessage {
+		c.readRemaining = length
+		return frameType, nil
+	}
+
+	// Control frame
+	payload := c.controlBuf[:length]
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return noFrame, readError(err)
+	}
+	if masked {
+		maskBytes(c.readMaskKey, 0, payload)
+	}
+
+	switch frameType {
+	case PingMessage:
+		if err := c.handlePing(string(payload)); err != nil {
+			return noFrame, err
+		}
+	case PongMessage:
+		if err := c.handlePong(string(payload)); err != nil {
+			return noFrame, err
+		}
+	case CloseMessage:
+		code := CloseNoStatusReceived
+		text := ""
+		if len(payload) == 1 {
+			return noFrame, c.protocolError(CloseProtocolError, "invalid close payload")
+		}
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+			if !validReceivedCloseCode(code) {
+				return noFrame, c.protocolError(CloseProtocolError, "invalid close code "+strconv.Itoa(code))
+			}
+			if !utf8.Valid(payload[2:]) {
+				return noFrame, c.protocolError(CloseInvalidFramePayloadData, "invalid UTF-8 in close reason")
+			}
+			text = string(payload[2:])
+		}
+		if err := c.handleClose(code, text); err != nil {
+			return noFrame, err
+		}
+		return noFrame, &CloseError{Code: code, Text: text}
+	}
+	return frameType, nil
+}
+
+// protocolError sends a close message with code to the peer, and returns the error
+// to report locally
+func (c *Conn) protocolError(code int, message string) error {
+	c.WriteControl(CloseMessage, FormatCloseMessage(code, message), time.Now().Add(writeWait)) //nolint:errcheck
+	return errors.New("websocket: " + message)
+}
+
+// messageReader reads the payload of the frames of a message
+type messageReader struct {
+	c *Conn
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	c := r.c
+	if c.messageReader != r {
+		return 0, io.EOF
+	}
+
+	for c.readErr == nil {
+		if c.readRemaining > 0 {
+			if int64(len(p)) > c.readRemaining {
+				p = p[:c.readRemaining]
+			}
+			n, err := c.br.Read(p)
+			if c.isServer {
+				c.readMaskPos = maskBytes(c.readMaskKey, c.readMaskPos, p[:n])
+			}
+			c.readRemaining -= int64(n)
+			if err != nil {
+				c.readErr = readError(err)
+			}
+			return n, c.readErr
+		}
+
+		if c.readFinal {
+			c.messageReader = nil
+			return 0, io.EOF
+		}
+		if _, err := c.advanceFrame(); err != nil {
+			c.readErr = err
+		}
+	}
+	return 0, c.readErr
+}
+
+// checkedReader enforces the read limit and validates the text messages, after
+// decompression
+type checkedReader struct {
+	c          *Conn
+	r          io.Reader
+	text       bool
+	compressed bool
+}
+
+func (r *checkedReader) Read(p []byte) (int, error) {
+	c := r.c
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.compressed && c.readErr == nil {
+		// The compressed data is invalid
+		c.readErr = c.protocolError(CloseProtocolError, "invalid compressed data")
+		return n, c.readErr
+	}
+
+	c.readLength += int64(n)
+	if c.readLimit > 0 && c.readLength > c.readLimit {
+		c.protocolError(CloseMessageTooBig, "message too big") //nolint:errcheck
+		c.readErr = ErrReadLimit
+		return 0, ErrReadLimit
+	}
+	if r.text && (!c.readUTF8.write(p[:n]) || (err == io.EOF && !c.readUTF8.done())) {
+		c.readErr = c.protocolError(CloseInvalidFramePayloadData, "invalid UTF-8 in text message")
+		return 0, c.readErr
+	}
+
+	if err == io.EOF && r.compressed && c.flateReader != nil {
+		releaseFlateReader(c.flateReader)
+		c.flateReader = nil
+	}
+	return n, err
+}
+
+// maskBytes masks b with key, starting at pos in the key, and returns the next pos
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+// utf8Validator validates UTF-8 text received in chunks, which may split the runes
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+func (v *utf8Validator) reset() {
+	v.n = 0
+}
+
+// write validates p, following the previous chunks
+func (v *utf8Validator) write(p []byte) bool {
+	if v.n > 0 {
+		for len(p) > 0 && !utf8.FullRune(v.pending[:v.n]) {
+			v.pending[v.n] = p[0]
+			v.n++
+			p = p[1:]
+		}
+		if !utf8.FullRune(v.pending[:v.n]) {
+			return true
+		}
+		if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size <= 1 {
+			return false
+		}
+		v.n = 0
+	}
+
+	// Keep the incomplete rune at the end for the next chunk
+	start := len(p) - 1
+	for start >= 0 && start > len(p)-utf8.UTFMax && !utf8.RuneStart(p[start]) {
+		start--
+	}
+	if start >= 0 && !utf8.FullRune(p[start:]) {
+		v.n = copy(v.pending[:], p[start:])
+		p = p[:start]
+	}
+	return utf8.Valid(p)
+}
+
+// done tells whether the text ended on a complete rune
+func (v *utf8Validator) done() bool {
+	return v.n == 0
+}
@@ -0,0 +1,368 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pablolagos/fns/fasthttputil"
+)
+
+// newTestConns returns the server and client sides of a connection
+func newTestConns(t *testing.T, writeBufferSize int) (server, client *Conn) {
+	t.Helper()
+	pc := fasthttputil.NewPipeConns()
+	server = newConn(pc.Conn1(), nil, true, 0, writeBufferSize)
+	client = newConn(pc.Conn2(), nil, false, 0, writeBufferSize)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+// newRawTestConn returns the server side of a connection, and the client side to
+// write raw frames to
+func newRawTestConn(t *testing.T) (*Conn, *Conn, io.ReadWriter) {
+	t.Helper()
+	pc := fasthttputil.NewPipeConns()
+	server := newConn(pc.Conn1(), nil, true, 0, 0)
+	client := newConn(pc.Conn2(), nil, false, 0, 0)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client, pc.Conn2()
+}
+
+// maskedFrame returns a client frame with the first byte b0 and payload
+func maskedFrame(b0 byte, payload []byte) []byte {
+	c := &Conn{}
+	frame := c.appendFrameHeader(nil, b0, len(payload))
+	start := len(frame)
+	frame = append(frame, payload...)
+	maskBytes(c.frameMaskKey(frame), 0, frame[start:])
+	return frame
+}
+
+func TestConnMessages(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 64)
+	messages := []struct {
+		messageType int
+		data        string
+	}{
+		{TextMessage, "hello"},
+		{BinaryMessage, "\x00\x01\x02\xff"},
+		{TextMessage, ""},
+		{TextMessage, strings.Repeat("fragmented ünïcödé ", 50)},
+		{BinaryMessage, strings.Repeat("x", 70000)},
+	}
+
+	go func() {
+		for _, m := range messages {
+			if err := client.WriteMessage(m.messageType, []byte(m.data)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+	for _, m := range messages {
+		mt, data, err := server.ReadMessage()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if mt != m.messageType || string(data) != m.data {
+			t.Fatalf("unexpected message %d %.20q, expecting %d %.20q", mt, data, m.messageType, m.data)
+		}
+	}
+
+	// And the other way, without masking
+	go func() {
+		if err := server.WriteMessage(TextMessage, []byte("from server")); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	if _, data, err := client.ReadMessage(); err != nil || string(data) != "from server" {
+		t.Fatalf("unexpected message %q, error %v", data, err)
+	}
+}
+
+func TestConnNextReaderDiscards(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 16)
+	go func() {
+		client.WriteMessage(BinaryMessage, []byte(strings.Repeat("a", 100))) //nolint:errcheck
+		client.WriteMessage(TextMessage, []byte("second"))                   //nolint:errcheck
+	}()
+
+	_, r, err := server.NextReader()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var b [10]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mt, data, err := server.ReadMessage()
+	if err != nil || mt != TextMessage || string(data) != "second" {
+		t.Fatalf("unexpected message %d %q, error %v", mt, data, err)
+	}
+	if n, err := r.Read(b[:]); n != 0 || err != io.EOF {
+		t.Fatalf("unexpected read of the stale reader: %d, %v", n, err)
+	}
+}
+
+func TestConnPingPong(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 0)
+	pongs := make(chan string, 1)
+	client.SetPongHandler(func(appData string) error {
+		pongs <- appData
+		return nil
+	})
+
+	go func() {
+		client.WriteControl(PingMessage, []byte("ping data"), time.Now().Add(time.Second)) //nolint:errcheck
+		client.WriteMessage(TextMessage, []byte("after ping"))                             //nolint:errcheck
+		client.ReadMessage()                                                               //nolint:errcheck
+	}()
+
+	// The ping is answered while reading the next message
+	if _, data, err := server.ReadMessage(); err != nil || string(data) != "after ping" {
+		t.Fatalf("unexpected message %q, error %v", data, err)
+	}
+	select {
+	case data := <-pongs:
+		if data != "ping data" {
+			t.Fatalf("unexpected pong %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the pong")
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 0)
+	if err := client.WriteControl(CloseMessage, FormatCloseMessage(CloseGoingAway, "bye"), time.Time{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.WriteMessage(TextMessage, []byte("late")); err != ErrCloseSent {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrCloseSent)
+	}
+
+	_, _, err := server.ReadMessage()
+	if !IsCloseError(err, CloseGoingAway) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if e := err.(*CloseError); e.Text != "bye" {
+		t.Fatalf("unexpected close text %q", e.Text)
+	}
+	if IsUnexpectedCloseError(err, CloseGoingAway, CloseNormalClosure) {
+		t.Fatal("the close error must be expected")
+	}
+
+	// The server echoed the close code
+	_, _, err = client.ReadMessage()
+	if !IsCloseError(err, CloseGoingAway) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The errors are permanent
+	if _, _, err2 := server.ReadMessage(); err2 == nil || err2.Error() != "websocket: close 1001: bye" {
+		t.Fatalf("unexpected error %v", err2)
+	}
+}
+
+func TestConnAbnormalClosure(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 0)
+	client.Close()
+	_, _, err := server.ReadMessage()
+	if !IsCloseError(err, CloseAbnormalClosure) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConnReadLimit(t *testing.T) {
+	t.Parallel()
+
+	server, client := newTestConns(t, 0)
+	server.SetReadLimit(100)
+	go func() {
+		client.WriteMessage(BinaryMessage, make([]byte, 100)) //nolint:errcheck
+		client.WriteMessage(BinaryMessage, make([]byte, 101)) //nolint:errcheck
+	}()
+
+	if _, data, err := server.ReadMessage(); err != nil || len(data) != 100 {
+		t.Fatalf("unexpected message of %d bytes, error %v", len(data), err)
+	}
+	if _, _, err := server.ReadMessage(); err != ErrReadLimit {
+		t.Fatalf("unexpected error %v, expecting %v", err, ErrReadLimit)
+	}
+	if _, _, err := client.ReadMessage(); !IsCloseError(err, CloseMessageTooBig) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConnInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	server, _, raw := newRawTestConn(t)
+	go func() {
+		// The invalid sequence is split between the frames
+		raw.Write(maskedFrame(TextMessage, []byte("ok \xe2\x82")))         //nolint:errcheck
+		raw.Write(maskedFrame(continuationFrame|finalBit, []byte("\xff"))) //nolint:errcheck
+	}()
+	if _, _, err := server.ReadMessage(); err == nil || !strings.Contains(err.Error(), "UTF-8") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConnValidUTF8Fragments(t *testing.T) {
+	t.Parallel()
+
+	server, _, raw := newRawTestConn(t)
+	go func() {
+		raw.Write(maskedFrame(TextMessage, []byte("\xe2")))                 //nolint:errcheck
+		raw.Write(maskedFrame(continuationFrame, []byte("\x82")))           //nolint:errcheck
+		raw.Write(maskedFrame(PingMessage|finalBit, nil))                   //nolint:errcheck
+		raw.Write(maskedFrame(continuationFrame|finalBit, []byte("\xac€"))) //nolint:errcheck
+	}()
+	if _, data, err := server.ReadMessage(); err != nil || string(data) != "€€" {
+		t.Fatalf("unexpected message %q, error %v", data, err)
+	}
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	t.Parallel()
+
+	long := bytes.Repeat([]byte("x"), 126)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+	}{
+		{"unmasked", [][]byte{{TextMessage | finalBit, 0}}, CloseProtocolError},
+		{"reserved bits", [][]byte{maskedFrame(TextMessage|finalBit|rsv2Bit, nil)}, CloseProtocolError},
+		{"uncompressed rsv1", [][]byte{maskedFrame(TextMessage|finalBit|rsv1Bit, nil)}, CloseProtocolError},
+		{"unknown opcode", [][]byte{maskedFrame(3|finalBit, nil)}, CloseProtocolError},
+		{"long control", [][]byte{maskedFrame(PingMessage|finalBit, long)}, CloseProtocolError},
+		{"fragmented control", [][]byte{maskedFrame(PingMessage, nil)}, CloseProtocolError},
+		{"lone continuation", [][]byte{maskedFrame(continuationFrame|finalBit, nil)}, CloseProtocolError},
+		{"interleaved message", [][]byte{maskedFrame(TextMessage, nil), maskedFrame(TextMessage|finalBit, nil)}, CloseProtocolError},
+		{"close code", [][]byte{maskedFrame(CloseMessage|finalBit, FormatCloseMessage(1004, ""))}, CloseProtocolError},
+		{"close payload", [][]byte{maskedFrame(CloseMessage|finalBit, []byte{3})}, CloseProtocolError},
+		{"close reason", [][]byte{maskedFrame(CloseMessage|finalBit, FormatCloseMessage(1000, "\xff"))}, CloseInvalidFramePayloadData},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, client, raw := newRawTestConn(t)
+			go func() {
+				for _, f := range tt.frames {
+					raw.Write(f) //nolint:errcheck
+				}
+			}()
+			if _, _, err := server.ReadMessage(); err == nil || IsCloseError(err, tt.code) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if _, _, err := client.ReadMessage(); !IsCloseError(err, tt.code) {
+				t.Fatalf("unexpected error %v, expecting close %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestConnWriteControlErrors(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestConns(t, 0)
+	if err := server.WriteControl(TextMessage, nil, time.Time{}); err != errInvalidType {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := server.WriteControl(PingMessage, make([]byte, 126), time.Time{}); err != errControlLarge {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := server.NextWriter(PingMessage); err != errInvalidType {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestConns(t, 16)
+	server.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)) //nolint:errcheck
+
+	// The frames fill the pipe, which isn't read
+	err := server.WriteMessage(BinaryMessage, make([]byte, 1<<16))
+	if err == nil {
+		t.Fatal("expecting a timeout")
+	}
+	if err2 := server.WriteMessage(BinaryMessage, []byte("again")); err2 != err {
+		t.Fatalf("unexpected error %v, expecting %v", err2, err)
+	}
+}
+
+func TestUTF8Validator(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		text  string
+		valid bool
+	}{
+		{"", true},
+		{"hello", true},
+		{"κόσμε €𝄞", true},
+		{"\xe2\x82", false},
+		{"\xed\xa0\x80", false},
+		{"\xf4\x90\x80\x80", false},
+		{"a\xffb", false},
+		{"\xc0\xaf", false},
+	}
+
+	for _, tt := range tests {
+		// Every split in two chunks must give the same result
+		for i := 0; i <= len(tt.text); i++ {
+			var v utf8Validator
+			valid := v.write([]byte(tt.text[:i])) && v.write([]byte(tt.text[i:])) && v.done()
+			if valid != tt.valid {
+				t.Fatalf("unexpected result %v for %q split at %d", valid, tt.text, i)
+			}
+		}
+
+		// And byte by byte
+		var v utf8Validator
+		valid := true
+		for i := 0; i < len(tt.text) && valid; i++ {
+			valid = v.write([]byte{tt.text[i]})
+		}
+		if valid = valid && v.done(); valid != tt.valid {
+			t.Fatalf("unexpected result %v for %q byte by byte", valid, tt.text)
+		}
+	}
+}
+
+func TestFormatCloseMessage(t *testing.T) {
+	t.Parallel()
+
+	if b := FormatCloseMessage(CloseNormalClosure, "done"); string(b) != "\x03\xe8done" {
+		t.Fatalf("unexpected payload %q", b)
+	}
+	if b := FormatCloseMessage(CloseNoStatusReceived, "ignored"); len(b) != 0 {
+		t.Fatalf("unexpected payload %q", b)
+	}
+}
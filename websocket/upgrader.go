@@ -0,0 +1,239 @@
+// Package websocket implements the WebSocket protocol of RFC 6455 for fns servers.
+//
+// An Upgrader validates the opening handshake of a request, hijacks its connection
+// and hands a Conn to the Handler:
+//
+//	var upgrader websocket.Upgrader
+//
+//	func echo(ctx *fns.RequestCtx) {
+//		err := upgrader.Upgrade(ctx, func(c *websocket.Conn) {
+//			for {
+//				mt, msg, err := c.ReadMessage()
+//				if err != nil {
+//					return
+//				}
+//				if err := c.WriteMessage(mt, msg); err != nil {
+//					return
+//				}
+//			}
+//		})
+//		if err != nil {
+//			log.Printf("websocket handshake: %v", err)
+//		}
+//	}
+//
+// The permessage-deflate extension of RFC 7692 is supported without context takeover.
+//
+// Over HTTP/2, the WebSockets are bootstrapped with extended CONNECT requests as defined
+// by RFC 8441, which must be enabled with fns.ServerConfig.EnableConnectProtocol. Each
+// connection is then carried by a stream.
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pablolagos/fns"
+)
+
+// Handler serves a WebSocket connection. The connection is closed when it returns,
+// unless fns.Server.KeepHijackedConns is set.
+type Handler func(c *Conn)
+
+// Upgrader upgrades HTTP requests to WebSocket connections. Its zero value is usable,
+// it must not be modified while upgrading.
+type Upgrader struct {
+	// ReadBufferSize and WriteBufferSize are the sizes of the read and write buffers
+	// of the connections, 4096 bytes if not set. The messages larger than the write
+	// buffer are sent in several frames.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Subprotocols are the subprotocols supported by the server, in order of
+	// preference. The first one offered by the client is selected.
+	Subprotocols []string
+
+	// CheckOrigin tells whether the Origin of the request is allowed. If not set, the
+	// requests without Origin, or with an Origin of the same host, are allowed.
+	CheckOrigin func(ctx *fns.RequestCtx) bool
+
+	// EnableCompression negotiates permessage-deflate with the clients offering it
+	EnableCompression bool
+
+	// ReadLimit is the initial read limit of the connections, see Conn.SetReadLimit
+	ReadLimit int64
+
+	// Error replies to the requests failing the handshake. If not set, status is sent
+	// with its status text.
+	Error func(ctx *fns.RequestCtx, status int, reason error)
+}
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errNotGet           = errors.New("websocket: the request method is not GET")
+	errNoUpgrade        = errors.New("websocket: the request is not an upgrade to websocket")
+	errBadVersion       = errors.New("websocket: unsupported Sec-WebSocket-Version")
+	errBadKey           = errors.New("websocket: invalid Sec-WebSocket-Key")
+	errOriginNotAllowed = errors.New("websocket: the request Origin is not allowed")
+)
+
+// Upgrade validates the WebSocket handshake of the request, replies to it, and serves
+// the connection with handler once the response is sent. If the handshake fails, the
+// error is returned after replying with Upgrader.Error.
+//
+// ctx must not be used by handler, which runs after the request handler returns.
+func (u *Upgrader) Upgrade(ctx *fns.RequestCtx, handler Handler) error {
+	// The extended CONNECT requests of HTTP/2 have neither key nor accept value
+	extendedConnect := ctx.ConnectProtocol() != ""
+	var key []byte
+	if extendedConnect {
+		if !IsWebSocketUpgrade(ctx) {
+			return u.fail(ctx, fns.StatusBadRequest, errNoUpgrade)
+		}
+	} else {
+		if !ctx.IsGet() {
+			ctx.Response.Header.Set(fns.HeaderAllow, fns.MethodGet)
+			return u.fail(ctx, fns.StatusMethodNotAllowed, errNotGet)
+		}
+		if !IsWebSocketUpgrade(ctx) {
+			return u.fail(ctx, fns.StatusBadRequest, errNoUpgrade)
+		}
+	}
+	if string(ctx.Request.Header.Peek(fns.HeaderSecWebSocketVersion)) != "13" {
+		return u.fail(ctx, fns.StatusUpgradeRequired, errBadVersion)
+	}
+	if !extendedConnect {
+		key = ctx.Request.Header.Peek(fns.HeaderSecWebSocketKey)
+		if !validKey(key) {
+			return u.fail(ctx, fns.StatusBadRequest, errBadKey)
+		}
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(ctx) {
+		return u.fail(ctx, fns.StatusForbidden, errOriginNotAllowed)
+	}
+
+	subprotocol := u.selectSubprotocol(ctx)
+	compress := u.EnableCompression &&
+		negotiatePermessageDeflate(string(ctx.Request.Header.Peek(fns.HeaderSecWebSocketExtensions)))
+
+	if extendedConnect {
+		ctx.SetStatusCode(fns.StatusOK)
+	} else {
+		ctx.SetStatusCode(fns.StatusSwitchingProtocols)
+		ctx.Response.Header.Set(fns.HeaderUpgrade, "websocket")
+		ctx.Response.Header.Set(fns.HeaderConnection, "Upgrade")
+		ctx.Response.Header.Set(fns.HeaderSecWebSocketAccept, computeAcceptKey(key))
+	}
+	if subprotocol != "" {
+		ctx.Response.Header.Set(fns.HeaderSecWebSocketProtocol, subprotocol)
+	}
+	if compress {
+		ctx.Response.Header.Set(fns.HeaderSecWebSocketExtensions, permessageDeflate)
+	}
+
+	ctx.Hijack(func(nc net.Conn) {
+		c := newConn(nc, nil, true, u.ReadBufferSize, u.WriteBufferSize)
+		c.subprotocol = subprotocol
+		c.compressionNegotiated = compress
+		c.readLimit = u.ReadLimit
+		handler(c)
+	})
+	return nil
+}
+
+// fail replies to a failed handshake and returns reason
+func (u *Upgrader) fail(ctx *fns.RequestCtx, status int, reason error) error {
+	if status == fns.StatusUpgradeRequired {
+		ctx.Response.Header.Set(fns.HeaderSecWebSocketVersion, "13")
+	}
+	if u.Error != nil {
+		u.Error(ctx, status, reason)
+	} else {
+		ctx.SetStatusCode(status)
+		ctx.SetBodyString(fns.StatusMessage(status))
+	}
+	return reason
+}
+
+// selectSubprotocol returns the preferred subprotocol offered by the client, if any
+func (u *Upgrader) selectSubprotocol(ctx *fns.RequestCtx) string {
+	offered := ctx.Request.Header.Peek(fns.HeaderSecWebSocketProtocol)
+	if len(offered) == 0 {
+		return ""
+	}
+	for _, p := range u.Subprotocols {
+		if headerContainsToken(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// IsWebSocketUpgrade tells whether the request asks for an upgrade to WebSocket, or is
+// an HTTP/2 extended CONNECT request for the websocket protocol
+func IsWebSocketUpgrade(ctx *fns.RequestCtx) bool {
+	if p := ctx.ConnectProtocol(); p != "" {
+		return p == "websocket"
+	}
+	return headerContainsToken(ctx.Request.Header.Peek(fns.HeaderConnection), "upgrade") &&
+		headerContainsToken(ctx.Request.Header.Peek(fns.HeaderUpgrade), "websocket")
+}
+
+// headerContainsToken tells whether the comma-separated list value contains token,
+// case-insensitively
+func headerContainsToken(value []byte, token string) bool {
+	for len(value) > 0 {
+		var item []byte
+		if i := bytes.IndexByte(value, ','); i >= 0 {
+			item, value = value[:i], value[i+1:]
+		} else {
+			item, value = value, nil
+		}
+		if strings.EqualFold(string(bytes.TrimSpace(item)), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// validKey tells whether key is the base64 encoding of 16 bytes
+func validKey(key []byte) bool {
+	if len(key) != 24 {
+		return false
+	}
+	var b [18]byte
+	n, err := base64.StdEncoding.Decode(b[:], key)
+	return err == nil && n == 16
+}
+
+// computeAcceptKey returns the Sec-WebSocket-Accept value for key
+func computeAcceptKey(key []byte) string {
+	h := sha1.New()
+	h.Write(key)
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkSameOrigin allows the requests without Origin, or with an Origin of the
+// requested host
+func checkSameOrigin(ctx *fns.RequestCtx) bool {
+	origin := ctx.Request.Header.Peek(fns.HeaderOrigin)
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(string(origin))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, string(ctx.Host()))
+}
@@ -0,0 +1,420 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pablolagos/fns"
+	"github.com/pablolagos/fns/fasthttputil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// startTestServer serves handler on an in-memory listener, and returns a function
+// dialing it
+func startTestServer(t *testing.T, handler fns.RequestHandler) func() net.Conn {
+	t.Helper()
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fns.Server{Handler: handler}
+	go s.Serve(ln) //nolint:errcheck
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return func() net.Conn {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() {
+			c.Close()
+		})
+		return c
+	}
+}
+
+// handshake sends an upgrade request with the extra headers, and returns the response
+// and a client Conn if it succeeded
+func handshake(t *testing.T, dial func() net.Conn, method string, headers ...string) (*http.Response, *Conn) {
+	t.Helper()
+	nc := dial()
+	req := method + " /ws HTTP/1.1\r\nHost: example.com\r\n"
+	defaults := map[string]string{
+		"Connection":            "Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     testKey,
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if _, ok := defaults[headers[i]]; ok {
+			defaults[headers[i]] = headers[i+1]
+		} else {
+			req += headers[i] + ": " + headers[i+1] + "\r\n"
+		}
+	}
+	for k, v := range defaults {
+		if v != "" {
+			req += k + ": " + v + "\r\n"
+		}
+	}
+	if _, err := nc.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != fns.StatusSwitchingProtocols {
+		return resp, nil
+	}
+	c := newConn(nc, br, false, 0, 0)
+	c.compressionNegotiated = resp.Header.Get("Sec-WebSocket-Extensions") != ""
+	return resp, c
+}
+
+func TestUpgraderEcho(t *testing.T) {
+	t.Parallel()
+
+	u := &Upgrader{
+		Subprotocols:      []string{"v2.chat", "v1.chat"},
+		EnableCompression: true,
+	}
+	dial := startTestServer(t, func(ctx *fns.RequestCtx) {
+		err := u.Upgrade(ctx, func(c *Conn) {
+			c.WriteMessage(TextMessage, []byte(c.Subprotocol())) //nolint:errcheck
+			for {
+				mt, msg, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := c.WriteMessage(mt, msg); err != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	resp, c := handshake(t, dial, "GET",
+		"Sec-WebSocket-Protocol", "v1.chat, v2.chat",
+		"Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits",
+		"Origin", "http://example.com")
+	if c == nil {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	for name, value := range map[string]string{
+		"Upgrade":                  "websocket",
+		"Connection":               "Upgrade",
+		"Sec-WebSocket-Accept":     "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+		"Sec-WebSocket-Protocol":   "v2.chat",
+		"Sec-WebSocket-Extensions": permessageDeflate,
+	} {
+		if v := resp.Header.Get(name); v != value {
+			t.Fatalf("unexpected %s %q, expecting %q", name, v, value)
+		}
+	}
+
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "v2.chat" {
+		t.Fatalf("unexpected message %q, error %v", data, err)
+	}
+	msg := strings.Repeat("echo ", 2000)
+	if err := c.WriteMessage(TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != msg {
+		t.Fatalf("unexpected message %.20q, error %v", data, err)
+	}
+
+	c.WriteControl(CloseMessage, FormatCloseMessage(CloseNormalClosure, ""), time.Time{}) //nolint:errcheck
+	if _, _, err := c.ReadMessage(); !IsCloseError(err, CloseNormalClosure) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUpgraderReadLimit(t *testing.T) {
+	t.Parallel()
+
+	u := &Upgrader{ReadLimit: 10}
+	dial := startTestServer(t, func(ctx *fns.RequestCtx) {
+		u.Upgrade(ctx, func(c *Conn) { //nolint:errcheck
+			c.ReadMessage() //nolint:errcheck
+		})
+	})
+
+	resp, c := handshake(t, dial, "GET")
+	if c == nil {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Extensions") != "" {
+		t.Fatal("compression must not be negotiated")
+	}
+	c.WriteMessage(BinaryMessage, make([]byte, 11)) //nolint:errcheck
+	if _, _, err := c.ReadMessage(); !IsCloseError(err, CloseMessageTooBig) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUpgraderHandshakeErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		method  string
+		headers []string
+		status  int
+		err     error
+	}{
+		{"method", "POST", nil, fns.StatusMethodNotAllowed, errNotGet},
+		{"no upgrade", "GET", []string{"Upgrade", ""}, fns.StatusBadRequest, errNoUpgrade},
+		{"no connection upgrade", "GET", []string{"Connection", "keep-alive"}, fns.StatusBadRequest, errNoUpgrade},
+		{"version", "GET", []string{"Sec-WebSocket-Version", "8"}, fns.StatusUpgradeRequired, errBadVersion},
+		{"no key", "GET", []string{"Sec-WebSocket-Key", ""}, fns.StatusBadRequest, errBadKey},
+		{"short key", "GET", []string{"Sec-WebSocket-Key", "c2hvcnQ="}, fns.StatusBadRequest, errBadKey},
+		{"origin", "GET", []string{"Origin", "http://evil.com"}, fns.StatusForbidden, errOriginNotAllowed},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			errs := make(chan error, 1)
+			dial := startTestServer(t, func(ctx *fns.RequestCtx) {
+				var u Upgrader
+				errs <- u.Upgrade(ctx, func(c *Conn) {})
+			})
+
+			resp, c := handshake(t, dial, tt.method, tt.headers...)
+			if c != nil || resp.StatusCode != tt.status {
+				t.Fatalf("unexpected status %d, expecting %d", resp.StatusCode, tt.status)
+			}
+			if err := <-errs; err != tt.err {
+				t.Fatalf("unexpected error %v, expecting %v", err, tt.err)
+			}
+			if tt.status == fns.StatusUpgradeRequired && resp.Header.Get("Sec-WebSocket-Version") != "13" {
+				t.Fatal("missing Sec-WebSocket-Version")
+			}
+			if tt.status == fns.StatusMethodNotAllowed && resp.Header.Get("Allow") != "GET" {
+				t.Fatal("missing Allow")
+			}
+		})
+	}
+}
+
+func TestUpgraderCustomError(t *testing.T) {
+	t.Parallel()
+
+	u := &Upgrader{
+		CheckOrigin: func(ctx *fns.RequestCtx) bool {
+			return string(ctx.Request.Header.Peek(fns.HeaderOrigin)) == "https://trusted.com"
+		},
+		Error: func(ctx *fns.RequestCtx, status int, reason error) {
+			ctx.Error(reason.Error(), status)
+		},
+	}
+	dial := startTestServer(t, func(ctx *fns.RequestCtx) {
+		u.Upgrade(ctx, func(c *Conn) {}) //nolint:errcheck
+	})
+
+	if resp, c := handshake(t, dial, "GET", "Origin", "https://trusted.com"); c == nil {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	resp, _ := handshake(t, dial, "GET", "Origin", "http://example.com")
+	var body [64]byte
+	n, _ := resp.Body.Read(body[:])
+	if resp.StatusCode != fns.StatusForbidden || string(body[:n]) != errOriginNotAllowed.Error() {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body[:n])
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		connection, upgrade string
+		ok                  bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, Upgrade", "WebSocket", true},
+		{"upgrade", "h2c", false},
+		{"keep-alive", "websocket", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		var ctx fns.RequestCtx
+		ctx.Request.Header.Set(fns.HeaderConnection, tt.connection)
+		ctx.Request.Header.Set(fns.HeaderUpgrade, tt.upgrade)
+		if ok := IsWebSocketUpgrade(&ctx); ok != tt.ok {
+			t.Fatalf("unexpected result %v for %q %q", ok, tt.connection, tt.upgrade)
+		}
+	}
+}
+
+// h2TestStream is the client side of an HTTP/2 stream carrying a WebSocket
+type h2TestStream struct {
+	net.Conn
+	fr  *http2.Framer
+	buf []byte
+}
+
+func (s *h2TestStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		f, err := s.fr.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch f := f.(type) {
+		case *http2.DataFrame:
+			s.buf = append(s.buf, f.Data()...)
+			if n := uint32(len(f.Data())); n > 0 {
+				s.fr.WriteWindowUpdate(0, n)          //nolint:errcheck
+				s.fr.WriteWindowUpdate(f.StreamID, n) //nolint:errcheck
+			}
+			if f.StreamEnded() && len(s.buf) == 0 {
+				return 0, io.EOF
+			}
+		case *http2.RSTStreamFrame:
+			return 0, http2.StreamError{StreamID: f.StreamID, Code: f.ErrCode}
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *h2TestStream) Write(p []byte) (int, error) {
+	if err := s.fr.WriteData(1, false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// h2Handshake opens stream 1 with an extended CONNECT request, and returns the response
+// headers and a client Conn if it succeeded
+func h2Handshake(t *testing.T, dial func() net.Conn, protocol string) (map[string]string, *Conn) {
+	t.Helper()
+	nc := dial()
+	if _, err := nc.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fr := http2.NewFramer(nc, nc)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range [][2]string{
+		{":method", "CONNECT"}, {":protocol", protocol}, {":scheme", "http"},
+		{":authority", "example.com"}, {":path", "/ws"}, {"sec-websocket-version", "13"},
+	} {
+		enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]}) //nolint:errcheck
+	}
+
+	headers := make(map[string]string)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				continue
+			}
+			if v, _ := f.Value(http2.SettingID(fns.SettingEnableConnectProtocol)); v != 1 {
+				t.Fatal("SETTINGS_ENABLE_CONNECT_PROTOCOL not announced")
+			}
+			fr.WriteSettingsAck() //nolint:errcheck
+			err = fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true,
+			})
+		case *http2.HeadersFrame:
+			fields, err := hpack.NewDecoder(4096, nil).DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, hf := range fields {
+				headers[hf.Name] = hf.Value
+			}
+			if headers[":status"] != "200" {
+				return headers, nil
+			}
+			return headers, newConn(&h2TestStream{Conn: nc, fr: fr}, nil, false, 0, 0)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestUpgraderHTTP2(t *testing.T) {
+	t.Parallel()
+
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fns.Server{Handler: func(ctx *fns.RequestCtx) {
+		var u Upgrader
+		u.Upgrade(ctx, func(c *Conn) { //nolint:errcheck
+			for {
+				mt, msg, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := c.WriteMessage(mt, msg); err != nil {
+					return
+				}
+			}
+		})
+	}}
+	fns.EnableHTTP2(s, fns.ServerConfig{H2C: true, EnableConnectProtocol: true})
+	go s.Serve(ln) //nolint:errcheck
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	dial := func() net.Conn {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() {
+			c.Close()
+		})
+		return c
+	}
+
+	if headers, c := h2Handshake(t, dial, "chat"); c != nil || headers[":status"] != "400" {
+		t.Fatalf("unexpected status %q", headers[":status"])
+	}
+
+	headers, c := h2Handshake(t, dial, "websocket")
+	if c == nil {
+		t.Fatalf("unexpected status %q", headers[":status"])
+	}
+	if _, ok := headers["sec-websocket-accept"]; ok {
+		t.Fatal("unexpected sec-websocket-accept")
+	}
+	msg := strings.Repeat("echo ", 20000)
+	if err := c.WriteMessage(TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != msg {
+		t.Fatalf("unexpected message %.20q, error %v", data, err)
+	}
+
+	c.WriteControl(CloseMessage, FormatCloseMessage(CloseNormalClosure, ""), time.Time{}) //nolint:errcheck
+	if _, _, err := c.ReadMessage(); !IsCloseError(err, CloseNormalClosure) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}